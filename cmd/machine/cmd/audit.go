@@ -0,0 +1,89 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/project-machine/machine/pkg/api"
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "show the audit log of machine operations",
+	Long:  `show who created, modified, started, stopped, deleted or attached to machines`,
+	RunE:  doAudit,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+func doAudit(cmd *cobra.Command, args []string) error {
+	machineName := cmd.Flag("machine").Value.String()
+	since := cmd.Flag("since").Value.String()
+	entries, err := getAudit(machineName, since)
+	if err != nil {
+		return err
+	}
+	tbl := table.New("Time", "User", "Action", "Machine", "Status", "Details")
+	tbl.AddRow("----", "----", "------", "-------", "------", "-------")
+	for _, entry := range entries {
+		details := entry.Summary
+		if entry.Error != "" {
+			details = entry.Error
+		}
+		tbl.AddRow(entry.Time.Local().Format(time.RFC3339), entry.User, entry.Action, entry.Machine, entry.Status, details)
+	}
+	tbl.Print()
+	return nil
+}
+
+func getAudit(machineName, since string) ([]api.AuditEntry, error) {
+	entries := []api.AuditEntry{}
+	auditURL := api.GetAPIURL("audit")
+	if len(auditURL) == 0 {
+		return entries, fmt.Errorf("Failed to get API URL for 'audit' endpoint")
+	}
+	req := rootclient.R().EnableTrace()
+	if machineName != "" {
+		req.SetQueryParam("machine", machineName)
+	}
+	if since != "" {
+		req.SetQueryParam("since", since)
+	}
+	resp, err := req.Get(auditURL)
+	if err != nil {
+		return entries, fmt.Errorf("Failed GET on 'audit' endpoint: %s", err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return entries, fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	if err := json.Unmarshal(resp.Body(), &entries); err != nil {
+		return entries, fmt.Errorf("Failed to unmarshal GET on /audit: %s", err)
+	}
+	return entries, nil
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.PersistentFlags().StringP("machine", "m", "", "only show entries for this machine")
+	auditCmd.PersistentFlags().StringP("since", "s", "", "only show entries since an RFC3339 time or duration ago (e.g. 24h)")
+}
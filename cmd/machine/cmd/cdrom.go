@@ -0,0 +1,154 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/project-machine/machine/pkg/api"
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+// cdromCmd represents the cdrom command
+var cdromCmd = &cobra.Command{
+	Use:   "cdrom",
+	Short: "Change the media of the cdrom drives of a running machine",
+	Long: `List, insert and eject the media of the cdrom drives of a running
+machine.  Drives are named cdrom0, cdrom1, ... in the order of the machine
+cdrom and cdroms.  Changes last until the machine stops.`,
+}
+
+var cdromListCmd = &cobra.Command{
+	Use:   "list <machine_name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "List the cdrom drives of a machine",
+	RunE:  doCdromList,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var cdromInsertCmd = &cobra.Command{
+	Use:   "insert <machine_name> <iso>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Insert an iso into a cdrom drive, replacing the current media",
+	RunE:  doCdromInsert,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var cdromEjectCmd = &cobra.Command{
+	Use:   "eject <machine_name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Eject the media from a cdrom drive",
+	RunE:  doCdromEject,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+func doCdromList(cmd *cobra.Command, args []string) error {
+	machineName := args[0]
+	endpoint := fmt.Sprintf("machines/%s/cdroms", machineName)
+	cdromsURL := api.GetAPIURL(endpoint)
+	if len(cdromsURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().Get(cdromsURL)
+	if err != nil {
+		return fmt.Errorf("Failed GET on '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	var cdroms []api.CdromInfo
+	if err := json.Unmarshal(resp.Body(), &cdroms); err != nil {
+		return fmt.Errorf("Failed to unmarshal response from %s: %s", endpoint, err)
+	}
+	tbl := table.New("Drive", "Tray", "Media")
+	tbl.AddRow("-----", "----", "-----")
+	for _, cdrom := range cdroms {
+		tray := "closed"
+		if cdrom.TrayOpen {
+			tray = "open"
+		}
+		tbl.AddRow(cdrom.Name, tray, cdrom.File)
+	}
+	tbl.Print()
+	return nil
+}
+
+func doCdromInsert(cmd *cobra.Command, args []string) error {
+	machineName := args[0]
+	drive := cmd.Flag("drive").Value.String()
+	request := api.CdromRequest{File: args[1]}
+	// machined resolves relative paths against its own working directory
+	if !filepath.IsAbs(request.File) && api.PathExists(request.File) {
+		absPath, err := filepath.Abs(request.File)
+		if err != nil {
+			return fmt.Errorf("Failed to get absolute path of %q: %s", request.File, err)
+		}
+		request.File = absPath
+	}
+
+	endpoint := fmt.Sprintf("machines/%s/cdroms/%s", machineName, drive)
+	cdromURL := api.GetAPIURL(endpoint)
+	if len(cdromURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Put(cdromURL)
+	if err != nil {
+		return fmt.Errorf("Failed PUT to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	fmt.Printf("Inserted %s into %s of %s\n", request.File, drive, machineName)
+	return nil
+}
+
+func doCdromEject(cmd *cobra.Command, args []string) error {
+	machineName := args[0]
+	drive := cmd.Flag("drive").Value.String()
+
+	endpoint := fmt.Sprintf("machines/%s/cdroms/%s", machineName, drive)
+	cdromURL := api.GetAPIURL(endpoint)
+	if len(cdromURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().Delete(cdromURL)
+	if err != nil {
+		return fmt.Errorf("Failed DELETE to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	fmt.Printf("Ejected %s of %s\n", drive, machineName)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(cdromCmd)
+	cdromCmd.AddCommand(cdromListCmd)
+	cdromCmd.AddCommand(cdromInsertCmd)
+	cdromCmd.AddCommand(cdromEjectCmd)
+	cdromInsertCmd.Flags().StringP("drive", "d", "cdrom0", "cdrom drive to insert the iso into")
+	cdromEjectCmd.Flags().StringP("drive", "d", "cdrom0", "cdrom drive to eject")
+}
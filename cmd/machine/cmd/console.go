@@ -15,14 +15,21 @@ limitations under the License.
 package main
 
 import (
+	"crypto/des"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/lxc/lxd/shared/termios"
 	"github.com/project-machine/machine/pkg/api"
+	table "github.com/rodaine/table"
 	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v2"
 )
 
 // consoleCmd represents the console command
@@ -35,14 +42,134 @@ var consoleCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(consoleCmd)
-	consoleCmd.PersistentFlags().StringP("console-type", "t", "", "console or vga")
+	consoleCmd.PersistentFlags().StringP("console-type", "t", "", "console, vga or vnc")
+	consoleCmd.PersistentFlags().BoolP("read-only", "r", false, "watch the serial console without sending input")
+	consoleCmd.Flags().String("record", "", "record the serial console session to an asciicast file")
+	consoleCmd.AddCommand(consoleReplayCmd)
+	consoleCmd.AddCommand(consoleExpectCmd)
+	consoleExpectCmd.Flags().StringP("file", "f", "", "script of expect/send/timeout steps (yaml)")
+	consoleExpectCmd.Flags().Bool("scrollback", false, "also match output printed before the script started")
+	consoleExpectCmd.Flags().StringP("transcript", "o", "", "write the console transcript to this file")
+	consoleExpectCmd.MarkFlagRequired("file")
+	consoleReplayCmd.Flags().Float64P("speed", "s", 1.0, "playback speed multiplier")
+	consoleReplayCmd.Flags().DurationP("idle-limit", "i", 0, "limit pauses to this duration, e.g. 2s")
 }
 
-// POST /machines/:machine/console '{"ConsoleType": "console|vga"}'
+var consoleReplayCmd = &cobra.Command{
+	Use:   "replay <file>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Replay a recorded serial console session",
+	Long:  `Replay a serial console session recorded in asciicast v2 format`,
+	RunE:  doConsoleReplay,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var consoleExpectCmd = &cobra.Command{
+	Use:   "expect <machine_name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Run an expect/send script against the serial console",
+	Long: `Run a script against the serial console of a running machine.  The
+script is a yaml list of steps, for example:
+
+  - expect: "login: "
+    send: "root\n"
+    timeout: 5m
+  - timeout: 10s
+  - expect: "Password: "
+    send: "secret\n"`,
+	RunE: doConsoleExpect,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+func doConsoleExpect(cmd *cobra.Command, args []string) error {
+	machineName := args[0]
+	scriptFile := cmd.Flag("file").Value.String()
+	transcriptFile := cmd.Flag("transcript").Value.String()
+	scrollback, _ := cmd.Flags().GetBool("scrollback")
+
+	content, err := os.ReadFile(scriptFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read script %q: %s", scriptFile, err)
+	}
+	script := api.ConsoleScript{Scrollback: scrollback}
+	if err := yaml.Unmarshal(content, &script.Steps); err != nil {
+		return fmt.Errorf("Failed to parse script %q: %s", scriptFile, err)
+	}
+	if err := script.Validate(); err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("machines/%s/console/script", machineName)
+	scriptURL := api.GetAPIURL(endpoint)
+	if len(scriptURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().SetBody(script).Post(scriptURL)
+	if err != nil {
+		return fmt.Errorf("Failed POST to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	var result api.ConsoleScriptResult
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return fmt.Errorf("Failed to unmarshal response from %s: %s", endpoint, err)
+	}
+
+	if transcriptFile != "" {
+		if err := os.WriteFile(transcriptFile, []byte(result.Transcript), 0644); err != nil {
+			return fmt.Errorf("Failed to write transcript %q: %s", transcriptFile, err)
+		}
+	}
+	tbl := table.New("Step", "Expect", "Send", "Elapsed", "Result")
+	tbl.AddRow("----", "------", "----", "-------", "------")
+	for _, step := range result.Steps {
+		status := "ok"
+		if step.Error != "" {
+			status = step.Error
+		}
+		send := ""
+		if step.SendLength > 0 {
+			send = fmt.Sprintf("(%d chars)", step.SendLength)
+		}
+		tbl.AddRow(step.Step, step.Expect, send, fmt.Sprintf("%.1fs", step.Elapsed), status)
+	}
+	tbl.Print()
+	if !result.Success {
+		if transcriptFile == "" {
+			fmt.Printf("Transcript:\n%s\n", result.Transcript)
+		}
+		return fmt.Errorf("Console script failed on machine %s", machineName)
+	}
+	return nil
+}
+
+func doConsoleReplay(cmd *cobra.Command, args []string) error {
+	speed, _ := cmd.Flags().GetFloat64("speed")
+	idleLimit, _ := cmd.Flags().GetDuration("idle-limit")
+	fh, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("Failed to open recording: %s", err)
+	}
+	defer fh.Close()
+	_, err = api.ReplayAsciicast(fh, os.Stdout, speed, idleLimit)
+	return err
+}
+
+// POST /machines/:machine/console '{"ConsoleType": "console|vga", "read-only": false}'
 // RESP
 // {
 //  "Type": "console",
-//  "Path": "$HOME/.../:machine/serial.sock"
+//  "Path": "$HOME/.../:machine/console-mux.sock",
+//  "read-only": false
+// }
+// {
+//  "Type": "vnc",
+//  "Path": "/tmp/msockets-.../vnc.sock",
 // }
 // {
 //  "Type": "vga",
@@ -55,15 +182,40 @@ func doConsole(cmd *cobra.Command, args []string) {
 	if consoleType == "" {
 		consoleType = api.SerialConsole
 	}
-	if consoleType != api.SerialConsole && consoleType != api.VGAConsole {
+	if consoleType != api.SerialConsole && consoleType != api.VGAConsole && consoleType != api.VNCConsole {
 		panic(fmt.Sprintf("Invalid console type '%s'", consoleType))
 	}
 	if len(args) < 1 {
 		panic("Missing required machine name")
 	}
 	machineName := args[0]
+	readOnly, _ := cmd.Flags().GetBool("read-only")
+
+	// the serial console is streamed from machined, nothing to look up
+	if consoleType == api.SerialConsole {
+		var output io.Writer
+		if recordFile := cmd.Flag("record").Value.String(); recordFile != "" {
+			fh, err := os.Create(recordFile)
+			if err != nil {
+				panic(fmt.Sprintf("Failed to create recording %q: %s", recordFile, err))
+			}
+			defer fh.Close()
+			cols, rows, err := termios.GetSize(unix.Stdout)
+			if err != nil {
+				cols, rows = 80, 24
+			}
+			output, err = api.NewAsciicastWriter(fh, cols, rows, fmt.Sprintf("%s serial console", machineName))
+			if err != nil {
+				panic(err)
+			}
+		}
+		if err := attachSerialConsole(machineName, readOnly, output); err != nil {
+			panic(err)
+		}
+		return
+	}
 
-	consoleInfo, err := GetMachineConsoleInfo(machineName, consoleType)
+	consoleInfo, err := GetMachineConsoleInfo(machineName, consoleType, readOnly)
 	if err != nil {
 		panic(err)
 	}
@@ -74,10 +226,10 @@ func doConsole(cmd *cobra.Command, args []string) {
 	}
 }
 
-func GetMachineConsoleInfo(machineName, consoleType string) (api.ConsoleInfo, error) {
+func GetMachineConsoleInfo(machineName, consoleType string, readOnly bool) (api.ConsoleInfo, error) {
 	consoleInfo := api.ConsoleInfo{}
 
-	request := api.MachineConsoleRequest{ConsoleType: consoleType}
+	request := api.MachineConsoleRequest{ConsoleType: consoleType, ReadOnly: readOnly}
 	endpoint := fmt.Sprintf("machines/%s/console", machineName)
 	consoleURL := api.GetAPIURL(endpoint)
 	if len(consoleURL) == 0 {
@@ -88,7 +240,10 @@ func GetMachineConsoleInfo(machineName, consoleType string) (api.ConsoleInfo, er
 	if err != nil {
 		return consoleInfo, fmt.Errorf("Failed POST to %s: %s", endpoint, err)
 	}
-	fmt.Printf("%s %s\n", resp, resp.Status())
+	// the response holds the display password, do not print it
+	if resp.StatusCode() != http.StatusOK {
+		return consoleInfo, fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
 
 	err = json.Unmarshal(resp.Body(), &consoleInfo)
 	if err != nil {
@@ -98,27 +253,45 @@ func GetMachineConsoleInfo(machineName, consoleType string) (api.ConsoleInfo, er
 	return consoleInfo, nil
 }
 
-func doConsoleAttach(machineName string, consoleInfo api.ConsoleInfo) error {
-	if consoleInfo.Path == "" {
-		return fmt.Errorf("Invalid ConsoleInfo, Path is empty")
-	}
-
-	// 0x1d => ]
-	args := []string{"stdin,echo=0,raw,escape=0x1d", fmt.Sprintf("unix-connect:%s", consoleInfo.Path)}
-	cmd := exec.Command("socat", args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	log.Infof("Running command: %s", cmd.Args)
-	fmt.Printf("Attaching to %s serial console, use 'Control-]' to detatch from console\n", machineName)
-	return cmd.Run()
-}
-
 func doVGAAttach(machineName string, consoleInfo api.ConsoleInfo) error {
+	// the password is only ever given to the viewer in a connection file,
+	// command lines are visible to every user
+	if api.Which("remote-viewer") != "" {
+		lines := []string{
+			"[virt-viewer]",
+			"type=spice",
+			"host=" + consoleInfo.Addr,
+			"title=machine " + machineName,
+		}
+		if consoleInfo.Secure {
+			lines = append(lines,
+				"tls-port="+consoleInfo.Port,
+				"ca="+strings.ReplaceAll(strings.TrimSpace(consoleInfo.CACert), "\n", `\n`),
+				"secure-channels=all")
+		} else {
+			lines = append(lines, "port="+consoleInfo.Port)
+		}
+		if consoleInfo.Password != "" {
+			lines = append(lines, "password="+consoleInfo.Password)
+		}
+		vvFile, err := writeTempFile("machine-*.vv", strings.Join(append(lines, ""), "\n"))
+		if err != nil {
+			return err
+		}
+		defer os.Remove(vvFile)
+		fmt.Printf("Attaching to %s vga console\n", machineName)
+		return exec.Command("remote-viewer", vvFile).Run()
+	}
 
 	args := []string{fmt.Sprintf("--host=%s", consoleInfo.Addr)}
 	if consoleInfo.Secure {
 		args = append(args, fmt.Sprintf("--secure-port=%s", consoleInfo.Port))
+		caFile, err := writeTempFile("machine-display-ca-*.pem", consoleInfo.CACert)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(caFile)
+		args = append(args, fmt.Sprintf("--spice-ca-file=%s", caFile), "--spice-secure-channels=all")
 	} else {
 		args = append(args, fmt.Sprintf("--port=%s", consoleInfo.Port))
 	}
@@ -126,15 +299,100 @@ func doVGAAttach(machineName string, consoleInfo api.ConsoleInfo) error {
 
 	cmd := exec.Command("spicy", args...)
 	fmt.Printf("Attaching to %s vga console\n", machineName)
+	if consoleInfo.Password != "" {
+		fmt.Printf("spicy will ask for the display password, install remote-viewer to connect without it\n")
+	}
 	return cmd.Run()
 }
 
+func doVNCAttach(machineName string, consoleInfo api.ConsoleInfo) error {
+	var uri string
+	if consoleInfo.Path != "" {
+		uri = fmt.Sprintf("vnc+unix://%s", consoleInfo.Path)
+	} else {
+		uri = fmt.Sprintf("vnc://%s:%s", consoleInfo.Addr, consoleInfo.Port)
+	}
+
+	// viewers are given the password in a file readable only by the user,
+	// never on the command line or the terminal
+	var cmd *exec.Cmd
+	if api.Which("remote-viewer") != "" && consoleInfo.Path == "" && consoleInfo.Password != "" {
+		vvFile, err := writeTempFile("machine-*.vv", strings.Join([]string{
+			"[virt-viewer]",
+			"type=vnc",
+			"host=" + consoleInfo.Addr,
+			"port=" + consoleInfo.Port,
+			"password=" + consoleInfo.Password,
+			"title=machine " + machineName,
+			"",
+		}, "\n"))
+		if err != nil {
+			return err
+		}
+		defer os.Remove(vvFile)
+		cmd = exec.Command("remote-viewer", vvFile)
+	} else if api.Which("vncviewer") != "" {
+		target := consoleInfo.Path
+		if target == "" {
+			target = fmt.Sprintf("%s::%s", consoleInfo.Addr, consoleInfo.Port)
+		}
+		args := []string{}
+		if consoleInfo.Password != "" {
+			passwdFile, err := writeTempFile("machine-vnc-*.passwd", string(vncPasswdFile(consoleInfo.Password)))
+			if err != nil {
+				return err
+			}
+			defer os.Remove(passwdFile)
+			args = append(args, "-passwd", passwdFile)
+		}
+		cmd = exec.Command("vncviewer", append(args, target)...)
+	} else if api.Which("remote-viewer") != "" {
+		if consoleInfo.Password != "" {
+			fmt.Printf("remote-viewer cannot be given the password for %s, install vncviewer to connect without it\n", uri)
+		}
+		cmd = exec.Command("remote-viewer", fmt.Sprintf("--title=machine %s", machineName), uri)
+	} else {
+		return fmt.Errorf("No VNC viewer found, install remote-viewer or vncviewer, or connect to %s", uri)
+	}
+	fmt.Printf("Attaching to %s vnc console\n", machineName)
+	return cmd.Run()
+}
+
+// vncPasswdFile returns password in the format written by vncpasswd, DES
+// with the fixed key VNC viewers use to obscure stored passwords.  VNC's
+// DES reverses the bits of each key byte, this is the key in standard order.
+func vncPasswdFile(password string) []byte {
+	key := []byte{0xe8, 0x4a, 0xd6, 0x60, 0xc4, 0x72, 0x1a, 0xe0}
+	block, _ := des.NewCipher(key)
+	plain := make([]byte, 8)
+	copy(plain, password)
+	obscured := make([]byte, 8)
+	block.Encrypt(obscured, plain)
+	return obscured
+}
+
+// writeTempFile writes content to a new file readable only by the user
+func writeTempFile(pattern, content string) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create temp file: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("Failed to write temp file %q: %s", f.Name(), err)
+	}
+	return f.Name(), nil
+}
+
 func DoConsoleAttach(machineName string, consoleInfo api.ConsoleInfo) error {
 	switch consoleInfo.Type {
 	case api.SerialConsole:
-		return doConsoleAttach(machineName, consoleInfo)
+		return attachSerialConsole(machineName, consoleInfo.ReadOnly, nil)
 	case api.VGAConsole:
 		return doVGAAttach(machineName, consoleInfo)
+	case api.VNCConsole:
+		return doVNCAttach(machineName, consoleInfo)
 	default:
 		return fmt.Errorf("Cannot attach to unknown console type '%s'", consoleInfo.Type)
 	}
@@ -0,0 +1,354 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/project-machine/machine/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+// diskCmd represents the disk command
+var diskCmd = &cobra.Command{
+	Use:   "disk",
+	Short: "Manage the disks of a machine",
+	Long: `Attach, detach, resize, convert, throttle and inspect disks, on running
+machines disks are hotplugged, resized and throttled online`,
+}
+
+var diskAttachCmd = &cobra.Command{
+	Use:   "attach <machine_name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Attach a disk to a machine",
+	Long: `Attach a disk to a machine and add it to the machine definition.  If
+--size is given and the file does not exist a new disk image is created in the
+machine directory, otherwise the file is imported.  Disks are hotplugged into
+running machines, which requires --attach virtio, nvme or scsi.`,
+	RunE: doDiskAttach,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var diskDetachCmd = &cobra.Command{
+	Use:   "detach <machine_name> <disk_name>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Detach a disk from a machine",
+	Long: `Detach a disk from a machine and remove it from the machine definition.
+The disk name is the base name of its file without extension.  The disk image
+itself is kept.  Only disks hotplugged since the machine started can be
+detached while it is running.`,
+	RunE: doDiskDetach,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var diskResizeCmd = &cobra.Command{
+	Use:   "resize <machine_name> <disk_name>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Grow a disk of a machine",
+	Long: `Grow a disk to --size and record the new size in the machine
+definition.  Disks of running machines are resized online, the guest still
+needs to grow its partitions and filesystems.  Disks are never shrunk.`,
+	RunE: doDiskResize,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var diskConvertCmd = &cobra.Command{
+	Use:   "convert <machine_name> <disk_name>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Convert a disk of a stopped machine between qcow2 and raw",
+	Long: `Convert a disk of a stopped machine to --format, keeping its file name.
+Any backing image is merged into the converted disk.`,
+	RunE: doDiskConvert,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var diskThrottleCmd = &cobra.Command{
+	Use:   "throttle <machine_name> <disk_name>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Limit the I/O of a disk",
+	Long: `Replace the I/O limits of a disk and record them in the machine
+definition, limits of running machines change at once.  Byte rates take sizes
+such as 100MiB, unset limits are unlimited so without any flags all limits are
+removed.  The -max limits allow bursts of up to --burst-length seconds.`,
+	RunE: doDiskThrottle,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var diskInfoCmd = &cobra.Command{
+	Use:   "info <machine_name> <disk_name>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Show the size, backing chain and snapshots of a disk",
+	RunE:  doDiskInfo,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+func doDiskAttach(cmd *cobra.Command, args []string) error {
+	machineName := args[0]
+	file := cmd.Flag("file").Value.String()
+	size := cmd.Flag("size").Value.String()
+	readOnly, _ := cmd.Flags().GetBool("read-only")
+
+	disk := api.QemuDisk{
+		File:        file,
+		Image:       cmd.Flag("image").Value.String(),
+		BackingFile: cmd.Flag("backing-file").Value.String(),
+		Format:      cmd.Flag("format").Value.String(),
+		Attach:      cmd.Flag("attach").Value.String(),
+		Type:        cmd.Flag("type").Value.String(),
+		ReadOnly:    readOnly,
+		Cache:       cmd.Flag("cache").Value.String(),
+		AIO:         cmd.Flag("aio").Value.String(),
+		Controller:  cmd.Flag("controller").Value.String(),
+		Secret:      cmd.Flag("secret").Value.String(),
+	}
+	if disk.Secret != "" {
+		disk.Encryption = api.DiskEncryptionLUKS
+	}
+	if cmd.Flags().Changed("unit") {
+		unit, _ := cmd.Flags().GetInt("unit")
+		disk.Unit = &unit
+	}
+	disk.LUN, _ = cmd.Flags().GetInt("lun")
+	if disk.BackingFile != "" && !filepath.IsAbs(disk.BackingFile) && api.PathExists(disk.BackingFile) {
+		absPath, err := filepath.Abs(disk.BackingFile)
+		if err != nil {
+			return fmt.Errorf("Failed to get absolute path of %q: %s", disk.BackingFile, err)
+		}
+		disk.BackingFile = absPath
+	}
+	if disk.File == "" && disk.Image == "" {
+		return fmt.Errorf("One of --file or --image is required")
+	}
+	if size != "" {
+		bytes, err := humanize.ParseBytes(size)
+		if err != nil {
+			return fmt.Errorf("Invalid disk size '%s': %s", size, err)
+		}
+		disk.Size = api.DiskSize(bytes)
+	}
+	// machined resolves relative paths against the machine directory, send
+	// local files with their full path
+	if file != "" && !filepath.IsAbs(file) && api.PathExists(file) {
+		absPath, err := filepath.Abs(file)
+		if err != nil {
+			return fmt.Errorf("Failed to get absolute path of %q: %s", file, err)
+		}
+		disk.File = absPath
+	}
+
+	endpoint := fmt.Sprintf("machines/%s/disks", machineName)
+	disksURL := api.GetAPIURL(endpoint)
+	if len(disksURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().SetBody(disk).Post(disksURL)
+	if err != nil {
+		return fmt.Errorf("Failed POST to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	if err := json.Unmarshal(resp.Body(), &disk); err != nil {
+		return fmt.Errorf("Failed to unmarshal response from %s: %s", endpoint, err)
+	}
+	fmt.Printf("Attached disk %s to %s\n", disk.Name(), machineName)
+	return nil
+}
+
+func doDiskDetach(cmd *cobra.Command, args []string) error {
+	machineName := args[0]
+	diskName := args[1]
+
+	endpoint := fmt.Sprintf("machines/%s/disks/%s", machineName, diskName)
+	diskURL := api.GetAPIURL(endpoint)
+	if len(diskURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().Delete(diskURL)
+	if err != nil {
+		return fmt.Errorf("Failed DELETE to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	fmt.Printf("Detached disk %s from %s\n", diskName, machineName)
+	return nil
+}
+
+func postDiskAction(machineName, diskName, action string, request interface{}) error {
+	endpoint := fmt.Sprintf("machines/%s/disks/%s/%s", machineName, diskName, action)
+	actionURL := api.GetAPIURL(endpoint)
+	if len(actionURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(actionURL)
+	if err != nil {
+		return fmt.Errorf("Failed POST to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	return nil
+}
+
+func doDiskResize(cmd *cobra.Command, args []string) error {
+	request := api.DiskResizeRequest{Size: cmd.Flag("size").Value.String()}
+	if err := postDiskAction(args[0], args[1], "resize", request); err != nil {
+		return err
+	}
+	fmt.Printf("Resized disk %s of %s to %s\n", args[1], args[0], request.Size)
+	return nil
+}
+
+func doDiskConvert(cmd *cobra.Command, args []string) error {
+	request := api.DiskConvertRequest{Format: cmd.Flag("format").Value.String()}
+	if err := postDiskAction(args[0], args[1], "convert", request); err != nil {
+		return err
+	}
+	fmt.Printf("Converted disk %s of %s to %s\n", args[1], args[0], request.Format)
+	return nil
+}
+
+func doDiskThrottle(cmd *cobra.Command, args []string) error {
+	throttle := api.DiskThrottle{}
+	byteRates := map[string]*api.DiskSize{
+		"bps": &throttle.BPS, "bps-read": &throttle.BPSRead, "bps-write": &throttle.BPSWrite,
+		"bps-max": &throttle.BPSMax, "bps-read-max": &throttle.BPSReadMax, "bps-write-max": &throttle.BPSWriteMax,
+	}
+	for flag, limit := range byteRates {
+		value := cmd.Flag(flag).Value.String()
+		if value == "" {
+			continue
+		}
+		bytes, err := humanize.ParseBytes(value)
+		if err != nil {
+			return fmt.Errorf("Invalid --%s '%s': %s", flag, value, err)
+		}
+		*limit = api.DiskSize(bytes)
+	}
+	opRates := map[string]*int64{
+		"iops": &throttle.IOPS, "iops-read": &throttle.IOPSRead, "iops-write": &throttle.IOPSWrite,
+		"iops-max": &throttle.IOPSMax, "iops-read-max": &throttle.IOPSReadMax, "iops-write-max": &throttle.IOPSWriteMax,
+		"burst-length": &throttle.BurstLength,
+	}
+	for flag, limit := range opRates {
+		*limit, _ = cmd.Flags().GetInt64(flag)
+	}
+	if err := postDiskAction(args[0], args[1], "throttle", throttle); err != nil {
+		return err
+	}
+	if throttle.IsZero() {
+		fmt.Printf("Removed I/O limits of disk %s of %s\n", args[1], args[0])
+	} else {
+		fmt.Printf("Set I/O limits of disk %s of %s\n", args[1], args[0])
+	}
+	return nil
+}
+
+func printDiskImageInfo(indent string, image api.DiskImageInfo) {
+	fmt.Printf("%sfile: %s\n", indent, image.Filename)
+	fmt.Printf("%sformat: %s\n", indent, image.Format)
+	fmt.Printf("%svirtual size: %s (%d bytes)\n", indent, humanize.IBytes(uint64(image.VirtualSize)), image.VirtualSize)
+	fmt.Printf("%sdisk size: %s\n", indent, humanize.IBytes(uint64(image.ActualSize)))
+	if image.BackingFilename != "" {
+		fmt.Printf("%sbacking file: %s (%s)\n", indent, image.BackingFilename, image.BackingFormat)
+	}
+	if len(image.Snapshots) > 0 {
+		fmt.Printf("%ssnapshots:\n", indent)
+		for _, snapshot := range image.Snapshots {
+			fmt.Printf("%s  %s %s %s\n", indent, snapshot.ID, snapshot.Name, time.Unix(snapshot.DateSec, 0).Format(time.RFC3339))
+		}
+	}
+}
+
+func doDiskInfo(cmd *cobra.Command, args []string) error {
+	endpoint := fmt.Sprintf("machines/%s/disks/%s", args[0], args[1])
+	diskURL := api.GetAPIURL(endpoint)
+	if len(diskURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().Get(diskURL)
+	if err != nil {
+		return fmt.Errorf("Failed GET on '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	var info api.DiskInfo
+	if err := json.Unmarshal(resp.Body(), &info); err != nil {
+		return fmt.Errorf("Failed to unmarshal response from %s: %s", endpoint, err)
+	}
+	fmt.Printf("name: %s\n", info.Name)
+	printDiskImageInfo("", info.DiskImageInfo)
+	for _, backing := range info.BackingChain {
+		fmt.Println("backing image:")
+		printDiskImageInfo("  ", backing)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(diskCmd)
+	diskCmd.AddCommand(diskAttachCmd)
+	diskCmd.AddCommand(diskDetachCmd)
+	diskCmd.AddCommand(diskResizeCmd)
+	diskCmd.AddCommand(diskConvertCmd)
+	diskCmd.AddCommand(diskThrottleCmd)
+	diskCmd.AddCommand(diskInfoCmd)
+	diskAttachCmd.Flags().StringP("file", "f", "", "disk image to import, or to create with --size")
+	diskAttachCmd.Flags().StringP("image", "i", "", "stored image to create the disk as an overlay of")
+	diskAttachCmd.Flags().StringP("size", "s", "", "size of a new disk image, e.g. 10GiB")
+	diskAttachCmd.Flags().String("backing-file", "", "create the new disk as a qcow2 overlay on this read-only image")
+	diskAttachCmd.Flags().String("format", "qcow2", "disk image format: qcow2 or raw")
+	diskAttachCmd.Flags().StringP("attach", "a", "virtio", "bus to attach the disk to: virtio, nvme, scsi, ide or usb")
+	diskAttachCmd.Flags().StringP("type", "t", "ssd", "disk type: ssd or hdd")
+	diskAttachCmd.Flags().Bool("read-only", false, "attach the disk read-only")
+	diskAttachCmd.Flags().String("cache", "", "cache mode: none, writeback, writethrough, directsync or unsafe (default)")
+	diskAttachCmd.Flags().String("aio", "", "asynchronous I/O: threads (default), native or io_uring")
+	diskAttachCmd.Flags().String("controller", "", "id of the storage controller to place the disk on, replaces --attach")
+	diskAttachCmd.Flags().Int("unit", 0, "unit of the disk on the controller, defaults to the next free unit")
+	diskAttachCmd.Flags().Int("lun", 0, "lun of the disk on a virtio-scsi controller")
+	diskAttachCmd.Flags().String("secret", "", "encrypt the disk with LUKS using this stored secret")
+	diskResizeCmd.Flags().StringP("size", "s", "", "new size of the disk, e.g. 40GiB")
+	diskResizeCmd.MarkFlagRequired("size")
+	diskConvertCmd.Flags().StringP("format", "f", "", "disk image format to convert to: qcow2 or raw")
+	diskConvertCmd.MarkFlagRequired("format")
+	for _, limit := range []string{"bps", "bps-read", "bps-write"} {
+		diskThrottleCmd.Flags().String(limit, "", "limit of bytes per second, e.g. 100MiB")
+		diskThrottleCmd.Flags().String(limit+"-max", "", "burst limit of bytes per second")
+	}
+	for _, limit := range []string{"iops", "iops-read", "iops-write"} {
+		diskThrottleCmd.Flags().Int64(limit, 0, "limit of operations per second")
+		diskThrottleCmd.Flags().Int64(limit+"-max", 0, "burst limit of operations per second")
+	}
+	diskThrottleCmd.Flags().Int64("burst-length", 0, "seconds the -max limits may be used for")
+}
@@ -52,7 +52,7 @@ var editCmd = &cobra.Command{
 //
 func doEdit(cmd *cobra.Command, args []string) {
 	machineName := args[0]
-	machines, err := getMachines()
+	machines, err := getMachines(false)
 	if err != nil {
 		panic(err)
 	}
@@ -33,7 +33,7 @@ func doGui(cmd *cobra.Command, args []string) {
 	}
 	machineName := args[0]
 
-	consoleInfo, err := GetMachineConsoleInfo(machineName, api.VGAConsole)
+	consoleInfo, err := GetMachineConsoleInfo(machineName, api.VGAConsole, false)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,250 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/project-machine/machine/pkg/api"
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+// imageCmd represents the image command
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Manage the base images stored by machined",
+	Long: `Import, pull, list, inspect and remove the base images stored by machined.
+Images are stored by the sha256 of their content and may have any number of
+names.  Disks with 'image: <name>' are created as qcow2 overlays on the image.`,
+}
+
+var imageImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Import a raw or qcow2 disk image",
+	RunE:  doImageImport,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var imagePullCmd = &cobra.Command{
+	Use:   "pull <oci://registry/repository:tag|oci-layout:dir:tag>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Pull a disk or cdrom image from an OCI registry or layout directory",
+	RunE:  doImagePull,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var imageListCmd = &cobra.Command{
+	Use:   "list",
+	Args:  cobra.NoArgs,
+	Short: "List stored images",
+	RunE:  doImageList,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var imageRmCmd = &cobra.Command{
+	Use:   "rm <image>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Remove an image name, or the image if it has no other names",
+	RunE:  doImageRm,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var imageInspectCmd = &cobra.Command{
+	Use:   "inspect <image>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Show the details of an image",
+	RunE:  doImageInspect,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+func doImageImport(cmd *cobra.Command, args []string) error {
+	names, _ := cmd.Flags().GetStringArray("name")
+	request := api.ImageImportRequest{Source: args[0], Names: names}
+	// machined resolves relative paths against its own working directory
+	if !filepath.IsAbs(request.Source) && api.PathExists(request.Source) {
+		absPath, err := filepath.Abs(request.Source)
+		if err != nil {
+			return fmt.Errorf("Failed to get absolute path of %q: %s", request.Source, err)
+		}
+		request.Source = absPath
+	}
+
+	endpoint := "images"
+	imagesURL := api.GetAPIURL(endpoint)
+	if len(imagesURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(imagesURL)
+	if err != nil {
+		return fmt.Errorf("Failed POST to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	var image api.Image
+	if err := json.Unmarshal(resp.Body(), &image); err != nil {
+		return fmt.Errorf("Failed to unmarshal response from %s: %s", endpoint, err)
+	}
+	fmt.Println(image.Digest)
+	return nil
+}
+
+func doImagePull(cmd *cobra.Command, args []string) error {
+	names, _ := cmd.Flags().GetStringArray("name")
+	request := api.ImagePullRequest{Ref: args[0], Names: names}
+	// layout directories are read by machined
+	if strings.HasPrefix(request.Ref, api.OCILayoutPrefix) {
+		ref, err := api.ParseOCIReference(request.Ref)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(ref.LayoutDir) {
+			absPath, err := filepath.Abs(ref.LayoutDir)
+			if err != nil {
+				return fmt.Errorf("Failed to get absolute path of %q: %s", ref.LayoutDir, err)
+			}
+			ref.LayoutDir = absPath
+			request.Ref = ref.String()
+		}
+	}
+
+	endpoint := "images/pull"
+	pullURL := api.GetAPIURL(endpoint)
+	if len(pullURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(pullURL)
+	if err != nil {
+		return fmt.Errorf("Failed POST to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	var image api.Image
+	if err := json.Unmarshal(resp.Body(), &image); err != nil {
+		return fmt.Errorf("Failed to unmarshal response from %s: %s", endpoint, err)
+	}
+	fmt.Println(image.Digest)
+	return nil
+}
+
+func getImage(ref string) (api.Image, error) {
+	var image api.Image
+	endpoint := fmt.Sprintf("images/%s", ref)
+	imageURL := api.GetAPIURL(endpoint)
+	if len(imageURL) == 0 {
+		return image, fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().Get(imageURL)
+	if err != nil {
+		return image, fmt.Errorf("Failed GET on '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return image, fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	if err := json.Unmarshal(resp.Body(), &image); err != nil {
+		return image, fmt.Errorf("Failed to unmarshal response from %s: %s", endpoint, err)
+	}
+	return image, nil
+}
+
+func doImageList(cmd *cobra.Command, args []string) error {
+	endpoint := "images"
+	imagesURL := api.GetAPIURL(endpoint)
+	if len(imagesURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().Get(imagesURL)
+	if err != nil {
+		return fmt.Errorf("Failed GET on '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	var images []api.Image
+	if err := json.Unmarshal(resp.Body(), &images); err != nil {
+		return fmt.Errorf("Failed to unmarshal response from %s: %s", endpoint, err)
+	}
+	tbl := table.New("ID", "Names", "Format", "Size", "Created")
+	tbl.AddRow("--", "-----", "------", "----", "-------")
+	for _, image := range images {
+		names := strings.Join(image.Names, ",")
+		if names == "" {
+			names = "<none>"
+		}
+		tbl.AddRow(image.ShortID(), names, image.Format, humanize.IBytes(uint64(image.Size)), humanize.Time(image.Created))
+	}
+	tbl.Print()
+	return nil
+}
+
+func doImageRm(cmd *cobra.Command, args []string) error {
+	ref := args[0]
+	endpoint := fmt.Sprintf("images/%s", ref)
+	imageURL := api.GetAPIURL(endpoint)
+	if len(imageURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().Delete(imageURL)
+	if err != nil {
+		return fmt.Errorf("Failed DELETE to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	fmt.Printf("Removed %s\n", ref)
+	return nil
+}
+
+func doImageInspect(cmd *cobra.Command, args []string) error {
+	image, err := getImage(args[0])
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(image, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal image: %s", err)
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(imageCmd)
+	imageCmd.AddCommand(imageImportCmd)
+	imageCmd.AddCommand(imagePullCmd)
+	imageCmd.AddCommand(imageListCmd)
+	imageCmd.AddCommand(imageRmCmd)
+	imageCmd.AddCommand(imageInspectCmd)
+	imageImportCmd.Flags().StringArrayP("name", "n", []string{}, "name for the image, may be repeated")
+	imagePullCmd.Flags().StringArrayP("name", "n", []string{}, "name for the image instead of <repository>:<tag>, may be repeated")
+}
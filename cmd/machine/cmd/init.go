@@ -38,7 +38,8 @@ ephemeral: false
 config:
   cpus: 2
   memory: 2048
-  uefi: true
+  firmware:
+    type: uefi
   tpm: true
   tpm-version: 2.0
   secure-boot: false
@@ -62,7 +63,8 @@ ephemeral: false
 config:
   cpus: 2
   memory: 2048
-  uefi: true
+  firmware:
+    type: uefi
   tpm: true
   tpm-version: 2.0
   secure-boot: true
@@ -274,6 +276,26 @@ func checkMachineFilePaths(newMachine *api.Machine) error {
 		log.Infof("Fully qualified uefi-code path %s", newPath)
 		newMachine.Config.UEFICode = newPath
 	}
+	firmware := &newMachine.Config.Firmware
+	for _, file := range []struct {
+		name string
+		path *string
+	}{
+		{"firmware code", &firmware.Code},
+		{"firmware vars", &firmware.Vars},
+		{"kernel", &firmware.Kernel},
+		{"initrd", &firmware.Initrd},
+	} {
+		if *file.path == "" {
+			continue
+		}
+		newPath, err := verifyPath(cwd, *file.path)
+		if err != nil {
+			return fmt.Errorf("Failed to verify path to %s: %q: %s", file.name, *file.path, err)
+		}
+		log.Infof("Fully qualified %s path %s", file.name, newPath)
+		*file.path = newPath
+	}
 	return nil
 }
 
@@ -31,10 +31,20 @@ var listCmd = &cobra.Command{
 }
 
 func doList(cmd *cobra.Command, args []string) {
-	machines, err := getMachines()
+	all, _ := cmd.Flags().GetBool("all")
+	machines, err := getMachines(all)
 	if err != nil {
 		panic(err)
 	}
+	if all {
+		tbl := table.New("Name", "Status", "Owner", "Description")
+		tbl.AddRow("----", "------", "-----", "-----------")
+		for _, machine := range machines {
+			tbl.AddRow(machine.Name, machine.Status, machine.OwnerUID, machine.Description)
+		}
+		tbl.Print()
+		return
+	}
 	tbl := table.New("Name", "Status", "Description")
 	tbl.AddRow("----", "------", "-----------")
 	for _, machine := range machines {
@@ -45,6 +55,7 @@ func doList(cmd *cobra.Command, args []string) {
 
 func init() {
 	rootCmd.AddCommand(listCmd)
+	listCmd.PersistentFlags().BoolP("all", "a", false, "list machines owned by all users (admins only)")
 	table.DefaultHeaderFormatter = func(format string, vals ...interface{}) string {
 		return strings.ToUpper(fmt.Sprintf(format, vals...))
 	}
@@ -0,0 +1,78 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/project-machine/machine/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+// logsCmd represents the logs command
+var logsCmd = &cobra.Command{
+	Use:        "logs <machine_name>",
+	Args:       cobra.MinimumNArgs(1),
+	ArgAliases: []string{"machineName"},
+	Short:      "show the logs of the specified machine",
+	Long: `show the serial console transcript, QEMU output or swtpm log of the
+specified machine.  Logs are kept after the machine stops.`,
+	RunE: doLogs,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+func doLogs(cmd *cobra.Command, args []string) error {
+	machineName := args[0]
+	source := cmd.Flag("source").Value.String()
+	follow, _ := cmd.Flags().GetBool("follow")
+	if !api.ValidLogSource(source) {
+		return fmt.Errorf("Invalid log source '%s', must be one of: %s", source, strings.Join(api.LogSources, ", "))
+	}
+
+	endpoint := fmt.Sprintf("machines/%s/logs", machineName)
+	logsURL := api.GetAPIURL(endpoint)
+	if len(logsURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	req := rootclient.R().SetDoNotParseResponse(true).SetQueryParam("source", source)
+	if follow {
+		req.SetQueryParam("follow", "true")
+	}
+	resp, err := req.Get(logsURL)
+	if err != nil {
+		return fmt.Errorf("Failed GET on '%s' endpoint: %s", endpoint, err)
+	}
+	body := resp.RawBody()
+	defer body.Close()
+	if resp.StatusCode() != http.StatusOK {
+		msg, _ := ioutil.ReadAll(body)
+		return fmt.Errorf("%s: %s", resp.Status(), msg)
+	}
+	_, err = io.Copy(os.Stdout, body)
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+	logsCmd.PersistentFlags().StringP("source", "s", api.LogSourceSerial, "log to show: serial, qemu or swtpm")
+	logsCmd.PersistentFlags().BoolP("follow", "f", false, "keep streaming new log output")
+}
@@ -27,6 +27,7 @@ import (
 
 	"github.com/go-resty/resty/v2"
 	"github.com/project-machine/machine/pkg/api"
+	"github.com/project-machine/machine/pkg/client"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -63,6 +64,13 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.client.yaml)")
+	rootCmd.PersistentFlags().String("remote", "", "connect to a remote machined at host:port instead of the local socket")
+	rootCmd.PersistentFlags().String("cert", "", "client certificate for the remote machined")
+	rootCmd.PersistentFlags().String("key", "", "client private key for the remote machined")
+	rootCmd.PersistentFlags().String("ca", "", "CA bundle used to verify the remote machined certificate")
+	for _, flag := range []string{"remote", "cert", "key", "ca"} {
+		viper.BindPFlag(flag, rootCmd.PersistentFlags().Lookup(flag))
+	}
 
 	// configure the http client to point to the unix socket
 	apiSocket := api.APISocketPath()
@@ -113,16 +121,35 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
+
+	// switch to the remote machined if one was requested
+	if remote := viper.GetString("remote"); remote != "" {
+		transport, err := client.NewRemoteTransport(client.RemoteConfig{
+			Address:  remote,
+			CertFile: viper.GetString("cert"),
+			KeyFile:  viper.GetString("key"),
+			CAFile:   viper.GetString("ca"),
+		})
+		cobra.CheckErr(err)
+		rootclient.SetTransport(transport).SetBaseURL(remote)
+	}
 }
 
 // common for all commands
-func getMachines() ([]api.Machine, error) {
+func getMachines(all bool) ([]api.Machine, error) {
 	machines := []api.Machine{}
 	listURL := api.GetAPIURL("machines")
 	if len(listURL) == 0 {
 		return machines, fmt.Errorf("Failed to get API URL for 'machines' endpoint")
 	}
-	resp, _ := rootclient.R().EnableTrace().Get(listURL)
+	req := rootclient.R().EnableTrace()
+	if all {
+		req.SetQueryParam("all", "true")
+	}
+	resp, _ := req.Get(listURL)
+	if resp.StatusCode() != http.StatusOK {
+		return machines, fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
 	err := json.Unmarshal(resp.Body(), &machines)
 	if err != nil {
 		return machines, fmt.Errorf("Failed to unmarshal GET on /machines")
@@ -0,0 +1,87 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/project-machine/machine/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+// screenshotCmd represents the screenshot command
+var screenshotCmd = &cobra.Command{
+	Use:        "screenshot <machine_name>",
+	Args:       cobra.ExactArgs(1),
+	ArgAliases: []string{"machineName"},
+	Short:      "save a screenshot of the display of the specified machine",
+	Long: `save a PNG screenshot of the display of the specified running machine.
+Use '-o -' to write the image to stdout.`,
+	RunE: doScreenshot,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+func doScreenshot(cmd *cobra.Command, args []string) error {
+	machineName := args[0]
+	output := cmd.Flag("output").Value.String()
+	if output == "" {
+		output = machineName + ".png"
+	}
+
+	endpoint := fmt.Sprintf("machines/%s/screenshot", machineName)
+	screenshotURL := api.GetAPIURL(endpoint)
+	if len(screenshotURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().SetDoNotParseResponse(true).Get(screenshotURL)
+	if err != nil {
+		return fmt.Errorf("Failed GET on '%s' endpoint: %s", endpoint, err)
+	}
+	body := resp.RawBody()
+	defer body.Close()
+	if resp.StatusCode() != http.StatusOK {
+		msg, _ := ioutil.ReadAll(body)
+		return fmt.Errorf("%s: %s", resp.Status(), msg)
+	}
+
+	if output == "-" {
+		_, err = io.Copy(os.Stdout, body)
+		return err
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("Failed to create screenshot file %q: %s", output, err)
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to write screenshot file %q: %s", output, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Saved screenshot of %s to %s\n", machineName, output)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(screenshotCmd)
+	screenshotCmd.PersistentFlags().StringP("output", "o", "", "file to write the PNG to, default <machine_name>.png")
+}
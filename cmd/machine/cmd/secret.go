@@ -0,0 +1,152 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/project-machine/machine/pkg/api"
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+// secretCmd represents the secret command
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Manage the secrets of encrypted disks",
+	Long: `Store, list and remove the passphrases of encrypted disks.  Disks with
+'encryption: luks' and 'secret: <name>' are created and opened with the named
+secret.  Secret values are kept by machined and never shown again.`,
+}
+
+var secretSetCmd = &cobra.Command{
+	Use:   "set <name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Store a secret read from --file or standard input",
+	RunE:  doSecretSet,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var secretListCmd = &cobra.Command{
+	Use:   "list",
+	Args:  cobra.NoArgs,
+	Short: "List stored secrets",
+	RunE:  doSecretList,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var secretRmCmd = &cobra.Command{
+	Use:   "rm <name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Remove a secret which no disk uses",
+	RunE:  doSecretRm,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+func doSecretSet(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	file := cmd.Flag("file").Value.String()
+	var value []byte
+	var err error
+	if file != "" {
+		value, err = os.ReadFile(file)
+	} else {
+		value, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read secret: %s", err)
+	}
+	// a trailing newline is not part of the passphrase
+	request := api.SecretSetRequest{Value: strings.TrimSuffix(string(value), "\n")}
+
+	endpoint := fmt.Sprintf("secrets/%s", name)
+	secretURL := api.GetAPIURL(endpoint)
+	if len(secretURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Put(secretURL)
+	if err != nil {
+		return fmt.Errorf("Failed PUT to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	fmt.Printf("Stored %s\n", name)
+	return nil
+}
+
+func doSecretList(cmd *cobra.Command, args []string) error {
+	endpoint := "secrets"
+	secretsURL := api.GetAPIURL(endpoint)
+	if len(secretsURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().Get(secretsURL)
+	if err != nil {
+		return fmt.Errorf("Failed GET on '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	var secrets []api.Secret
+	if err := json.Unmarshal(resp.Body(), &secrets); err != nil {
+		return fmt.Errorf("Failed to unmarshal response from %s: %s", endpoint, err)
+	}
+	tbl := table.New("Name", "Owner", "Created")
+	tbl.AddRow("----", "-----", "-------")
+	for _, secret := range secrets {
+		tbl.AddRow(secret.Name, secret.OwnerUID, humanize.Time(secret.Created))
+	}
+	tbl.Print()
+	return nil
+}
+
+func doSecretRm(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	endpoint := fmt.Sprintf("secrets/%s", name)
+	secretURL := api.GetAPIURL(endpoint)
+	if len(secretURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().Delete(secretURL)
+	if err != nil {
+		return fmt.Errorf("Failed DELETE to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
+	fmt.Printf("Removed %s\n", name)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(secretCmd)
+	secretCmd.AddCommand(secretSetCmd)
+	secretCmd.AddCommand(secretListCmd)
+	secretCmd.AddCommand(secretRmCmd)
+	secretSetCmd.Flags().StringP("file", "f", "", "file holding the secret instead of standard input")
+}
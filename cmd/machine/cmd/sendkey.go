@@ -0,0 +1,84 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/project-machine/machine/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+// sendkeyCmd represents the sendkey command
+var sendkeyCmd = &cobra.Command{
+	Use:        "sendkey <machine_name> [key-combination...]",
+	Args:       cobra.MinimumNArgs(1),
+	ArgAliases: []string{"machineName"},
+	Short:      "send keystrokes to the display of the specified machine",
+	Long: `press keys on the keyboard of the specified running machine.  Each
+key combination is pressed in order, keys pressed together are joined with
+'-', for example:
+
+  machine sendkey vm1 ctrl-alt-del
+  machine sendkey vm1 esc f2 down down ret
+  machine sendkey vm1 --text 'root\n'
+
+Text given with --text is typed after the key combinations using a US
+keyboard layout.`,
+	RunE: doSendKey,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+// textEscapes lets enter and tab be given on the command line
+var textEscapes = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\t`, "\t")
+
+func doSendKey(cmd *cobra.Command, args []string) error {
+	machineName := args[0]
+	text, _ := cmd.Flags().GetString("text")
+	delay, _ := cmd.Flags().GetInt("delay")
+	request := api.SendKeysRequest{
+		Keys:    args[1:],
+		Text:    textEscapes.Replace(text),
+		DelayMS: delay,
+	}
+	// catch typos before contacting machined
+	if _, err := request.Combos(); err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("machines/%s/keys", machineName)
+	keysURL := api.GetAPIURL(endpoint)
+	if len(keysURL) == 0 {
+		return fmt.Errorf("Failed to get API URL for '%s' endpoint", endpoint)
+	}
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(keysURL)
+	if err != nil {
+		return fmt.Errorf("Failed POST to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status(), resp.String())
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(sendkeyCmd)
+	sendkeyCmd.PersistentFlags().StringP("text", "t", "", "text to type after the key combinations, \\n and \\t type enter and tab")
+	sendkeyCmd.PersistentFlags().IntP("delay", "d", 0, "milliseconds to wait between key combinations, default 20")
+}
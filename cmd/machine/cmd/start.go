@@ -45,7 +45,7 @@ var startCmd = &cobra.Command{
 func doStart(cmd *cobra.Command, args []string) {
 	machineName := args[0]
 	if err := DoStartMachine(machineName); err != nil {
-		panic(fmt.Sprintf("Failed to start machines '%s': %s", machineName))
+		panic(fmt.Sprintf("Failed to start machines '%s': %s", machineName, err))
 	}
 }
 
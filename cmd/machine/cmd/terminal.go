@@ -0,0 +1,208 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lxc/lxd/shared/termios"
+	"github.com/project-machine/machine/pkg/api"
+	"golang.org/x/sys/unix"
+)
+
+// Control-] detaches from the console, like telnet and the old socat client
+const consoleEscapeKey = 0x1d
+
+// dialConsoleStream opens the machined console websocket using the same
+// transport as the REST client, so it works locally and through --remote
+func dialConsoleStream(machineName string, readOnly bool) (*websocket.Conn, error) {
+	transport, ok := rootclient.GetClient().Transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported client transport %T", rootclient.GetClient().Transport)
+	}
+	dialer := websocket.Dialer{
+		NetDialContext:   transport.DialContext,
+		HandshakeTimeout: time.Second * 30,
+	}
+	endpoint := fmt.Sprintf("machines/%s/console/stream", machineName)
+	streamURL := strings.Replace(api.GetAPIURL(endpoint), "http://", "ws://", 1)
+	if readOnly {
+		streamURL += "?read-only=true"
+	}
+	ws, resp, err := dialer.Dial(streamURL, nil)
+	if err != nil {
+		if resp != nil {
+			defer resp.Body.Close()
+			var apiErr struct {
+				Error string `json:"error"`
+			}
+			if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+				return nil, fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+			}
+			return nil, fmt.Errorf("Failed to attach to %s console: %s", machineName, resp.Status)
+		}
+		return nil, fmt.Errorf("Failed to attach to %s console: %s", machineName, err)
+	}
+	return ws, nil
+}
+
+// consoleRecorder is notified of terminal size changes if the output passed
+// to attachSerialConsole implements it
+type consoleRecorder interface {
+	Resize(cols, rows int) error
+}
+
+// attachSerialConsole connects the terminal to the machine serial console
+// until the escape key is pressed or the machine goes away.  output, if
+// not nil, receives a copy of everything written to the terminal.
+func attachSerialConsole(machineName string, readOnly bool, output io.Writer) error {
+	ws, err := dialConsoleStream(machineName, readOnly)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	var writeLock sync.Mutex
+	writeMessage := func(messageType int, data []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		return ws.WriteMessage(messageType, data)
+	}
+
+	stdinFd := unix.Stdin
+	onTerm := termios.IsTerminal(stdinFd)
+	if onTerm {
+		oldState, err := termios.MakeRaw(stdinFd)
+		if err != nil {
+			return fmt.Errorf("Failed to put terminal in raw mode: %s", err)
+		}
+		defer termios.Restore(stdinFd, oldState)
+	}
+
+	mode := ""
+	if readOnly {
+		mode = " (read-only)"
+	}
+	fmt.Printf("Attaching to %s serial console%s, use 'Control-]' to detach from console\r\n", machineName, mode)
+
+	sendSize := func() {
+		cols, rows, err := termios.GetSize(unix.Stdout)
+		if err != nil {
+			return
+		}
+		if recorder, ok := output.(consoleRecorder); ok {
+			recorder.Resize(cols, rows)
+		}
+		ctl, _ := json.Marshal(api.ConsoleControl{Type: api.ConsoleControlResize, Cols: cols, Rows: rows})
+		writeMessage(websocket.TextMessage, ctl)
+	}
+
+	// restore the terminal if we are asked to exit while attached
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	detach := make(chan struct{})
+	var detachOnce sync.Once
+	doDetach := func() { detachOnce.Do(func() { close(detach) }) }
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				data := buf[:n]
+				escape := strings.IndexByte(string(data), consoleEscapeKey)
+				if escape >= 0 {
+					data = data[:escape]
+				}
+				if len(data) > 0 && !readOnly {
+					if err := writeMessage(websocket.BinaryMessage, data); err != nil {
+						doDetach()
+						return
+					}
+				}
+				if escape >= 0 {
+					doDetach()
+					return
+				}
+			}
+			if err != nil {
+				// keep watching the console when stdin is not interactive
+				if !onTerm {
+					return
+				}
+				doDetach()
+				return
+			}
+		}
+	}()
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					err = nil
+				}
+				closed <- err
+				return
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			os.Stdout.Write(data)
+			if output != nil {
+				output.Write(data)
+			}
+		}
+	}()
+
+	if onTerm {
+		sendSize()
+	}
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGWINCH {
+				sendSize()
+				continue
+			}
+			writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return fmt.Errorf("Detached from %s console: %s", machineName, sig)
+		case <-detach:
+			writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			fmt.Printf("\r\nDetached from %s console\r\n", machineName)
+			return nil
+		case err := <-closed:
+			if err != nil {
+				return fmt.Errorf("\r\nConsole connection to %s lost: %s", machineName, err)
+			}
+			fmt.Printf("\r\nConsole of %s closed\r\n", machineName)
+			return nil
+		}
+	}
+}
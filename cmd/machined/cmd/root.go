@@ -123,6 +123,16 @@ func installTemplate(templateSource, target string) error {
 
 func doServerRun(cmd *cobra.Command, args []string) {
 	conf := api.DefaultMachineDaemonConfig()
+	conf.RemoteListenAddress = viper.GetString("remote-listen")
+	conf.RemoteTLSCert = viper.GetString("tls-cert")
+	conf.RemoteTLSKey = viper.GetString("tls-key")
+	conf.RemoteTLSClientCA = viper.GetString("tls-client-ca")
+	conf.AuthPolicy = viper.GetString("auth-policy")
+	conf.AdminGroup = viper.GetString("admin-group")
+	conf.RemoteAllowAdminUsers = viper.GetBool("remote-allow-admin-users")
+	if err := conf.ValidateAuthPolicy(); err != nil {
+		panic(err)
+	}
 	ctrl := api.NewController(conf)
 
 	cwd, err := os.Getwd()
@@ -166,6 +176,16 @@ func init() {
 
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.server.yaml)")
+	rootCmd.Flags().String("remote-listen", "", "also serve the API on this host:port using mutual TLS")
+	rootCmd.Flags().String("tls-cert", "", "server certificate for the remote listener")
+	rootCmd.Flags().String("tls-key", "", "server private key for the remote listener")
+	rootCmd.Flags().String("tls-client-ca", "", "CA bundle used to verify remote client certificates")
+	rootCmd.Flags().String("auth-policy", api.AuthPolicyOpen, "who may modify machines: open, owner or group")
+	rootCmd.Flags().String("admin-group", "", "members of this group may manage all machines")
+	rootCmd.Flags().Bool("remote-allow-admin-users", false, "let client certificates for root or the machined user act as that user")
+	for _, flag := range []string{"remote-listen", "tls-cert", "tls-key", "tls-client-ca", "auth-policy", "admin-group", "remote-allow-admin-users"} {
+		viper.BindPFlag(flag, rootCmd.Flags().Lookup(flag))
+	}
 }
 
 // initConfig reads in config file and ENV variables if set.
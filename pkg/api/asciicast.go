@@ -0,0 +1,244 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Console sessions are recorded in asciinema's asciicast v2 format:
+// a JSON header line followed by one [time, type, data] event per line.
+// https://docs.asciinema.org/manual/asciicast/v2/
+const (
+	AsciicastVersion     = 2
+	AsciicastOutputEvent = "o"
+	AsciicastResizeEvent = "r"
+	RecordingsDirName    = "recordings"
+)
+
+type AsciicastHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Title     string `json:"title,omitempty"`
+}
+
+type AsciicastEvent struct {
+	Time float64
+	Type string
+	Data string
+}
+
+func (e AsciicastEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Time, e.Type, e.Data})
+}
+
+func (e *AsciicastEvent) UnmarshalJSON(b []byte) error {
+	var fields []interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("Invalid asciicast event: %s", string(b))
+	}
+	var ok bool
+	if e.Time, ok = fields[0].(float64); !ok {
+		return fmt.Errorf("Invalid asciicast event time: %s", string(b))
+	}
+	if e.Type, ok = fields[1].(string); !ok {
+		return fmt.Errorf("Invalid asciicast event type: %s", string(b))
+	}
+	if e.Data, ok = fields[2].(string); !ok {
+		return fmt.Errorf("Invalid asciicast event data: %s", string(b))
+	}
+	return nil
+}
+
+// AsciicastWriter records terminal output as asciicast events
+type AsciicastWriter struct {
+	w       io.Writer
+	start   time.Time
+	mutex   sync.Mutex
+	pending []byte
+	cols    int
+	rows    int
+}
+
+func NewAsciicastWriter(w io.Writer, cols, rows int, title string) (*AsciicastWriter, error) {
+	start := time.Now()
+	header, err := json.Marshal(AsciicastHeader{
+		Version:   AsciicastVersion,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: start.Unix(),
+		Title:     title,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", header); err != nil {
+		return nil, fmt.Errorf("Failed to write asciicast header: %s", err)
+	}
+	return &AsciicastWriter{w: w, start: start, cols: cols, rows: rows}, nil
+}
+
+func (a *AsciicastWriter) event(eventType, data string) error {
+	line, err := json.Marshal(AsciicastEvent{
+		Time: float64(time.Since(a.start).Microseconds()) / 1e6,
+		Type: eventType,
+		Data: data,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(a.w, "%s\n", line)
+	return err
+}
+
+// Write records console output.  An incomplete UTF-8 sequence at the end of
+// p is held back until the rest arrives, events must be valid strings.
+func (a *AsciicastWriter) Write(p []byte) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	data := append(a.pending, p...)
+	end := len(data)
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				end = len(data) - i
+			}
+			break
+		}
+	}
+	a.pending = append([]byte{}, data[end:]...)
+	if end == 0 {
+		return len(p), nil
+	}
+	if err := a.event(AsciicastOutputEvent, string(data[:end])); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Resize records a terminal size change if the size differs
+func (a *AsciicastWriter) Resize(cols, rows int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if cols == a.cols && rows == a.rows {
+		return nil
+	}
+	a.cols = cols
+	a.rows = rows
+	return a.event(AsciicastResizeEvent, fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// ReplayAsciicast writes the output events of a recording to w with their
+// original timing scaled by speed.  Pauses are limited to maxIdle if it is
+// greater than zero.
+func ReplayAsciicast(r io.Reader, w io.Writer, speed float64, maxIdle time.Duration) (AsciicastHeader, error) {
+	var header AsciicastHeader
+	if speed <= 0 {
+		speed = 1
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		return header, fmt.Errorf("Failed to read asciicast header: %v", scanner.Err())
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return header, fmt.Errorf("Failed to parse asciicast header: %s", err)
+	}
+	if header.Version != AsciicastVersion {
+		return header, fmt.Errorf("Unsupported asciicast version %d", header.Version)
+	}
+
+	last := 0.0
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event AsciicastEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return header, err
+		}
+		delay := time.Duration((event.Time - last) / speed * float64(time.Second))
+		if maxIdle > 0 && delay > maxIdle {
+			delay = maxIdle
+		}
+		last = event.Time
+		time.Sleep(delay)
+		if event.Type == AsciicastOutputEvent {
+			if _, err := io.WriteString(w, event.Data); err != nil {
+				return header, err
+			}
+		}
+	}
+	return header, scanner.Err()
+}
+
+// recordConsole writes the console output to a new asciicast file in dir
+// until the console closes
+func recordConsole(console *SerialMux, dir string) error {
+	if err := EnsureDir(dir); err != nil {
+		return fmt.Errorf("Failed to create recordings dir %q: %s", dir, err)
+	}
+	start := time.Now()
+	castFile := filepath.Join(dir, fmt.Sprintf("console-%s.cast", start.Format("20060102-150405")))
+	fh, err := os.OpenFile(castFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return fmt.Errorf("Failed to create console recording %q: %s", castFile, err)
+	}
+	client, err := console.AttachRecorder()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	cols, rows := console.Size()
+	cast, err := NewAsciicastWriter(fh, cols, rows, fmt.Sprintf("%s serial console", console.Name))
+	if err != nil {
+		fh.Close()
+		client.Close()
+		return err
+	}
+	log.Infof("VM:%s recording serial console to %s", console.Name, castFile)
+	go func() {
+		defer fh.Close()
+		failed := false
+		for data := range client.Output() {
+			if failed {
+				// drain what was queued before the client was detached
+				continue
+			}
+			cast.Resize(console.Size())
+			if _, err := cast.Write(data); err != nil {
+				log.Errorf("VM:%s console recording %s failed: %s", console.Name, castFile, err)
+				failed = true
+				client.Close()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAsciicastRoundTrip(t *testing.T) {
+	var cast bytes.Buffer
+	writer, err := NewAsciicastWriter(&cast, 80, 24, "vm1 serial console")
+	if err != nil {
+		t.Fatalf("failed to create asciicast writer: %s", err)
+	}
+	euro := []byte("€")
+	writer.Write([]byte("login: "))
+	// a multibyte character split across two reads
+	writer.Write(euro[:1])
+	writer.Write(euro[1:])
+	writer.Resize(80, 24)
+	writer.Resize(132, 50)
+	writer.Write([]byte("\r\n"))
+
+	lines := strings.Split(strings.TrimSpace(cast.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected header and 4 events, got:\n%s", cast.String())
+	}
+	var header AsciicastHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || header.Version != 2 || header.Width != 80 {
+		t.Fatalf("bad asciicast header %q: %v", lines[0], err)
+	}
+	var event AsciicastEvent
+	if err := json.Unmarshal([]byte(lines[2]), &event); err != nil || event.Data != "€" {
+		t.Fatalf("expected the euro sign in one event, got %q: %v", lines[2], err)
+	}
+	if err := json.Unmarshal([]byte(lines[3]), &event); err != nil || event.Type != "r" || event.Data != "132x50" {
+		t.Fatalf("expected a resize event, got %q: %v", lines[3], err)
+	}
+
+	var out bytes.Buffer
+	if _, err := ReplayAsciicast(&cast, &out, 100, 0); err != nil {
+		t.Fatalf("failed to replay: %s", err)
+	}
+	if out.String() != "login: €\r\n" {
+		t.Fatalf("unexpected replay output %q", out.String())
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const AuditLogName = "audit.log"
+
+// AuditEntry is a single line in the audit log
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	UID      int       `json:"uid"`
+	User     string    `json:"user"`
+	Remote   bool      `json:"remote,omitempty"`
+	Action   string    `json:"action"`
+	Machine  string    `json:"machine,omitempty"`
+	OwnerUID int       `json:"owner-uid"`
+	Request  string    `json:"request"`
+	Summary  string    `json:"summary,omitempty"`
+	Status   int       `json:"status"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// AuditLog is an append-only JSON-lines log of mutating API calls
+type AuditLog struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+func NewAuditLog(path string) (*AuditLog, error) {
+	if err := EnsureDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("Failed to create audit log dir: %s", err)
+	}
+	return &AuditLog{Path: path}, nil
+}
+
+func (a *AuditLog) Append(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal audit entry: %s", err)
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	fh, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit log %q: %s", a.Path, err)
+	}
+	defer fh.Close()
+	if _, err := fh.Write(line); err != nil {
+		return fmt.Errorf("Failed to write audit log %q: %s", a.Path, err)
+	}
+	return fh.Close()
+}
+
+// Query returns entries for machineName (all machines if empty) recorded at
+// or after since.
+func (a *AuditLog) Query(machineName string, since time.Time) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	fh, err := os.Open(a.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return entries, fmt.Errorf("Failed to open audit log %q: %s", a.Path, err)
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Warnf("Skipping malformed audit log entry: %s", err)
+			continue
+		}
+		if machineName != "" && entry.Machine != machineName {
+			continue
+		}
+		if entry.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, fmt.Errorf("Failed reading audit log %q: %s", a.Path, err)
+	}
+	return entries, nil
+}
+
+// ParseAuditSince accepts either an RFC3339 timestamp or a duration (e.g. 24h)
+// relative to now.
+func ParseAuditSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid since value '%s', expected RFC3339 time or duration", since)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// auditSummary condenses the request body into a short description
+func auditSummary(action string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	switch action {
+	case "create", "update":
+		var m Machine
+		if err := json.Unmarshal(body, &m); err != nil {
+			return ""
+		}
+		return fmt.Sprintf("type=%s cpus=%d memory=%d disks=%d nics=%d ephemeral=%v",
+			m.Type, m.Config.Cpus, m.Config.Memory, len(m.Config.Disks), len(m.Config.Nics), m.Ephemeral)
+	case "console-script":
+		// scripts often type passwords, only record their length
+		var script ConsoleScript
+		if err := json.Unmarshal(body, &script); err != nil {
+			return ""
+		}
+		return fmt.Sprintf("steps=%d", len(script.Steps))
+	case "keys":
+		// as for console scripts the text may be a password
+		var request SendKeysRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			return ""
+		}
+		return fmt.Sprintf("keys=%s text=%d", strings.Join(request.Keys, ","), len(request.Text))
+	case "secret-set":
+		// never record the secret
+		return ""
+	default:
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, body); err != nil {
+			return ""
+		}
+		return compact.String()
+	}
+}
+
+// auditWriter keeps a copy of error responses so the error can be logged
+type auditWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.Status() >= 400 && w.body.Len() < 4096 {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Audit returns a handler which records the outcome of the request in the
+// audit log under the given action name.
+func (rh *RouteHandler) Audit(action string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		caller := getCaller(ctx)
+		var body []byte
+		if ctx.Request.Body != nil {
+			body, _ = io.ReadAll(ctx.Request.Body)
+			ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		entry := AuditEntry{
+			Time:     time.Now().UTC(),
+			UID:      caller.UID,
+			User:     caller.Name,
+			Remote:   caller.Remote,
+			Action:   action,
+			Machine:  ctx.Param("machinename"),
+			OwnerUID: caller.UID,
+			Request:  ctx.Request.Method + " " + ctx.Request.URL.Path,
+			Summary:  auditSummary(action, body),
+		}
+		if entry.Machine == "" {
+			var m Machine
+			if err := json.Unmarshal(body, &m); err == nil {
+				entry.Machine = m.Name
+			}
+		} else if m, err := rh.c.MachineController.GetMachineByName(entry.Machine); err == nil {
+			entry.OwnerUID = m.OwnerUID
+		}
+
+		writer := &auditWriter{ResponseWriter: ctx.Writer}
+		ctx.Writer = writer
+		ctx.Next()
+
+		entry.Status = writer.Status()
+		if entry.Status >= 400 {
+			var resp struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(writer.body.Bytes(), &resp); err == nil {
+				entry.Error = resp.Error
+			} else {
+				entry.Error = strings.TrimSpace(writer.body.String())
+			}
+		}
+		if err := rh.c.AuditLog.Append(entry); err != nil {
+			log.Errorf("Failed to record audit entry %+v: %s", entry, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLogQuery(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-audit-log")
+	if err != nil {
+		t.Fatalf("failed to create a tempdir for test")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	auditLog, err := NewAuditLog(filepath.Join(tmpDir, "state", AuditLogName))
+	if err != nil {
+		t.Fatalf("failed to create audit log: %s", err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour).UTC()
+	for _, entry := range []AuditEntry{
+		{Time: old, Action: "create", Machine: "vm1", Status: 200},
+		{Time: time.Now().UTC(), Action: "delete", Machine: "vm1", Status: 200},
+		{Time: time.Now().UTC(), Action: "start", Machine: "vm2", Status: 400, Error: "boom"},
+	} {
+		if err := auditLog.Append(entry); err != nil {
+			t.Fatalf("failed to append audit entry: %s", err)
+		}
+	}
+
+	entries, err := auditLog.Query("", time.Time{})
+	if err != nil {
+		t.Fatalf("failed to query audit log: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	since, err := ParseAuditSince("24h")
+	if err != nil {
+		t.Fatalf("failed to parse since: %s", err)
+	}
+	entries, err = auditLog.Query("vm1", since)
+	if err != nil {
+		t.Fatalf("failed to query audit log: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Action != "delete" {
+		t.Fatalf("expected only the vm1 delete entry, got %+v", entries)
+	}
+}
@@ -0,0 +1,342 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// AuthPolicyOpen allows any caller which can reach the API to manage any machine
+	AuthPolicyOpen = "open"
+	// AuthPolicyOwner only allows the owner of a machine (or an admin) to modify it
+	AuthPolicyOwner = "owner"
+	// AuthPolicyGroup additionally allows members of the owner's group to modify it
+	AuthPolicyGroup = "group"
+)
+
+// UnknownID is used for the UID/GID of callers which can't be mapped to a local user
+const UnknownID = -1
+
+type callerCtxKey struct{}
+
+// Caller is the identity of an API client.  Local clients are identified by
+// the peer credentials of the unix socket, remote clients by mapping the
+// common name of their TLS client certificate to a local user.
+type Caller struct {
+	UID    int
+	GID    int
+	Groups []int
+	Name   string
+	Remote bool
+}
+
+func (c Caller) String() string {
+	if c.Remote {
+		return fmt.Sprintf("%s(uid=%d,remote)", c.Name, c.UID)
+	}
+	return fmt.Sprintf("%s(uid=%d)", c.Name, c.UID)
+}
+
+// Known returns true if the caller maps to a local user
+func (c Caller) Known() bool {
+	return c.UID != UnknownID
+}
+
+func (c Caller) InGroup(gid int) bool {
+	if gid == UnknownID {
+		return false
+	}
+	if c.GID == gid {
+		return true
+	}
+	for _, g := range c.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Credential returns the credential of processes started on behalf of the
+// caller
+func (c Caller) Credential() *syscall.Credential {
+	cred := &syscall.Credential{Uid: uint32(c.UID), Gid: uint32(c.GID)}
+	for _, g := range c.Groups {
+		cred.Groups = append(cred.Groups, uint32(g))
+	}
+	return cred
+}
+
+// lookupCaller fills in the user name and supplementary groups for a caller
+func lookupCaller(caller *Caller) {
+	if !caller.Known() {
+		return
+	}
+	u, err := user.LookupId(strconv.Itoa(caller.UID))
+	if err != nil {
+		log.Debugf("Failed to lookup user for uid %d: %s", caller.UID, err)
+		if caller.Name == "" {
+			caller.Name = strconv.Itoa(caller.UID)
+		}
+		return
+	}
+	caller.Name = u.Username
+	gids, err := u.GroupIds()
+	if err != nil {
+		log.Debugf("Failed to lookup groups for user %s: %s", u.Username, err)
+		return
+	}
+	for _, g := range gids {
+		if gid, err := strconv.Atoi(g); err == nil {
+			caller.Groups = append(caller.Groups, gid)
+		}
+	}
+}
+
+func getPeerCred(conn *net.UnixConn) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// PeerCredContext is used as http.Server.ConnContext to record the identity
+// of clients connecting over the unix socket.
+func PeerCredContext(ctx context.Context, conn net.Conn) context.Context {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := getPeerCred(uc)
+	if err != nil {
+		log.Warnf("Failed to get peer credentials on API socket: %s", err)
+		return ctx
+	}
+	caller := Caller{UID: int(cred.Uid), GID: int(cred.Gid)}
+	lookupCaller(&caller)
+	return context.WithValue(ctx, callerCtxKey{}, caller)
+}
+
+// CallerFromRequest returns the identity of the client making the request.
+// A certificate naming root or the user running machined is only mapped to
+// that user with RemoteAllowAdminUsers, as it would make the client an admin.
+func (c *MachineDaemonConfig) CallerFromRequest(req *http.Request) Caller {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		cn := req.TLS.PeerCertificates[0].Subject.CommonName
+		caller := Caller{UID: UnknownID, GID: UnknownID, Name: cn, Remote: true}
+		u, err := user.Lookup(cn)
+		if err != nil {
+			return caller
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		if (uid == 0 || uid == os.Getuid()) && !c.RemoteAllowAdminUsers {
+			log.Warnf("Not mapping remote client certificate %q to local user %s", cn, u.Username)
+			return caller
+		}
+		caller.UID = uid
+		caller.GID, _ = strconv.Atoi(u.Gid)
+		lookupCaller(&caller)
+		return caller
+	}
+	if caller, ok := req.Context().Value(callerCtxKey{}).(Caller); ok {
+		return caller
+	}
+	return Caller{UID: UnknownID, GID: UnknownID, Name: "unknown"}
+}
+
+func (c *MachineDaemonConfig) ValidateAuthPolicy() error {
+	switch c.AuthPolicy {
+	case "":
+		c.AuthPolicy = AuthPolicyOpen
+	case AuthPolicyOpen, AuthPolicyOwner, AuthPolicyGroup:
+	default:
+		return fmt.Errorf("Invalid auth policy '%s', must be one of: %s, %s, %s", c.AuthPolicy, AuthPolicyOpen, AuthPolicyOwner, AuthPolicyGroup)
+	}
+	if c.AdminGroup != "" {
+		if _, err := c.adminGID(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *MachineDaemonConfig) adminGID() (int, error) {
+	if c.AdminGroup == "" {
+		return UnknownID, nil
+	}
+	if gid, err := strconv.Atoi(c.AdminGroup); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(c.AdminGroup)
+	if err != nil {
+		return UnknownID, fmt.Errorf("Failed to lookup admin group '%s': %s", c.AdminGroup, err)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// IsOpen returns true if any caller may manage any machine.  An unset
+// policy is open, as in ValidateAuthPolicy.
+func (c *MachineDaemonConfig) IsOpen() bool {
+	return c.AuthPolicy == AuthPolicyOpen || c.AuthPolicy == ""
+}
+
+// IsAdmin returns true if the caller may manage all machines.  root and the
+// user running machined are always admins.
+func (c *MachineDaemonConfig) IsAdmin(caller Caller) bool {
+	if !caller.Known() {
+		return false
+	}
+	if caller.UID == 0 || caller.UID == os.Getuid() {
+		return true
+	}
+	gid, err := c.adminGID()
+	if err != nil {
+		return false
+	}
+	return caller.InGroup(gid)
+}
+
+// CanAccessMachine returns true if the caller may modify the machine under the
+// configured auth policy.
+func (c *MachineDaemonConfig) CanAccessMachine(caller Caller, m *Machine) bool {
+	if c.IsOpen() {
+		return true
+	}
+	if c.IsAdmin(caller) {
+		return true
+	}
+	return c.SharesMachine(caller, m)
+}
+
+// SharesMachine returns true if the caller owns the machine, or is in the
+// owning group under the group policy.  Admin rights are not considered.
+func (c *MachineDaemonConfig) SharesMachine(caller Caller, m *Machine) bool {
+	if !caller.Known() {
+		return false
+	}
+	if caller.UID == m.OwnerUID {
+		return true
+	}
+	if c.AuthPolicy == AuthPolicyGroup {
+		return caller.InGroup(m.OwnerGID)
+	}
+	return false
+}
+
+// CanUseSecret returns true if the caller may give the machine a disk
+// encrypted with secret.  Machines only use secrets of their owner unless an
+// admin says otherwise.
+func (c *MachineDaemonConfig) CanUseSecret(caller Caller, m *Machine, secret Secret) bool {
+	if c.IsOpen() {
+		return true
+	}
+	if c.IsAdmin(caller) {
+		return true
+	}
+	return secret.OwnerUID == m.OwnerUID
+}
+
+// CanCreateMachine returns true if the caller may define new machines
+func (c *MachineDaemonConfig) CanCreateMachine(caller Caller) bool {
+	if c.IsOpen() {
+		return true
+	}
+	return caller.Known()
+}
+
+// PathAccessFunc returns an error unless a caller may use path with the
+// access mode, a combination of unix.R_OK, unix.W_OK and unix.X_OK
+type PathAccessFunc func(path string, mode uint32) error
+
+// PathAccess returns the PathAccessFunc of the caller.  machined usually
+// runs as root, so host paths named by callers are checked against the
+// caller's own uid and groups before machined or QEMU open them.  Admins
+// may use any path, callers which do not map to a local user none.
+func (c *MachineDaemonConfig) PathAccess(caller Caller) PathAccessFunc {
+	return func(path string, mode uint32) error {
+		if c.IsAdmin(caller) {
+			return nil
+		}
+		if !caller.Known() {
+			return fmt.Errorf("Caller %s may not use host path %q", caller, path)
+		}
+		return checkPathAccess(caller, path, mode)
+	}
+}
+
+func checkPathAccess(caller Caller, path string, mode uint32) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve %q: %s", path, err)
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve %q: %s", path, err)
+	}
+	// every directory above the path must be searchable
+	for dir := filepath.Dir(resolved); ; dir = filepath.Dir(dir) {
+		if !callerMayAccess(caller, dir, unix.X_OK) {
+			return fmt.Errorf("Caller %s may not access %q", caller, path)
+		}
+		if dir == "/" {
+			break
+		}
+	}
+	if !callerMayAccess(caller, resolved, mode) {
+		return fmt.Errorf("Caller %s may not access %q", caller, path)
+	}
+	return nil
+}
+
+// callerMayAccess applies the owner, group or other permission bits of path
+// to the caller like the kernel does
+func callerMayAccess(caller Caller, path string, mode uint32) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	perm := uint32(info.Mode().Perm())
+	switch {
+	case int(stat.Uid) == caller.UID:
+		perm >>= 6
+	case caller.InGroup(int(stat.Gid)):
+		perm >>= 3
+	}
+	return perm&mode == mode
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAuthPolicyOpenAllowsAnyone(t *testing.T) {
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyOpen}
+	m := Machine{Name: "vm1", OwnerUID: 4242, OwnerGID: 4242}
+	caller := Caller{UID: UnknownID, GID: UnknownID}
+
+	if !cfg.CanAccessMachine(caller, &m) {
+		t.Fatalf("expected open policy to allow unknown caller")
+	}
+
+	// an unset policy is open
+	cfg = MachineDaemonConfig{}
+	if !cfg.IsOpen() || !cfg.CanAccessMachine(caller, &m) {
+		t.Fatalf("expected unset policy to be open")
+	}
+}
+
+func TestAuthPolicyOwner(t *testing.T) {
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyOwner}
+	m := Machine{Name: "vm1", OwnerUID: 4242, OwnerGID: 5000}
+
+	owner := Caller{UID: 4242, GID: 4242}
+	if !cfg.CanAccessMachine(owner, &m) {
+		t.Fatalf("expected owner to be allowed")
+	}
+
+	groupMember := Caller{UID: 4343, GID: 5000}
+	if cfg.CanAccessMachine(groupMember, &m) {
+		t.Fatalf("expected group member to be denied under owner policy")
+	}
+
+	unknown := Caller{UID: UnknownID, GID: UnknownID, Remote: true}
+	if cfg.CanAccessMachine(unknown, &m) {
+		t.Fatalf("expected unknown caller to be denied")
+	}
+	if cfg.CanCreateMachine(unknown) {
+		t.Fatalf("expected unknown caller to be denied machine creation")
+	}
+}
+
+func TestAuthPolicyGroup(t *testing.T) {
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyGroup}
+	m := Machine{Name: "vm1", OwnerUID: 4242, OwnerGID: 5000}
+
+	groupMember := Caller{UID: 4343, GID: 4343, Groups: []int{5000}}
+	if !cfg.CanAccessMachine(groupMember, &m) {
+		t.Fatalf("expected supplementary group member to be allowed")
+	}
+
+	other := Caller{UID: 4444, GID: 4444, Groups: []int{6000}}
+	if cfg.CanAccessMachine(other, &m) {
+		t.Fatalf("expected non group member to be denied")
+	}
+}
+
+func TestAuthAdmins(t *testing.T) {
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyOwner, AdminGroup: "7000"}
+	m := Machine{Name: "vm1", OwnerUID: 4242, OwnerGID: 4242}
+
+	admin := Caller{UID: 4545, GID: 4545, Groups: []int{7000}}
+	if !cfg.CanAccessMachine(admin, &m) {
+		t.Fatalf("expected admin group member to be allowed")
+	}
+	if cfg.SharesMachine(admin, &m) {
+		t.Fatalf("expected admin to not share a machine it doesn't own")
+	}
+
+	daemonUser := Caller{UID: os.Getuid(), GID: os.Getgid()}
+	if !cfg.IsAdmin(daemonUser) {
+		t.Fatalf("expected the machined user to be an admin")
+	}
+}
+
+func TestPathAccess(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-path-access")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	file := filepath.Join(tmpDir, "disk.img")
+	if err := os.WriteFile(file, []byte("disk"), 0640); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.Chown(file, 4242, 5000); err != nil {
+		t.Skipf("cannot chown test file: %s", err)
+	}
+	link := filepath.Join(tmpDir, "link.img")
+	if err := os.Symlink("/etc/shadow", link); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyOwner}
+	owner := cfg.PathAccess(Caller{UID: 4242, GID: 4242})
+	member := cfg.PathAccess(Caller{UID: 4343, GID: 4343, Groups: []int{5000}})
+	other := cfg.PathAccess(Caller{UID: 4444, GID: 4444})
+
+	if err := owner(file, unix.R_OK|unix.W_OK); err != nil {
+		t.Fatalf("expected owner to read and write: %s", err)
+	}
+	if err := member(file, unix.R_OK); err != nil {
+		t.Fatalf("expected group member to read: %s", err)
+	}
+	if err := member(file, unix.R_OK|unix.W_OK); err == nil {
+		t.Fatalf("expected group member not to write")
+	}
+	if err := other(file, unix.R_OK); err == nil {
+		t.Fatalf("expected others not to read")
+	}
+	if err := owner(link, unix.R_OK); err == nil {
+		t.Fatalf("expected symlinks to be checked at their target")
+	}
+	if err := cfg.PathAccess(Caller{UID: UnknownID, GID: UnknownID})(tmpDir, unix.R_OK); err == nil {
+		t.Fatalf("expected unknown callers to be refused")
+	}
+	if err := cfg.PathAccess(Caller{UID: 0, GID: 0})(link, unix.R_OK); err != nil {
+		t.Fatalf("expected admins to use any path: %s", err)
+	}
+}
+
+func TestRemoteCaller(t *testing.T) {
+	remote := func(cn string) *http.Request {
+		req := httptest.NewRequest("GET", "/machines", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}}}
+		return req
+	}
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyOwner}
+
+	if caller := cfg.CallerFromRequest(remote("no-such-user")); caller.Known() || !caller.Remote {
+		t.Fatalf("expected an unknown remote caller, got %s", caller)
+	}
+	if u, err := user.Lookup("nobody"); err == nil {
+		caller := cfg.CallerFromRequest(remote("nobody"))
+		if strconv.Itoa(caller.UID) != u.Uid || caller.Name != "nobody" {
+			t.Fatalf("expected the certificate to map to user nobody, got %s", caller)
+		}
+	}
+
+	// certificates naming admins only map to them when configured
+	daemonUser, err := user.Current()
+	if err != nil {
+		t.Fatalf("failed to lookup current user: %s", err)
+	}
+	for _, cn := range []string{"root", daemonUser.Username} {
+		if caller := cfg.CallerFromRequest(remote(cn)); caller.Known() || cfg.IsAdmin(caller) {
+			t.Fatalf("expected certificate for %s not to map to a local user, got %s", cn, caller)
+		}
+	}
+	cfg.RemoteAllowAdminUsers = true
+	if caller := cfg.CallerFromRequest(remote("root")); caller.UID != 0 {
+		t.Fatalf("expected certificate for root to map to uid 0, got %s", caller)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// CdromInfo describes a cdrom drive of a running VM.  Drives are named
+// cdrom0, cdrom1, ... in the order of the machine cdroms.
+type CdromInfo struct {
+	Name     string `json:"name"`
+	File     string `json:"file"`
+	TrayOpen bool   `json:"tray-open"`
+}
+
+// CdromRequest inserts File into a cdrom drive
+type CdromRequest struct {
+	File string `json:"file"`
+}
+
+type qmpBlockInfo struct {
+	Device   string `json:"device"`
+	TrayOpen bool   `json:"tray_open"`
+	Inserted *struct {
+		File string `json:"file"`
+	} `json:"inserted"`
+}
+
+// cdromDrives returns the QEMU drive ids of the cdroms by name
+func (v *VM) cdromDrives() ([]string, map[string]string) {
+	names := []string{}
+	drives := map[string]string{}
+	for _, blk := range v.qcli.BlkDevices {
+		if blk.Media == "cdrom" {
+			name := fmt.Sprintf("cdrom%d", len(names))
+			names = append(names, name)
+			drives[name] = blk.ID
+		}
+	}
+	return names, drives
+}
+
+func (v *VM) cdromDrive(name string) (string, error) {
+	names, drives := v.cdromDrives()
+	drive, ok := drives[name]
+	if !ok {
+		return "", fmt.Errorf("VM:%s has no cdrom drive '%s', found: %v", v.Name(), name, names)
+	}
+	return drive, nil
+}
+
+// Cdroms returns the cdrom drives and the media currently inserted
+func (v *VM) Cdroms() ([]CdromInfo, error) {
+	var blocks []qmpBlockInfo
+	if err := v.QMPExecute("query-block", nil, &blocks); err != nil {
+		return nil, fmt.Errorf("Failed to query block devices: %s", err)
+	}
+	byDrive := map[string]qmpBlockInfo{}
+	for _, block := range blocks {
+		byDrive[block.Device] = block
+	}
+	names, drives := v.cdromDrives()
+	cdroms := []CdromInfo{}
+	for _, name := range names {
+		info := CdromInfo{Name: name}
+		if block, ok := byDrive[drives[name]]; ok {
+			info.TrayOpen = block.TrayOpen
+			if block.Inserted != nil {
+				info.File = block.Inserted.File
+			}
+		}
+		cdroms = append(cdroms, info)
+	}
+	return cdroms, nil
+}
+
+// ChangeCdrom replaces the media in the named cdrom drive
+func (v *VM) ChangeCdrom(name, file string) error {
+	drive, err := v.cdromDrive(name)
+	if err != nil {
+		return err
+	}
+	if !PathExists(file) {
+		return fmt.Errorf("Cdrom image %q does not exist", file)
+	}
+	log.Infof("VM:%s inserting %s into %s", v.Name(), file, name)
+	args := map[string]string{
+		"device":         drive,
+		"filename":       file,
+		"format":         "raw",
+		"read-only-mode": "read-only",
+	}
+	if err := v.QMPExecute("blockdev-change-medium", args, nil); err != nil {
+		return fmt.Errorf("Failed to insert %s into %s: %s", file, name, err)
+	}
+	return nil
+}
+
+// EjectCdrom removes the media from the named cdrom drive, even if the
+// guest has locked the tray
+func (v *VM) EjectCdrom(name string) error {
+	drive, err := v.cdromDrive(name)
+	if err != nil {
+		return err
+	}
+	log.Infof("VM:%s ejecting %s", v.Name(), name)
+	args := map[string]interface{}{"device": drive, "force": true}
+	if err := v.QMPExecute("eject", args, nil); err != nil {
+		return fmt.Errorf("Failed to eject %s: %s", name, err)
+	}
+	return nil
+}
+
+func (m *Machine) Cdroms() ([]CdromInfo, error) {
+	if !m.IsRunning() {
+		return nil, fmt.Errorf("Machine '%s' is not running", m.Name)
+	}
+	return m.instance.Cdroms()
+}
+
+// InsertCdrom changes the media of a cdrom drive of a running machine, the
+// machine definition is not changed.  The image is checked with access
+// before QEMU opens it.
+func (m *Machine) InsertCdrom(name, file string, access PathAccessFunc) error {
+	if !m.IsRunning() {
+		return fmt.Errorf("Machine '%s' is not running", m.Name)
+	}
+	path, err := resolveCdromPath(file)
+	if err != nil {
+		return err
+	}
+	if err := access(path, unix.R_OK); err != nil {
+		return err
+	}
+	return m.instance.ChangeCdrom(name, path)
+}
+
+func (m *Machine) EjectCdrom(name string) error {
+	if !m.IsRunning() {
+		return fmt.Errorf("Machine '%s' is not running", m.Name)
+	}
+	return m.instance.EjectCdrom(name)
+}
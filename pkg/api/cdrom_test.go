@@ -0,0 +1,82 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/project-machine/qcli"
+)
+
+func TestCdroms(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-cdrom")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	iso := filepath.Join(tmpDir, "install.iso")
+	if err := os.WriteFile(iso, []byte("iso"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	handler := func(cmd fakeQMPCommand) (interface{}, *QMPError, []QMPEvent) {
+		if cmd.Execute == "query-block" {
+			return []map[string]interface{}{
+				{"device": "drive0", "tray_open": false, "inserted": map[string]string{"file": "/disk.qcow2"}},
+				{"device": "drive1", "tray_open": false, "inserted": map[string]string{"file": "/boot.iso"}},
+				{"device": "drive2", "tray_open": true},
+			}, nil, nil
+		}
+		return nil, nil, nil
+	}
+	vm, fake := newFakeQMPVM(t, tmpDir, handler)
+	defer fake.Close()
+	vm.qcli.BlkDevices = []qcli.BlockDevice{
+		{ID: "drive0", File: "/disk.qcow2"},
+		{ID: "drive1", File: "/boot.iso", Media: "cdrom"},
+		{ID: "drive2", File: "/tools.iso", Media: "cdrom"},
+	}
+
+	cdroms, err := vm.Cdroms()
+	if err != nil {
+		t.Fatalf("failed to list cdroms: %s", err)
+	}
+	expected := []CdromInfo{{Name: "cdrom0", File: "/boot.iso"}, {Name: "cdrom1", TrayOpen: true}}
+	if len(cdroms) != len(expected) || cdroms[0] != expected[0] || cdroms[1] != expected[1] {
+		t.Fatalf("expected %+v, got %+v", expected, cdroms)
+	}
+
+	if err := vm.ChangeCdrom("cdrom1", iso); err != nil {
+		t.Fatalf("failed to insert cdrom: %s", err)
+	}
+	if err := vm.EjectCdrom("cdrom0"); err != nil {
+		t.Fatalf("failed to eject cdrom: %s", err)
+	}
+	cmds := fake.Commands()
+	change, eject := cmds[len(cmds)-2], cmds[len(cmds)-1]
+	if change.Execute != "blockdev-change-medium" || change.Arguments["device"] != "drive2" || change.Arguments["filename"] != iso {
+		t.Fatalf("unexpected change command %+v", change)
+	}
+	if eject.Execute != "eject" || eject.Arguments["device"] != "drive1" || eject.Arguments["force"] != true {
+		t.Fatalf("unexpected eject command %+v", eject)
+	}
+
+	if err := vm.EjectCdrom("cdrom2"); err == nil {
+		t.Fatalf("expected error ejecting unknown drive")
+	}
+	if err := vm.ChangeCdrom("cdrom0", filepath.Join(tmpDir, "missing.iso")); err == nil {
+		t.Fatalf("expected error inserting a missing iso")
+	}
+	// machines only insert images the caller can read
+	m := Machine{Name: "vm1", instance: vm}
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyOwner}
+	if err := m.InsertCdrom("cdrom1", iso, cfg.PathAccess(Caller{UID: 54321, GID: 54321})); err == nil {
+		t.Fatalf("expected error inserting an iso the caller cannot read")
+	}
+	if cmds := fake.Commands(); cmds[len(cmds)-1].Execute == "blockdev-change-medium" {
+		t.Fatalf("QEMU was asked to open the iso")
+	}
+	if err := m.InsertCdrom("cdrom1", iso, cfg.PathAccess(Caller{UID: os.Getuid(), GID: os.Getgid()})); err != nil {
+		t.Fatalf("failed to insert cdrom: %s", err)
+	}
+}
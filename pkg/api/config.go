@@ -25,6 +25,24 @@ type MachineDaemonConfig struct {
 	ConfigDirectory string
 	DataDirectory   string
 	StateDirectory  string
+
+	// Where ephemeral machines keep their state, on tmpfs by default
+	EphemeralDirectory string
+
+	// Optional TCP listener for remote clients, requires mutual TLS
+	RemoteListenAddress string
+	RemoteTLSCert       string
+	RemoteTLSKey        string
+	RemoteTLSClientCA   string
+
+	// Who may modify machines, one of AuthPolicy{Open,Owner,Group}, and
+	// the group (name or gid) whose members may manage all machines
+	AuthPolicy string
+	AdminGroup string
+
+	// Client certificates naming root or the user running machined only
+	// map to them when set
+	RemoteAllowAdminUsers bool
 }
 
 var (
@@ -32,6 +50,7 @@ var (
 	mdcCtxConfDir  = mdcCtx + "-confdir"
 	mdcCtxDataDir  = mdcCtx + "-datadir"
 	mdcCtxStateDir = mdcCtx + "-statedir"
+	mdcCtxEphemDir = mdcCtx + "-ephemeraldir"
 )
 
 func DefaultMachineDaemonConfig() *MachineDaemonConfig {
@@ -48,9 +67,15 @@ func DefaultMachineDaemonConfig() *MachineDaemonConfig {
 	if err != nil {
 		panic(fmt.Sprintf("Error getting user state dir: %s", err))
 	}
+	urd, err := UserRuntimeDir()
+	if err != nil {
+		panic(fmt.Sprintf("Error getting user runtime dir: %s", err))
+	}
 	cfg.ConfigDirectory = filepath.Join(ucd, "machine")
 	cfg.DataDirectory = filepath.Join(udd, "machine")
 	cfg.StateDirectory = filepath.Join(usd, "machine")
+	cfg.EphemeralDirectory = filepath.Join(urd, "machined", "ephemeral")
+	cfg.AuthPolicy = AuthPolicyOpen
 	return &cfg
 }
 
@@ -59,9 +84,19 @@ func (c *MachineDaemonConfig) GetConfigContext() context.Context {
 	ctx = context.WithValue(ctx, mdcCtxConfDir, c.ConfigDirectory)
 	ctx = context.WithValue(ctx, mdcCtxDataDir, c.DataDirectory)
 	ctx = context.WithValue(ctx, mdcCtxStateDir, c.StateDirectory)
+	ctx = context.WithValue(ctx, mdcCtxEphemDir, c.GetEphemeralDirectory())
 	return ctx
 }
 
+// GetEphemeralDirectory returns the directory holding ephemeral machine
+// state, falling back to StateDirectory if none was configured.
+func (c *MachineDaemonConfig) GetEphemeralDirectory() string {
+	if c.EphemeralDirectory != "" {
+		return c.EphemeralDirectory
+	}
+	return filepath.Join(c.StateDirectory, "ephemeral")
+}
+
 // XDG_RUNTIME_DIR
 func UserRuntimeDir() (string, error) {
 	env := "XDG_RUNTIME_DIR"
@@ -0,0 +1,189 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	consoleScriptDefaultTimeout = time.Second * 60
+	consoleScriptMaxTranscript  = 1024 * 1024
+)
+
+// ConsoleScriptStep waits for Expect to match the console output, if set,
+// and then types Send, if set.  A step with only a Timeout changes the
+// timeout of the steps which follow it.
+type ConsoleScriptStep struct {
+	Expect  string `json:"expect,omitempty" yaml:"expect,omitempty"`
+	Send    string `json:"send,omitempty" yaml:"send,omitempty"`
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+type ConsoleScript struct {
+	Steps []ConsoleScriptStep `json:"steps"`
+	// match against the console scrollback as well as new output
+	Scrollback bool `json:"scrollback"`
+}
+
+type ConsoleStepResult struct {
+	Step   int    `json:"step"`
+	Expect string `json:"expect,omitempty"`
+	// scripts type passwords, results only carry the length of the text
+	SendLength int     `json:"send-length,omitempty"`
+	Matched    string  `json:"matched,omitempty"`
+	Elapsed    float64 `json:"elapsed"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type ConsoleScriptResult struct {
+	Success    bool                `json:"success"`
+	Steps      []ConsoleStepResult `json:"steps"`
+	Transcript string              `json:"transcript"`
+}
+
+type compiledStep struct {
+	ConsoleScriptStep
+	expect  *regexp.Regexp
+	timeout time.Duration
+}
+
+// compile validates the script and resolves the timeout of each step
+func (cs *ConsoleScript) compile() ([]compiledStep, error) {
+	steps := []compiledStep{}
+	timeout := consoleScriptDefaultTimeout
+	for idx, step := range cs.Steps {
+		compiled := compiledStep{ConsoleScriptStep: step, timeout: timeout}
+		if step.Timeout != "" {
+			t, err := time.ParseDuration(step.Timeout)
+			if err != nil || t <= 0 {
+				return nil, fmt.Errorf("Step %d: invalid timeout '%s'", idx+1, step.Timeout)
+			}
+			if step.Expect == "" && step.Send == "" {
+				timeout = t
+				continue
+			}
+			compiled.timeout = t
+		}
+		if step.Expect == "" && step.Send == "" {
+			return nil, fmt.Errorf("Step %d: must have expect, send or timeout", idx+1)
+		}
+		if step.Expect != "" {
+			re, err := regexp.Compile(step.Expect)
+			if err != nil {
+				return nil, fmt.Errorf("Step %d: invalid expect pattern '%s': %s", idx+1, step.Expect, err)
+			}
+			compiled.expect = re
+		}
+		steps = append(steps, compiled)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("Console script has no steps")
+	}
+	return steps, nil
+}
+
+// Validate checks the script syntax without running it
+func (cs *ConsoleScript) Validate() error {
+	_, err := cs.compile()
+	return err
+}
+
+// RunConsoleScript executes the script against the console.  Each expect
+// only matches output which arrived after the previous match.  The script
+// stops at the current step when ctx is done, e.g. the client went away.
+func RunConsoleScript(ctx context.Context, console *SerialMux, script ConsoleScript) (result ConsoleScriptResult, err error) {
+	result.Steps = []ConsoleStepResult{}
+	steps, err := script.compile()
+	if err != nil {
+		return result, err
+	}
+	var client *ConsoleClient
+	if script.Scrollback {
+		client, err = console.Attach(false)
+	} else {
+		client, err = console.AttachLive(false)
+	}
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+
+	var transcript strings.Builder
+	pending := ""
+	closed := false
+	defer func() {
+		result.Transcript = transcript.String()
+	}()
+
+	for idx, step := range steps {
+		start := time.Now()
+		stepResult := ConsoleStepResult{Step: idx + 1, Expect: step.Expect, SendLength: len(step.Send)}
+		if step.expect != nil {
+			timer := time.NewTimer(step.timeout)
+			for stepResult.Matched == "" && stepResult.Error == "" {
+				if loc := step.expect.FindStringIndex(pending); loc != nil {
+					stepResult.Matched = pending[loc[0]:loc[1]]
+					pending = pending[loc[1]:]
+					break
+				}
+				if closed {
+					stepResult.Error = "console closed"
+					break
+				}
+				select {
+				case data, ok := <-client.Output():
+					if !ok {
+						closed = true
+						continue
+					}
+					if transcript.Len() < consoleScriptMaxTranscript {
+						transcript.Write(data)
+					}
+					pending += string(data)
+					if len(pending) > consoleScriptMaxTranscript {
+						pending = pending[len(pending)-consoleScriptMaxTranscript:]
+					}
+				case <-timer.C:
+					stepResult.Error = fmt.Sprintf("timed out after %s waiting for '%s'", step.timeout, step.Expect)
+				case <-ctx.Done():
+					stepResult.Error = fmt.Sprintf("cancelled: %s", ctx.Err())
+				}
+			}
+			timer.Stop()
+		}
+		if stepResult.Error == "" && ctx.Err() != nil {
+			stepResult.Error = fmt.Sprintf("cancelled: %s", ctx.Err())
+		}
+		if stepResult.Error == "" && step.Send != "" {
+			if _, err := client.Write([]byte(step.Send)); err != nil {
+				stepResult.Error = fmt.Sprintf("send failed: %s", err)
+			}
+		}
+		stepResult.Elapsed = time.Since(start).Seconds()
+		result.Steps = append(result.Steps, stepResult)
+		if stepResult.Error != "" {
+			log.Infof("VM:%s console script failed at step %d: %s", console.Name, idx+1, stepResult.Error)
+			return result, nil
+		}
+	}
+	result.Success = true
+	return result, nil
+}
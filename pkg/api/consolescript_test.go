@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsoleScriptValidate(t *testing.T) {
+	for _, steps := range [][]ConsoleScriptStep{
+		{},
+		{{Timeout: "10s"}},
+		{{Expect: "login: ", Timeout: "soon"}},
+		{{Expect: "login: ("}},
+	} {
+		script := ConsoleScript{Steps: steps}
+		if err := script.Validate(); err == nil {
+			t.Errorf("expected script %+v to be invalid", steps)
+		}
+	}
+}
+
+func TestRunConsoleScript(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-console-script")
+	if err != nil {
+		t.Fatalf("failed to create a tempdir for test")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	serialSocket := filepath.Join(tmpDir, "console.sock")
+	listener, err := net.Listen("unix", serialSocket)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer listener.Close()
+	guestCh := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			guestCh <- conn
+		}
+	}()
+
+	console := NewSerialMux("vm1", serialSocket)
+	if err := console.Start(); err != nil {
+		t.Fatalf("failed to start mux: %s", err)
+	}
+	defer console.Close()
+	guest := <-guestCh
+	defer guest.Close()
+
+	// a guest which asks for a login and then sits at a prompt
+	go func() {
+		reader := bufio.NewReader(guest)
+		guest.Write([]byte("Ubuntu 22.04 tty1\r\nlogin: "))
+		user, _ := reader.ReadString('\n')
+		guest.Write([]byte("Welcome " + strings.TrimSpace(user) + "\r\n# "))
+	}()
+
+	script := ConsoleScript{Scrollback: true, Steps: []ConsoleScriptStep{
+		{Timeout: "5s"},
+		{Expect: "login: $", Send: "root\n"},
+		{Expect: `Welcome (\w+)`},
+		{Expect: "# ", Timeout: "100ms"},
+		{Expect: "never printed", Timeout: "100ms"},
+	}}
+	result, err := RunConsoleScript(context.Background(), console, script)
+	if err != nil {
+		t.Fatalf("failed to run script: %s", err)
+	}
+	if result.Success {
+		t.Fatalf("expected the last step to time out")
+	}
+	if len(result.Steps) != 4 {
+		t.Fatalf("expected 4 step results, got %+v", result.Steps)
+	}
+	if result.Steps[0].SendLength != len("root\n") {
+		t.Errorf("expected the length of the sent text, got %+v", result.Steps[0])
+	}
+	if result.Steps[1].Matched != "Welcome root" {
+		t.Errorf("expected to match 'Welcome root', got %q", result.Steps[1].Matched)
+	}
+	if result.Steps[2].Error != "" || !strings.Contains(result.Steps[3].Error, "timed out") {
+		t.Errorf("unexpected step results %+v", result.Steps)
+	}
+	if !strings.HasPrefix(result.Transcript, "Ubuntu 22.04 tty1") {
+		t.Errorf("unexpected transcript %q", result.Transcript)
+	}
+
+	// the script stops when the request goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	script = ConsoleScript{Steps: []ConsoleScriptStep{{Expect: "never printed", Send: "x", Timeout: "1h"}}}
+	result, err = RunConsoleScript(ctx, console, script)
+	if err != nil {
+		t.Fatalf("failed to run script: %s", err)
+	}
+	if result.Success || len(result.Steps) != 1 || !strings.Contains(result.Steps[0].Error, "cancelled") || time.Since(start) > 5*time.Second {
+		t.Errorf("expected the script to be cancelled, got %+v", result.Steps)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// The console stream is a websocket: binary messages carry console data in
+// both directions and text messages carry ConsoleControl requests from the
+// client.
+const (
+	ConsoleControlResize = "resize"
+
+	consolePingInterval = time.Second * 30
+	consoleWriteTimeout = time.Second * 10
+)
+
+type ConsoleControl struct {
+	Type string `json:"type"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+}
+
+var consoleUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// UpgradeConsoleStream switches the request to a websocket and serves the
+// console until the client or the machine goes away
+func UpgradeConsoleStream(w http.ResponseWriter, r *http.Request, console *SerialMux, readOnly bool) error {
+	ws, err := consoleUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied to the client
+		return err
+	}
+	defer ws.Close()
+
+	client, err := console.Attach(readOnly)
+	if err != nil {
+		ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()))
+		return err
+	}
+	defer client.Close()
+
+	// gorilla websockets allow a single concurrent writer
+	var writeLock sync.Mutex
+	writeMessage := func(messageType int, data []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		ws.SetWriteDeadline(time.Now().Add(consoleWriteTimeout))
+		return ws.WriteMessage(messageType, data)
+	}
+
+	go func() {
+		defer client.Close()
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			switch messageType {
+			case websocket.BinaryMessage:
+				if readOnly {
+					continue
+				}
+				if _, err := client.Write(data); err != nil {
+					log.Infof("VM:%s console write failed: %s", console.Name, err)
+					return
+				}
+			case websocket.TextMessage:
+				var ctl ConsoleControl
+				if err := json.Unmarshal(data, &ctl); err != nil {
+					log.Warnf("VM:%s invalid console control message: %s", console.Name, err)
+					continue
+				}
+				if ctl.Type == ConsoleControlResize && !readOnly {
+					console.Resize(ctl.Cols, ctl.Rows)
+				}
+			}
+		}
+	}()
+
+	ping := time.NewTicker(consolePingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case data, ok := <-client.Output():
+			if !ok {
+				writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "console closed"))
+				return nil
+			}
+			if err := writeMessage(websocket.BinaryMessage, data); err != nil {
+				return err
+			}
+		case <-ping.C:
+			if err := writeMessage(websocket.PingMessage, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
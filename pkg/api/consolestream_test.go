@@ -0,0 +1,86 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConsoleStream(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-console-stream")
+	if err != nil {
+		t.Fatalf("failed to create a tempdir for test")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	serialSocket := filepath.Join(tmpDir, "console.sock")
+	listener, err := net.Listen("unix", serialSocket)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer listener.Close()
+	guestCh := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			guestCh <- conn
+		}
+	}()
+
+	console := NewSerialMux("vm1", serialSocket)
+	if err := console.Start(); err != nil {
+		t.Fatalf("failed to start mux: %s", err)
+	}
+	defer console.Close()
+	guest := <-guestCh
+	guest.Write([]byte("login: "))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		UpgradeConsoleStream(w, r, console, false)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial(strings.Replace(server.URL, "http://", "ws://", 1), nil)
+	if err != nil {
+		t.Fatalf("failed to dial console stream: %s", err)
+	}
+	defer ws.Close()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err := ws.ReadMessage()
+	if err != nil || messageType != websocket.BinaryMessage || string(data) != "login: " {
+		t.Fatalf("expected scrollback 'login: ', got %d %q: %v", messageType, string(data), err)
+	}
+
+	ctl, _ := json.Marshal(ConsoleControl{Type: ConsoleControlResize, Cols: 132, Rows: 50})
+	if err := ws.WriteMessage(websocket.TextMessage, ctl); err != nil {
+		t.Fatalf("failed to send resize: %s", err)
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte("root\n")); err != nil {
+		t.Fatalf("failed to send input: %s", err)
+	}
+	line, err := bufio.NewReader(guest).ReadString('\n')
+	if err != nil || line != "root\n" {
+		t.Fatalf("expected guest to receive 'root', got %q: %v", line, err)
+	}
+	// the resize was handled before the input which followed it
+	if cols, rows := console.Size(); cols != 132 || rows != 50 {
+		t.Errorf("expected console size 132x50, got %dx%d", cols, rows)
+	}
+
+	// the stream is closed cleanly when the machine goes away
+	guest.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected a normal close, got %v", err)
+	}
+}
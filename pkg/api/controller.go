@@ -32,6 +32,10 @@ type Controller struct {
 	Router            *gin.Engine
 	MachineController MachineController
 	Server            *http.Server
+	AuditLog          *AuditLog
+	Metrics           *Metrics
+	ImageStore        *ImageStore
+	SecretStore       *SecretStore
 	wgShutDown        *sync.WaitGroup
 	portNumber        int
 }
@@ -41,11 +45,19 @@ func NewController(config *MachineDaemonConfig) *Controller {
 
 	controller.Config = config
 	controller.wgShutDown = new(sync.WaitGroup)
+	controller.Metrics = NewMetrics()
+	controller.ImageStore = NewImageStore(filepath.Join(config.DataDirectory, ImagesDirName))
+	controller.SecretStore = NewSecretStore(filepath.Join(config.ConfigDirectory, SecretsDirName))
 
 	return &controller
 }
 
 func (c *Controller) Run(ctx context.Context) error {
+	// ephemeral machines do not survive a restart of machined
+	if err := c.Config.RemoveEphemeralState(); err != nil {
+		return err
+	}
+
 	// load existing machines
 	machineDir := filepath.Join(c.Config.ConfigDirectory, "machines")
 	if PathExists(machineDir) {
@@ -63,7 +75,7 @@ func (c *Controller) Run(ctx context.Context) error {
 					}
 					newMachine.ctx = c.Config.GetConfigContext()
 					log.Infof("  loaded machine %s", newMachine.Name)
-					c.MachineController.Machines = append(c.MachineController.Machines, newMachine)
+					c.MachineController.Machines = append(c.MachineController.Machines, &newMachine)
 				}
 			}
 			return nil
@@ -91,11 +103,31 @@ func (c *Controller) Run(ctx context.Context) error {
 		panic(err)
 	}
 
+	auditLog, err := NewAuditLog(filepath.Join(c.Config.StateDirectory, AuditLogName))
+	if err != nil {
+		return err
+	}
+	c.AuditLog = auditLog
+
 	// configure engine, router, and server
 	engine := gin.Default()
 	c.Router = engine
 	_ = NewRouteHandler(c)
-	c.Server = &http.Server{Handler: c.Router.Handler()}
+	c.Server = &http.Server{Handler: c.Router.Handler(), ConnContext: PeerCredContext}
+
+	// the remote listener is served in addition to the unix socket
+	if c.Config.HasRemoteListener() {
+		remoteListener, err := c.Config.RemoteListener()
+		if err != nil {
+			return fmt.Errorf("Failed to configure remote API listener: %s", err)
+		}
+		log.Infof("Using machined remote API listener: %s", c.Config.RemoteListenAddress)
+		go func() {
+			if err := c.Server.Serve(remoteListener); err != nil && err != http.ErrServerClosed {
+				log.Errorf("machined remote API listener failed: %s", err)
+			}
+		}()
+	}
 
 	// either systemd socket unit isn't started or we're not using systemd
 	if len(listeners) > 0 {
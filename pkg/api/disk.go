@@ -42,6 +42,7 @@ func (s *DiskSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 type QemuDisk struct {
 	File      string   `yaml:"file,omitempty"`
+	Image     string   `yaml:"image,omitempty"`
 	Format    string   `yaml:"format,omitempty"`
 	Size      DiskSize `yaml:"size"`
 	Attach    string   `yaml:"attach,omitempty"`
@@ -50,8 +51,34 @@ type QemuDisk struct {
 	BusAddr   string   `yaml:"addr,omitempty"`
 	BootIndex string   `yaml:"bootindex,omitempty"`
 	ReadOnly  bool     `yaml:"read-only,omitempty"`
+
+	// qcow2 disks may be created on top of a read-only backing image which
+	// is shared rather than copied
+	BackingFile   string `yaml:"backing-file,omitempty"`
+	BackingFormat string `yaml:"backing-format,omitempty"`
+
+	// I/O policy and limits, see diskio.go
+	Cache        string        `yaml:"cache,omitempty"`
+	AIO          string        `yaml:"aio,omitempty"`
+	Discard      string        `yaml:"discard,omitempty"`
+	DetectZeroes string        `yaml:"detect-zeroes,omitempty"`
+	Throttle     *DiskThrottle `yaml:"throttle,omitempty"`
+
+	// address on one of VMDef.Controllers, see storage.go
+	Controller string `yaml:"controller,omitempty"`
+	Unit       *int   `yaml:"unit,omitempty"`
+	LUN        int    `yaml:"lun,omitempty"`
+
+	// encrypted disks are opened with the named secret of the secret
+	// store, see encryption.go
+	Encryption string `yaml:"encryption,omitempty"`
+	Secret     string `yaml:"secret,omitempty"`
+	secretFile string
 }
 
+// maxBackingChain limits how deep backing chains are followed
+const maxBackingChain = 16
+
 func (q *QemuDisk) Sanitize(basedir string) error {
 	validate := func(name string, found string, valid ...string) string {
 		for _, i := range valid {
@@ -76,6 +103,24 @@ func (q *QemuDisk) Sanitize(basedir string) error {
 		q.Attach = "scsi"
 	}
 
+	// disks from OCI registries and layouts are pulled into the image store
+	if IsOCIReference(q.File) && q.Image == "" {
+		q.Image = q.File
+		q.File = ""
+	}
+
+	// image disks are overlays named after their image unless a file is given
+	if q.Image != "" {
+		if q.File == "" {
+			q.File = imageFileName(q.Image, q.Type)
+		}
+		if q.Type == "cdrom" {
+			q.Format = "raw"
+		} else if q.Format != "qcow2" {
+			errors = append(errors, fmt.Sprintf("invalid format for image disk: found %s expected qcow2", q.Format))
+		}
+	}
+
 	if q.File == "" {
 		errors = append(errors, "empty File")
 	}
@@ -88,6 +133,12 @@ func (q *QemuDisk) Sanitize(basedir string) error {
 		errors = append(errors, msg)
 	}
 
+	if q.BackingFile != "" {
+		if msg := q.sanitizeBacking(basedir); msg != "" {
+			errors = append(errors, msg)
+		}
+	}
+
 	if msg := validate("attach", q.Attach, "scsi", "nvme", "virtio", "ide", "usb"); msg != "" {
 		errors = append(errors, msg)
 	}
@@ -96,6 +147,9 @@ func (q *QemuDisk) Sanitize(basedir string) error {
 		errors = append(errors, msg)
 	}
 
+	errors = append(errors, q.sanitizeIO()...)
+	errors = append(errors, q.sanitizeEncryption()...)
+
 	if len(errors) != 0 {
 		return fmt.Errorf("bad disk %#v: %s", q, strings.Join(errors, "\n"))
 	}
@@ -103,8 +157,130 @@ func (q *QemuDisk) Sanitize(basedir string) error {
 	return nil
 }
 
+// sanitizeBacking resolves the backing file like File and validates the
+// backing chain, returning a message describing any problem
+func (q *QemuDisk) sanitizeBacking(basedir string) string {
+	if q.Image != "" {
+		return "backing-file cannot be combined with image"
+	}
+	if q.Type == "cdrom" {
+		return "cdroms cannot have a backing-file"
+	}
+	if q.Format != "qcow2" {
+		return fmt.Sprintf("invalid format for disk with backing-file: found %s expected qcow2", q.Format)
+	}
+	if !strings.Contains(q.BackingFile, "/") {
+		q.BackingFile = path.Join(basedir, q.BackingFile)
+	} else if !filepath.IsAbs(q.BackingFile) {
+		// like cdroms, relative paths are relative to machined
+		if absPath, err := filepath.Abs(q.BackingFile); err == nil {
+			q.BackingFile = absPath
+		}
+	}
+	if !PathExists(q.BackingFile) {
+		return fmt.Sprintf("backing-file %q does not exist", q.BackingFile)
+	}
+	if q.BackingFormat == "" {
+		format, err := DetectImageFormat(q.BackingFile)
+		if err != nil {
+			return err.Error()
+		}
+		q.BackingFormat = format
+	}
+	if q.BackingFormat != "qcow2" && q.BackingFormat != "raw" {
+		return fmt.Sprintf("invalid backing-format: found %s expected [qcow2 raw]", q.BackingFormat)
+	}
+	if err := validateBackingChain(q.File, q.BackingFile, q.BackingFormat); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// validateBackingChain follows the qcow2 backing files starting at backing
+// and fails if one is missing, the chain loops or it contains file
+func validateBackingChain(file, backing, format string) error {
+	seen := map[string]bool{filepath.Clean(file): true}
+	for depth := 0; backing != ""; depth++ {
+		if depth >= maxBackingChain {
+			return fmt.Errorf("backing chain of %q is longer than %d images", file, maxBackingChain)
+		}
+		if seen[filepath.Clean(backing)] {
+			return fmt.Errorf("backing chain of %q loops at %q", file, backing)
+		}
+		seen[filepath.Clean(backing)] = true
+		if !PathExists(backing) {
+			return fmt.Errorf("backing file %q in the chain of %q does not exist", backing, file)
+		}
+		if format != "qcow2" {
+			return nil
+		}
+		next, err := qcow2BackingFile(backing)
+		if err != nil {
+			return err
+		}
+		// relative backing files are relative to the image referencing them
+		if next != "" && !filepath.IsAbs(next) {
+			next = filepath.Join(filepath.Dir(backing), next)
+		}
+		if next != "" {
+			if format, err = DetectImageFormat(next); err != nil {
+				return err
+			}
+		}
+		backing = next
+	}
+	return nil
+}
+
+// imageFiles returns the host files QEMU opens for the image at path: path
+// itself followed by the external data files and backing chain named in
+// qcow2 headers
+func imageFiles(path string) ([]string, error) {
+	files := []string{path}
+	seen := map[string]bool{filepath.Clean(path): true}
+	// names in an image are relative to the image
+	resolve := func(image, name string) string {
+		if filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(filepath.Dir(image), name)
+	}
+	for current, depth := path, 0; ; depth++ {
+		if depth >= maxBackingChain {
+			return files, fmt.Errorf("backing chain of %q is longer than %d images", path, maxBackingChain)
+		}
+		if format, err := DetectImageFormat(current); err != nil || format != "qcow2" {
+			return files, err
+		}
+		dataFile, err := qcow2DataFile(current)
+		if err != nil {
+			return files, err
+		}
+		if dataFile != "" {
+			files = append(files, resolve(current, dataFile))
+		}
+		next, err := qcow2BackingFile(current)
+		if err != nil || next == "" {
+			return files, err
+		}
+		next = resolve(current, next)
+		if seen[filepath.Clean(next)] {
+			return files, fmt.Errorf("backing chain of %q loops at %q", path, next)
+		}
+		seen[filepath.Clean(next)] = true
+		files = append(files, next)
+		if !PathExists(next) {
+			return files, fmt.Errorf("backing file %q in the chain of %q does not exist", next, path)
+		}
+		current = next
+	}
+}
+
 // Create - create the qemu disk at fpath or its File if it does not exist.
 func (q *QemuDisk) Create() error {
+	if q.BackingFile != "" {
+		return createOverlay(q.File, q.BackingFile, q.BackingFormat, int64(q.Size))
+	}
 	if q.Type == "cdrom" {
 		log.Debugf("Ignoring Create on QemuDisk.Name:%s wth Type 'cdrom'", q.File)
 		return nil
@@ -113,7 +289,29 @@ func (q *QemuDisk) Create() error {
 		return nil
 	}
 	log.Infof("Creating %s type %s size %d attach %s", q.File, q.Format, q.Size, q.Attach)
-	cmd := []string{"qemu-img", "create", "-f", q.Format, q.File, fmt.Sprintf("%d", q.Size)}
+	cmd := []string{"qemu-img", "create"}
+	if q.Encrypted() {
+		log.Infof("Encrypting %s with secret %s", q.File, q.Secret)
+		cmd = append(cmd, "--object", q.secretObject("sec0"))
+	}
+	cmd = append(cmd, q.qemuImgTarget("-f", q.Format)...)
+	cmd = append(cmd, q.File, fmt.Sprintf("%d", q.Size))
+	out, err, rc := RunCommandWithOutputErrorRc(cmd...)
+	if rc != 0 {
+		return fmt.Errorf("qemu-img create failed: %v\n rc: %d\n out: %s\n, err: %s",
+			cmd, rc, out, err)
+	}
+	return nil
+}
+
+// createOverlay creates a qcow2 image at file on top of backing, of the
+// same size as backing unless size is given
+func createOverlay(file, backing, backingFormat string, size int64) error {
+	log.Infof("Creating %s on backing file %s (%s)", file, backing, backingFormat)
+	cmd := []string{"qemu-img", "create", "-f", "qcow2", "-F", backingFormat, "-b", backing, file}
+	if size > 0 {
+		cmd = append(cmd, fmt.Sprintf("%d", size))
+	}
 	out, err, rc := RunCommandWithOutputErrorRc(cmd...)
 	if rc != 0 {
 		return fmt.Errorf("qemu-img create failed: %v\n rc: %d\n out: %s\n, err: %s",
@@ -122,6 +320,13 @@ func (q *QemuDisk) Create() error {
 	return nil
 }
 
+// Name identifies the disk within a machine, the base name of its file
+// without extension
+func (q *QemuDisk) Name() string {
+	ext := filepath.Ext(q.File)
+	return path.Base(q.File[0 : len(q.File)-len(ext)])
+}
+
 func (q *QemuDisk) serial() string {
 	// serial gets basename without extension
 	ext := filepath.Ext(q.File)
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskBackingFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-backing")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	golden := filepath.Join(tmpDir, "golden.qcow2")
+	writeQcow2Header(t, golden, "base.raw")
+	base := filepath.Join(tmpDir, "base.raw")
+	if err := os.WriteFile(base, []byte("raw"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	disk := QemuDisk{File: "root.qcow2", BackingFile: golden}
+	if err := disk.Sanitize(tmpDir); err != nil {
+		t.Fatalf("failed to sanitize disk with backing file: %s", err)
+	}
+	if disk.BackingFormat != "qcow2" || disk.File != filepath.Join(tmpDir, "root.qcow2") {
+		t.Fatalf("unexpected disk %+v", disk)
+	}
+
+	bad := []QemuDisk{
+		{File: "root.qcow2", BackingFile: "missing.qcow2"},
+		{File: "root.qcow2", BackingFile: golden, Format: "raw"},
+		{File: "root.qcow2", BackingFile: golden, Image: "ubuntu"},
+		{File: "root.qcow2", BackingFile: golden, BackingFormat: "vmdk"},
+		{File: "golden.qcow2", BackingFile: golden},
+	}
+	for _, d := range bad {
+		if err := d.Sanitize(tmpDir); err == nil {
+			t.Fatalf("expected error for disk %+v", d)
+		}
+	}
+
+	// a chain with a missing link or a loop is rejected
+	os.Remove(base)
+	if err := (&QemuDisk{File: "root.qcow2", BackingFile: golden}).Sanitize(tmpDir); err == nil {
+		t.Fatalf("expected error for a chain with a missing backing file")
+	}
+	writeQcow2Header(t, base, "golden.qcow2")
+	if err := validateBackingChain(filepath.Join(tmpDir, "root.qcow2"), golden, "qcow2"); err == nil {
+		t.Fatalf("expected error for a looping chain")
+	}
+}
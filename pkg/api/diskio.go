@@ -0,0 +1,303 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/project-machine/qcli"
+	log "github.com/sirupsen/logrus"
+)
+
+// Disk I/O policy defaults, fast but unsafe if the host crashes
+const (
+	DefaultDiskCache        = "unsafe"
+	DefaultDiskAIO          = "threads"
+	DefaultDiskDiscard      = "unmap"
+	DefaultDiskDetectZeroes = "unmap"
+)
+
+var (
+	diskCacheModes   = []string{"none", "writeback", "writethrough", "directsync", "unsafe"}
+	diskAIOModes     = []string{"threads", "native", "io_uring"}
+	diskDiscardModes = []string{"ignore", "unmap"}
+	diskDetectZeroes = []string{"off", "on", "unmap"}
+)
+
+// DiskThrottle limits the I/O of a disk.  bps limits are in bytes and iops
+// limits in operations per second, 0 is unlimited.  The -max limits allow
+// bursts above the limit for up to BurstLength seconds.
+type DiskThrottle struct {
+	BPS          DiskSize `yaml:"bps,omitempty" json:"bps,omitempty"`
+	BPSRead      DiskSize `yaml:"bps-read,omitempty" json:"bps-read,omitempty"`
+	BPSWrite     DiskSize `yaml:"bps-write,omitempty" json:"bps-write,omitempty"`
+	IOPS         int64    `yaml:"iops,omitempty" json:"iops,omitempty"`
+	IOPSRead     int64    `yaml:"iops-read,omitempty" json:"iops-read,omitempty"`
+	IOPSWrite    int64    `yaml:"iops-write,omitempty" json:"iops-write,omitempty"`
+	BPSMax       DiskSize `yaml:"bps-max,omitempty" json:"bps-max,omitempty"`
+	BPSReadMax   DiskSize `yaml:"bps-read-max,omitempty" json:"bps-read-max,omitempty"`
+	BPSWriteMax  DiskSize `yaml:"bps-write-max,omitempty" json:"bps-write-max,omitempty"`
+	IOPSMax      int64    `yaml:"iops-max,omitempty" json:"iops-max,omitempty"`
+	IOPSReadMax  int64    `yaml:"iops-read-max,omitempty" json:"iops-read-max,omitempty"`
+	IOPSWriteMax int64    `yaml:"iops-write-max,omitempty" json:"iops-write-max,omitempty"`
+	BurstLength  int64    `yaml:"burst-length,omitempty" json:"burst-length,omitempty"`
+}
+
+// throttleLimit is one limit with its names in the machine definition, the
+// -drive throttling options and block_set_io_throttle
+type throttleLimit struct {
+	name   string
+	option string
+	arg    string
+	value  int64
+	max    int64
+}
+
+func (t DiskThrottle) limits() []throttleLimit {
+	return []throttleLimit{
+		{"bps", "bps-total", "bps", int64(t.BPS), int64(t.BPSMax)},
+		{"bps-read", "bps-read", "bps_rd", int64(t.BPSRead), int64(t.BPSReadMax)},
+		{"bps-write", "bps-write", "bps_wr", int64(t.BPSWrite), int64(t.BPSWriteMax)},
+		{"iops", "iops-total", "iops", t.IOPS, t.IOPSMax},
+		{"iops-read", "iops-read", "iops_rd", t.IOPSRead, t.IOPSReadMax},
+		{"iops-write", "iops-write", "iops_wr", t.IOPSWrite, t.IOPSWriteMax},
+	}
+}
+
+// IsZero returns true if no limit is set
+func (t DiskThrottle) IsZero() bool {
+	return t == DiskThrottle{}
+}
+
+// validate returns a message for each invalid limit
+func (t DiskThrottle) validate() []string {
+	errors := []string{}
+	limits := t.limits()
+	hasMax := false
+	for _, l := range limits {
+		if l.value < 0 || l.max < 0 {
+			errors = append(errors, fmt.Sprintf("invalid throttle %s: limits must not be negative", l.name))
+			continue
+		}
+		if l.max > 0 {
+			hasMax = true
+			if l.max < l.value {
+				errors = append(errors, fmt.Sprintf("invalid throttle %s-max: must not be less than %s", l.name, l.name))
+			}
+			if l.value == 0 {
+				errors = append(errors, fmt.Sprintf("invalid throttle %s-max: requires %s", l.name, l.name))
+			}
+		}
+	}
+	// QEMU limits either the total or reads and writes separately
+	for _, idx := range []int{0, 3} {
+		total, read, write := limits[idx], limits[idx+1], limits[idx+2]
+		if total.value+total.max > 0 && read.value+read.max+write.value+write.max > 0 {
+			errors = append(errors, fmt.Sprintf("invalid throttle: %s cannot be combined with %s or %s", total.name, read.name, write.name))
+		}
+	}
+	if t.BurstLength < 0 {
+		errors = append(errors, "invalid throttle burst-length: must not be negative")
+	} else if t.BurstLength > 0 && !hasMax {
+		errors = append(errors, "invalid throttle burst-length: requires one of the -max limits")
+	}
+	return errors
+}
+
+// driveOptions returns the -drive throttling options
+func (t DiskThrottle) driveOptions() []string {
+	opts := []string{}
+	for _, l := range t.limits() {
+		if l.value > 0 {
+			opts = append(opts, fmt.Sprintf("throttling.%s=%d", l.option, l.value))
+		}
+		if l.max > 0 {
+			opts = append(opts, fmt.Sprintf("throttling.%s-max=%d", l.option, l.max))
+			if t.BurstLength > 0 {
+				opts = append(opts, fmt.Sprintf("throttling.%s-max-length=%d", l.option, t.BurstLength))
+			}
+		}
+	}
+	return opts
+}
+
+// qmpArgs returns the block_set_io_throttle arguments, the six base limits
+// are mandatory
+func (t DiskThrottle) qmpArgs() map[string]interface{} {
+	args := map[string]interface{}{}
+	for _, l := range t.limits() {
+		args[l.arg] = l.value
+		if l.max > 0 {
+			args[l.arg+"_max"] = l.max
+			if t.BurstLength > 0 {
+				args[l.arg+"_max_length"] = t.BurstLength
+			}
+		}
+	}
+	return args
+}
+
+// sanitizeIO sets the default I/O policy and returns a message for each
+// invalid setting
+func (q *QemuDisk) sanitizeIO() []string {
+	if q.Cache == "" {
+		q.Cache = DefaultDiskCache
+	}
+	if q.AIO == "" {
+		q.AIO = DefaultDiskAIO
+	}
+	if q.Discard == "" {
+		q.Discard = DefaultDiskDiscard
+	}
+	if q.DetectZeroes == "" {
+		q.DetectZeroes = DefaultDiskDetectZeroes
+	}
+
+	errors := []string{}
+	check := func(name, found string, valid []string) {
+		for _, v := range valid {
+			if found == v {
+				return
+			}
+		}
+		errors = append(errors, fmt.Sprintf("invalid %s: found %s expected %v", name, found, valid))
+	}
+	check("cache", q.Cache, diskCacheModes)
+	check("aio", q.AIO, diskAIOModes)
+	check("discard", q.Discard, diskDiscardModes)
+	check("detect-zeroes", q.DetectZeroes, diskDetectZeroes)
+
+	if q.AIO == "native" && !q.cacheDirect() {
+		errors = append(errors, fmt.Sprintf("invalid aio: native requires cache none or directsync, found %s", q.Cache))
+	}
+	if q.DetectZeroes == "unmap" && q.Discard != "unmap" {
+		errors = append(errors, "invalid detect-zeroes: unmap requires discard unmap")
+	}
+	if q.Throttle != nil {
+		errors = append(errors, q.Throttle.validate()...)
+	}
+	return errors
+}
+
+// cacheDirect returns true if the cache mode bypasses the host page cache
+func (q *QemuDisk) cacheDirect() bool {
+	return q.Cache == "none" || q.Cache == "directsync"
+}
+
+// writeCache returns false if the guest sees a write-through disk
+func (q *QemuDisk) writeCache() bool {
+	return q.Cache != "writethrough" && q.Cache != "directsync"
+}
+
+// addDriveOptions appends options which qcli does not support to the -drive
+// with the given id
+func addDriveOptions(params []string, driveID string, options []string) []string {
+	if len(options) == 0 {
+		return params
+	}
+	for idx := 0; idx+1 < len(params); idx++ {
+		if params[idx] != "-drive" {
+			continue
+		}
+		for _, opt := range strings.Split(params[idx+1], ",") {
+			if opt == "id="+driveID {
+				params[idx+1] += "," + strings.Join(options, ",")
+				return params
+			}
+		}
+	}
+	return params
+}
+
+// addDiskThrottles adds the throttling options of disks to their drives
+func addDiskThrottles(params []string, blkDevices []qcli.BlockDevice, runDir string, disks []QemuDisk) ([]string, error) {
+	for _, disk := range disks {
+		if disk.Throttle == nil || disk.Throttle.IsZero() {
+			continue
+		}
+		if err := disk.Sanitize(runDir); err != nil {
+			return params, err
+		}
+		for _, blk := range blkDevices {
+			if blk.File == disk.File {
+				params = addDriveOptions(params, blk.ID, disk.Throttle.driveOptions())
+			}
+		}
+	}
+	return params, nil
+}
+
+// SetDiskThrottle changes the throttle limits of a disk of the running VM
+func (v *VM) SetDiskThrottle(disk QemuDisk, throttle DiskThrottle) error {
+	args := throttle.qmpArgs()
+	if hp, ok := v.hotpluggedDisk(disk.Name()); ok {
+		args["id"] = hp.Device
+	} else {
+		for _, blk := range v.qcli.BlkDevices {
+			if blk.File == disk.File {
+				args["device"] = blk.ID
+			}
+		}
+	}
+	if args["id"] == nil && args["device"] == nil {
+		return fmt.Errorf("VM:%s has no block device for disk '%s'", v.Name(), disk.Name())
+	}
+	log.Infof("VM:%s setting I/O throttle of disk %s: %+v", v.Name(), disk.Name(), throttle)
+	if err := v.QMPExecute("block_set_io_throttle", args, nil); err != nil {
+		return fmt.Errorf("Failed to set I/O throttle of disk '%s': %s", disk.Name(), err)
+	}
+	return nil
+}
+
+// SetDiskThrottle replaces the throttle limits of the named disk, applying
+// them at once if the machine is running, and records them in the machine
+// definition.  A throttle without limits removes them.
+func (m *Machine) SetDiskThrottle(name string, throttle DiskThrottle) error {
+	m.disksLock.Lock()
+	defer m.disksLock.Unlock()
+	if errors := throttle.validate(); len(errors) != 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
+	idx := m.findDisk(name)
+	if idx < 0 {
+		return fmt.Errorf("Machine '%s' has no disk named '%s'", m.Name, name)
+	}
+	disk := m.Config.Disks[idx]
+	if err := disk.Sanitize(filepath.Join(m.StateDir(), m.Config.Name)); err != nil {
+		return err
+	}
+	if m.IsRunning() {
+		if err := m.instance.SetDiskThrottle(disk, throttle); err != nil {
+			return err
+		}
+	}
+	m.updateDisk(idx, func(d *QemuDisk) {
+		if throttle.IsZero() {
+			d.Throttle = nil
+		} else {
+			d.Throttle = &throttle
+		}
+	})
+	return m.saveDisks()
+}
+
+func (ctl *MachineController) ThrottleMachineDisk(machineName, diskName string, throttle DiskThrottle) error {
+	machine := ctl.findMachine(machineName)
+	if machine == nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot throttle disk of unknown machine", machineName)
+	}
+	return machine.SetDiskThrottle(diskName, throttle)
+}
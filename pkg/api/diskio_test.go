@@ -0,0 +1,109 @@
+package api
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/project-machine/qcli"
+)
+
+func TestDiskIOSanitize(t *testing.T) {
+	disk := QemuDisk{File: "root.qcow2"}
+	if err := disk.Sanitize("/state/vm1"); err != nil {
+		t.Fatalf("failed to sanitize disk: %s", err)
+	}
+	if disk.Cache != "unsafe" || disk.AIO != "threads" || disk.Discard != "unmap" || disk.DetectZeroes != "unmap" {
+		t.Fatalf("unexpected default I/O policy %+v", disk)
+	}
+
+	good := []QemuDisk{
+		{File: "root.qcow2", Cache: "none", AIO: "native"},
+		{File: "root.qcow2", Cache: "writeback", AIO: "io_uring", Discard: "ignore", DetectZeroes: "on"},
+		{File: "root.qcow2", Throttle: &DiskThrottle{IOPSRead: 100, IOPSReadMax: 500, BurstLength: 10, BPS: 1 << 20}},
+	}
+	for _, d := range good {
+		if err := d.Sanitize("/state/vm1"); err != nil {
+			t.Fatalf("unexpected error for disk %+v: %s", d, err)
+		}
+	}
+
+	bad := []QemuDisk{
+		{File: "root.qcow2", Cache: "fast"},
+		{File: "root.qcow2", AIO: "posix"},
+		{File: "root.qcow2", AIO: "native"},
+		{File: "root.qcow2", Discard: "ignore"},
+		{File: "root.qcow2", Throttle: &DiskThrottle{IOPS: 100, IOPSWrite: 50}},
+		{File: "root.qcow2", Throttle: &DiskThrottle{BPSMax: 1 << 20}},
+		{File: "root.qcow2", Throttle: &DiskThrottle{BPS: 1 << 20, BPSMax: 1 << 10}},
+		{File: "root.qcow2", Throttle: &DiskThrottle{IOPS: 100, BurstLength: 10}},
+		{File: "root.qcow2", Throttle: &DiskThrottle{IOPS: -1}},
+	}
+	for _, d := range bad {
+		if err := d.Sanitize("/state/vm1"); err == nil {
+			t.Fatalf("expected error for disk %+v", d)
+		}
+	}
+}
+
+func TestDiskThrottleOptions(t *testing.T) {
+	throttle := DiskThrottle{BPSWrite: 1 << 20, IOPS: 100, IOPSMax: 200, BurstLength: 5}
+	opts := strings.Join(throttle.driveOptions(), ",")
+	expected := "throttling.bps-write=1048576,throttling.iops-total=100,throttling.iops-total-max=200,throttling.iops-total-max-length=5"
+	if opts != expected {
+		t.Fatalf("expected options %q, got %q", expected, opts)
+	}
+
+	params := []string{"-drive", "file=/a.qcow2,id=drive0", "-drive", "file=/b.qcow2,id=drive1", "-device", "id=drive1"}
+	params = addDriveOptions(params, "drive1", throttle.driveOptions())
+	if params[1] != "file=/a.qcow2,id=drive0" || params[3] != "file=/b.qcow2,id=drive1,"+expected || params[5] != "id=drive1" {
+		t.Fatalf("unexpected params %v", params)
+	}
+
+	args := throttle.qmpArgs()
+	for _, arg := range []string{"bps", "bps_rd", "bps_wr", "iops", "iops_rd", "iops_wr"} {
+		if _, ok := args[arg]; !ok {
+			t.Fatalf("missing mandatory block_set_io_throttle argument %s in %v", arg, args)
+		}
+	}
+	if args["iops_max"] != int64(200) || args["iops_max_length"] != int64(5) || args["bps_wr"] != int64(1<<20) {
+		t.Fatalf("unexpected block_set_io_throttle arguments %v", args)
+	}
+}
+
+func TestVMSetDiskThrottle(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-throttle")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	handler := func(cmd fakeQMPCommand) (interface{}, *QMPError, []QMPEvent) {
+		return nil, nil, nil
+	}
+	vm, fake := newFakeQMPVM(t, tmpDir, handler)
+	defer fake.Close()
+	vm.qcli.BlkDevices = []qcli.BlockDevice{{ID: "drive0", File: "/state/vm1/root.qcow2"}}
+	vm.hotplugged = map[string]hotpluggedDisk{"data": {Node: "hp-data", Device: "hp-dev-data"}}
+
+	if err := vm.SetDiskThrottle(QemuDisk{File: "/state/vm1/root.qcow2"}, DiskThrottle{IOPS: 100}); err != nil {
+		t.Fatalf("failed to throttle disk: %s", err)
+	}
+	if err := vm.SetDiskThrottle(QemuDisk{File: "/images/data.qcow2"}, DiskThrottle{}); err != nil {
+		t.Fatalf("failed to throttle hotplugged disk: %s", err)
+	}
+	if err := vm.SetDiskThrottle(QemuDisk{File: "/images/missing.qcow2"}, DiskThrottle{}); err == nil {
+		t.Fatalf("expected error throttling an unknown disk")
+	}
+
+	commands := fake.Commands()
+	if len(commands) != 2 || commands[0].Execute != "block_set_io_throttle" {
+		t.Fatalf("expected two block_set_io_throttle commands, got %+v", commands)
+	}
+	if commands[0].Arguments["device"] != "drive0" || commands[0].Arguments["iops"] != float64(100) {
+		t.Fatalf("unexpected arguments %+v", commands[0].Arguments)
+	}
+	if commands[1].Arguments["id"] != "hp-dev-data" || commands[1].Arguments["iops"] != float64(0) {
+		t.Fatalf("unexpected arguments for hotplugged disk %+v", commands[1].Arguments)
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+)
+
+// DiskImageInfo is one image of the output of qemu-img info --output=json
+type DiskImageInfo struct {
+	Filename        string         `json:"filename"`
+	Format          string         `json:"format"`
+	VirtualSize     int64          `json:"virtual-size"`
+	ActualSize      int64          `json:"actual-size"`
+	ClusterSize     int64          `json:"cluster-size,omitempty"`
+	BackingFilename string         `json:"backing-filename,omitempty"`
+	BackingFormat   string         `json:"backing-filename-format,omitempty"`
+	DirtyFlag       bool           `json:"dirty-flag,omitempty"`
+	Snapshots       []DiskSnapshot `json:"snapshots,omitempty"`
+}
+
+type DiskSnapshot struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	VMStateSize int64  `json:"vm-state-size"`
+	DateSec     int64  `json:"date-sec"`
+}
+
+// DiskInfo describes a machine disk and the images backing it
+type DiskInfo struct {
+	Name string `json:"name"`
+	DiskImageInfo
+	BackingChain []DiskImageInfo `json:"backing-chain,omitempty"`
+}
+
+type DiskResizeRequest struct {
+	Size string `json:"size"`
+}
+
+type DiskConvertRequest struct {
+	Format string `json:"format"`
+}
+
+// parseQemuImgInfo parses qemu-img info --backing-chain --output=json,
+// the disk image comes first followed by its backing files
+func parseQemuImgInfo(out []byte) ([]DiskImageInfo, error) {
+	chain := []DiskImageInfo{}
+	if err := json.Unmarshal(out, &chain); err != nil {
+		return nil, fmt.Errorf("Failed to parse qemu-img info output: %s", err)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("qemu-img info returned no images")
+	}
+	return chain, nil
+}
+
+// QemuImgInfo returns the image information of file and its backing chain.
+// The image is opened shared so this also works for disks in use.
+func QemuImgInfo(file string) ([]DiskImageInfo, error) {
+	cmd := []string{"qemu-img", "info", "--force-share", "--backing-chain", "--output=json", file}
+	out, stderr, rc := RunCommandWithOutputErrorRc(cmd...)
+	if rc != 0 {
+		return nil, fmt.Errorf("qemu-img info failed: %v\n rc: %d\n out: %s\n, err: %s",
+			cmd, rc, out, stderr)
+	}
+	return parseQemuImgInfo(out)
+}
+
+// growToSize resizes an existing disk which is smaller than its Size
+func (q *QemuDisk) growToSize() error {
+	if q.Size == 0 || q.Type == "cdrom" {
+		return nil
+	}
+	chain, err := QemuImgInfo(q.File)
+	if err != nil {
+		return err
+	}
+	current := chain[0].VirtualSize
+	if int64(q.Size) < current {
+		log.Warnf("Disk %s is larger (%d) than its size %d, disks are not shrunk", q.File, current, q.Size)
+		return nil
+	}
+	if int64(q.Size) == current {
+		return nil
+	}
+	return q.resize(int64(q.Size))
+}
+
+// resize grows the disk image of a stopped machine
+func (q *QemuDisk) resize(size int64) error {
+	log.Infof("Resizing %s to %d", q.File, size)
+	cmd := append([]string{"qemu-img", "resize"}, q.qemuImgSource()...)
+	cmd = append(cmd, fmt.Sprintf("%d", size))
+	out, stderr, rc := RunCommandWithOutputErrorRc(cmd...)
+	if rc != 0 {
+		return fmt.Errorf("qemu-img resize failed: %v\n rc: %d\n out: %s\n, err: %s",
+			cmd, rc, out, stderr)
+	}
+	return nil
+}
+
+// convert rewrites the disk image in format.  Files with a format extension
+// get the extension of the new format, which keeps the name of the disk.  The
+// backing chain is merged into the new image.
+func (q *QemuDisk) convert(format string) error {
+	target := q.File
+	if ext := filepath.Ext(q.File); ext == ".qcow2" || ext == ".raw" {
+		target = strings.TrimSuffix(q.File, ext) + "." + format
+		if PathExists(target) {
+			return fmt.Errorf("Cannot convert %s, %s already exists", q.File, target)
+		}
+	}
+	tmpFile := target + ".convert"
+	log.Infof("Converting %s from %s to %s", q.File, q.Format, format)
+	cmd := append([]string{"qemu-img", "convert"}, q.qemuImgSource()...)
+	cmd = append(cmd, q.qemuImgTarget("-O", format)...)
+	cmd = append(cmd, tmpFile)
+	out, stderr, rc := RunCommandWithOutputErrorRc(cmd...)
+	if rc != 0 {
+		os.Remove(tmpFile)
+		return fmt.Errorf("qemu-img convert failed: %v\n rc: %d\n out: %s\n, err: %s",
+			cmd, rc, out, stderr)
+	}
+	if err := os.Rename(tmpFile, target); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("Failed to replace %s with the converted image: %s", q.File, err)
+	}
+	if target != q.File {
+		if err := os.Remove(q.File); err != nil {
+			log.Warnf("Failed to remove %s after converting it: %s", q.File, err)
+		}
+		q.File = target
+	}
+	return nil
+}
+
+// ResizeDisk grows a disk of the running VM with block_resize
+func (v *VM) ResizeDisk(disk QemuDisk, size int64) error {
+	args := map[string]interface{}{"size": size}
+	if hp, ok := v.hotpluggedDisk(disk.Name()); ok {
+		args["node-name"] = hp.Node
+	} else {
+		for _, blk := range v.qcli.BlkDevices {
+			if blk.File == disk.File {
+				args["device"] = blk.ID
+			}
+		}
+	}
+	if args["node-name"] == nil && args["device"] == nil {
+		return fmt.Errorf("VM:%s has no block device for disk '%s'", v.Name(), disk.Name())
+	}
+	log.Infof("VM:%s resizing disk %s to %d", v.Name(), disk.Name(), size)
+	if err := v.QMPExecute("block_resize", args, nil); err != nil {
+		return fmt.Errorf("Failed to resize disk '%s': %s", disk.Name(), err)
+	}
+	return nil
+}
+
+// diskPath returns the disk with its File resolved against the machine
+// directory
+func (m *Machine) diskPath(name string) (int, QemuDisk, error) {
+	idx := m.findDisk(name)
+	if idx < 0 {
+		return idx, QemuDisk{}, fmt.Errorf("Machine '%s' has no disk named '%s'", m.Name, name)
+	}
+	disk := m.Config.Disks[idx]
+	if err := disk.Sanitize(filepath.Join(m.StateDir(), m.Config.Name)); err != nil {
+		return idx, disk, err
+	}
+	if !PathExists(disk.File) {
+		return idx, disk, fmt.Errorf("Disk '%s' has not been created yet, start the machine first", name)
+	}
+	if err := disk.setSecretFile(m.SecretStore()); err != nil {
+		return idx, disk, err
+	}
+	return idx, disk, nil
+}
+
+func (m *Machine) DiskInfo(name string) (DiskInfo, error) {
+	_, disk, err := m.diskPath(name)
+	if err != nil {
+		return DiskInfo{}, err
+	}
+	chain, err := QemuImgInfo(disk.File)
+	if err != nil {
+		return DiskInfo{}, err
+	}
+	return DiskInfo{Name: name, DiskImageInfo: chain[0], BackingChain: chain[1:]}, nil
+}
+
+// ResizeDisk grows the named disk, online if the machine is running, and
+// records the new size in the machine definition
+func (m *Machine) ResizeDisk(name string, size string) error {
+	m.disksLock.Lock()
+	defer m.disksLock.Unlock()
+	newSize, err := humanize.ParseBytes(size)
+	if err != nil {
+		return fmt.Errorf("Invalid disk size '%s': %s", size, err)
+	}
+	idx, disk, err := m.diskPath(name)
+	if err != nil {
+		return err
+	}
+	if disk.Type == "cdrom" {
+		return fmt.Errorf("Cannot resize cdrom '%s'", name)
+	}
+	chain, err := QemuImgInfo(disk.File)
+	if err != nil {
+		return err
+	}
+	if int64(newSize) < chain[0].VirtualSize {
+		return fmt.Errorf("Disk '%s' is %s, shrinking disks is not supported", name, humanize.IBytes(uint64(chain[0].VirtualSize)))
+	}
+	if m.IsRunning() {
+		err = m.instance.ResizeDisk(disk, int64(newSize))
+	} else {
+		err = disk.resize(int64(newSize))
+	}
+	if err != nil {
+		return err
+	}
+	m.updateDisk(idx, func(d *QemuDisk) { d.Size = DiskSize(newSize) })
+	return m.saveDisks()
+}
+
+// ConvertDisk converts the named disk of a stopped machine to format
+func (m *Machine) ConvertDisk(name string, format string) error {
+	m.disksLock.Lock()
+	defer m.disksLock.Unlock()
+	if format != "qcow2" && format != "raw" {
+		return fmt.Errorf("Invalid disk format '%s', expected qcow2 or raw", format)
+	}
+	if m.IsRunning() {
+		return fmt.Errorf("Machine '%s' is running, stop it to convert disk '%s'", m.Name, name)
+	}
+	idx, disk, err := m.diskPath(name)
+	if err != nil {
+		return err
+	}
+	if disk.Type == "cdrom" {
+		return fmt.Errorf("Cannot convert cdrom '%s'", name)
+	}
+	if disk.Format == format {
+		return fmt.Errorf("Disk '%s' is already %s", name, format)
+	}
+	if err := disk.convert(format); err != nil {
+		return err
+	}
+	// the converted image no longer depends on a stored image
+	m.updateDisk(idx, func(d *QemuDisk) {
+		d.File = disk.File
+		d.Image = ""
+		d.BackingFile = ""
+		d.BackingFormat = ""
+		d.Format = format
+	})
+	return m.saveDisks()
+}
+
+func (ctl *MachineController) ResizeMachineDisk(machineName, diskName, size string) error {
+	machine := ctl.findMachine(machineName)
+	if machine == nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot resize disk of unknown machine", machineName)
+	}
+	return machine.ResizeDisk(diskName, size)
+}
+
+func (ctl *MachineController) ConvertMachineDisk(machineName, diskName, format string) error {
+	machine := ctl.findMachine(machineName)
+	if machine == nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot convert disk of unknown machine", machineName)
+	}
+	return machine.ConvertDisk(diskName, format)
+}
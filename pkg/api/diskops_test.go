@@ -0,0 +1,127 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/project-machine/qcli"
+)
+
+func TestParseQemuImgInfo(t *testing.T) {
+	out := []byte(`[
+    {
+        "virtual-size": 21474836480,
+        "filename": "/state/vm1/root.qcow2",
+        "cluster-size": 65536,
+        "format": "qcow2",
+        "actual-size": 200704,
+        "backing-filename": "/data/images/blobs/sha256/abc",
+        "backing-filename-format": "raw",
+        "snapshots": [
+            {"icount": 0, "vm-clock-nsec": 0, "name": "clean", "date-sec": 1700000000, "date-nsec": 0, "vm-clock-sec": 0, "id": "1", "vm-state-size": 0}
+        ],
+        "dirty-flag": false
+    },
+    {
+        "virtual-size": 2361393152,
+        "filename": "/data/images/blobs/sha256/abc",
+        "format": "raw",
+        "actual-size": 2361393152,
+        "dirty-flag": false
+    }
+]`)
+	chain, err := parseQemuImgInfo(out)
+	if err != nil {
+		t.Fatalf("failed to parse qemu-img info: %s", err)
+	}
+	if len(chain) != 2 || chain[0].VirtualSize != 21474836480 || chain[0].ActualSize != 200704 || chain[0].BackingFormat != "raw" {
+		t.Fatalf("unexpected chain %+v", chain)
+	}
+	if len(chain[0].Snapshots) != 1 || chain[0].Snapshots[0].Name != "clean" {
+		t.Fatalf("unexpected snapshots %+v", chain[0].Snapshots)
+	}
+	if _, err := parseQemuImgInfo([]byte(`[]`)); err == nil {
+		t.Fatalf("expected error for empty output")
+	}
+}
+
+func TestVMResizeDisk(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-resize")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	handler := func(cmd fakeQMPCommand) (interface{}, *QMPError, []QMPEvent) {
+		return nil, nil, nil
+	}
+	vm, fake := newFakeQMPVM(t, tmpDir, handler)
+	defer fake.Close()
+	vm.qcli.BlkDevices = []qcli.BlockDevice{{ID: "drive0", File: "/state/vm1/root.qcow2"}}
+	vm.hotplugged = map[string]hotpluggedDisk{"data": {Node: "hp-data"}}
+
+	if err := vm.ResizeDisk(QemuDisk{File: "/state/vm1/root.qcow2"}, 1<<30); err != nil {
+		t.Fatalf("failed to resize disk: %s", err)
+	}
+	if err := vm.ResizeDisk(QemuDisk{File: "/images/data.qcow2"}, 1<<30); err != nil {
+		t.Fatalf("failed to resize hotplugged disk: %s", err)
+	}
+	if err := vm.ResizeDisk(QemuDisk{File: "/images/missing.qcow2"}, 1<<30); err == nil {
+		t.Fatalf("expected error resizing an unknown disk")
+	}
+
+	commands := fake.Commands()
+	if len(commands) != 2 || commands[0].Execute != "block_resize" {
+		t.Fatalf("expected two block_resize commands, got %+v", commands)
+	}
+	if commands[0].Arguments["device"] != "drive0" || commands[1].Arguments["node-name"] != "hp-data" {
+		t.Fatalf("unexpected block_resize arguments %+v", commands)
+	}
+}
+
+func TestConvertDiskRename(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-convert")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// the fake qemu-img writes the target, its last argument
+	fake := filepath.Join(tmpDir, "qemu-img")
+	if err := os.WriteFile(fake, []byte("#!/bin/sh\neval target=\\${$#}\necho converted > \"$target\"\n"), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	t.Setenv("PATH", tmpDir+":"+os.Getenv("PATH"))
+
+	disk := QemuDisk{File: filepath.Join(tmpDir, "scratch.qcow2"), Format: "qcow2"}
+	if err := os.WriteFile(disk.File, []byte("image"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := disk.convert("raw"); err != nil {
+		t.Fatalf("failed to convert disk: %s", err)
+	}
+	if disk.File != filepath.Join(tmpDir, "scratch.raw") || disk.Name() != "scratch" {
+		t.Fatalf("expected the disk to be renamed to scratch.raw, got %s", disk.File)
+	}
+	if PathExists(filepath.Join(tmpDir, "scratch.qcow2")) || !PathExists(disk.File) {
+		t.Fatalf("expected only the converted image to be left")
+	}
+
+	// an existing file with the new name is not replaced
+	if err := os.WriteFile(filepath.Join(tmpDir, "scratch.qcow2"), []byte("other"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := disk.convert("qcow2"); err == nil {
+		t.Fatalf("expected error converting onto an existing file")
+	}
+
+	// other file names are kept
+	disk = QemuDisk{File: filepath.Join(tmpDir, "data.img"), Format: "raw"}
+	if err := os.WriteFile(disk.File, []byte("image"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := disk.convert("qcow2"); err != nil || disk.File != filepath.Join(tmpDir, "data.img") {
+		t.Fatalf("expected data.img to be converted in place, got %s: %v", disk.File, err)
+	}
+}
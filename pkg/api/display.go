@@ -0,0 +1,223 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/project-machine/qcli"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DisplayNone  = "none"
+	DisplaySpice = "spice"
+	DisplayVNC   = "vnc"
+
+	// DisplayListenUnix serves the display on a unix socket in the VM socket dir
+	DisplayListenUnix = "unix"
+	VNCSocketName     = "vnc.sock"
+
+	// VNC authentication only uses the first 8 characters of a password
+	vncMaxPasswordLen = 8
+
+	displayPasswordChars = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+	spicePasswordLen     = 16
+)
+
+// DisplayDef selects the remote display protocol of the machine.  Type is
+// spice (default), vnc or none.  Listen is an IP address, default 127.0.0.1,
+// or "unix" to serve VNC on a socket in the VM socket directory.  Port is
+// picked from 5900 when not set.  Unless NoPassword is set the display
+// requires Password, or a random password generated on each start.  TLS
+// serves spice with a certificate signed by the machined display CA.
+type DisplayDef struct {
+	Type       string `yaml:"type"`
+	Listen     string `yaml:"listen"`
+	Port       int    `yaml:"port"`
+	Password   string `yaml:"password"`
+	NoPassword bool   `yaml:"no-password"`
+	TLS        bool   `yaml:"tls"`
+}
+
+func (d *DisplayDef) Sanitize() error {
+	switch d.Type {
+	case "":
+		d.Type = DisplaySpice
+	case DisplaySpice, DisplayVNC, DisplayNone:
+	default:
+		return fmt.Errorf("Invalid display type '%s', must be one of %s, %s or %s", d.Type, DisplaySpice, DisplayVNC, DisplayNone)
+	}
+	if d.Type == DisplayNone {
+		return nil
+	}
+	if d.Listen == "" {
+		d.Listen = "127.0.0.1"
+	}
+	if d.Listen == DisplayListenUnix {
+		if d.Type != DisplayVNC {
+			return fmt.Errorf("Display listen '%s' is only supported for %s", DisplayListenUnix, DisplayVNC)
+		}
+	} else if net.ParseIP(d.Listen) == nil {
+		return fmt.Errorf("Invalid display listen address '%s', must be an IP address or '%s'", d.Listen, DisplayListenUnix)
+	}
+	if d.Port != 0 && (d.Port < qcli.RemoteDisplayPortBase || d.Port > 65535) {
+		return fmt.Errorf("Invalid display port %d, must be between %d and 65535", d.Port, qcli.RemoteDisplayPortBase)
+	}
+	if d.Type == DisplayVNC && len(d.Password) > vncMaxPasswordLen {
+		return fmt.Errorf("VNC passwords are limited to %d characters", vncMaxPasswordLen)
+	}
+	if d.NoPassword && d.Password != "" {
+		return fmt.Errorf("Display password is set with no-password")
+	}
+	if d.TLS && d.Type != DisplaySpice {
+		return fmt.Errorf("Display tls is only supported for %s", DisplaySpice)
+	}
+	return nil
+}
+
+// UsesPassword returns true if clients must authenticate to the display
+func (d DisplayDef) UsesPassword() bool {
+	return d.Type != DisplayNone && !d.NoPassword
+}
+
+// StartPassword returns the display password for a new start of the VM
+func (d DisplayDef) StartPassword() (string, error) {
+	if !d.UsesPassword() {
+		return "", nil
+	}
+	if d.Password != "" {
+		return d.Password, nil
+	}
+	length := spicePasswordLen
+	if d.Type == DisplayVNC {
+		length = vncMaxPasswordLen
+	}
+	return RandomDisplayPassword(length)
+}
+
+// RandomDisplayPassword returns a password of unambiguous characters
+func RandomDisplayPassword(length int) (string, error) {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Failed to generate display password: %s", err)
+	}
+	for idx := range buf {
+		buf[idx] = displayPasswordChars[int(buf[idx])%len(displayPasswordChars)]
+	}
+	return string(buf), nil
+}
+
+// IsTCP returns true if the display listens on a TCP port
+func (d DisplayDef) IsTCP() bool {
+	return d.Type != DisplayNone && d.Listen != DisplayListenUnix
+}
+
+// ConfigureDisplay sets up the qcli display devices for the display type.
+// qcli has no VNC support, see VNCConnection.QemuParams.
+func ConfigureDisplay(c *qcli.Config, display DisplayDef) {
+	switch display.Type {
+	case DisplaySpice:
+		c.SpiceDevice.HostAddress = display.Listen
+		if display.Port != 0 {
+			c.SpiceDevice.Port = strconv.Itoa(display.Port)
+		}
+		if display.TLS {
+			c.SpiceDevice.TLSPort = c.SpiceDevice.Port
+			c.SpiceDevice.Port = ""
+		}
+		// with ticketing enabled no client can connect until the password
+		// is set over QMP once running
+		c.SpiceDevice.DisableTicketing = display.NoPassword
+	case DisplayVNC:
+		c.SpiceDevice = qcli.SpiceDevice{}
+		c.VGA = "std"
+	case DisplayNone:
+		c.SpiceDevice = qcli.SpiceDevice{}
+		c.VGA = "none"
+	}
+}
+
+type VNCConnection struct {
+	Socket      string
+	HostAddress string
+	Port        string
+	Password    string
+}
+
+// NewVNCConnection picks the socket or port the VM will serve VNC on
+func NewVNCConnection(display DisplayDef, sockDir, password string) VNCConnection {
+	vnc := VNCConnection{Password: password}
+	if display.Listen == DisplayListenUnix {
+		vnc.Socket = filepath.Join(sockDir, VNCSocketName)
+		return vnc
+	}
+	port := display.Port
+	if port == 0 {
+		port = NextFreePort(qcli.RemoteDisplayPortBase)
+	}
+	vnc.HostAddress = display.Listen
+	vnc.Port = strconv.Itoa(port)
+	return vnc
+}
+
+// QemuParams returns the -vnc argument, QEMU numbers TCP displays from 5900
+func (vnc VNCConnection) QemuParams() []string {
+	opts := []string{}
+	if vnc.Socket != "" {
+		opts = append(opts, "unix:"+vnc.Socket)
+	} else {
+		port, _ := strconv.Atoi(vnc.Port)
+		host := vnc.HostAddress
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		opts = append(opts, fmt.Sprintf("%s:%d", host, port-qcli.RemoteDisplayPortBase))
+	}
+	if vnc.Password != "" {
+		opts = append(opts, "password=on")
+	}
+	return []string{"-vnc", strings.Join(opts, ",")}
+}
+
+// addSpiceOption appends an option which qcli does not support to -spice
+func addSpiceOption(params []string, option string) []string {
+	for idx := 0; idx+1 < len(params); idx++ {
+		if params[idx] == "-spice" {
+			params[idx+1] += "," + option
+			break
+		}
+	}
+	return params
+}
+
+// configureDisplayPassword sets the display password over QMP, QEMU has no
+// command line option for it
+func (v *VM) configureDisplayPassword() error {
+	display := v.Config.Display
+	if v.displayPassword == "" {
+		return nil
+	}
+	log.Infof("VM:%s setting %s display password", v.Name(), display.Type)
+	args := map[string]string{"protocol": display.Type, "password": v.displayPassword}
+	if err := v.QMPExecute("set_password", args, nil); err != nil {
+		return fmt.Errorf("Failed to set %s display password: %s", display.Type, err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/project-machine/qcli"
+)
+
+func TestDisplaySanitize(t *testing.T) {
+	d := DisplayDef{}
+	if err := d.Sanitize(); err != nil {
+		t.Fatalf("unexpected error sanitizing empty display: %s", err)
+	}
+	if d.Type != DisplaySpice || d.Listen != "127.0.0.1" {
+		t.Fatalf("expected spice on 127.0.0.1 by default, got %+v", d)
+	}
+
+	bad := []DisplayDef{
+		{Type: "rdp"},
+		{Type: DisplaySpice, Listen: DisplayListenUnix},
+		{Type: DisplayVNC, Listen: "localhost"},
+		{Type: DisplayVNC, Port: 22},
+		{Type: DisplayVNC, Password: "toolongpassword"},
+		{Type: DisplaySpice, Password: "secret", NoPassword: true},
+		{Type: DisplayVNC, TLS: true},
+	}
+	for _, d := range bad {
+		if err := d.Sanitize(); err == nil {
+			t.Fatalf("expected error sanitizing %+v", d)
+		}
+	}
+
+	d = DisplayDef{Type: DisplayVNC, Listen: DisplayListenUnix, Password: "secret"}
+	if err := d.Sanitize(); err != nil {
+		t.Fatalf("unexpected error sanitizing %+v: %s", d, err)
+	}
+	if d.IsTCP() {
+		t.Fatalf("expected unix display to not be TCP")
+	}
+}
+
+func TestVNCQemuParams(t *testing.T) {
+	tests := []struct {
+		display  DisplayDef
+		password string
+		want     []string
+	}{
+		{DisplayDef{Type: DisplayVNC, Listen: DisplayListenUnix}, "", []string{"-vnc", "unix:/run/vm1/vnc.sock"}},
+		{DisplayDef{Type: DisplayVNC, Listen: "127.0.0.1", Port: 5905}, "pw", []string{"-vnc", "127.0.0.1:5,password=on"}},
+		{DisplayDef{Type: DisplayVNC, Listen: "::1", Port: 5910}, "", []string{"-vnc", "[::1]:10"}},
+	}
+	for _, tc := range tests {
+		got := NewVNCConnection(tc.display, "/run/vm1", tc.password).QemuParams()
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("expected %v for %+v, got %v", tc.want, tc.display, got)
+		}
+	}
+}
+
+func TestConfigureDisplay(t *testing.T) {
+	c := &qcli.Config{SpiceDevice: qcli.SpiceDevice{ID: "spice0", Port: "5900"}, VGA: "qxl"}
+	ConfigureDisplay(c, DisplayDef{Type: DisplayVNC, Listen: "127.0.0.1"})
+	if c.SpiceDevice.Port != "" || c.VGA != "std" {
+		t.Fatalf("expected spice removed and std vga for vnc, got %+v %s", c.SpiceDevice, c.VGA)
+	}
+
+	c = &qcli.Config{SpiceDevice: qcli.SpiceDevice{ID: "spice0", Port: "5900"}}
+	ConfigureDisplay(c, DisplayDef{Type: DisplaySpice, Listen: "0.0.0.0", Port: 5999, Password: "pw"})
+	if c.SpiceDevice.HostAddress != "0.0.0.0" || c.SpiceDevice.Port != "5999" || c.SpiceDevice.DisableTicketing {
+		t.Fatalf("unexpected spice device %+v", c.SpiceDevice)
+	}
+
+	c = &qcli.Config{SpiceDevice: qcli.SpiceDevice{ID: "spice0", Port: "5900"}}
+	ConfigureDisplay(c, DisplayDef{Type: DisplaySpice, Listen: "127.0.0.1", TLS: true})
+	if c.SpiceDevice.Port != "" || c.SpiceDevice.TLSPort != "5900" || c.SpiceDevice.DisableTicketing {
+		t.Fatalf("expected only a tls port with ticketing, got %+v", c.SpiceDevice)
+	}
+
+	c = &qcli.Config{SpiceDevice: qcli.SpiceDevice{ID: "spice0", Port: "5900"}}
+	ConfigureDisplay(c, DisplayDef{Type: DisplaySpice, Listen: "127.0.0.1", NoPassword: true})
+	if !c.SpiceDevice.DisableTicketing {
+		t.Fatalf("expected ticketing disabled with no-password")
+	}
+}
+
+func TestDisplayStartPassword(t *testing.T) {
+	spice := DisplayDef{Type: DisplaySpice}
+	first, err := spice.StartPassword()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	second, _ := spice.StartPassword()
+	if len(first) != spicePasswordLen || first == second {
+		t.Fatalf("expected a new random password each start, got %q and %q", first, second)
+	}
+
+	vnc := DisplayDef{Type: DisplayVNC}
+	if password, _ := vnc.StartPassword(); len(password) != vncMaxPasswordLen {
+		t.Fatalf("expected %d character vnc password, got %q", vncMaxPasswordLen, password)
+	}
+
+	fixed := DisplayDef{Type: DisplaySpice, Password: "secret"}
+	if password, _ := fixed.StartPassword(); password != "secret" {
+		t.Fatalf("expected configured password, got %q", password)
+	}
+
+	for _, d := range []DisplayDef{{Type: DisplaySpice, NoPassword: true}, {Type: DisplayNone}} {
+		if password, _ := d.StartPassword(); password != "" {
+			t.Fatalf("expected no password for %+v, got %q", d, password)
+		}
+	}
+}
+
+func TestAddSpiceOption(t *testing.T) {
+	params := []string{"-m", "1024", "-spice", "tls-port=5900,addr=127.0.0.1", "-device", "virtio-serial-pci"}
+	got := addSpiceOption(params, "x509-dir=/tls")
+	if got[3] != "tls-port=5900,addr=127.0.0.1,x509-dir=/tls" {
+		t.Fatalf("unexpected -spice argument %q", got[3])
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// machined keeps one CA for TLS displays under DataDirectory.  The CA key
+// stays in a directory only machined reads, QEMU is given the x509 dir with
+// the file names it expects for spice.
+const (
+	DisplayTLSDirName = "display-tls"
+	DisplayCACertFile = "ca-cert.pem"
+
+	displayCADirName      = "ca"
+	displayX509DirName    = "x509"
+	displayCAKeyFile      = "ca-key.pem"
+	displayServerCertFile = "server-cert.pem"
+	displayServerKeyFile  = "server-key.pem"
+
+	displayCAValidity     = time.Hour * 24 * 365 * 10
+	displayServerValidity = time.Hour * 24 * 365
+	displayServerRenew    = time.Hour * 24 * 30
+)
+
+var displayTLSLock sync.Mutex
+
+// EnsureDisplayTLS creates the display CA and server certificate under dir
+// if required and returns the x509 dir for QEMU, which holds the CA
+// certificate and the server certificate and key.  The server certificate
+// is reissued when it is about to expire or does not cover listenAddr.
+func EnsureDisplayTLS(dir, listenAddr string) (string, error) {
+	displayTLSLock.Lock()
+	defer displayTLSLock.Unlock()
+
+	caDir := filepath.Join(dir, displayCADirName)
+	x509Dir := filepath.Join(dir, displayX509DirName)
+	for _, d := range []string{caDir, x509Dir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return "", fmt.Errorf("Failed to create display TLS dir %q: %s", d, err)
+		}
+	}
+	caCert, caKey, err := loadDisplayCA(caDir)
+	if err != nil {
+		return "", err
+	}
+	// spice and its clients verify against the CA certificate in the x509 dir
+	if !PathExists(filepath.Join(x509Dir, DisplayCACertFile)) {
+		if err := writePEM(filepath.Join(x509Dir, DisplayCACertFile), "CERTIFICATE", caCert.Raw, 0644); err != nil {
+			return "", err
+		}
+	}
+	if displayServerCertValid(x509Dir, caCert, listenAddr) {
+		return x509Dir, nil
+	}
+	log.Infof("Issuing display TLS server certificate in %s", x509Dir)
+	if err := issueDisplayServerCert(x509Dir, caCert, caKey, listenAddr); err != nil {
+		return "", err
+	}
+	return x509Dir, nil
+}
+
+// loadDisplayCA reads the display CA from dir, creating it on first use
+func loadDisplayCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile := filepath.Join(dir, DisplayCACertFile)
+	keyFile := filepath.Join(dir, displayCAKeyFile)
+	if PathExists(certFile) && PathExists(keyFile) {
+		cert, err := readCertificate(certFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := readECKey(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, key, nil
+	}
+
+	log.Infof("Creating display TLS CA in %s", dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to generate display CA key: %s", err)
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          newSerialNumber(),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("machined display CA %s", hostname)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(displayCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create display CA certificate: %s", err)
+	}
+	if err := writeECKey(keyFile, key); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse display CA certificate: %s", err)
+	}
+	return cert, key, nil
+}
+
+// displayServerCertValid returns true if the server certificate in dir was
+// issued by caCert, is not close to expiry and covers listenAddr
+func displayServerCertValid(dir string, caCert *x509.Certificate, listenAddr string) bool {
+	if !PathExists(filepath.Join(dir, displayServerKeyFile)) {
+		return false
+	}
+	cert, err := readCertificate(filepath.Join(dir, displayServerCertFile))
+	if err != nil {
+		return false
+	}
+	if cert.CheckSignatureFrom(caCert) != nil || time.Now().Add(displayServerRenew).After(cert.NotAfter) {
+		return false
+	}
+	ip := net.ParseIP(listenAddr)
+	if ip == nil || ip.IsUnspecified() {
+		return true
+	}
+	return cert.VerifyHostname(ip.String()) == nil
+}
+
+func issueDisplayServerCert(dir string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, listenAddr string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Failed to generate display server key: %s", err)
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject:      pkix.Name{CommonName: hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(displayServerValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  displayServerIPs(listenAddr),
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("Failed to create display server certificate: %s", err)
+	}
+	if err := writeECKey(filepath.Join(dir, displayServerKeyFile), key); err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, displayServerCertFile), "CERTIFICATE", der, 0644)
+}
+
+// displayServerIPs returns the loopback and host addresses, and listenAddr
+// if it is not among them
+func displayServerIPs(listenAddr string) []net.IP {
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	if ip := net.ParseIP(listenAddr); ip != nil && !ip.IsUnspecified() {
+		for _, known := range ips {
+			if known.Equal(ip) {
+				return ips
+			}
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// ReadDisplayCACert returns the PEM encoded display CA certificate
+func ReadDisplayCACert(dir string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, DisplayCACertFile))
+	if err != nil {
+		return "", fmt.Errorf("Failed to read display CA certificate: %s", err)
+	}
+	return string(content), nil
+}
+
+func newSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read certificate %q: %s", path, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No certificate found in %q", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse certificate %q: %s", path, err)
+	}
+	return cert, nil
+}
+
+func readECKey(path string) (*ecdsa.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read key %q: %s", path, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("No key found in %q", path)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse key %q: %s", path, err)
+	}
+	return key, nil
+}
+
+func writeECKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal key: %s", err)
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+func writePEM(path, blockType string, der []byte, mode os.FileMode) error {
+	content := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, content, mode); err != nil {
+		return fmt.Errorf("Failed to write %q: %s", path, err)
+	}
+	return nil
+}
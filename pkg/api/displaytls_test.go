@@ -0,0 +1,81 @@
+package api
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnsureDisplayTLS(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-display-tls")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tlsDir := filepath.Join(tmpDir, DisplayTLSDirName)
+
+	x509Dir, err := EnsureDisplayTLS(tlsDir, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to create display TLS: %s", err)
+	}
+	caDir := filepath.Join(tlsDir, displayCADirName)
+	for _, path := range []string{
+		filepath.Join(caDir, DisplayCACertFile),
+		filepath.Join(caDir, displayCAKeyFile),
+		filepath.Join(x509Dir, DisplayCACertFile),
+		filepath.Join(x509Dir, displayServerCertFile),
+		filepath.Join(x509Dir, displayServerKeyFile),
+	} {
+		if !PathExists(path) {
+			t.Fatalf("expected %s to be created", path)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(caDir, displayCAKeyFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected CA key to be private, got %v %v", info.Mode(), err)
+	}
+	// QEMU must not be able to read the CA key
+	if PathExists(filepath.Join(x509Dir, displayCAKeyFile)) || strings.HasPrefix(caDir, x509Dir) {
+		t.Fatalf("CA key is in the x509 dir %s", x509Dir)
+	}
+
+	caCert, err := readCertificate(filepath.Join(x509Dir, DisplayCACertFile))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	serverCert, err := readCertificate(filepath.Join(x509Dir, displayServerCertFile))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	opts := x509.VerifyOptions{Roots: pool, DNSName: "127.0.0.1", KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	if _, err := serverCert.Verify(opts); err != nil {
+		t.Fatalf("server certificate does not verify against the display CA: %s", err)
+	}
+
+	// an existing certificate is reused, a new listen address reissues it
+	if _, err := EnsureDisplayTLS(tlsDir, "127.0.0.1"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	again, _ := readCertificate(filepath.Join(x509Dir, displayServerCertFile))
+	if again.SerialNumber.Cmp(serverCert.SerialNumber) != 0 {
+		t.Fatalf("expected server certificate to be reused")
+	}
+	if _, err := EnsureDisplayTLS(tlsDir, "192.0.2.10"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	reissued, _ := readCertificate(filepath.Join(x509Dir, displayServerCertFile))
+	if reissued.VerifyHostname("192.0.2.10") != nil {
+		t.Fatalf("expected reissued certificate to cover the listen address")
+	}
+	if reissued.CheckSignatureFrom(caCert) != nil {
+		t.Fatalf("expected the CA to be kept")
+	}
+
+	caPEM, err := ReadDisplayCACert(x509Dir)
+	if err != nil || caPEM == "" {
+		t.Fatalf("failed to read CA certificate: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/project-machine/qcli"
+)
+
+// DiskEncryptionLUKS encrypts qcow2 disks with qcow2's built-in LUKS
+// support and raw disks in the LUKS format
+const DiskEncryptionLUKS = "luks"
+
+// Encrypted returns true if the disk image is encrypted
+func (q *QemuDisk) Encrypted() bool {
+	return q.Encryption != ""
+}
+
+// sanitizeEncryption returns a message for each invalid encryption setting
+func (q *QemuDisk) sanitizeEncryption() []string {
+	errors := []string{}
+	if q.Encryption == "" {
+		if q.Secret != "" {
+			errors = append(errors, "secret requires encryption")
+		}
+		return errors
+	}
+	if q.Encryption != DiskEncryptionLUKS {
+		errors = append(errors, fmt.Sprintf("invalid encryption: found %s expected [%s]", q.Encryption, DiskEncryptionLUKS))
+	}
+	if q.Secret == "" {
+		errors = append(errors, "encryption requires a secret")
+	} else if err := ValidSecretName(q.Secret); err != nil {
+		errors = append(errors, err.Error())
+	}
+	// overlays would need the secret of their backing image and would keep
+	// the writes of the guest in the clear
+	if q.Image != "" || q.BackingFile != "" {
+		errors = append(errors, "encrypted disks cannot be overlays of an image or backing-file")
+	}
+	if q.Type == "cdrom" {
+		errors = append(errors, "cdroms cannot be encrypted")
+	}
+	return errors
+}
+
+// setSecretFile records where QEMU and qemu-img read the passphrase of an
+// encrypted disk
+func (q *QemuDisk) setSecretFile(store *SecretStore) error {
+	if !q.Encrypted() {
+		return nil
+	}
+	if !PathExists(store.Path(q.Secret)) {
+		return fmt.Errorf("Secret '%s' of disk '%s' not found, store it with 'machine secret set'", q.Secret, q.Name())
+	}
+	q.secretFile = store.Path(q.Secret)
+	return nil
+}
+
+// resolveDiskSecrets sets the secret file of the encrypted disks from the
+// secret store of the machine context
+func resolveDiskSecrets(ctx context.Context, disks []QemuDisk) error {
+	store := NewSecretStore(ctx.Value(clsCtxSecretDir).(string))
+	for idx := range disks {
+		if err := disks[idx].setSecretFile(store); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDiskSecrets returns an error unless mayUse allows every stored secret
+// of the encrypted disks.  Missing secrets are reported once the disk is used.
+func checkDiskSecrets(store *SecretStore, disks []QemuDisk, mayUse func(Secret) bool) error {
+	for _, disk := range disks {
+		if !disk.Encrypted() {
+			continue
+		}
+		secret, err := store.Get(disk.Secret)
+		if err != nil {
+			continue
+		}
+		if !mayUse(secret) {
+			return fmt.Errorf("Secret '%s' of disk '%s' belongs to another user", disk.Secret, disk.Name())
+		}
+	}
+	return nil
+}
+
+// secretObject returns the QEMU secret object named id holding the
+// passphrase of the disk
+func (q *QemuDisk) secretObject(id string) string {
+	return fmt.Sprintf("secret,id=%s,file=%s,format=raw", id, escapeOptionValue(q.secretFile))
+}
+
+// escapeOptionValue doubles commas, which separate QEMU options
+func escapeOptionValue(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
+}
+
+// encryptOptions returns the image format and the options which encrypt
+// the image with the secret object id.  Raw images are LUKS images.
+func (q *QemuDisk) encryptOptions(format, id string) (string, []string) {
+	if format == "raw" {
+		return "luks", []string{"key-secret=" + id}
+	}
+	return format, []string{"encrypt.format=" + q.Encryption, "encrypt.key-secret=" + id}
+}
+
+// qemuImgSource returns the qemu-img arguments which open the disk image,
+// with the passphrase for encrypted disks
+func (q *QemuDisk) qemuImgSource() []string {
+	if !q.Encrypted() {
+		return []string{"-f", q.Format, q.File}
+	}
+	format, opts := q.encryptOptions(q.Format, "sec0")
+	imageOpts := append([]string{"driver=" + format, "file.filename=" + escapeOptionValue(q.File)}, opts...)
+	return []string{"--object", q.secretObject("sec0"), "--image-opts", strings.Join(imageOpts, ",")}
+}
+
+// qemuImgTarget returns the qemu-img arguments which create an image in
+// format, encrypted like the disk.  The secret object must already be
+// defined by the source arguments.
+func (q *QemuDisk) qemuImgTarget(formatFlag, format string) []string {
+	if !q.Encrypted() {
+		return []string{formatFlag, format}
+	}
+	format, opts := q.encryptOptions(format, "sec0")
+	return []string{formatFlag, format, "-o", strings.Join(opts, ",")}
+}
+
+// addDiskEncryption defines a secret object for each encrypted disk and
+// passes it to its drive
+func addDiskEncryption(params []string, blkDevices []qcli.BlockDevice, runDir string, disks []QemuDisk) ([]string, error) {
+	objects := []string{}
+	for _, disk := range disks {
+		if !disk.Encrypted() {
+			continue
+		}
+		if err := disk.Sanitize(runDir); err != nil {
+			return params, err
+		}
+		for _, blk := range blkDevices {
+			if blk.File != disk.File {
+				continue
+			}
+			id := "secret-" + blk.ID
+			objects = append(objects, "-object", disk.secretObject(id))
+			format, opts := disk.encryptOptions(disk.Format, id)
+			if format != disk.Format {
+				params = setDriveFormat(params, blk.ID, format)
+			}
+			params = addDriveOptions(params, blk.ID, opts)
+		}
+	}
+	if len(objects) == 0 {
+		return params, nil
+	}
+	// secrets must be defined before the drives using them
+	for idx := range params {
+		if params[idx] == "-drive" {
+			return append(append(params[:idx:idx], objects...), params[idx:]...), nil
+		}
+	}
+	return append(params, objects...), nil
+}
+
+// setDriveFormat replaces the format of the -drive with the given id
+func setDriveFormat(params []string, driveID, format string) []string {
+	for idx := 0; idx+1 < len(params); idx++ {
+		if params[idx] != "-drive" {
+			continue
+		}
+		opts := strings.Split(params[idx+1], ",")
+		if !slices.Contains(opts, "id="+driveID) {
+			continue
+		}
+		for i, opt := range opts {
+			if strings.HasPrefix(opt, "format=") {
+				opts[i] = "format=" + format
+			}
+		}
+		params[idx+1] = strings.Join(opts, ",")
+		return params
+	}
+	return params
+}
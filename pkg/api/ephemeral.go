@@ -0,0 +1,105 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Ephemeral machines keep everything they write under their run dir, which
+// lives in MachineDaemonConfig.EphemeralDirectory (tmpfs by default), and
+// are deleted once their VM exits.  Only their logs, recordings and
+// screenshots are kept, in Machine.ArtifactDir.
+
+// ephemeralDisks returns a copy of disks where every writable disk is
+// created in runDir.  Existing disk files become the backing file of a
+// qcow2 overlay so they are never modified.
+func ephemeralDisks(runDir string, disks []QemuDisk) ([]QemuDisk, error) {
+	overlays := make([]QemuDisk, len(disks))
+	copy(overlays, disks)
+	for idx := range overlays {
+		disk := &overlays[idx]
+		if disk.Type == "cdrom" || disk.ReadOnly {
+			continue
+		}
+		if err := disk.Sanitize(runDir); err != nil {
+			return []QemuDisk{}, err
+		}
+		if filepath.Dir(disk.File) == runDir {
+			continue
+		}
+		if disk.Image != "" || disk.BackingFile != "" || !PathExists(disk.File) {
+			disk.File = filepath.Join(runDir, filepath.Base(disk.File))
+			continue
+		}
+		if disk.Encrypted() {
+			return []QemuDisk{}, fmt.Errorf("Encrypted disk '%s' cannot be used by an ephemeral machine, its overlay would not be encrypted", disk.Name())
+		}
+		log.Infof("Ephemeral disk %s is an overlay on %s", disk.Name(), disk.File)
+		disk.BackingFile = disk.File
+		disk.BackingFormat = disk.Format
+		disk.Format = "qcow2"
+		disk.File = filepath.Join(runDir, disk.Name()+".qcow2")
+		// the overlay has the size of the disk it is based on
+		disk.Size = 0
+		if err := disk.Sanitize(runDir); err != nil {
+			return []QemuDisk{}, err
+		}
+	}
+	return overlays, nil
+}
+
+// deleteEphemeral removes an ephemeral machine after vm has exited, unless
+// the machine was deleted or started again in the meantime.
+func (ctl *MachineController) deleteEphemeral(machineName string, vm *VM) {
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+	for idx := range ctl.Machines {
+		machine := ctl.Machines[idx]
+		if machine.Name != machineName || machine.instance != vm {
+			continue
+		}
+		log.Infof("Ephemeral machine %s exited, deleting it", machineName)
+		if vm.SwTPM != nil {
+			if err := vm.SwTPM.Stop(); err != nil {
+				log.Infof("Failed to stop swtpm of machine %s: %s", machineName, err)
+			}
+		}
+		if vm.Console != nil {
+			vm.Console.Close()
+		}
+		if err := ctl.deleteMachine(machineName, true); err != nil {
+			log.Infof("Failed to delete ephemeral machine %s: %s", machineName, err)
+		}
+		return
+	}
+}
+
+// RemoveEphemeralState deletes whatever ephemeral machines left behind when
+// machined last exited.
+func (c *MachineDaemonConfig) RemoveEphemeralState() error {
+	dir := c.GetEphemeralDirectory()
+	if !PathExists(dir) {
+		return nil
+	}
+	log.Infof("Removing ephemeral machine state %q", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("Failed to remove ephemeral machine state %q: %s", dir, err)
+	}
+	return nil
+}
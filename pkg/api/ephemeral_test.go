@@ -0,0 +1,147 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEphemeralStateDir(t *testing.T) {
+	cfg := MachineDaemonConfig{
+		ConfigDirectory:    "/conf",
+		DataDirectory:      "/data",
+		StateDirectory:     "/state",
+		EphemeralDirectory: "/run/ephemeral",
+	}
+	m := Machine{Name: "vm1", ctx: cfg.GetConfigContext()}
+	if m.StateDir() != "/state/machines/vm1" {
+		t.Fatalf("unexpected state dir %q", m.StateDir())
+	}
+	m.Ephemeral = true
+	if m.StateDir() != "/run/ephemeral/machines/vm1" {
+		t.Fatalf("unexpected ephemeral state dir %q", m.StateDir())
+	}
+
+	cfg.EphemeralDirectory = ""
+	m.ctx = cfg.GetConfigContext()
+	if m.StateDir() != "/state/ephemeral/machines/vm1" {
+		t.Fatalf("unexpected default ephemeral state dir %q", m.StateDir())
+	}
+}
+
+func TestEphemeralDisks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-ephemeral")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	runDir := filepath.Join(tmpDir, "run")
+	data := filepath.Join(tmpDir, "data.img")
+	if err := os.WriteFile(data, []byte("raw"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	disks := []QemuDisk{
+		{File: data, Format: "raw", Attach: "virtio"},
+		{File: filepath.Join(tmpDir, "scratch.qcow2"), Size: 1 << 30},
+		{File: "root.qcow2", Size: 1 << 30},
+		{File: filepath.Join(tmpDir, "install.iso"), Type: "cdrom", Format: "raw"},
+	}
+	overlays, err := ephemeralDisks(runDir, disks)
+	if err != nil {
+		t.Fatalf("failed to make ephemeral disks: %s", err)
+	}
+
+	if disks[0].File != data || disks[0].BackingFile != "" {
+		t.Fatalf("ephemeralDisks modified the machine disks: %+v", disks[0])
+	}
+
+	overlay := overlays[0]
+	if overlay.File != filepath.Join(runDir, "data.qcow2") || overlay.Format != "qcow2" ||
+		overlay.BackingFile != data || overlay.BackingFormat != "raw" || overlay.Size != 0 {
+		t.Fatalf("unexpected overlay for existing disk %+v", overlay)
+	}
+	if overlay.Name() != "data" {
+		t.Fatalf("overlay renamed disk data to %q", overlay.Name())
+	}
+	if overlays[1].File != filepath.Join(runDir, "scratch.qcow2") || overlays[1].BackingFile != "" {
+		t.Fatalf("new disk not created in run dir %+v", overlays[1])
+	}
+	if overlays[2].File != filepath.Join(runDir, "root.qcow2") {
+		t.Fatalf("unexpected file for relative disk %+v", overlays[2])
+	}
+	if overlays[3] != disks[3] {
+		t.Fatalf("cdrom should not be changed %+v", overlays[3])
+	}
+}
+
+func TestDeleteEphemeral(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-ephemeral")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := MachineDaemonConfig{
+		ConfigDirectory:    filepath.Join(tmpDir, "conf"),
+		DataDirectory:      filepath.Join(tmpDir, "data"),
+		StateDirectory:     filepath.Join(tmpDir, "state"),
+		EphemeralDirectory: filepath.Join(tmpDir, "ephemeral"),
+	}
+	ctl := MachineController{Machines: []*Machine{{}, {}}}
+	for idx, name := range []string{"keep", "vm1"} {
+		m := ctl.Machines[idx]
+		m.Name = name
+		m.Ephemeral = true
+		m.ctx = cfg.GetConfigContext()
+		m.instance = &VM{State: VMStopped, RunDir: filepath.Join(m.StateDir(), name)}
+		if err := EnsureDir(m.instance.RunDir); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	vm := ctl.Machines[1].instance
+	stateDir := ctl.Machines[1].StateDir()
+	serialLog := LogFile(ctl.Machines[1].LogDir(), LogSourceSerial)
+	if err := EnsureDir(filepath.Dir(serialLog)); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.WriteFile(serialLog, []byte("login:"), 0644); err != nil {
+		t.Fatalf("failed to write log: %s", err)
+	}
+
+	// an exit of a previous instance is ignored
+	ctl.deleteEphemeral("vm1", &VM{})
+	if len(ctl.Machines) != 2 {
+		t.Fatalf("machine deleted on exit of a stale VM")
+	}
+
+	ctl.deleteEphemeral("vm1", vm)
+	if len(ctl.Machines) != 1 || ctl.Machines[0].Name != "keep" {
+		t.Fatalf("expected only machine keep, found %d machines", len(ctl.Machines))
+	}
+	if PathExists(stateDir) {
+		t.Fatalf("state dir %q of ephemeral machine not removed", stateDir)
+	}
+	if !PathExists(serialLog) {
+		t.Fatalf("log %q of ephemeral machine removed with it", serialLog)
+	}
+
+	if err := cfg.RemoveEphemeralState(); err != nil {
+		t.Fatalf("failed to remove ephemeral state: %s", err)
+	}
+	if PathExists(cfg.EphemeralDirectory) {
+		t.Fatalf("ephemeral directory not removed")
+	}
+	if !PathExists(serialLog) {
+		t.Fatalf("log %q removed with the ephemeral directory", serialLog)
+	}
+
+	// the logs go once a machine of the same name is defined again
+	if err := ctl.AddMachine(Machine{Name: "vm1", Ephemeral: true}, &cfg); err != nil {
+		t.Fatalf("failed to add machine: %s", err)
+	}
+	if PathExists(serialLog) {
+		t.Fatalf("log %q of previous machine vm1 not removed", serialLog)
+	}
+}
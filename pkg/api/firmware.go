@@ -0,0 +1,384 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/project-machine/qcli"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	FirmwareUEFI = "uefi"
+	FirmwareBIOS = "bios"
+
+	// FirmwareSecureBoot is the descriptor feature of secure boot firmware
+	FirmwareSecureBoot = "secure-boot"
+
+	// the UEFI code is copied to the run dir on each start
+	uefiCodeFileName = "uefi-code.fd"
+)
+
+var (
+	// QEMU firmware descriptors, the first directory has the highest
+	// priority and a file masks the file of the same name in later
+	// directories
+	firmwareDescriptorDirs = []string{"/etc/qemu/firmware", "/usr/share/qemu/firmware"}
+
+	// descriptors with these features need extra host and QEMU setup and
+	// are only picked when requested
+	firmwareOptInFeatures = []string{"amd-sev", "amd-sev-es", "amd-sev-snp", "intel-tdx"}
+)
+
+// FirmwareDef selects the firmware of the machine.  Type is uefi (default)
+// or bios, which boots with QEMU's SeaBIOS.  Code and Vars replace the
+// system UEFI code and variable template, Code is the BIOS image for bios.
+// Without Code, uefi firmware is picked from the QEMU firmware descriptors
+// providing all of Features, e.g. secure-boot or requires-smm.  Kernel,
+// Initrd and Cmdline boot a kernel directly instead of from a disk.
+type FirmwareDef struct {
+	Type     string   `yaml:"type,omitempty"`
+	Code     string   `yaml:"code,omitempty"`
+	Vars     string   `yaml:"vars,omitempty"`
+	Features []string `yaml:"features,omitempty"`
+	Kernel   string   `yaml:"kernel,omitempty"`
+	Initrd   string   `yaml:"initrd,omitempty"`
+	Cmdline  string   `yaml:"cmdline,omitempty"`
+}
+
+func (f *FirmwareDef) Sanitize() error {
+	switch f.Type {
+	case "":
+		f.Type = FirmwareUEFI
+	case FirmwareUEFI:
+	case FirmwareBIOS:
+		if qemuArch() != "x86_64" {
+			return fmt.Errorf("Firmware type %s is only supported on x86_64", FirmwareBIOS)
+		}
+		if f.Vars != "" {
+			return fmt.Errorf("Firmware vars are only supported for %s", FirmwareUEFI)
+		}
+		if len(f.Features) != 0 {
+			return fmt.Errorf("Firmware features are only supported for %s", FirmwareUEFI)
+		}
+	default:
+		return fmt.Errorf("Invalid firmware type '%s', must be one of %s or %s", f.Type, FirmwareUEFI, FirmwareBIOS)
+	}
+	for _, feature := range f.Features {
+		if feature == "" || strings.ContainsAny(feature, " ,") {
+			return fmt.Errorf("Invalid firmware feature '%s'", feature)
+		}
+	}
+	if f.Kernel == "" && (f.Initrd != "" || f.Cmdline != "") {
+		return fmt.Errorf("Firmware initrd and cmdline require a kernel")
+	}
+	return nil
+}
+
+// firmware returns the firmware of the VM, including the uefi-code,
+// uefi-vars and secure-boot settings which predate the firmware section
+func (v VMDef) firmware() (FirmwareDef, error) {
+	f := v.Firmware
+	f.Features = slices.Clone(f.Features)
+	if err := f.Sanitize(); err != nil {
+		return f, err
+	}
+	if v.SecureBoot && f.Type != FirmwareUEFI {
+		return f, fmt.Errorf("secure-boot requires firmware type %s", FirmwareUEFI)
+	}
+	if f.Type != FirmwareUEFI {
+		if v.UEFICode != "" || v.UEFIVars != "" {
+			return f, fmt.Errorf("uefi-code and uefi-vars require firmware type %s", FirmwareUEFI)
+		}
+		return f, nil
+	}
+	if f.Code == "" {
+		f.Code = v.UEFICode
+	}
+	if f.Vars == "" {
+		f.Vars = v.UEFIVars
+	}
+	return f, nil
+}
+
+// checkFirmwareAccess checks the firmware files named by the VM with access,
+// the guest sees their content
+func (v VMDef) checkFirmwareAccess(access PathAccessFunc) error {
+	for _, path := range []string{v.Firmware.Code, v.Firmware.Vars, v.Firmware.Kernel, v.Firmware.Initrd, v.UEFICode, v.UEFIVars} {
+		if path == "" {
+			continue
+		}
+		if err := access(path, unix.R_OK); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// qemuArch returns the QEMU name of the host architecture
+func qemuArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	}
+	return runtime.GOARCH
+}
+
+type firmwareFile struct {
+	Filename string `json:"filename"`
+	Format   string `json:"format"`
+}
+
+type firmwareTarget struct {
+	Architecture string   `json:"architecture"`
+	Machines     []string `json:"machines"`
+}
+
+// firmwareDescriptor is the part of a QEMU firmware descriptor (see
+// docs/interop/firmware.json in QEMU) used to pick firmware
+type firmwareDescriptor struct {
+	Description    string   `json:"description"`
+	InterfaceTypes []string `json:"interface-types"`
+	Mapping        struct {
+		Device        string       `json:"device"`
+		Mode          string       `json:"mode"`
+		Executable    firmwareFile `json:"executable"`
+		NVRAMTemplate firmwareFile `json:"nvram-template"`
+	} `json:"mapping"`
+	Targets  []firmwareTarget `json:"targets"`
+	Features []string         `json:"features"`
+
+	// the descriptor file
+	path string
+}
+
+// loadFirmwareDescriptors returns the firmware descriptors in dirs ordered
+// by file name, which is their priority
+func loadFirmwareDescriptors(dirs []string) []firmwareDescriptor {
+	files := map[string]string{}
+	for _, dir := range dirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		for _, match := range matches {
+			if _, ok := files[filepath.Base(match)]; !ok {
+				files[filepath.Base(match)] = match
+			}
+		}
+	}
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	descriptors := []firmwareDescriptor{}
+	for _, name := range names {
+		content, err := os.ReadFile(files[name])
+		if err != nil {
+			log.Warnf("Failed to read firmware descriptor %q: %s", files[name], err)
+			continue
+		}
+		// an empty file masks a descriptor
+		if len(strings.TrimSpace(string(content))) == 0 {
+			continue
+		}
+		var desc firmwareDescriptor
+		if err := json.Unmarshal(content, &desc); err != nil {
+			log.Warnf("Failed to parse firmware descriptor %q: %s", files[name], err)
+			continue
+		}
+		desc.path = files[name]
+		descriptors = append(descriptors, desc)
+	}
+	return descriptors
+}
+
+// matches returns true if the descriptor is flash firmware of the interface
+// for the machine which provides all of features
+func (d firmwareDescriptor) matches(iface, arch, machine string, smm bool, features []string) bool {
+	if !slices.Contains(d.InterfaceTypes, iface) {
+		return false
+	}
+	// qcli maps the code read-only and a copy of the vars as raw pflash
+	if d.Mapping.Device != "flash" || (d.Mapping.Mode != "" && d.Mapping.Mode != "split") {
+		return false
+	}
+	for _, file := range []firmwareFile{d.Mapping.Executable, d.Mapping.NVRAMTemplate} {
+		if file.Filename == "" || (file.Format != "" && file.Format != "raw") {
+			return false
+		}
+	}
+	// q35 and virt are aliases of the latest pc-q35-* and virt-* machines
+	names := []string{machine, "pc-" + machine + "-latest", machine + "-latest"}
+	target := false
+	for _, t := range d.Targets {
+		if t.Architecture != arch {
+			continue
+		}
+		for _, pattern := range t.Machines {
+			for _, name := range names {
+				if ok, _ := filepath.Match(pattern, name); ok {
+					target = true
+				}
+			}
+		}
+	}
+	if !target {
+		return false
+	}
+	if !smm && slices.Contains(d.Features, "requires-smm") {
+		return false
+	}
+	for _, feature := range features {
+		if !slices.Contains(d.Features, feature) {
+			return false
+		}
+	}
+	for _, feature := range firmwareOptInFeatures {
+		if slices.Contains(d.Features, feature) && !slices.Contains(features, feature) {
+			return false
+		}
+	}
+	return true
+}
+
+// findUEFIFirmware returns the code and vars template of the highest
+// priority uefi firmware descriptor matching the machine and features
+func findUEFIFirmware(c *qcli.Config, features []string) (qcli.UEFIFirmwareDevice, error) {
+	arch := qemuArch()
+	for _, desc := range loadFirmwareDescriptors(firmwareDescriptorDirs) {
+		if !desc.matches(FirmwareUEFI, arch, c.Machine.Type, c.Machine.SMM == "on", features) {
+			continue
+		}
+		dev := qcli.UEFIFirmwareDevice{
+			Code: desc.Mapping.Executable.Filename,
+			Vars: desc.Mapping.NVRAMTemplate.Filename,
+		}
+		if found, _ := dev.Exists(); !found {
+			log.Warnf("Firmware descriptor %q refers to missing files", desc.path)
+			continue
+		}
+		log.Infof("Using firmware descriptor %q: %s", desc.path, desc.Description)
+		return dev, nil
+	}
+	return qcli.UEFIFirmwareDevice{}, fmt.Errorf("No %s firmware for %s %s with features %v found in %v", FirmwareUEFI, arch, c.Machine.Type, features, firmwareDescriptorDirs)
+}
+
+// systemUEFIFirmware returns the system UEFI code and vars template,
+// firmware descriptors are searched when qcli does not find them
+func systemUEFIFirmware(c *qcli.Config, features []string, secureBoot bool) (qcli.UEFIFirmwareDevice, error) {
+	if len(features) != 0 {
+		return findUEFIFirmware(c, features)
+	}
+	dev, err := qcli.NewSystemUEFIFirmwareDevice(secureBoot)
+	if err == nil {
+		return *dev, nil
+	}
+	if secureBoot {
+		features = []string{FirmwareSecureBoot}
+	}
+	found, descErr := findUEFIFirmware(c, features)
+	if descErr != nil {
+		return qcli.UEFIFirmwareDevice{}, fmt.Errorf("%s, %s", err, descErr)
+	}
+	return found, nil
+}
+
+// configureUEFI imports the code and, unless already imported, the vars of
+// the firmware into runDir
+func configureUEFI(c *qcli.Config, f FirmwareDef, runDir string, secureBoot bool) error {
+	uefiDev := qcli.UEFIFirmwareDevice{Code: f.Code, Vars: f.Vars}
+	if uefiDev.Code == "" || uefiDev.Vars == "" {
+		system, err := systemUEFIFirmware(c, f.Features, secureBoot)
+		if err != nil {
+			return fmt.Errorf("failed to create a UEFI Firmware Device: %s", err)
+		}
+		if uefiDev.Code == "" {
+			uefiDev.Code = system.Code
+		}
+		if uefiDev.Vars == "" {
+			uefiDev.Vars = system.Vars
+		}
+	}
+
+	src := uefiDev.Code
+	dest := filepath.Join(runDir, uefiCodeFileName)
+	log.Infof("Importing UEFI Code from '%s' to '%q'", src, dest)
+	if err := CopyFileBits(src, dest); err != nil {
+		return fmt.Errorf("Failed to import UEFI Code from '%s' to '%q': %s", src, dest, err)
+	}
+	uefiDev.Code = dest
+
+	src = uefiDev.Vars
+	dest = filepath.Join(runDir, qcli.UEFIVarsFileName)
+	log.Infof("Importing UEFI Vars from '%s' to '%q'", src, dest)
+	if !PathExists(dest) {
+		if err := CopyFileBits(src, dest); err != nil {
+			return fmt.Errorf("Failed to import UEFI Vars from '%s' to '%q': %s", src, dest, err)
+		}
+	} else {
+		log.Infof("Already imported UEFI Vars file %q to %q.  Not overwriting.", src, dest)
+	}
+	uefiDev.Vars = dest
+
+	c.UEFIFirmwareDevices = []qcli.UEFIFirmwareDevice{uefiDev}
+	return nil
+}
+
+// ConfigureFirmware configures the firmware and direct kernel boot of the VM
+func ConfigureFirmware(c *qcli.Config, v VMDef, runDir string) error {
+	f, err := v.firmware()
+	if err != nil {
+		return err
+	}
+	switch f.Type {
+	case FirmwareUEFI:
+		if err := configureUEFI(c, f, runDir, v.SecureBoot); err != nil {
+			return err
+		}
+	case FirmwareBIOS:
+		// QEMU boots its SeaBIOS without -bios
+		if f.Code != "" {
+			if !PathExists(f.Code) {
+				return fmt.Errorf("Firmware code %q does not exist", f.Code)
+			}
+			c.Bios = f.Code
+		}
+	}
+
+	if f.Kernel == "" {
+		return nil
+	}
+	for _, file := range []string{f.Kernel, f.Initrd} {
+		if file != "" && !PathExists(file) {
+			return fmt.Errorf("Firmware kernel or initrd %q does not exist", file)
+		}
+	}
+	c.Kernel = qcli.Kernel{
+		Path:       f.Kernel,
+		InitrdPath: f.Initrd,
+		Params:     f.Cmdline,
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/project-machine/qcli"
+)
+
+func TestFirmwareSanitize(t *testing.T) {
+	f := FirmwareDef{}
+	if err := f.Sanitize(); err != nil {
+		t.Fatalf("unexpected error sanitizing empty firmware: %s", err)
+	}
+	if f.Type != FirmwareUEFI {
+		t.Fatalf("expected uefi by default, got %+v", f)
+	}
+
+	bad := []FirmwareDef{
+		{Type: "coreboot"},
+		{Type: FirmwareBIOS, Vars: "/vars.fd"},
+		{Type: FirmwareBIOS, Features: []string{FirmwareSecureBoot}},
+		{Features: []string{"secure boot"}},
+		{Initrd: "/boot/initrd.img"},
+		{Cmdline: "console=ttyS0"},
+	}
+	for _, f := range bad {
+		if err := f.Sanitize(); err == nil {
+			t.Fatalf("expected error sanitizing %+v", f)
+		}
+	}
+
+	v := VMDef{UEFICode: "/code.fd", UEFIVars: "/vars.fd", Firmware: FirmwareDef{Vars: "/other-vars.fd"}}
+	f, err := v.firmware()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.Code != "/code.fd" || f.Vars != "/other-vars.fd" {
+		t.Fatalf("expected uefi-code and firmware vars, got %+v", f)
+	}
+
+	if qemuArch() != "x86_64" {
+		return
+	}
+	for _, v := range []VMDef{
+		{SecureBoot: true, Firmware: FirmwareDef{Type: FirmwareBIOS}},
+		{UEFIVars: "/vars.fd", Firmware: FirmwareDef{Type: FirmwareBIOS}},
+	} {
+		if _, err := v.firmware(); err == nil {
+			t.Fatalf("expected error for %+v", v)
+		}
+	}
+}
+
+func writeFirmwareDescriptor(t *testing.T, dir, name, format string, machines, features []string) (string, string) {
+	code := filepath.Join(dir, name+"-code.fd")
+	vars := filepath.Join(dir, name+"-vars.fd")
+	for _, file := range []string{code, vars} {
+		if err := os.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	desc := fmt.Sprintf(`{
+    "description": "%s",
+    "interface-types": ["uefi"],
+    "mapping": {
+        "device": "flash",
+        "executable": {"filename": "%s", "format": "%s"},
+        "nvram-template": {"filename": "%s", "format": "%s"}
+    },
+    "targets": [{"architecture": "%s", "machines": ["%s"]}],
+    "features": ["%s"]
+}`, name, code, format, vars, format, qemuArch(), strings.Join(machines, `", "`), strings.Join(features, `", "`))
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), []byte(desc), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return code, vars
+}
+
+func TestFindUEFIFirmware(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-firmware")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	etcDir := filepath.Join(tmpDir, "etc")
+	shareDir := filepath.Join(tmpDir, "share")
+	for _, dir := range []string{etcDir, shareDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	saved := firmwareDescriptorDirs
+	defer func() { firmwareDescriptorDirs = saved }()
+	firmwareDescriptorDirs = []string{etcDir, shareDir}
+
+	q35 := []string{"pc-q35-*", "virt-*"}
+	sevCode, _ := writeFirmwareDescriptor(t, shareDir, "10-sev", "raw", q35, []string{"amd-sev"})
+	writeFirmwareDescriptor(t, shareDir, "20-i440fx", "raw", []string{"pc-i440fx-*"}, []string{FirmwareSecureBoot})
+	writeFirmwareDescriptor(t, shareDir, "30-qcow2", "qcow2", q35, []string{FirmwareSecureBoot})
+	secCode, secVars := writeFirmwareDescriptor(t, shareDir, "40-secboot", "raw", q35, []string{FirmwareSecureBoot, "requires-smm"})
+	plainCode, _ := writeFirmwareDescriptor(t, shareDir, "50-plain", "raw", q35, []string{"verbose-static"})
+
+	c := &qcli.Config{Machine: qcli.Machine{Type: qcli.MachineTypePC35, SMM: "on"}}
+	if qemuArch() == "aarch64" {
+		c.Machine = qcli.Machine{Type: qcli.MachineTypeVirt}
+	}
+	dev, err := findUEFIFirmware(c, []string{FirmwareSecureBoot})
+	if qemuArch() == "x86_64" {
+		if err != nil || dev.Code != secCode || dev.Vars != secVars {
+			t.Fatalf("expected secure boot firmware, got %+v: %v", dev, err)
+		}
+	}
+	if dev, err := findUEFIFirmware(c, []string{"amd-sev"}); err != nil || dev.Code != sevCode {
+		t.Fatalf("expected sev firmware, got %+v: %v", dev, err)
+	}
+	if _, err := findUEFIFirmware(c, []string{"enrolled-keys"}); err == nil {
+		t.Fatalf("expected error for missing feature")
+	}
+
+	// requires-smm firmware is skipped without SMM
+	c.Machine.SMM = "off"
+	if dev, err := findUEFIFirmware(c, nil); err != nil || dev.Code != plainCode {
+		t.Fatalf("expected plain firmware, got %+v: %v", dev, err)
+	}
+
+	// an empty file in a higher priority directory masks a descriptor
+	if err := os.WriteFile(filepath.Join(etcDir, "50-plain.json"), []byte{}, 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := findUEFIFirmware(c, nil); err == nil {
+		t.Fatalf("expected masked descriptor to be skipped")
+	}
+}
+
+func TestConfigureFirmware(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-firmware")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, name := range []string{"code.fd", "vars.fd", "vmlinuz", "initrd.img"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	runDir := filepath.Join(tmpDir, "run")
+	if err := os.Mkdir(runDir, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	v := VMDef{Firmware: FirmwareDef{
+		Code:    filepath.Join(tmpDir, "code.fd"),
+		Vars:    filepath.Join(tmpDir, "vars.fd"),
+		Kernel:  filepath.Join(tmpDir, "vmlinuz"),
+		Initrd:  filepath.Join(tmpDir, "initrd.img"),
+		Cmdline: "console=ttyS0 root=/dev/vda1",
+	}}
+	c := &qcli.Config{Name: "x", Path: "/bin/true"}
+	if err := ConfigureFirmware(c, v, runDir); err != nil {
+		t.Fatalf("failed to configure firmware: %s", err)
+	}
+	varsFile := filepath.Join(runDir, qcli.UEFIVarsFileName)
+	if len(c.UEFIFirmwareDevices) != 1 || c.UEFIFirmwareDevices[0].Vars != varsFile || !PathExists(filepath.Join(runDir, uefiCodeFileName)) {
+		t.Fatalf("unexpected uefi firmware %+v", c.UEFIFirmwareDevices)
+	}
+	params, err := qcli.ConfigureParams(c, nil)
+	if err != nil {
+		t.Fatalf("failed to configure params: %s", err)
+	}
+	expected := fmt.Sprintf("-kernel %s/vmlinuz -initrd %s/initrd.img -append console=ttyS0 root=/dev/vda1", tmpDir, tmpDir)
+	if !strings.Contains(strings.Join(params, " "), expected) {
+		t.Fatalf("expected %q in params %v", expected, params)
+	}
+
+	// the vars of the machine are kept
+	if err := os.WriteFile(varsFile, []byte("modified"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ConfigureFirmware(&qcli.Config{}, v, runDir); err != nil {
+		t.Fatalf("failed to configure firmware: %s", err)
+	}
+	if content, _ := os.ReadFile(varsFile); string(content) != "modified" {
+		t.Fatalf("uefi vars were overwritten")
+	}
+
+	v.Firmware.Kernel = filepath.Join(tmpDir, "missing")
+	if err := ConfigureFirmware(&qcli.Config{}, v, runDir); err == nil {
+		t.Fatalf("expected error for missing kernel")
+	}
+
+	if qemuArch() != "x86_64" {
+		return
+	}
+	c = &qcli.Config{}
+	v = VMDef{Firmware: FirmwareDef{Type: FirmwareBIOS}}
+	if err := ConfigureFirmware(c, v, runDir); err != nil || c.Bios != "" || len(c.UEFIFirmwareDevices) != 0 {
+		t.Fatalf("expected QEMU's SeaBIOS, got bios %q uefi %+v: %v", c.Bios, c.UEFIFirmwareDevices, err)
+	}
+	v.Firmware.Code = filepath.Join(tmpDir, "code.fd")
+	if err := ConfigureFirmware(c, v, runDir); err != nil || c.Bios != v.Firmware.Code {
+		t.Fatalf("expected custom bios, got %q: %v", c.Bios, err)
+	}
+}
+
+func TestFirmwareAccess(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("firmware access checks need files owned by another user")
+	}
+	tmpDir, err := os.MkdirTemp("", "test-firmware")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	public := filepath.Join(tmpDir, "vmlinuz")
+	private := filepath.Join(tmpDir, "private")
+	if err := os.WriteFile(public, []byte("kernel"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.WriteFile(private, []byte("secret"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyOwner}
+	access := cfg.PathAccess(Caller{UID: 54321, GID: 54321})
+	if err := (VMDef{Firmware: FirmwareDef{Kernel: public}}).checkFirmwareAccess(access); err != nil {
+		t.Fatalf("unexpected error for a readable kernel: %s", err)
+	}
+	for _, v := range []VMDef{
+		{Firmware: FirmwareDef{Code: private}},
+		{Firmware: FirmwareDef{Vars: private}},
+		{Firmware: FirmwareDef{Kernel: public, Initrd: private}},
+		{UEFICode: private},
+		{UEFIVars: private},
+	} {
+		if err := v.checkFirmwareAccess(access); err == nil {
+			t.Fatalf("expected error for firmware %+v", v)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	hotplugPrefix = "hp-"
+	// QEMU limits node names to 31 characters
+	qemuIDMaxLen = 31
+	// PCIe unplug needs the guest to release the device
+	hotUnplugTimeout = time.Second * 30
+)
+
+// hotpluggedDisk records the QEMU objects backing a disk added at runtime
+type hotpluggedDisk struct {
+	Node   string
+	Device string
+	Port   string
+	// the secret object of an encrypted disk
+	Secret string
+}
+
+// HotpluggableAttach returns true if disks on the attach bus can be added
+// to a running VM
+func HotpluggableAttach(attach string) bool {
+	return attach == "virtio" || attach == "nvme" || attach == "scsi"
+}
+
+// qemuID returns a valid QEMU id or node name for the disk name
+func qemuID(prefix, name string) string {
+	id := []byte(prefix)
+	for _, c := range []byte(name) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' {
+			id = append(id, c)
+		} else {
+			id = append(id, '_')
+		}
+	}
+	if len(id) > qemuIDMaxLen {
+		id = id[:qemuIDMaxLen]
+	}
+	return string(id)
+}
+
+// blockdevAddArgs returns the blockdev-add arguments for disk, matching the
+// options QBlockDevice uses for disks defined at start
+func blockdevAddArgs(disk QemuDisk, node, secret string) map[string]interface{} {
+	args := map[string]interface{}{
+		"driver":        disk.Format,
+		"node-name":     node,
+		"read-only":     disk.ReadOnly,
+		"discard":       disk.Discard,
+		"detect-zeroes": disk.DetectZeroes,
+		"cache":         map[string]bool{"direct": disk.cacheDirect(), "no-flush": disk.Cache == "unsafe"},
+		"file": map[string]interface{}{
+			"driver":   "file",
+			"filename": disk.File,
+			"aio":      disk.AIO,
+		},
+	}
+	if disk.Encrypted() {
+		if disk.Format == "raw" {
+			args["driver"] = "luks"
+			args["key-secret"] = secret
+		} else {
+			args["encrypt"] = map[string]string{"format": disk.Encryption, "key-secret": secret}
+		}
+	}
+	return args
+}
+
+// deviceAddArgs returns the device_add arguments which attach node to the
+// guest on bus
+func deviceAddArgs(disk QemuDisk, node, device, bus string) (map[string]interface{}, error) {
+	args := map[string]interface{}{
+		"id":                  device,
+		"drive":               node,
+		"bus":                 bus,
+		"serial":              disk.serial(),
+		"logical_block_size":  512,
+		"physical_block_size": 512,
+	}
+	if !disk.writeCache() {
+		args["write-cache"] = "off"
+	}
+	switch disk.Attach {
+	case "virtio":
+		args["driver"] = "virtio-blk-pci"
+		args["config-wce"] = false
+	case "nvme":
+		args["driver"] = "nvme"
+	case "scsi":
+		args["driver"] = "scsi-hd"
+		if disk.Type == "ssd" {
+			args["rotation_rate"] = 1
+		}
+	default:
+		return nil, fmt.Errorf("Disks attached with '%s' cannot be hotplugged, use one of virtio, nvme or scsi", disk.Attach)
+	}
+	return args, nil
+}
+
+// hotpluggedDisk returns the QEMU objects of a disk hotplugged by name
+func (v *VM) hotpluggedDisk(name string) (hotpluggedDisk, bool) {
+	v.hotplugLock.Lock()
+	defer v.hotplugLock.Unlock()
+	hp, ok := v.hotplugged[name]
+	return hp, ok
+}
+
+// freeRootPort returns a PCIe root port without a hotplugged device
+func (v *VM) freeRootPort() (string, error) {
+	v.hotplugLock.Lock()
+	defer v.hotplugLock.Unlock()
+	used := map[string]bool{}
+	for _, hp := range v.hotplugged {
+		used[hp.Port] = true
+	}
+	for _, port := range v.qcli.PCIeRootPortDevices {
+		if !used[port.ID] {
+			return port.ID, nil
+		}
+	}
+	return "", fmt.Errorf("VM:%s has no free PCIe root port for hotplug", v.Name())
+}
+
+// HotplugDisk adds an existing disk image to the running VM
+func (v *VM) HotplugDisk(disk QemuDisk) error {
+	name := disk.Name()
+	return v.WithQMP(func(q *QMPConn) error {
+		if _, ok := v.hotpluggedDisk(name); ok {
+			return fmt.Errorf("VM:%s already has a disk named '%s'", v.Name(), name)
+		}
+		hp := hotpluggedDisk{
+			Node:   qemuID(hotplugPrefix, name),
+			Device: qemuID(hotplugPrefix+"dev-", name),
+		}
+		bus := ""
+		switch disk.Attach {
+		case "virtio", "nvme":
+			port, err := v.freeRootPort()
+			if err != nil {
+				return err
+			}
+			hp.Port = port
+			bus = port
+		case "scsi":
+			if len(v.qcli.SCSIControllerDevices) == 0 {
+				return fmt.Errorf("VM:%s has no scsi controller, attach the disk with virtio or nvme", v.Name())
+			}
+			bus = v.qcli.SCSIControllerDevices[0].ID + ".0"
+			if disk.Controller != "" {
+				bus = disk.Controller + ".0"
+			}
+		}
+		deviceArgs, err := deviceAddArgs(disk, hp.Node, hp.Device, bus)
+		if err != nil {
+			return err
+		}
+		if disk.Attach == "scsi" && disk.Unit != nil {
+			deviceArgs["scsi-id"] = *disk.Unit
+			deviceArgs["lun"] = disk.LUN
+		}
+
+		log.Infof("VM:%s hotplugging disk %s on %s", v.Name(), disk.File, bus)
+		if disk.Encrypted() {
+			hp.Secret = qemuID(hotplugPrefix+"secret-", name)
+			secretArgs := map[string]string{"qom-type": "secret", "id": hp.Secret, "file": disk.secretFile, "format": "raw"}
+			if err := q.Execute("object-add", secretArgs, nil); err != nil {
+				return fmt.Errorf("Failed to add secret for %s: %s", disk.File, err)
+			}
+		}
+		delSecret := func() {
+			if hp.Secret == "" {
+				return
+			}
+			if err := q.Execute("object-del", map[string]string{"id": hp.Secret}, nil); err != nil {
+				log.Warnf("VM:%s failed to remove secret %s: %s", v.Name(), hp.Secret, err)
+			}
+		}
+		if err := q.Execute("blockdev-add", blockdevAddArgs(disk, hp.Node, hp.Secret), nil); err != nil {
+			delSecret()
+			return fmt.Errorf("Failed to add block device for %s: %s", disk.File, err)
+		}
+		if err := q.Execute("device_add", deviceArgs, nil); err != nil {
+			if delErr := q.Execute("blockdev-del", map[string]string{"node-name": hp.Node}, nil); delErr != nil {
+				log.Warnf("VM:%s failed to remove block device %s: %s", v.Name(), hp.Node, delErr)
+			}
+			delSecret()
+			return fmt.Errorf("Failed to add disk device for %s: %s", disk.File, err)
+		}
+		v.hotplugLock.Lock()
+		if v.hotplugged == nil {
+			v.hotplugged = map[string]hotpluggedDisk{}
+		}
+		v.hotplugged[name] = hp
+		v.hotplugLock.Unlock()
+		if disk.Throttle != nil && !disk.Throttle.IsZero() {
+			args := disk.Throttle.qmpArgs()
+			args["id"] = hp.Device
+			if err := q.Execute("block_set_io_throttle", args, nil); err != nil {
+				log.Warnf("VM:%s failed to set I/O throttle of disk %s: %s", v.Name(), disk.File, err)
+			}
+		}
+		return nil
+	})
+}
+
+// HotUnplugDisk removes a disk which was hotplugged into the running VM
+func (v *VM) HotUnplugDisk(name string) error {
+	return v.WithQMP(func(q *QMPConn) error {
+		hp, ok := v.hotpluggedDisk(name)
+		if !ok {
+			return fmt.Errorf("Disk '%s' was attached when VM:%s started, stop the machine to detach it", name, v.Name())
+		}
+		log.Infof("VM:%s unplugging disk %s", v.Name(), name)
+		if err := q.Execute("device_del", map[string]string{"id": hp.Device}, nil); err != nil {
+			return fmt.Errorf("Failed to remove disk device %s: %s", hp.Device, err)
+		}
+		deleted := func(data json.RawMessage) bool {
+			var event struct {
+				Device string `json:"device"`
+			}
+			return json.Unmarshal(data, &event) == nil && event.Device == hp.Device
+		}
+		if _, err := q.WaitEvent("DEVICE_DELETED", deleted, hotUnplugTimeout); err != nil {
+			return fmt.Errorf("Guest did not release disk '%s': %s", name, err)
+		}
+		if err := q.Execute("blockdev-del", map[string]string{"node-name": hp.Node}, nil); err != nil {
+			return fmt.Errorf("Failed to remove block device %s: %s", hp.Node, err)
+		}
+		if hp.Secret != "" {
+			if err := q.Execute("object-del", map[string]string{"id": hp.Secret}, nil); err != nil {
+				log.Warnf("VM:%s failed to remove secret %s: %s", v.Name(), hp.Secret, err)
+			}
+		}
+		v.hotplugLock.Lock()
+		delete(v.hotplugged, name)
+		v.hotplugLock.Unlock()
+		return nil
+	})
+}
+
+func (ctl *MachineController) AttachMachineDisk(machineName string, disk QemuDisk, access PathAccessFunc) (QemuDisk, error) {
+	machine := ctl.findMachine(machineName)
+	if machine == nil {
+		return disk, fmt.Errorf("Failed to find machine '%s', cannot attach disk to unknown machine", machineName)
+	}
+	return machine.AttachDisk(disk, access)
+}
+
+func (ctl *MachineController) DetachMachineDisk(machineName, diskName string) error {
+	machine := ctl.findMachine(machineName)
+	if machine == nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot detach disk from unknown machine", machineName)
+	}
+	return machine.DetachDisk(diskName)
+}
+
+// findDisk returns the index of the named disk in the machine definition
+func (m *Machine) findDisk(name string) int {
+	for idx := range m.Config.Disks {
+		if m.Config.Disks[idx].Name() == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+// AttachDisk creates or imports disk and adds it to the machine definition,
+// hotplugging it if the machine is running.  The host files of the disk
+// are checked with access.
+func (m *Machine) AttachDisk(disk QemuDisk, access PathAccessFunc) (QemuDisk, error) {
+	m.disksLock.Lock()
+	defer m.disksLock.Unlock()
+	runDir := filepath.Join(m.StateDir(), m.Config.Name)
+	if err := disk.Sanitize(runDir); err != nil {
+		return disk, err
+	}
+	if err := m.checkDiskAccess(disk, access); err != nil {
+		return disk, err
+	}
+	if disk.Type == "cdrom" {
+		return disk, fmt.Errorf("Cannot attach a cdrom as a disk")
+	}
+	if idx := m.findDisk(disk.Name()); idx >= 0 {
+		return disk, fmt.Errorf("Machine '%s' already has a disk named '%s'", m.Name, disk.Name())
+	}
+	if err := m.placeDisk(&disk); err != nil {
+		return disk, err
+	}
+	if err := disk.setSecretFile(m.SecretStore()); err != nil {
+		return disk, err
+	}
+	running := m.IsRunning()
+	if running && disk.Controller != "" && disk.Attach != "scsi" {
+		return disk, fmt.Errorf("Disks on controller '%s' cannot be hotplugged, only virtio-scsi controllers support hotplug", disk.Controller)
+	}
+	if running && !HotpluggableAttach(disk.Attach) {
+		return disk, fmt.Errorf("Disks attached with '%s' cannot be hotplugged, use one of virtio, nvme or scsi", disk.Attach)
+	}
+	if err := EnsureDir(runDir); err != nil {
+		return disk, fmt.Errorf("Error creating VM run dir '%s': %s", runDir, err)
+	}
+	if disk.Image != "" {
+		if err := disk.CreateFromImage(m.ImageStore()); err != nil {
+			return disk, err
+		}
+	}
+	if err := disk.ImportDiskImage(runDir); err != nil {
+		return disk, err
+	}
+	if running {
+		if err := m.instance.HotplugDisk(disk); err != nil {
+			return disk, err
+		}
+	}
+
+	m.setDisks(append(slices.Clone(m.Config.Disks), disk))
+	if err := m.saveDisks(); err != nil {
+		return disk, err
+	}
+	log.Infof("Attached disk '%s' to machine '%s'", disk.Name(), m.Name)
+	return disk, nil
+}
+
+// checkDiskAccess checks the host files of a sanitized disk with access,
+// including every file named in the qcow2 headers of its images.  Files in
+// the run dir of the machine are managed by machined.
+func (m *Machine) checkDiskAccess(disk QemuDisk, access PathAccessFunc) error {
+	runDir := filepath.Join(m.StateDir(), m.Config.Name)
+	inRunDir := func(path string) bool {
+		return strings.HasPrefix(filepath.Clean(path), runDir+"/")
+	}
+	if disk.File != "" && !inRunDir(disk.File) {
+		if PathExists(disk.File) {
+			// existing files are copied into the run dir, unless they are
+			// sized or overlays, which are used in place
+			mode := uint32(unix.R_OK)
+			if (disk.Size > 0 || disk.BackingFile != "") && !disk.ReadOnly {
+				mode |= unix.W_OK
+			}
+			if err := access(disk.File, mode); err != nil {
+				return err
+			}
+			if err := checkImageFilesAccess(disk.File, access); err != nil {
+				return err
+			}
+		} else if err := access(filepath.Dir(disk.File), unix.W_OK|unix.X_OK); err != nil {
+			// machined creates the file
+			return err
+		}
+	}
+	if disk.BackingFile != "" && !inRunDir(disk.BackingFile) {
+		if err := access(disk.BackingFile, unix.R_OK); err != nil {
+			return err
+		}
+		if err := checkImageFilesAccess(disk.BackingFile, access); err != nil {
+			return err
+		}
+	}
+	return checkOCILayoutAccess(disk.Image, access)
+}
+
+// checkImageFilesAccess checks that the backing chain and data files the
+// image at path names may be read, QEMU opens them with the rights of
+// machined
+func checkImageFilesAccess(path string, access PathAccessFunc) error {
+	files, err := imageFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files[1:] {
+		if err := access(file, unix.R_OK); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckHostAccess checks the host files of the disks, cdroms, shares and
+// firmware of the machine definition with access before it is created or
+// updated.  9p shares are served by QEMU with the privileges of machined, so
+// they need serve9P as well.
+func (m *Machine) CheckHostAccess(access PathAccessFunc, serve9P bool) error {
+	shares := slices.Clone(m.Config.Shares)
+	if err := sanitizeShares(shares); err != nil {
+		return err
+	}
+	if err := checkShareAccess(shares, access, serve9P); err != nil {
+		return err
+	}
+	if err := m.Config.checkFirmwareAccess(access); err != nil {
+		return err
+	}
+	cdroms, err := m.Config.cdromDisks()
+	if err != nil {
+		return err
+	}
+	runDir := filepath.Join(m.StateDir(), m.Config.Name)
+	for _, disk := range append(slices.Clone(m.Config.Disks), cdroms...) {
+		if err := disk.Sanitize(runDir); err != nil {
+			return err
+		}
+		if err := m.checkDiskAccess(disk, access); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// placeDisk checks that disk has a free address on the storage controllers
+// of the machine and sets its attach bus from its controller
+func (m *Machine) placeDisk(disk *QemuDisk) error {
+	cdroms, err := m.Config.cdromDisks()
+	if err != nil {
+		return err
+	}
+	disks := append(slices.Clone(m.Config.Disks), cdroms...)
+	for idx := range disks {
+		if err := disks[idx].Sanitize(filepath.Join(m.StateDir(), m.Config.Name)); err != nil {
+			return err
+		}
+	}
+	disks = append(disks, *disk)
+	storage, err := newStorageTopology(m.Config.Controllers)
+	if err != nil {
+		return err
+	}
+	if _, err := storage.placeAll(disks); err != nil {
+		return err
+	}
+	disk.Attach = disks[len(disks)-1].Attach
+	return nil
+}
+
+// DetachDisk removes the named disk from the machine definition, unplugging
+// it if the machine is running.  The disk image is kept.
+func (m *Machine) DetachDisk(name string) error {
+	m.disksLock.Lock()
+	defer m.disksLock.Unlock()
+	idx := m.findDisk(name)
+	if idx < 0 {
+		return fmt.Errorf("Machine '%s' has no disk named '%s'", m.Name, name)
+	}
+	if m.IsRunning() {
+		if err := m.instance.HotUnplugDisk(name); err != nil {
+			return err
+		}
+	}
+	m.setDisks(slices.Delete(slices.Clone(m.Config.Disks), idx, idx+1))
+	if err := m.saveDisks(); err != nil {
+		return err
+	}
+	log.Infof("Detached disk '%s' from machine '%s'", name, m.Name)
+	return nil
+}
+
+// disks returns the disk list of the machine for readers which do not hold
+// disksLock
+func (m *Machine) disks() []QemuDisk {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+	return m.Config.Disks
+}
+
+// setDisks replaces the disk list of the machine.  The list is never changed
+// in place since copies of the machine share it.  Callers hold disksLock.
+func (m *Machine) setDisks(disks []QemuDisk) {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+	m.Config.Disks = disks
+}
+
+// updateDisk replaces the disk at idx with a copy changed by update
+func (m *Machine) updateDisk(idx int, update func(disk *QemuDisk)) {
+	disks := slices.Clone(m.Config.Disks)
+	update(&disks[idx])
+	m.setDisks(disks)
+}
+
+func (m *Machine) saveDisks() error {
+	if m.Ephemeral {
+		return nil
+	}
+	if err := m.SaveConfig(); err != nil {
+		return fmt.Errorf("Could not save '%s' machine to %q: %s", m.Name, m.ConfigFile(), err)
+	}
+	return nil
+}
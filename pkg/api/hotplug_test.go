@@ -0,0 +1,161 @@
+package api
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/project-machine/qcli"
+)
+
+func TestQemuID(t *testing.T) {
+	if id := qemuID(hotplugPrefix, "data disk"); id != "hp-data_disk" {
+		t.Fatalf("unexpected id %q", id)
+	}
+	if id := qemuID(hotplugPrefix, "a-very-long-disk-name-which-does-not-fit"); len(id) != qemuIDMaxLen {
+		t.Fatalf("expected id truncated to %d, got %q", qemuIDMaxLen, id)
+	}
+}
+
+func TestDeviceAddArgs(t *testing.T) {
+	disk := QemuDisk{File: "/images/data.qcow2", Attach: "scsi", Type: "ssd"}
+	args, err := deviceAddArgs(disk, "hp-data", "hp-dev-data", "scsi0.0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if args["driver"] != "scsi-hd" || args["bus"] != "scsi0.0" || args["rotation_rate"] != 1 || args["serial"] != "data" {
+		t.Fatalf("unexpected scsi device args %v", args)
+	}
+	disk.Attach = "ide"
+	if _, err := deviceAddArgs(disk, "hp-data", "hp-dev-data", "ide.0"); err == nil {
+		t.Fatalf("expected ide hotplug to fail")
+	}
+}
+
+func TestHotplugDisk(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-hotplug")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	handler := func(cmd fakeQMPCommand) (interface{}, *QMPError, []QMPEvent) {
+		if cmd.Execute == "device_del" {
+			data, _ := json.Marshal(map[string]interface{}{"device": cmd.Arguments["id"]})
+			return nil, nil, []QMPEvent{{Event: "DEVICE_DELETED", Data: data}}
+		}
+		return nil, nil, nil
+	}
+	vm, fake := newFakeQMPVM(t, tmpDir, handler)
+	defer fake.Close()
+	vm.qcli.PCIeRootPortDevices = []qcli.PCIeRootPortDevice{{ID: "root-port.0x4.0"}}
+
+	disk := QemuDisk{File: "/images/data.qcow2", Format: "qcow2", Attach: "virtio", Type: "ssd"}
+	if err := vm.HotplugDisk(disk); err != nil {
+		t.Fatalf("failed to hotplug disk: %s", err)
+	}
+	other := QemuDisk{File: "/images/other.qcow2", Format: "qcow2", Attach: "nvme", Type: "ssd"}
+	if err := vm.HotplugDisk(other); err == nil {
+		t.Fatalf("expected hotplug to fail without a free root port")
+	}
+
+	cmds := fake.Commands()
+	if len(cmds) != 2 || cmds[0].Execute != "blockdev-add" || cmds[1].Execute != "device_add" {
+		t.Fatalf("unexpected commands %+v", cmds)
+	}
+	if cmds[1].Arguments["bus"] != "root-port.0x4.0" || cmds[1].Arguments["drive"] != cmds[0].Arguments["node-name"] {
+		t.Fatalf("device not attached to block node on root port: %+v", cmds)
+	}
+
+	if err := vm.HotUnplugDisk("unknown"); err == nil {
+		t.Fatalf("expected error unplugging a disk which was not hotplugged")
+	}
+	if err := vm.HotUnplugDisk("data"); err != nil {
+		t.Fatalf("failed to unplug disk: %s", err)
+	}
+	cmds = fake.Commands()
+	if cmds[len(cmds)-1].Execute != "blockdev-del" {
+		t.Fatalf("expected block node to be deleted, got %+v", cmds)
+	}
+	if err := vm.HotplugDisk(other); err != nil {
+		t.Fatalf("expected root port to be free after unplug: %s", err)
+	}
+}
+
+func TestAttachDiskStopped(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-attach-disk")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := MachineDaemonConfig{
+		ConfigDirectory: filepath.Join(tmpDir, "config"),
+		DataDirectory:   filepath.Join(tmpDir, "data"),
+		StateDirectory:  filepath.Join(tmpDir, "state"),
+	}
+	ctl := MachineController{}
+	if err := ctl.AddMachine(Machine{Name: "vm1", Config: VMDef{Name: "vm1"}}, &cfg); err != nil {
+		t.Fatalf("failed to add machine: %s", err)
+	}
+	src := filepath.Join(tmpDir, "data.qcow2")
+	if err := os.WriteFile(src, []byte("image"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// the caller must be able to read the file themselves
+	user := cfg.PathAccess(Caller{UID: 54321, GID: 54321})
+	if _, err := ctl.AttachMachineDisk("vm1", QemuDisk{File: src}, user); err == nil {
+		t.Fatalf("expected error attaching a file the caller cannot read")
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	// including files named in the qcow2 header, which QEMU opens
+	private := filepath.Join(tmpDir, "private")
+	if err := os.WriteFile(private, []byte("secret"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	backed := filepath.Join(tmpDir, "backed.qcow2")
+	writeQcow2Header(t, backed, private)
+	if _, err := ctl.AttachMachineDisk("vm1", QemuDisk{File: backed}, user); err == nil {
+		t.Fatalf("expected error attaching an image backed by a file the caller cannot read")
+	}
+	disk, err := ctl.AttachMachineDisk("vm1", QemuDisk{File: src}, user)
+	if err != nil {
+		t.Fatalf("failed to attach disk: %s", err)
+	}
+	if !PathExists(disk.File) || disk.File == src {
+		t.Fatalf("expected disk to be imported into the machine dir, got %s", disk.File)
+	}
+	if _, err := ctl.AttachMachineDisk("vm1", QemuDisk{File: src}, user); err == nil {
+		t.Fatalf("expected error attaching a disk with the same name")
+	}
+
+	saved, err := LoadConfig(ctl.Machines[0].ConfigFile())
+	if err != nil {
+		t.Fatalf("failed to load saved config: %s", err)
+	}
+	if len(saved.Config.Disks) != 1 || saved.Config.Disks[0].Name() != "data" {
+		t.Fatalf("expected attached disk to be saved, got %+v", saved.Config.Disks)
+	}
+
+	before, err := ctl.GetMachine("vm1")
+	if err != nil {
+		t.Fatalf("failed to get machine: %s", err)
+	}
+	if err := ctl.DetachMachineDisk("vm1", "data"); err != nil {
+		t.Fatalf("failed to detach disk: %s", err)
+	}
+	if len(ctl.Machines[0].Config.Disks) != 0 || !PathExists(disk.File) {
+		t.Fatalf("expected disk removed from the definition and its image kept")
+	}
+	// the disk list is replaced, not changed under earlier copies
+	if len(before.Config.Disks) != 1 || before.Config.Disks[0].Name() != "data" {
+		t.Fatalf("expected the copy of the machine to keep its disks, got %+v", before.Config.Disks)
+	}
+	if err := ctl.DetachMachineDisk("vm1", "data"); err == nil {
+		t.Fatalf("expected error detaching an unknown disk")
+	}
+}
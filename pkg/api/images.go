@@ -0,0 +1,606 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// machined keeps base images in DataDirectory/images, stored by the sha256
+// of their content and referenced by any number of names
+const (
+	ImagesDirName   = "images"
+	imageIndexName  = "index.json"
+	imageBlobsDir   = "blobs"
+	ImageDigestAlgo = "sha256"
+
+	// shortest digest prefix accepted as an image reference
+	imageMinPrefixLen = 6
+	imageShortIDLen   = 12
+
+	// qcow2 incompatible feature bit and header extension of external data
+	// files
+	qcow2ExternalDataFile  = 1 << 2
+	qcow2DataFileExtension = 0x44415441
+	qcow2MaxExtensions     = 64
+)
+
+var (
+	imageNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]*$`)
+	qcow2Magic      = []byte("QFI\xfb")
+
+	// the index is rewritten by each change
+	imageStoreLock sync.Mutex
+)
+
+type Image struct {
+	Digest   string    `json:"digest"`
+	Names    []string  `json:"names"`
+	Format   string    `json:"format"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	Source   string    `json:"source"`
+	OwnerUID int       `json:"owner-uid"`
+}
+
+// ShortID returns the abbreviated digest shown by image list
+func (i Image) ShortID() string {
+	hexDigest := strings.TrimPrefix(i.Digest, ImageDigestAlgo+":")
+	if len(hexDigest) > imageShortIDLen {
+		return hexDigest[:imageShortIDLen]
+	}
+	return hexDigest
+}
+
+type ImageStore struct {
+	Dir string
+}
+
+func NewImageStore(dir string) *ImageStore {
+	return &ImageStore{Dir: dir}
+}
+
+// BlobPath returns the path of the image file with digest
+func (s *ImageStore) BlobPath(digest string) string {
+	algo, hexDigest, _ := strings.Cut(digest, ":")
+	return filepath.Join(s.Dir, imageBlobsDir, algo, hexDigest)
+}
+
+// ValidImageName returns an error if name cannot be used for an image
+func ValidImageName(name string) error {
+	if !imageNameRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid image name '%s', names start with a letter or digit followed by letters, digits, '.', '_', ':' or '-'", name)
+	}
+	if strings.HasPrefix(name, ImageDigestAlgo+":") {
+		return fmt.Errorf("Invalid image name '%s', names may not look like a digest", name)
+	}
+	return nil
+}
+
+func (s *ImageStore) load() ([]Image, error) {
+	content, err := os.ReadFile(filepath.Join(s.Dir, imageIndexName))
+	if os.IsNotExist(err) {
+		return []Image{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read image index: %s", err)
+	}
+	images := []Image{}
+	if err := json.Unmarshal(content, &images); err != nil {
+		return nil, fmt.Errorf("Failed to parse image index: %s", err)
+	}
+	return images, nil
+}
+
+func (s *ImageStore) save(images []Image) error {
+	content, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal image index: %s", err)
+	}
+	indexFile := filepath.Join(s.Dir, imageIndexName)
+	tmpFile := indexFile + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0644); err != nil {
+		return fmt.Errorf("Failed to write image index: %s", err)
+	}
+	if err := os.Rename(tmpFile, indexFile); err != nil {
+		return fmt.Errorf("Failed to replace image index: %s", err)
+	}
+	return nil
+}
+
+// findImage returns the index of the image matching ref, which is a name,
+// a digest or a unique prefix of a digest
+func findImage(images []Image, ref string) (int, error) {
+	for idx, image := range images {
+		for _, name := range image.Names {
+			if name == ref {
+				return idx, nil
+			}
+		}
+	}
+	hexRef := strings.TrimPrefix(ref, ImageDigestAlgo+":")
+	if len(hexRef) < imageMinPrefixLen {
+		return -1, fmt.Errorf("Image '%s' not found", ref)
+	}
+	found := -1
+	for idx, image := range images {
+		if strings.HasPrefix(strings.TrimPrefix(image.Digest, ImageDigestAlgo+":"), hexRef) {
+			if found >= 0 {
+				return -1, fmt.Errorf("Image reference '%s' is ambiguous", ref)
+			}
+			found = idx
+		}
+	}
+	if found < 0 {
+		return -1, fmt.Errorf("Image '%s' not found", ref)
+	}
+	return found, nil
+}
+
+// List returns the stored images, newest first
+func (s *ImageStore) List() ([]Image, error) {
+	imageStoreLock.Lock()
+	defer imageStoreLock.Unlock()
+	images, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(images, func(i, j int) bool { return images[i].Created.After(images[j].Created) })
+	return images, nil
+}
+
+func (s *ImageStore) Get(ref string) (Image, error) {
+	imageStoreLock.Lock()
+	defer imageStoreLock.Unlock()
+	images, err := s.load()
+	if err != nil {
+		return Image{}, err
+	}
+	idx, err := findImage(images, ref)
+	if err != nil {
+		return Image{}, err
+	}
+	return images[idx], nil
+}
+
+// Import adds the image file src to the store under names.  Content which
+// is already stored is not copied again, names are moved from any image
+// which had them before.
+func (s *ImageStore) Import(src string, names []string, ownerUID int) (Image, error) {
+	for _, name := range names {
+		if err := ValidImageName(name); err != nil {
+			return Image{}, err
+		}
+	}
+	log.Infof("Copying image %s", src)
+	tmpFile, digest, size, err := copyImage(src, filepath.Join(s.Dir, "tmp"))
+	if err != nil {
+		return Image{}, err
+	}
+	defer os.Remove(tmpFile)
+	format, err := DetectImageFormat(tmpFile)
+	if err != nil {
+		return Image{}, err
+	}
+	if err := checkStandaloneImage(tmpFile); err != nil {
+		return Image{}, err
+	}
+	return s.add(tmpFile, Image{
+		Digest:   digest,
+		Names:    names,
+		Format:   format,
+		Size:     size,
+		Source:   src,
+		OwnerUID: ownerUID,
+	})
+}
+
+// add moves the temporary file src to image.Digest unless the content is
+// already stored and records image in the index
+func (s *ImageStore) add(src string, image Image) (Image, error) {
+	imageStoreLock.Lock()
+	defer imageStoreLock.Unlock()
+	images, err := s.load()
+	if err != nil {
+		return Image{}, err
+	}
+
+	blobPath := s.BlobPath(image.Digest)
+	if !PathExists(blobPath) {
+		if err := EnsureDir(filepath.Dir(blobPath)); err != nil {
+			return Image{}, fmt.Errorf("Failed to create image dir: %s", err)
+		}
+		log.Infof("Storing image %s as %s", image.Source, image.Digest)
+		// overlays depend on the base never changing
+		if err := os.Chmod(src, 0444); err != nil {
+			return Image{}, fmt.Errorf("Failed to make image read-only: %s", err)
+		}
+		if err := os.Rename(src, blobPath); err != nil {
+			return Image{}, fmt.Errorf("Failed to store image: %s", err)
+		}
+	}
+
+	// names refer to a single image
+	for idx := range images {
+		images[idx].Names = removeNames(images[idx].Names, image.Names)
+	}
+	found := -1
+	for idx := range images {
+		if images[idx].Digest == image.Digest {
+			found = idx
+		}
+	}
+	if found < 0 {
+		entry := image
+		entry.Names = []string{}
+		entry.Created = time.Now().UTC()
+		images = append(images, entry)
+		found = len(images) - 1
+	}
+	images[found].Names = append(images[found].Names, image.Names...)
+	if err := s.save(images); err != nil {
+		return Image{}, err
+	}
+	return images[found], nil
+}
+
+// Remove deletes the image ref.  If ref is one of several names of the
+// image only that name is removed.  inUse is called before the image
+// itself is deleted and may veto it.
+func (s *ImageStore) Remove(ref string, inUse func(Image) error) (Image, error) {
+	imageStoreLock.Lock()
+	defer imageStoreLock.Unlock()
+	images, err := s.load()
+	if err != nil {
+		return Image{}, err
+	}
+	idx, err := findImage(images, ref)
+	if err != nil {
+		return Image{}, err
+	}
+	image := images[idx]
+	remaining := removeNames(image.Names, []string{ref})
+	if len(remaining) > 0 && len(remaining) < len(image.Names) {
+		images[idx].Names = remaining
+		log.Infof("Removed name %s from image %s", ref, image.Digest)
+		return images[idx], s.save(images)
+	}
+	if inUse != nil {
+		if err := inUse(image); err != nil {
+			return image, err
+		}
+	}
+	if err := os.Remove(s.BlobPath(image.Digest)); err != nil && !os.IsNotExist(err) {
+		return image, fmt.Errorf("Failed to remove image %s: %s", image.Digest, err)
+	}
+	images = append(images[:idx], images[idx+1:]...)
+	log.Infof("Removed image %s", image.Digest)
+	return image, s.save(images)
+}
+
+func removeNames(names, remove []string) []string {
+	kept := []string{}
+	for _, name := range names {
+		keep := true
+		for _, r := range remove {
+			if name == r {
+				keep = false
+			}
+		}
+		if keep {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// hashFile returns the digest and size of the file at path
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to open image %q: %s", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to read image %q: %s", path, err)
+	}
+	return ImageDigestAlgo + ":" + hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// copyImage copies the image file src to a new temporary file in dir and
+// returns its path with the digest and size of the copied content, which
+// stay right even if src changes during the copy.  Zero blocks are skipped
+// so the copy is sparse.
+func copyImage(src, dir string) (string, string, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("Failed to open image %q: %s", src, err)
+	}
+	defer in.Close()
+	if err := EnsureDir(dir); err != nil {
+		return "", "", 0, fmt.Errorf("Failed to create image dir: %s", err)
+	}
+	out, err := os.CreateTemp(dir, "import-*")
+	if err != nil {
+		return "", "", 0, fmt.Errorf("Failed to create image copy: %s", err)
+	}
+	tmpFile := out.Name()
+	fail := func(err error) (string, string, int64, error) {
+		out.Close()
+		os.Remove(tmpFile)
+		return "", "", 0, fmt.Errorf("Failed to copy image %q: %s", src, err)
+	}
+
+	h := sha256.New()
+	buf := make([]byte, 1<<20)
+	zero := make([]byte, len(buf))
+	var size int64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			if bytes.Equal(buf[:n], zero[:n]) {
+				_, werr := out.Seek(int64(n), io.SeekCurrent)
+				if werr != nil {
+					return fail(werr)
+				}
+			} else if _, werr := out.Write(buf[:n]); werr != nil {
+				return fail(werr)
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := out.Truncate(size); err != nil {
+		return fail(err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpFile)
+		return "", "", 0, fmt.Errorf("Failed to copy image %q: %s", src, err)
+	}
+	return tmpFile, ImageDigestAlgo + ":" + hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// checkStandaloneImage returns an error if the image at path refers to
+// other host files, which QEMU would open for every overlay on it
+func checkStandaloneImage(path string) error {
+	files, err := imageFiles(path)
+	if err != nil {
+		return err
+	}
+	if len(files) > 1 {
+		return fmt.Errorf("Image %q refers to %q, images with a backing or data file cannot be stored", path, files[1])
+	}
+	return nil
+}
+
+// DetectImageFormat returns qcow2 or raw
+func DetectImageFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open image %q: %s", path, err)
+	}
+	defer f.Close()
+	magic := make([]byte, len(qcow2Magic))
+	if _, err := io.ReadFull(f, magic); err == nil && bytes.Equal(magic, qcow2Magic) {
+		return "qcow2", nil
+	}
+	return "raw", nil
+}
+
+// qcow2BackingFile returns the backing file recorded in a qcow2 header,
+// empty if the image has none
+func qcow2BackingFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// magic, version, backing_file_offset, backing_file_size
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "", fmt.Errorf("Failed to read qcow2 header of %q: %s", path, err)
+	}
+	if !bytes.Equal(header[:4], qcow2Magic) {
+		return "", fmt.Errorf("%q is not a qcow2 image", path)
+	}
+	offset := binary.BigEndian.Uint64(header[8:16])
+	size := binary.BigEndian.Uint32(header[16:20])
+	if offset == 0 || size == 0 {
+		return "", nil
+	}
+	name := make([]byte, size)
+	if _, err := f.ReadAt(name, int64(offset)); err != nil {
+		return "", fmt.Errorf("Failed to read backing file of %q: %s", path, err)
+	}
+	return string(name), nil
+}
+
+// qcow2DataFile returns the external data file recorded in a qcow2 header
+// extension, empty if the image has none
+func qcow2DataFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// version 3 headers end with incompatible_features ... header_length
+	header := make([]byte, 104)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return "", fmt.Errorf("Failed to read qcow2 header of %q: %s", path, err)
+	}
+	if !bytes.Equal(header[:4], qcow2Magic) {
+		return "", fmt.Errorf("%q is not a qcow2 image", path)
+	}
+	if binary.BigEndian.Uint32(header[4:8]) < 3 || binary.BigEndian.Uint64(header[72:80])&qcow2ExternalDataFile == 0 {
+		return "", nil
+	}
+	offset := int64(binary.BigEndian.Uint32(header[100:104]))
+	for idx := 0; idx < qcow2MaxExtensions; idx++ {
+		ext := make([]byte, 8)
+		if _, err := f.ReadAt(ext, offset); err != nil {
+			return "", fmt.Errorf("Failed to read qcow2 header extensions of %q: %s", path, err)
+		}
+		extType := binary.BigEndian.Uint32(ext[:4])
+		extLen := binary.BigEndian.Uint32(ext[4:8])
+		if extType == 0 {
+			break
+		}
+		if extType == qcow2DataFileExtension {
+			name := make([]byte, extLen)
+			if _, err := f.ReadAt(name, offset+8); err != nil {
+				return "", fmt.Errorf("Failed to read data file of %q: %s", path, err)
+			}
+			return string(name), nil
+		}
+		// extension data is padded to 8 bytes
+		offset += 8 + int64((extLen+7)&^7)
+	}
+	// QEMU cannot open the image without being told the data file
+	return "", nil
+}
+
+// ImageImportRequest is the body of POST /images, Source is a path on the
+// machined host
+type ImageImportRequest struct {
+	Source string   `json:"source"`
+	Names  []string `json:"names"`
+}
+
+// CreateFromImage creates the disk File as a qcow2 overlay on its stored
+// image, pulling OCI references into the store first.  cdroms link to the
+// image itself.  An existing File is kept.
+func (q *QemuDisk) CreateFromImage(store *ImageStore) error {
+	if PathExists(q.File) {
+		log.Infof("Skipping creation of existing disk: %s", q.File)
+		return nil
+	}
+	var image Image
+	var err error
+	if IsOCIReference(q.Image) {
+		// images pulled for a disk belong to machined
+		image, err = store.Pull(q.Image, nil, os.Getuid())
+	} else {
+		image, err = store.Get(q.Image)
+	}
+	if err != nil {
+		return err
+	}
+	if q.Type == "cdrom" {
+		log.Infof("Linking cdrom %s to image %s (%s)", q.File, q.Image, image.Digest)
+		if err := ForceLink(store.BlobPath(image.Digest), q.File); err != nil {
+			return fmt.Errorf("Failed to link cdrom %s to image %s: %s", q.File, q.Image, err)
+		}
+		return nil
+	}
+	log.Infof("Creating %s as an overlay on image %s (%s)", q.File, q.Image, image.Digest)
+	return createOverlay(q.File, store.BlobPath(image.Digest), image.Format, int64(q.Size))
+}
+
+// imageFileName returns the default file name of a disk created from image
+func imageFileName(image string, diskType string) string {
+	name := image
+	if IsOCIReference(image) {
+		if ref, err := ParseOCIReference(image); err == nil {
+			name = ref.Name()
+		}
+	}
+	name = strings.NewReplacer(":", "-", "/", "-", "@", "-").Replace(name)
+	if diskType == "cdrom" {
+		return name + ".iso"
+	}
+	return name + ".qcow2"
+}
+
+// prepareImageDisks creates the overlays of image disks before the VM
+// starts
+func prepareImageDisks(ctx context.Context, runDir string, disks []QemuDisk) error {
+	for idx := range disks {
+		disk := &disks[idx]
+		if disk.Image == "" {
+			continue
+		}
+		if err := disk.Sanitize(runDir); err != nil {
+			return err
+		}
+		if err := disk.CreateFromImage(NewImageStore(ctx.Value(clsCtxImageDir).(string))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImageInUse returns an error if a disk of any machine refers to image,
+// either by name or as the backing file of its overlay
+func (ctl *MachineController) ImageInUse(store *ImageStore, image Image) error {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+	blobPath := store.BlobPath(image.Digest)
+	for idx := range ctl.Machines {
+		machine := ctl.Machines[idx]
+		runDir := filepath.Join(machine.StateDir(), machine.Config.Name)
+		disks := slices.Clone(machine.disks())
+		if cdroms, err := machine.Config.cdromDisks(); err == nil {
+			disks = append(disks, cdroms...)
+		}
+		for _, disk := range disks {
+			// sanitizing turns image references in File into Image
+			sanitizeErr := disk.Sanitize(runDir)
+			if disk.Image != "" && (disk.Image == image.Digest || slices.Contains(image.Names, disk.Image)) {
+				return fmt.Errorf("Image %s is used by disk '%s' of machine '%s'", image.ShortID(), disk.Image, machine.Name)
+			}
+			if sanitizeErr != nil {
+				continue
+			}
+			// cdroms are links to raw images
+			if target, err := os.Readlink(disk.File); err == nil && target == blobPath {
+				return fmt.Errorf("Image %s is linked to cdrom '%s' of machine '%s'", image.ShortID(), disk.Name(), machine.Name)
+			}
+			if !PathExists(disk.File) {
+				continue
+			}
+			if format, err := DetectImageFormat(disk.File); err != nil || format != "qcow2" {
+				continue
+			}
+			if backing, err := qcow2BackingFile(disk.File); err == nil && backing == blobPath {
+				return fmt.Errorf("Image %s is the backing file of disk '%s' of machine '%s'", image.ShortID(), disk.Name(), machine.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// qcow2Header returns just enough of a qcow2 header to record backing and
+// an external dataFile
+func qcow2Header(backing, dataFile string) []byte {
+	header := make([]byte, 512)
+	copy(header, qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:8], 3)
+	if backing != "" {
+		binary.BigEndian.PutUint64(header[8:16], 384)
+		binary.BigEndian.PutUint32(header[16:20], uint32(len(backing)))
+		copy(header[384:], backing)
+	}
+	binary.BigEndian.PutUint32(header[100:104], 112)
+	if dataFile != "" {
+		binary.BigEndian.PutUint64(header[72:80], qcow2ExternalDataFile)
+		binary.BigEndian.PutUint32(header[112:116], qcow2DataFileExtension)
+		binary.BigEndian.PutUint32(header[116:120], uint32(len(dataFile)))
+		copy(header[120:], dataFile)
+	}
+	return header
+}
+
+// writeQcow2Header writes just enough of a qcow2 header to record backing
+func writeQcow2Header(t *testing.T, path, backing string) {
+	if err := os.WriteFile(path, qcow2Header(backing, ""), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestImageStoreImport(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-images")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	store := NewImageStore(filepath.Join(tmpDir, "images"))
+
+	src := filepath.Join(tmpDir, "ubuntu.img")
+	if err := os.WriteFile(src, []byte("raw image"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	image, err := store.Import(src, []string{"ubuntu-22.04"}, 1000)
+	if err != nil {
+		t.Fatalf("failed to import image: %s", err)
+	}
+	if !strings.HasPrefix(image.Digest, "sha256:") || image.Format != "raw" || image.Size != 9 || image.OwnerUID != 1000 {
+		t.Fatalf("unexpected image %+v", image)
+	}
+	if !PathExists(store.BlobPath(image.Digest)) {
+		t.Fatalf("expected blob %s", store.BlobPath(image.Digest))
+	}
+
+	// the same content is stored once and gains the new name
+	copied := filepath.Join(tmpDir, "copy.img")
+	if err := os.WriteFile(copied, []byte("raw image"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	again, err := store.Import(copied, []string{"ubuntu"}, 1000)
+	if err != nil {
+		t.Fatalf("failed to import image again: %s", err)
+	}
+	if again.Digest != image.Digest || len(again.Names) != 2 {
+		t.Fatalf("expected names to be added to the stored image, got %+v", again)
+	}
+
+	// names move to the newest image
+	other := filepath.Join(tmpDir, "other.qcow2")
+	writeQcow2Header(t, other, "")
+	moved, err := store.Import(other, []string{"ubuntu"}, 1000)
+	if err != nil {
+		t.Fatalf("failed to import image: %s", err)
+	}
+	if moved.Format != "qcow2" {
+		t.Fatalf("expected qcow2 format, got %s", moved.Format)
+	}
+	images, err := store.List()
+	if err != nil {
+		t.Fatalf("failed to list images: %s", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+	if found, _ := store.Get("ubuntu"); found.Digest != moved.Digest {
+		t.Fatalf("expected name to move to %s, got %s", moved.Digest, found.Digest)
+	}
+
+	for _, ref := range []string{"ubuntu-22.04", image.Digest, image.ShortID(), image.ShortID()[:6]} {
+		if found, err := store.Get(ref); err != nil || found.Digest != image.Digest {
+			t.Fatalf("failed to resolve %s: %s", ref, err)
+		}
+	}
+	if _, err := store.Get(image.ShortID()[:4]); err == nil {
+		t.Fatalf("expected short digest prefix to be rejected")
+	}
+	if _, err := store.Import(src, []string{"bad/name"}, 1000); err == nil {
+		t.Fatalf("expected invalid name to be rejected")
+	}
+
+	// images naming other host files would expose them to every overlay
+	for idx, header := range [][]byte{qcow2Header(src, ""), qcow2Header("", src)} {
+		refers := filepath.Join(tmpDir, fmt.Sprintf("refers%d.qcow2", idx))
+		if err := os.WriteFile(refers, header, 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if _, err := store.Import(refers, []string{"refers"}, 1000); err == nil {
+			t.Fatalf("expected image %s referring to %s to be rejected", refers, src)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(store.Dir, "tmp")); len(entries) != 0 {
+		t.Fatalf("import left temporary files %v", entries)
+	}
+}
+
+func TestImageStoreRemove(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-images")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := MachineDaemonConfig{
+		ConfigDirectory: filepath.Join(tmpDir, "config"),
+		DataDirectory:   filepath.Join(tmpDir, "data"),
+		StateDirectory:  filepath.Join(tmpDir, "state"),
+	}
+	store := NewImageStore(filepath.Join(cfg.DataDirectory, ImagesDirName))
+	src := filepath.Join(tmpDir, "base.img")
+	if err := os.WriteFile(src, []byte("raw image"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	image, err := store.Import(src, []string{"base", "base:latest"}, 1000)
+	if err != nil {
+		t.Fatalf("failed to import image: %s", err)
+	}
+
+	ctl := MachineController{}
+	if err := ctl.AddMachine(Machine{Name: "vm1", Config: VMDef{Name: "vm1"}}, &cfg); err != nil {
+		t.Fatalf("failed to add machine: %s", err)
+	}
+	runDir := filepath.Join(ctl.Machines[0].StateDir(), "vm1")
+	if err := EnsureDir(runDir); err != nil {
+		t.Fatalf("%s", err)
+	}
+	overlay := filepath.Join(runDir, "root.qcow2")
+	writeQcow2Header(t, overlay, store.BlobPath(image.Digest))
+	ctl.Machines[0].Config.Disks = []QemuDisk{{File: "root.qcow2"}}
+	inUse := func(image Image) error { return ctl.ImageInUse(store, image) }
+
+	// with other names left only the name is removed
+	if _, err := store.Remove("base:latest", inUse); err != nil {
+		t.Fatalf("failed to remove image name: %s", err)
+	}
+	if _, err := store.Remove("base", inUse); err == nil {
+		t.Fatalf("expected removing an image backing a disk to fail")
+	}
+
+	ctl.Machines[0].Config.Disks = []QemuDisk{{Image: "base"}}
+	if _, err := store.Remove(image.ShortID(), inUse); err == nil {
+		t.Fatalf("expected removing an image referenced by a disk to fail")
+	}
+
+	// cdroms are raw links to the image
+	ctl.Machines[0].Config.Disks = nil
+	cdrom := filepath.Join(runDir, "base.iso")
+	if err := os.Symlink(store.BlobPath(image.Digest), cdrom); err != nil {
+		t.Fatalf("%s", err)
+	}
+	ctl.Machines[0].Config.Cdroms = []string{cdrom}
+	if _, err := store.Remove("base", inUse); err == nil {
+		t.Fatalf("expected removing an image linked to a cdrom to fail")
+	}
+
+	ctl.Machines[0].Config.Cdroms = nil
+	if _, err := store.Remove("base", inUse); err != nil {
+		t.Fatalf("failed to remove image: %s", err)
+	}
+	if PathExists(store.BlobPath(image.Digest)) {
+		t.Fatalf("expected blob to be removed")
+	}
+	if images, _ := store.List(); len(images) != 0 {
+		t.Fatalf("expected no images, got %+v", images)
+	}
+}
+
+func TestQcow2BackingFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-qcow2")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	overlay := filepath.Join(tmpDir, "overlay.qcow2")
+	writeQcow2Header(t, overlay, "/images/blobs/sha256/abc")
+	backing, err := qcow2BackingFile(overlay)
+	if err != nil || backing != "/images/blobs/sha256/abc" {
+		t.Fatalf("expected backing file, got %q: %v", backing, err)
+	}
+
+	base := filepath.Join(tmpDir, "base.qcow2")
+	writeQcow2Header(t, base, "")
+	if backing, err := qcow2BackingFile(base); err != nil || backing != "" {
+		t.Fatalf("expected no backing file, got %q: %v", backing, err)
+	}
+
+	// the whole chain and data files count, relative names are relative
+	// to the image naming them
+	data := filepath.Join(tmpDir, "base.raw")
+	if err := os.WriteFile(data, []byte("data"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.WriteFile(base, qcow2Header("", "base.raw"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if dataFile, err := qcow2DataFile(base); err != nil || dataFile != "base.raw" {
+		t.Fatalf("expected data file, got %q: %v", dataFile, err)
+	}
+	top := filepath.Join(tmpDir, "top.qcow2")
+	writeQcow2Header(t, top, "base.qcow2")
+	files, err := imageFiles(top)
+	if err != nil || strings.Join(files, " ") != strings.Join([]string{top, base, data}, " ") {
+		t.Fatalf("unexpected image files %v: %v", files, err)
+	}
+	writeQcow2Header(t, base, "top.qcow2")
+	if _, err := imageFiles(top); err == nil {
+		t.Fatalf("expected looping backing chain to fail")
+	}
+
+	disk := QemuDisk{Image: "ubuntu-22.04"}
+	if err := disk.Sanitize(tmpDir); err != nil {
+		t.Fatalf("failed to sanitize image disk: %s", err)
+	}
+	if disk.File != filepath.Join(tmpDir, "ubuntu-22.04.qcow2") {
+		t.Fatalf("expected image disk file to default to the image name, got %s", disk.File)
+	}
+	disk = QemuDisk{Image: "ubuntu-22.04", Format: "raw"}
+	if err := disk.Sanitize(tmpDir); err == nil {
+		t.Fatalf("expected raw image disk to be rejected")
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	keyDefaultDelay = time.Millisecond * 20
+	keyMaxDelay     = time.Second * 10
+	keyMaxCombos    = 4096
+	// the pauses between the combinations of one request may add up to
+	// at most this
+	keyMaxDuration = time.Minute * 2
+)
+
+// keyAliases maps friendly key names to QEMU qcodes
+var keyAliases = map[string]string{
+	"del":       "delete",
+	"enter":     "ret",
+	"return":    "ret",
+	"escape":    "esc",
+	"space":     "spc",
+	"backspace": "backspace",
+	"pageup":    "pgup",
+	"pagedown":  "pgdn",
+	"win":       "meta_l",
+	"super":     "meta_l",
+	"meta":      "meta_l",
+	"control":   "ctrl",
+}
+
+// qcodes are the QEMU key codes accepted by send-key
+var qcodes = map[string]bool{}
+
+func init() {
+	for _, k := range []string{
+		"shift", "shift_r", "alt", "alt_r", "ctrl", "ctrl_r", "meta_l", "meta_r", "menu",
+		"esc", "tab", "ret", "spc", "backspace", "caps_lock", "num_lock", "scroll_lock",
+		"minus", "equal", "bracket_left", "bracket_right", "semicolon", "apostrophe",
+		"grave_accent", "backslash", "comma", "dot", "slash", "less",
+		"print", "sysrq", "pause", "insert", "delete", "home", "end", "pgup", "pgdn",
+		"up", "down", "left", "right",
+		"kp_0", "kp_1", "kp_2", "kp_3", "kp_4", "kp_5", "kp_6", "kp_7", "kp_8", "kp_9",
+		"kp_add", "kp_subtract", "kp_multiply", "kp_divide", "kp_decimal", "kp_enter",
+	} {
+		qcodes[k] = true
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		qcodes[string(c)] = true
+	}
+	for c := '0'; c <= '9'; c++ {
+		qcodes[string(c)] = true
+	}
+	for n := 1; n <= 12; n++ {
+		qcodes[fmt.Sprintf("f%d", n)] = true
+	}
+}
+
+// textKeys maps characters to the qcode typing them on a US keyboard, and
+// shiftedKeys those which also need shift held down
+var textKeys = map[rune]string{
+	' ': "spc", '\n': "ret", '\t': "tab",
+	'-': "minus", '=': "equal", '[': "bracket_left", ']': "bracket_right",
+	';': "semicolon", '\'': "apostrophe", '`': "grave_accent", '\\': "backslash",
+	',': "comma", '.': "dot", '/': "slash",
+}
+
+var shiftedKeys = map[rune]string{
+	'!': "1", '@': "2", '#': "3", '$': "4", '%': "5", '^': "6", '&': "7", '*': "8",
+	'(': "9", ')': "0", '_': "minus", '+': "equal", '{': "bracket_left",
+	'}': "bracket_right", ':': "semicolon", '"': "apostrophe", '~': "grave_accent",
+	'|': "backslash", '<': "comma", '>': "dot", '?': "slash",
+}
+
+// ParseKeyCombo parses keys pressed together, e.g. ctrl-alt-del, into qcodes
+func ParseKeyCombo(combo string) ([]string, error) {
+	combo = strings.ToLower(strings.TrimSpace(combo))
+	if combo == "" {
+		return nil, fmt.Errorf("Empty key combination")
+	}
+	keys := []string{}
+	for _, name := range strings.Split(combo, "-") {
+		if alias, ok := keyAliases[name]; ok {
+			name = alias
+		}
+		if !qcodes[name] {
+			return nil, fmt.Errorf("Unknown key '%s' in '%s', use one of: %s", name, combo, KnownKeys())
+		}
+		keys = append(keys, name)
+	}
+	return keys, nil
+}
+
+// TextKeyCombos returns the key combinations which type text
+func TextKeyCombos(text string) ([][]string, error) {
+	combos := [][]string{}
+	for _, c := range text {
+		switch {
+		case c >= 'a' && c <= 'z' || c >= '0' && c <= '9':
+			combos = append(combos, []string{string(c)})
+		case c >= 'A' && c <= 'Z':
+			combos = append(combos, []string{"shift", strings.ToLower(string(c))})
+		case textKeys[c] != "":
+			combos = append(combos, []string{textKeys[c]})
+		case shiftedKeys[c] != "":
+			combos = append(combos, []string{"shift", shiftedKeys[c]})
+		default:
+			return nil, fmt.Errorf("Character %q cannot be typed", c)
+		}
+	}
+	return combos, nil
+}
+
+// KnownKeys returns the sorted list of key names
+func KnownKeys() string {
+	names := []string{}
+	for k := range qcodes {
+		names = append(names, k)
+	}
+	for k := range keyAliases {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// SendKeysRequest presses each of Keys in order, then types Text
+type SendKeysRequest struct {
+	Keys    []string `json:"keys"`
+	Text    string   `json:"text"`
+	DelayMS int      `json:"delay-ms"`
+}
+
+// Combos returns the key combinations to send
+func (r SendKeysRequest) Combos() ([][]string, error) {
+	if len(r.Keys) == 0 && r.Text == "" {
+		return nil, fmt.Errorf("No keys or text to send")
+	}
+	combos := [][]string{}
+	for _, combo := range r.Keys {
+		keys, err := ParseKeyCombo(combo)
+		if err != nil {
+			return nil, err
+		}
+		combos = append(combos, keys)
+	}
+	textCombos, err := TextKeyCombos(r.Text)
+	if err != nil {
+		return nil, err
+	}
+	combos = append(combos, textCombos...)
+	if len(combos) > keyMaxCombos {
+		return nil, fmt.Errorf("Too many keys, at most %d may be sent at once", keyMaxCombos)
+	}
+	return combos, nil
+}
+
+// Delay returns the pause between key combinations
+func (r SendKeysRequest) Delay() (time.Duration, error) {
+	delay := time.Duration(r.DelayMS) * time.Millisecond
+	if delay < 0 || delay > keyMaxDelay {
+		return 0, fmt.Errorf("Invalid delay %dms, must be between 0 and %dms", r.DelayMS, keyMaxDelay.Milliseconds())
+	}
+	if delay == 0 {
+		delay = keyDefaultDelay
+	}
+	return delay, nil
+}
+
+type qmpKeyValue struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// SendKeys presses each key combination on the guest keyboard
+func (v *VM) SendKeys(combos [][]string, delay time.Duration) error {
+	if total := time.Duration(len(combos)-1) * delay; total > keyMaxDuration {
+		return fmt.Errorf("Sending %d keys %s apart takes %s, at most %s is allowed", len(combos), delay, total, keyMaxDuration)
+	}
+	log.Infof("VM:%s sending %d key combinations", v.Name(), len(combos))
+	for idx, combo := range combos {
+		keys := []qmpKeyValue{}
+		for _, key := range combo {
+			keys = append(keys, qmpKeyValue{Type: "qcode", Data: key})
+		}
+		// QMP is not held during the delay so that other requests, e.g.
+		// screenshots, are not stalled by long key sequences
+		args := map[string]interface{}{"keys": keys}
+		if err := v.QMPExecute("send-key", args, nil); err != nil {
+			return fmt.Errorf("Failed to send keys %s: %s", strings.Join(combo, "-"), err)
+		}
+		if idx < len(combos)-1 {
+			time.Sleep(delay)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyCombo(t *testing.T) {
+	tests := map[string][]string{
+		"ctrl-alt-del": {"ctrl", "alt", "delete"},
+		"Esc":          {"esc"},
+		"f2":           {"f2"},
+		"shift-tab":    {"shift", "tab"},
+		"enter":        {"ret"},
+	}
+	for combo, want := range tests {
+		got, err := ParseKeyCombo(combo)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %s", combo, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v for %q, got %v", want, combo, got)
+		}
+	}
+	for _, combo := range []string{"", "ctrl-", "hyper", "f13"} {
+		if _, err := ParseKeyCombo(combo); err == nil {
+			t.Fatalf("expected error parsing %q", combo)
+		}
+	}
+}
+
+func TestTextKeyCombos(t *testing.T) {
+	got, err := TextKeyCombos("aZ1 ?\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := [][]string{{"a"}, {"shift", "z"}, {"1"}, {"spc"}, {"shift", "slash"}, {"ret"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if _, err := TextKeyCombos("café"); err == nil {
+		t.Fatalf("expected error typing non-ascii text")
+	}
+}
+
+func TestSendKeysRequest(t *testing.T) {
+	request := SendKeysRequest{Keys: []string{"esc", "ctrl-alt-del"}, Text: "ok"}
+	combos, err := request.Combos()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := [][]string{{"esc"}, {"ctrl", "alt", "delete"}, {"o"}, {"k"}}
+	if !reflect.DeepEqual(combos, want) {
+		t.Fatalf("expected %v, got %v", want, combos)
+	}
+	if delay, _ := request.Delay(); delay != keyDefaultDelay {
+		t.Fatalf("expected default delay %s, got %s", keyDefaultDelay, delay)
+	}
+
+	if _, err := (SendKeysRequest{}).Combos(); err == nil {
+		t.Fatalf("expected error for empty request")
+	}
+	if _, err := (SendKeysRequest{Text: strings.Repeat("a", keyMaxCombos+1)}).Combos(); err == nil {
+		t.Fatalf("expected error for too many keys")
+	}
+	if _, err := (SendKeysRequest{DelayMS: int(time.Minute / time.Millisecond)}).Delay(); err == nil {
+		t.Fatalf("expected error for long delay")
+	}
+}
+
+func TestVMSendKeys(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-keys")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	vm, f := newFakeQMPVM(t, dir, nil)
+	defer f.Close()
+
+	combos := [][]string{{"a"}, {"b"}, {"c"}}
+	done := make(chan error, 1)
+	go func() { done <- vm.SendKeys(combos, 500*time.Millisecond) }()
+
+	// QMP is free while the keys are being typed
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if err := vm.QMPExecute("query-status", nil, nil); err != nil {
+		t.Fatalf("failed to query status: %s", err)
+	}
+	if time.Since(start) > 250*time.Millisecond {
+		t.Fatalf("QMP was held during the key delay")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("failed to send keys: %s", err)
+	}
+	sent := 0
+	for _, cmd := range f.Commands() {
+		if cmd.Execute == "send-key" {
+			sent++
+		}
+	}
+	if sent != len(combos) {
+		t.Fatalf("expected %d send-key commands, got %+v", len(combos), f.Commands())
+	}
+
+	if err := vm.SendKeys(make([][]string, keyMaxCombos), keyMaxDelay); err == nil {
+		t.Fatalf("expected error for a key sequence longer than %s", keyMaxDuration)
+	}
+}
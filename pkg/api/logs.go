@@ -0,0 +1,224 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	LogSourceSerial   = "serial"
+	LogSourceQemu     = "qemu"
+	LogSourceSwTPM    = "swtpm"
+	LogSourceVirtioFS = "virtiofsd"
+)
+
+var LogSources = []string{LogSourceSerial, LogSourceQemu, LogSourceSwTPM, LogSourceVirtioFS}
+
+const (
+	logMaxSize       = 10 * 1024 * 1024
+	logMaxBackups    = 3
+	logRotateEvery   = time.Second * 30
+	logFollowPolling = time.Millisecond * 500
+)
+
+func ValidLogSource(source string) bool {
+	for _, s := range LogSources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// LogFile returns the path of the log file for source in logDir
+func LogFile(logDir, source string) string {
+	return filepath.Join(logDir, source+".log")
+}
+
+// rotateLogFiles shifts path.N-1 to path.N ... and path to path.1
+func rotateLogFiles(path string, backups int) error {
+	os.Remove(fmt.Sprintf("%s.%d", path, backups))
+	for idx := backups - 1; idx > 0; idx-- {
+		src := fmt.Sprintf("%s.%d", path, idx)
+		if PathExists(src) {
+			if err := os.Rename(src, fmt.Sprintf("%s.%d", path, idx+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if backups > 0 && PathExists(path) {
+		return os.Rename(path, path+".1")
+	}
+	return nil
+}
+
+// RotatingLog is an io.Writer which rotates the file once it reaches
+// MaxSize bytes, keeping MaxBackups previous files.
+type RotatingLog struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	mutex      sync.Mutex
+	fh         *os.File
+	size       int64
+}
+
+func OpenRotatingLog(path string) (*RotatingLog, error) {
+	r := &RotatingLog{Path: path, MaxSize: logMaxSize, MaxBackups: logMaxBackups}
+	if err := EnsureDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("Failed to create log dir for %q: %s", path, err)
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingLog) open() error {
+	fh, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("Failed to open log file %q: %s", r.Path, err)
+	}
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return fmt.Errorf("Failed to stat log file %q: %s", r.Path, err)
+	}
+	r.fh = fh
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingLog) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.fh == nil {
+		return 0, fmt.Errorf("Log file %q is closed", r.Path)
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.MaxSize {
+		r.fh.Close()
+		r.fh = nil
+		if err := rotateLogFiles(r.Path, r.MaxBackups); err != nil {
+			log.Warnf("Failed to rotate log file %q: %s", r.Path, err)
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.fh.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Printf writes a machined message into the log, e.g. to mark a restart
+func (r *RotatingLog) Printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintf(r, "=== %s machined: %s ===\n", time.Now().Format(time.RFC3339), msg)
+}
+
+func (r *RotatingLog) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.fh == nil {
+		return nil
+	}
+	err := r.fh.Close()
+	r.fh = nil
+	return err
+}
+
+// copyTruncateLog rotates a log file which another process holds open in
+// append mode by copying it to path.1 and truncating it in place.
+func copyTruncateLog(path string, maxSize int64, backups int) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() < maxSize {
+		return nil
+	}
+	tmpFile := path + ".rotate"
+	if err := CopyFileBits(path, tmpFile); err != nil {
+		return fmt.Errorf("Failed to copy log file %q: %s", path, err)
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("Failed to truncate log file %q: %s", path, err)
+	}
+	// shift the backups, then move the copy into path.1
+	os.Remove(fmt.Sprintf("%s.%d", path, backups))
+	for idx := backups - 1; idx > 0; idx-- {
+		src := fmt.Sprintf("%s.%d", path, idx)
+		if PathExists(src) {
+			if err := os.Rename(src, fmt.Sprintf("%s.%d", path, idx+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(tmpFile, path+".1")
+}
+
+// FollowLog copies the log at path to w and then keeps sending new data as
+// it is appended until ctx is done.  Rotation and truncation are detected
+// and the new file is read from the start.
+func FollowLog(ctx context.Context, path string, w io.Writer, flush func()) error {
+	var fh *os.File
+	var inode uint64
+	var offset int64
+	defer func() {
+		if fh != nil {
+			fh.Close()
+		}
+	}()
+
+	for {
+		if fh == nil {
+			if f, err := os.Open(path); err == nil {
+				fh = f
+				offset = 0
+				if info, err := fh.Stat(); err == nil {
+					inode = info.Sys().(*syscall.Stat_t).Ino
+				}
+			}
+		}
+		if fh != nil {
+			n, err := io.Copy(w, fh)
+			if err != nil {
+				return err
+			}
+			offset += n
+			if n > 0 {
+				flush()
+			}
+			// reopen if the file was rotated or truncated
+			if info, err := os.Stat(path); err != nil || info.Sys().(*syscall.Stat_t).Ino != inode || info.Size() < offset {
+				fh.Close()
+				fh = nil
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(logFollowPolling):
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotatingLog(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-rotating-log")
+	if err != nil {
+		t.Fatalf("failed to create a tempdir for test")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	logPath := filepath.Join(tmpDir, "logs", LogFile("", LogSourceQemu))
+	rlog, err := OpenRotatingLog(logPath)
+	if err != nil {
+		t.Fatalf("failed to open log: %s", err)
+	}
+	rlog.MaxSize = 10
+	rlog.MaxBackups = 2
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if _, err := rlog.Write([]byte(line)); err != nil {
+			t.Fatalf("failed to write log: %s", err)
+		}
+	}
+	rlog.Close()
+
+	expected := map[string]string{
+		logPath:        "four\nfive\n",
+		logPath + ".1": "three\n",
+		logPath + ".2": "one\ntwo\n",
+	}
+	for path, content := range expected {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", path, err)
+		}
+		if string(got) != content {
+			t.Errorf("%s: expected %q got %q", path, content, string(got))
+		}
+	}
+	if PathExists(logPath + ".3") {
+		t.Errorf("expected only %d backups", rlog.MaxBackups)
+	}
+}
+
+func TestAddCharDevLogFile(t *testing.T) {
+	params := []string{"-chardev", "socket,id=monitor0,path=/tmp/m.sock", "-chardev", "socket,id=serial0,path=/tmp/c.sock,server=on,wait=off"}
+	params = addCharDevLogFile(params, "serial0", "/state/logs/serial.log")
+	if params[1] != "socket,id=monitor0,path=/tmp/m.sock" {
+		t.Errorf("unexpected change to monitor chardev: %s", params[1])
+	}
+	if !strings.HasSuffix(params[3], ",logfile=/state/logs/serial.log,logappend=on") {
+		t.Errorf("serial chardev is missing logfile: %s", params[3])
+	}
+}
+
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestFollowLogTruncate(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-follow-log")
+	if err != nil {
+		t.Fatalf("failed to create a tempdir for test")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	logPath := filepath.Join(tmpDir, "serial.log")
+	if err := os.WriteFile(logPath, []byte("booting\n"), 0644); err != nil {
+		t.Fatalf("failed to write log: %s", err)
+	}
+
+	var out syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- FollowLog(ctx, logPath, &out, func() {})
+	}()
+
+	waitFor := func(expected string) {
+		for i := 0; i < 50; i++ {
+			if out.String() == expected {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("expected %q got %q", expected, out.String())
+	}
+	waitFor("booting\n")
+
+	// copyTruncateLog truncates in place, following should start over
+	if err := copyTruncateLog(logPath, 1, 1); err != nil {
+		t.Fatalf("failed to rotate log: %s", err)
+	}
+	fh, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("failed to open log: %s", err)
+	}
+	fh.WriteString("login:")
+	fh.Close()
+	waitFor("booting\nlogin:")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("FollowLog failed: %s", err)
+	}
+	if content, _ := os.ReadFile(logPath + ".1"); string(content) != "booting\n" {
+		t.Errorf("expected rotated log to hold the old content, got %q", string(content))
+	}
+}
@@ -17,9 +17,11 @@ package api
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -35,12 +37,16 @@ const (
 	MachineStatusFailed      string = "failed"
 	SerialConsole            string = "console"
 	VGAConsole               string = "vga"
+	VNCConsole               string = "vnc"
 )
 
 type StopChannel chan struct{}
 
 type MachineController struct {
-	Machines []Machine
+	Machines []*Machine
+	// guards Machines, which VM exit hooks change as well as requests.
+	// Slow work on a machine runs after the lock is released.
+	lock sync.RWMutex
 }
 
 type Machine struct {
@@ -50,18 +56,51 @@ type Machine struct {
 	Description string `yaml:"description"`
 	Ephemeral   bool   `yaml:"ephemeral"`
 	Name        string `yaml:"name"`
+	OwnerUID    int    `yaml:"owner-uid"`
+	OwnerGID    int    `yaml:"owner-gid"`
 	Status      string
 	statusCode  int64
 	vmCount     sync.WaitGroup
 	instance    *VM
+	onExit      func(*VM)
+
+	// serializes changes to the disks of the machine
+	disksLock sync.Mutex
+	// guards replacing Config.Disks, which copies of the machine share
+	configLock sync.RWMutex
+}
+
+// snapshot returns a copy of the machine which is safe to read while the
+// disks of the machine change
+func (m *Machine) snapshot() Machine {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+	machine := *m
+	machine.disksLock = sync.Mutex{}
+	machine.configLock = sync.RWMutex{}
+	return machine
+}
+
+// findMachine returns the named machine, or nil.  The machine stays valid
+// after the lock is released, so callers can work on it without the lock.
+func (ctl *MachineController) findMachine(machineName string) *Machine {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+	for _, machine := range ctl.Machines {
+		if machine.Name == machineName {
+			return machine
+		}
+	}
+	return nil
 }
 
 func (ctl *MachineController) GetMachineByName(machineName string) (*Machine, error) {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
 	for id := range ctl.Machines {
-		machine := ctl.Machines[id]
-		if machine.Name == machineName {
-			machine.GetStatus()
-			ctl.Machines[id] = machine
+		if ctl.Machines[id].Name == machineName {
+			ctl.Machines[id].GetStatus()
+			machine := ctl.Machines[id].snapshot()
 			return &machine, nil
 		}
 	}
@@ -69,45 +108,60 @@ func (ctl *MachineController) GetMachineByName(machineName string) (*Machine, er
 }
 
 func (ctl *MachineController) GetMachines() []Machine {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+	machines := []Machine{}
 	for id := range ctl.Machines {
-		machine := ctl.Machines[id]
-		machine.GetStatus()
-		ctl.Machines[id] = machine
+		ctl.Machines[id].GetStatus()
+		machines = append(machines, ctl.Machines[id].snapshot())
 	}
 
-	return ctl.Machines
+	return machines
 }
 
 func (ctl *MachineController) GetMachine(machineName string) (Machine, error) {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
 	for id := range ctl.Machines {
-		machine := ctl.Machines[id]
-		if machine.Name == machineName {
-			machine.GetStatus()
-			ctl.Machines[id] = machine
-			return machine, nil
+		if ctl.Machines[id].Name == machineName {
+			ctl.Machines[id].GetStatus()
+			return ctl.Machines[id].snapshot(), nil
 		}
 	}
 	return Machine{}, fmt.Errorf("Failed to find machine with Name: %s", machineName)
 }
 
 func (ctl *MachineController) AddMachine(newMachine Machine, cfg *MachineDaemonConfig) error {
-	if _, err := ctl.GetMachineByName(newMachine.Name); err == nil {
-		return fmt.Errorf("Machine '%s' is already defined", newMachine.Name)
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+	for id := range ctl.Machines {
+		if ctl.Machines[id].Name == newMachine.Name {
+			return fmt.Errorf("Machine '%s' is already defined", newMachine.Name)
+		}
 	}
 	newMachine.Status = MachineStatusStopped
 	newMachine.ctx = cfg.GetConfigContext()
+	// logs left behind by an earlier ephemeral machine of the same name
+	if dir := newMachine.ArtifactDir(); PathExists(dir) {
+		log.Infof("Removing artifacts of previous machine %s %q", newMachine.Name, dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("Failed to remove machine %s dir %q: %s", newMachine.Name, dir, err)
+		}
+	}
 	if !newMachine.Ephemeral {
 		if err := newMachine.SaveConfig(); err != nil {
 			return fmt.Errorf("Could not save '%s' machine to %q: %s", newMachine.Name, newMachine.ConfigFile(), err)
 		}
 	}
-	ctl.Machines = append(ctl.Machines, newMachine)
+	ctl.Machines = append(ctl.Machines, &newMachine)
 	return nil
 }
 
 func (ctl *MachineController) StopMachines() error {
-	for idx, _ := range ctl.Machines {
-		machine := ctl.Machines[idx]
+	ctl.lock.RLock()
+	machines := slices.Clone(ctl.Machines)
+	ctl.lock.RUnlock()
+	for _, machine := range machines {
 		if machine.IsRunning() {
 			if err := machine.Stop(false); err != nil {
 				log.Infof("Error while stopping machine '%s': %s", machine.Name, err)
@@ -118,13 +172,21 @@ func (ctl *MachineController) StopMachines() error {
 }
 
 func (ctl *MachineController) DeleteMachine(machineName string, cfg *MachineDaemonConfig) error {
-	machines := []Machine{}
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+	return ctl.deleteMachine(machineName, false)
+}
+
+// deleteMachine must be called with the lock held.  The logs and other
+// artifacts of the machine are kept if keepArtifacts is set.
+func (ctl *MachineController) deleteMachine(machineName string, keepArtifacts bool) error {
+	machines := []*Machine{}
 	for idx, _ := range ctl.Machines {
 		machine := ctl.Machines[idx]
 		if machine.Name != machineName {
 			machines = append(machines, machine)
 		} else {
-			err := machine.Delete()
+			err := machine.delete(keepArtifacts)
 			if err != nil {
 				return fmt.Errorf("Machine:%s delete failed: %s", machine.Name, err)
 			}
@@ -139,11 +201,16 @@ func (ctl *MachineController) UpdateMachine(updateMachine Machine, cfg *MachineD
 	// FIXME: decide if update will modify the in-memory state (I think yes, but
 	// maybe only the on-disk format if it's running? but what does subsequent
 	// GET return (on-disk or in-memory?)
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
 
 	for idx, machine := range ctl.Machines {
 		if machine.Name == updateMachine.Name {
 			updateMachine.ctx = cfg.GetConfigContext()
-			ctl.Machines[idx] = updateMachine
+			// ownership is only set at creation time
+			updateMachine.OwnerUID = machine.OwnerUID
+			updateMachine.OwnerGID = machine.OwnerGID
+			ctl.Machines[idx] = &updateMachine
 			if !updateMachine.Ephemeral {
 				if err := updateMachine.SaveConfig(); err != nil {
 					return fmt.Errorf("Could not save '%s' machine to %q: %s", updateMachine.Name, updateMachine.ConfigFile(), err)
@@ -157,51 +224,69 @@ func (ctl *MachineController) UpdateMachine(updateMachine Machine, cfg *MachineD
 }
 
 func (ctl *MachineController) StartMachine(machineName string) error {
-	for idx, machine := range ctl.Machines {
-		if machine.Name == machineName {
-			err := ctl.Machines[idx].Start()
-			if err != nil {
-				return fmt.Errorf("Could not start '%s' machine: %s", machineName, err)
-			}
-			return nil
-		}
+	machine := ctl.findMachine(machineName)
+	if machine == nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot start unknown machine", machineName)
 	}
-	return fmt.Errorf("Failed to find machine '%s', cannot start unknown machine", machineName)
+	if machine.Ephemeral {
+		machine.onExit = func(vm *VM) { ctl.deleteEphemeral(machineName, vm) }
+	}
+	if err := machine.Start(); err != nil {
+		return fmt.Errorf("Could not start '%s' machine: %s", machineName, err)
+	}
+	return nil
 }
 
 func (ctl *MachineController) StopMachine(machineName string, force bool) error {
-	for idx, machine := range ctl.Machines {
-		if machine.Name == machineName {
-			err := ctl.Machines[idx].Stop(force)
-			if err != nil {
-				return fmt.Errorf("Could not stop '%s' machine: %s", machineName, err)
-			}
-			return nil
-		}
+	machine := ctl.findMachine(machineName)
+	if machine == nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot stop unknown machine", machineName)
 	}
-	return fmt.Errorf("Failed to find machine '%s', cannot stop unknown machine", machineName)
+	if err := machine.Stop(force); err != nil {
+		return fmt.Errorf("Could not stop '%s' machine: %s", machineName, err)
+	}
+	return nil
 }
 
 type ConsoleInfo struct {
-	Type   string `json:"type"`
-	Path   string `json:"path"`
-	Addr   string `json:"addr"`
-	Port   string `json:"port"`
-	Secure bool   `json:"secure"`
+	Type     string `json:"type"`
+	Path     string `json:"path"`
+	Addr     string `json:"addr"`
+	Port     string `json:"port"`
+	Secure   bool   `json:"secure"`
+	ReadOnly bool   `json:"read-only"`
+	Password string `json:"password"`
+	CACert   string `json:"ca-cert"`
 }
 
-func (ctl *MachineController) GetMachineConsole(machineName string, consoleType string) (ConsoleInfo, error) {
+func (ctl *MachineController) GetMachineConsole(machineName string, consoleType string, readOnly bool) (ConsoleInfo, error) {
 	consoleInfo := ConsoleInfo{Type: consoleType}
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
 	for _, machine := range ctl.Machines {
 		if machine.Name == machineName {
 			if consoleType == SerialConsole {
-				path, err := machine.SerialSocket()
+				path, err := machine.ConsoleSocket(readOnly)
+				consoleInfo.ReadOnly = readOnly
 				if err != nil {
 					return consoleInfo, fmt.Errorf("Failed to get serial socket info: %s", err)
 				}
 				consoleInfo.Path = path
 				return consoleInfo, nil
 			}
+			// vga attaches to whichever graphical display is configured
+			if consoleType == VNCConsole || (consoleType == VGAConsole && machine.Config.Display.Type == DisplayVNC) {
+				vncInfo, err := machine.VNCConnection()
+				if err != nil {
+					return consoleInfo, fmt.Errorf("Failed to get vnc connection info: %s", err)
+				}
+				consoleInfo.Type = VNCConsole
+				consoleInfo.Path = vncInfo.Socket
+				consoleInfo.Addr = vncInfo.HostAddress
+				consoleInfo.Port = vncInfo.Port
+				consoleInfo.Password = vncInfo.Password
+				return consoleInfo, nil
+			}
 			if consoleType == VGAConsole {
 				spiceInfo, err := machine.SpiceConnection()
 				if err != nil {
@@ -209,9 +294,11 @@ func (ctl *MachineController) GetMachineConsole(machineName string, consoleType
 				}
 				consoleInfo.Addr = spiceInfo.HostAddress
 				consoleInfo.Port = spiceInfo.Port
+				consoleInfo.Password = spiceInfo.Password
 				if spiceInfo.TLSPort != "" {
 					consoleInfo.Port = spiceInfo.TLSPort
 					consoleInfo.Secure = true
+					consoleInfo.CACert = spiceInfo.CACert
 				}
 				return consoleInfo, nil
 			}
@@ -232,15 +319,43 @@ func (cls *Machine) DataDir() string {
 	return filepath.Join(cls.ctx.Value(mdcCtxDataDir).(string), "machines", cls.Name)
 }
 
+// StateDir of ephemeral machines is below the ephemeral directory so that
+// nothing they write outlives them
 func (cls *Machine) StateDir() string {
+	if cls.Ephemeral {
+		if ephemDir, ok := cls.ctx.Value(mdcCtxEphemDir).(string); ok {
+			return filepath.Join(ephemDir, "machines", cls.Name)
+		}
+	}
+	return filepath.Join(cls.ctx.Value(mdcCtxStateDir).(string), "machines", cls.Name)
+}
+
+// ArtifactDir holds the logs, recordings and screenshots of the machine.
+// It is always below the state directory, so that the artifacts of an
+// ephemeral machine outlive it until a machine of the same name is defined
+// again.
+func (cls *Machine) ArtifactDir() string {
 	return filepath.Join(cls.ctx.Value(mdcCtxStateDir).(string), "machines", cls.Name)
 }
 
+// LogDir holds the serial, QEMU and swtpm logs which are kept after the
+// machine stops
+func (cls *Machine) LogDir() string {
+	return filepath.Join(cls.ArtifactDir(), "logs")
+}
+
 var (
 	clsCtx         = "machine-ctx"
 	clsCtxConfDir  = mdcCtx + "-confdir"
 	clsCtxDataDir  = mdcCtx + "-datadir"
 	clsCtxStateDir = mdcCtx + "-statedir"
+
+	clsCtxDisplayTLSDir = clsCtx + "-display-tls-dir"
+	clsCtxImageDir      = clsCtx + "-image-dir"
+	clsCtxEphemeral     = clsCtx + "-ephemeral"
+	clsCtxSecretDir     = clsCtx + "-secret-dir"
+	clsCtxArtifactDir   = clsCtx + "-artifact-dir"
+	clsCtxOwner         = clsCtx + "-owner"
 )
 
 func (cls *Machine) Context() context.Context {
@@ -248,9 +363,27 @@ func (cls *Machine) Context() context.Context {
 	ctx = context.WithValue(ctx, clsCtxConfDir, cls.ConfigDir())
 	ctx = context.WithValue(ctx, clsCtxDataDir, cls.DataDir())
 	ctx = context.WithValue(ctx, clsCtxStateDir, cls.StateDir())
+	// the display CA is shared by all machines
+	ctx = context.WithValue(ctx, clsCtxDisplayTLSDir, filepath.Join(cls.ctx.Value(mdcCtxDataDir).(string), DisplayTLSDirName))
+	ctx = context.WithValue(ctx, clsCtxImageDir, cls.ImageStore().Dir)
+	ctx = context.WithValue(ctx, clsCtxEphemeral, cls.Ephemeral)
+	ctx = context.WithValue(ctx, clsCtxSecretDir, cls.SecretStore().Dir)
+	ctx = context.WithValue(ctx, clsCtxArtifactDir, cls.ArtifactDir())
+	ctx = context.WithValue(ctx, clsCtxOwner, Caller{UID: cls.OwnerUID, GID: cls.OwnerGID})
 	return ctx
 }
 
+// ImageStore returns the image library shared by all machines
+func (cls *Machine) ImageStore() *ImageStore {
+	return NewImageStore(filepath.Join(cls.ctx.Value(mdcCtxDataDir).(string), ImagesDirName))
+}
+
+// SecretStore returns the passphrases of encrypted disks shared by all
+// machines
+func (cls *Machine) SecretStore() *SecretStore {
+	return NewSecretStore(filepath.Join(cls.ctx.Value(mdcCtxConfDir).(string), SecretsDirName))
+}
+
 func (cls *Machine) ConfigFile() string {
 	// FIXME: need to decide on the name of this yaml file
 	return filepath.Join(cls.ConfigDir(), "machine.yaml")
@@ -309,6 +442,10 @@ func (m *Machine) GetStatus() string {
 }
 
 func (m *Machine) Start() error {
+	// disk changes which require a stopped machine hold the lock while
+	// they check
+	m.disksLock.Lock()
+	defer m.disksLock.Unlock()
 
 	// check if machine is running, if so return
 	if m.IsRunning() {
@@ -321,6 +458,7 @@ func (m *Machine) Start() error {
 		return fmt.Errorf("Failed to create new VM '%s': %s", m.Name, err)
 	}
 	m.instance = vm
+	vm.exitHook = m.onExit
 	log.Infof("machine.Start()")
 
 	err = vm.Start()
@@ -357,6 +495,10 @@ func (m *Machine) Stop(force bool) error {
 }
 
 func (m *Machine) Delete() error {
+	return m.delete(false)
+}
+
+func (m *Machine) delete(keepArtifacts bool) error {
 	// Stop machine, if running
 	// Delete VM (stop and remove state)
 	// Remove Machine Config
@@ -372,6 +514,9 @@ func (m *Machine) Delete() error {
 	}
 
 	dirs := []string{m.ConfigDir(), m.DataDir(), m.StateDir()}
+	if !keepArtifacts && m.ArtifactDir() != m.StateDir() {
+		dirs = append(dirs, m.ArtifactDir())
+	}
 	for _, dir := range dirs {
 		if PathExists(dir) {
 			log.Infof("Removing machine dir %q", dir)
@@ -395,24 +540,85 @@ func (m *Machine) SerialSocket() (string, error) {
 	return m.instance.SerialSocket()
 }
 
+// ConsoleSocket returns the path clients use to attach to the serial console
+func (m *Machine) ConsoleSocket(readOnly bool) (string, error) {
+	if m.instance == nil || m.instance.Console == nil {
+		return "", fmt.Errorf("Machine '%s' serial console is not available", m.Name)
+	}
+	return m.instance.ConsoleSocket(readOnly), nil
+}
+
+// Console returns the multiplexed serial console of a running machine
+func (m *Machine) Console() (*SerialMux, error) {
+	if !m.IsRunning() || m.instance.Console == nil {
+		return nil, fmt.Errorf("Machine '%s' serial console is not available", m.Name)
+	}
+	return m.instance.Console, nil
+}
+
+// Screenshot writes a PNG of the display of a running machine to w
+func (m *Machine) Screenshot(w io.Writer) error {
+	if !m.IsRunning() {
+		return fmt.Errorf("Machine '%s' is not running", m.Name)
+	}
+	return m.instance.Screendump(w)
+}
+
+// SendKeys types on the keyboard of a running machine
+func (m *Machine) SendKeys(request SendKeysRequest) error {
+	if !m.IsRunning() {
+		return fmt.Errorf("Machine '%s' is not running", m.Name)
+	}
+	combos, err := request.Combos()
+	if err != nil {
+		return err
+	}
+	delay, err := request.Delay()
+	if err != nil {
+		return err
+	}
+	return m.instance.SendKeys(combos, delay)
+}
+
 type SpiceConnection struct {
 	HostAddress string
 	Port        string
 	TLSPort     string
-	// Password    string
+	Password    string
+	CACert      string
 }
 
 func (m *Machine) SpiceConnection() (SpiceConnection, error) {
 	spiceCon := SpiceConnection{}
+	if !m.IsRunning() {
+		return spiceCon, fmt.Errorf("Machine '%s' is not running", m.Name)
+	}
 
 	spiceDev, err := m.instance.SpiceDevice()
 	if err != nil {
 		return SpiceConnection{}, err
 	}
+	if spiceDev.Port == "" && spiceDev.TLSPort == "" {
+		return SpiceConnection{}, fmt.Errorf("Machine '%s' does not have a spice display", m.Name)
+	}
 	spiceCon.HostAddress = spiceDev.HostAddress
 	spiceCon.Port = spiceDev.Port
 	spiceCon.TLSPort = spiceDev.TLSPort
-	// spiceCon.Password = spiceDev.Password
+	spiceCon.Password = m.instance.displayPassword
+	if m.instance.displayTLSDir != "" {
+		caCert, err := ReadDisplayCACert(m.instance.displayTLSDir)
+		if err != nil {
+			return SpiceConnection{}, err
+		}
+		spiceCon.CACert = caCert
+	}
 
 	return spiceCon, nil
 }
+
+func (m *Machine) VNCConnection() (VNCConnection, error) {
+	if !m.IsRunning() {
+		return VNCConnection{}, fmt.Errorf("Machine '%s' is not running", m.Name)
+	}
+	return m.instance.VNCConnection()
+}
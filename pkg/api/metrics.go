@@ -0,0 +1,568 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MetricsContentType is the Prometheus text exposition format version
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// /proc/<pid>/stat reports cpu time in USER_HZ which is 100 on linux
+const procClockTicks = 100.0
+
+var (
+	// a machine which does not answer QMP in time is left out of a scrape
+	metricsCollectTimeout = 5 * time.Second
+
+	// collectStats is replaced in tests
+	collectStats = collectMachineStats
+)
+
+var metricsDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var machineStatuses = []string{
+	MachineStatusInitialized,
+	MachineStatusStopped,
+	MachineStatusStarting,
+	MachineStatusRunning,
+	MachineStatusStopping,
+	MachineStatusFailed,
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]uint64, len(metricsDurationBuckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for idx, bound := range metricsDurationBuckets {
+		if value <= bound {
+			h.buckets[idx]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+type requestKey struct {
+	method string
+	route  string
+	status string
+}
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+type operationKey struct {
+	operation string
+	result    string
+}
+
+// Metrics holds the machined counters exported on /metrics.  Per machine
+// metrics are gathered from the running VMs at scrape time.
+type Metrics struct {
+	mutex              sync.Mutex
+	requests           map[requestKey]uint64
+	requestDurations   map[routeKey]*histogram
+	operations         map[operationKey]uint64
+	operationDurations map[string]*histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:           map[requestKey]uint64{},
+		requestDurations:   map[routeKey]*histogram{},
+		operations:         map[operationKey]uint64{},
+		operationDurations: map[string]*histogram{},
+	}
+}
+
+func (m *Metrics) ObserveRequest(method, route string, status int, elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.requests[requestKey{method, route, strconv.Itoa(status)}]++
+	rk := routeKey{method, route}
+	if _, ok := m.requestDurations[rk]; !ok {
+		m.requestDurations[rk] = newHistogram()
+	}
+	m.requestDurations[rk].observe(elapsed.Seconds())
+}
+
+func (m *Metrics) ObserveOperation(operation string, success bool, elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	m.operations[operationKey{operation, result}]++
+	if _, ok := m.operationDurations[operation]; !ok {
+		m.operationDurations[operation] = newHistogram()
+	}
+	m.operationDurations[operation].observe(elapsed.Seconds())
+}
+
+// WriteDaemonMetrics writes the request and operation metrics
+func (m *Metrics) WriteDaemonMetrics(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mw := metricsWriter{w: w}
+
+	mw.family("machined_http_requests_total", "counter", "Number of API requests by method, route and status code.")
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, key := range requests {
+		mw.sample("machined_http_requests_total", float64(m.requests[key]),
+			"method", key.method, "route", key.route, "status", key.status)
+	}
+
+	mw.family("machined_http_request_duration_seconds", "histogram", "API request latency by method and route.")
+	routes := make([]routeKey, 0, len(m.requestDurations))
+	for key := range m.requestDurations {
+		routes = append(routes, key)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].route != routes[j].route {
+			return routes[i].route < routes[j].route
+		}
+		return routes[i].method < routes[j].method
+	})
+	for _, key := range routes {
+		mw.histogram("machined_http_request_duration_seconds", m.requestDurations[key],
+			"method", key.method, "route", key.route)
+	}
+
+	mw.family("machined_operations_total", "counter", "Number of machine operations by result.")
+	operations := make([]operationKey, 0, len(m.operations))
+	for key := range m.operations {
+		operations = append(operations, key)
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		if operations[i].operation != operations[j].operation {
+			return operations[i].operation < operations[j].operation
+		}
+		return operations[i].result < operations[j].result
+	})
+	for _, key := range operations {
+		mw.sample("machined_operations_total", float64(m.operations[key]),
+			"operation", key.operation, "result", key.result)
+	}
+
+	mw.family("machined_operation_duration_seconds", "histogram", "Duration of machine operations.")
+	names := make([]string, 0, len(m.operationDurations))
+	for name := range m.operationDurations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mw.histogram("machined_operation_duration_seconds", m.operationDurations[name], "operation", name)
+	}
+}
+
+// metricsWriter emits the Prometheus text format.  Samples of a metric
+// family must be written together, directly after its HELP and TYPE lines.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (mw *metricsWriter) family(name, metricType, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// sample writes a single value, labels are given as name, value pairs
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(labels) > 0 {
+		sb.WriteString("{")
+		for idx := 0; idx+1 < len(labels); idx += 2 {
+			if idx > 0 {
+				sb.WriteString(",")
+			}
+			fmt.Fprintf(&sb, "%s=\"%s\"", labels[idx], escapeLabelValue(labels[idx+1]))
+		}
+		sb.WriteString("}")
+	}
+	fmt.Fprintf(mw.w, "%s %s\n", sb.String(), formatMetricValue(value))
+}
+
+func (mw *metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	for idx, bound := range metricsDurationBuckets {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		mw.sample(name+"_bucket", float64(h.buckets[idx]), append(labels, "le", le)...)
+	}
+	mw.sample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+	mw.sample(name+"_sum", h.sum, labels...)
+	mw.sample(name+"_count", float64(h.count), labels...)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type blockStats struct {
+	Device   string `json:"device"`
+	NodeName string `json:"node-name"`
+	QDev     string `json:"qdev"`
+	Stats    struct {
+		ReadBytes       uint64 `json:"rd_bytes"`
+		WriteBytes      uint64 `json:"wr_bytes"`
+		ReadOperations  uint64 `json:"rd_operations"`
+		WriteOperations uint64 `json:"wr_operations"`
+		FlushOperations uint64 `json:"flush_operations"`
+	} `json:"stats"`
+}
+
+func (b blockStats) Name() string {
+	for _, name := range []string{b.Device, b.QDev, b.NodeName} {
+		if name != "" {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+type vcpuInfo struct {
+	CPUIndex int `json:"cpu-index"`
+	ThreadID int `json:"thread-id"`
+}
+
+type rxFilterInfo struct {
+	Name    string `json:"name"`
+	MainMac string `json:"main-mac"`
+}
+
+type balloonInfo struct {
+	Actual uint64 `json:"actual"`
+}
+
+type vcpuTime struct {
+	index   int
+	seconds float64
+}
+
+// machineStats is a snapshot of a running machine
+type machineStats struct {
+	name         string
+	memoryBytes  uint64
+	balloonBytes uint64
+	hasBalloon   bool
+	blocks       []blockStats
+	nics         []rxFilterInfo
+	traffic      map[string]NICTraffic
+	vcpus        []vcpuTime
+	cpuSeconds   float64
+	rssBytes     uint64
+	hasProcess   bool
+}
+
+func collectMachineStats(m *Machine) machineStats {
+	stats := machineStats{name: m.Name, memoryBytes: uint64(m.Config.Memory) * 1024 * 1024}
+	vm := m.instance
+	if vm == nil {
+		return stats
+	}
+	stats.traffic = vm.NICTraffic()
+
+	var vcpus []vcpuInfo
+	err := vm.WithQMP(func(q *QMPConn) error {
+		if err := q.Execute("query-blockstats", nil, &stats.blocks); err != nil {
+			return err
+		}
+		if err := q.Execute("query-cpus-fast", nil, &vcpus); err != nil {
+			return err
+		}
+		// not every machine has a balloon or a nic which supports rx-filter
+		var balloon balloonInfo
+		if err := q.Execute("query-balloon", nil, &balloon); err == nil {
+			stats.balloonBytes = balloon.Actual
+			stats.hasBalloon = true
+		}
+		if err := q.Execute("query-rx-filter", nil, &stats.nics); err != nil {
+			log.Debugf("VM:%s query-rx-filter failed: %s", vm.Name(), err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Failed to collect QMP metrics for machine %s: %s", m.Name, err)
+	}
+
+	pid := vm.Pid()
+	if pid == 0 {
+		return stats
+	}
+	procDir := filepath.Join("/proc", strconv.Itoa(pid))
+	if cpuSeconds, err := readProcCPUSeconds(filepath.Join(procDir, "stat")); err == nil {
+		stats.cpuSeconds = cpuSeconds
+		stats.hasProcess = true
+	}
+	if rss, err := readProcRSS(filepath.Join(procDir, "status")); err == nil {
+		stats.rssBytes = rss
+	}
+	for _, vcpu := range vcpus {
+		statFile := filepath.Join(procDir, "task", strconv.Itoa(vcpu.ThreadID), "stat")
+		if seconds, err := readProcCPUSeconds(statFile); err == nil {
+			stats.vcpus = append(stats.vcpus, vcpuTime{index: vcpu.CPUIndex, seconds: seconds})
+		}
+	}
+	return stats
+}
+
+// readProcCPUSeconds returns utime + stime from a /proc stat file
+func readProcCPUSeconds(statFile string) (float64, error) {
+	content, err := os.ReadFile(statFile)
+	if err != nil {
+		return 0, err
+	}
+	// the command name may contain spaces, fields are counted after it
+	closeParen := strings.LastIndex(string(content), ")")
+	if closeParen < 0 {
+		return 0, fmt.Errorf("Failed to parse %s", statFile)
+	}
+	fields := strings.Fields(string(content[closeParen+1:]))
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("Failed to parse %s: too few fields", statFile)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse utime in %s: %s", statFile, err)
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse stime in %s: %s", statFile, err)
+	}
+	return float64(utime+stime) / procClockTicks, nil
+}
+
+// readProcRSS returns VmRSS from a /proc status file in bytes
+func readProcRSS(statusFile string) (uint64, error) {
+	fh, err := os.Open(statusFile)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("Failed to parse VmRSS in %s: %s", statusFile, err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("VmRSS not found in %s", statusFile)
+}
+
+// collectRunningStats queries the machines in parallel so that a machine
+// which does not answer only delays the scrape by metricsCollectTimeout.
+// Such machines only report their configured memory.
+func collectRunningStats(machines []*Machine) []machineStats {
+	// goroutines of machines which do not answer outlive the scrape
+	collect, timeout := collectStats, metricsCollectTimeout
+	results := make([]chan machineStats, len(machines))
+	for idx, m := range machines {
+		results[idx] = make(chan machineStats, 1)
+		go func(m *Machine, result chan machineStats) {
+			result <- collect(m)
+		}(m, results[idx])
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	expired := false
+	stats := make([]machineStats, len(machines))
+	for idx, m := range machines {
+		if !expired {
+			select {
+			case stats[idx] = <-results[idx]:
+				continue
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		select {
+		case stats[idx] = <-results[idx]:
+		default:
+			log.Warnf("Machine %s did not report metrics within %s", m.Name, timeout)
+			stats[idx] = machineStats{name: m.Name, memoryBytes: uint64(m.Config.Memory) * 1024 * 1024}
+		}
+	}
+	return stats
+}
+
+// WriteMachineMetrics writes machine counts and per machine metrics
+func WriteMachineMetrics(w io.Writer, machines []Machine) {
+	mw := metricsWriter{w: w}
+
+	counts := map[string]int{}
+	var runningMachines []*Machine
+	for idx := range machines {
+		counts[machines[idx].Status]++
+		if machines[idx].Status == MachineStatusRunning {
+			runningMachines = append(runningMachines, &machines[idx])
+		}
+	}
+	running := collectRunningStats(runningMachines)
+	mw.family("machined_machines", "gauge", "Number of defined machines by status.")
+	for _, status := range machineStatuses {
+		mw.sample("machined_machines", float64(counts[status]), "status", status)
+	}
+
+	mw.family("machine_up", "gauge", "Whether the machine is running.")
+	for idx := range machines {
+		up := 0.0
+		if machines[idx].Status == MachineStatusRunning {
+			up = 1
+		}
+		mw.sample("machine_up", up, "machine", machines[idx].Name)
+	}
+
+	mw.family("machine_memory_bytes", "gauge", "Memory configured for the machine.")
+	for _, s := range running {
+		mw.sample("machine_memory_bytes", float64(s.memoryBytes), "machine", s.name)
+	}
+	mw.family("machine_balloon_bytes", "gauge", "Guest memory as reported by the balloon device.")
+	for _, s := range running {
+		if s.hasBalloon {
+			mw.sample("machine_balloon_bytes", float64(s.balloonBytes), "machine", s.name)
+		}
+	}
+
+	blockCounters := []struct {
+		name  string
+		help  string
+		value func(b blockStats) uint64
+	}{
+		{"machine_block_read_bytes_total", "Bytes read by the guest per block device.",
+			func(b blockStats) uint64 { return b.Stats.ReadBytes }},
+		{"machine_block_write_bytes_total", "Bytes written by the guest per block device.",
+			func(b blockStats) uint64 { return b.Stats.WriteBytes }},
+		{"machine_block_read_ops_total", "Read operations per block device.",
+			func(b blockStats) uint64 { return b.Stats.ReadOperations }},
+		{"machine_block_write_ops_total", "Write operations per block device.",
+			func(b blockStats) uint64 { return b.Stats.WriteOperations }},
+		{"machine_block_flush_ops_total", "Flush operations per block device.",
+			func(b blockStats) uint64 { return b.Stats.FlushOperations }},
+	}
+	for _, counter := range blockCounters {
+		mw.family(counter.name, "counter", counter.help)
+		for _, s := range running {
+			for _, b := range s.blocks {
+				mw.sample(counter.name, float64(counter.value(b)), "machine", s.name, "device", b.Name())
+			}
+		}
+	}
+
+	mw.family("machine_vcpu_seconds_total", "counter", "Host cpu time consumed by each vCPU thread.")
+	for _, s := range running {
+		for _, vcpu := range s.vcpus {
+			mw.sample("machine_vcpu_seconds_total", vcpu.seconds, "machine", s.name, "vcpu", strconv.Itoa(vcpu.index))
+		}
+	}
+
+	mw.family("machine_nic_info", "gauge", "Guest network interfaces.")
+	for _, s := range running {
+		for _, nic := range s.nics {
+			mw.sample("machine_nic_info", 1, "machine", s.name, "nic", nic.Name, "mac", nic.MainMac)
+		}
+	}
+
+	nicCounters := []struct {
+		name  string
+		help  string
+		value func(t NICTraffic) uint64
+	}{
+		{"machine_nic_receive_bytes_total", "Bytes received by the guest per netdev.",
+			func(t NICTraffic) uint64 { return t.RxBytes }},
+		{"machine_nic_receive_packets_total", "Packets received by the guest per netdev.",
+			func(t NICTraffic) uint64 { return t.RxPackets }},
+		{"machine_nic_transmit_bytes_total", "Bytes sent by the guest per netdev.",
+			func(t NICTraffic) uint64 { return t.TxBytes }},
+		{"machine_nic_transmit_packets_total", "Packets sent by the guest per netdev.",
+			func(t NICTraffic) uint64 { return t.TxPackets }},
+	}
+	for _, counter := range nicCounters {
+		mw.family(counter.name, "counter", counter.help)
+		for _, s := range running {
+			netdevs := []string{}
+			for netdev := range s.traffic {
+				netdevs = append(netdevs, netdev)
+			}
+			sort.Strings(netdevs)
+			for _, netdev := range netdevs {
+				mw.sample(counter.name, float64(counter.value(s.traffic[netdev])), "machine", s.name, "netdev", netdev)
+			}
+		}
+	}
+
+	mw.family("machine_process_cpu_seconds_total", "counter", "Host cpu time consumed by the QEMU process.")
+	for _, s := range running {
+		if s.hasProcess {
+			mw.sample("machine_process_cpu_seconds_total", s.cpuSeconds, "machine", s.name)
+		}
+	}
+	mw.family("machine_process_resident_memory_bytes", "gauge", "Resident memory of the QEMU process.")
+	for _, s := range running {
+		if s.hasProcess {
+			mw.sample("machine_process_resident_memory_bytes", float64(s.rssBytes), "machine", s.name)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/project-machine/qcli"
+)
+
+func TestMetricsText(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveRequest("GET", "/machines", 200, 20*time.Millisecond)
+	m.ObserveRequest("GET", "/machines", 200, 2*time.Second)
+	m.ObserveOperation("start", false, time.Second)
+
+	var out bytes.Buffer
+	m.WriteDaemonMetrics(&out)
+	WriteMachineMetrics(&out, []Machine{{Name: `vm"1`, Status: MachineStatusStopped}})
+	text := out.String()
+
+	for _, expected := range []string{
+		"# TYPE machined_http_requests_total counter\n",
+		`machined_http_requests_total{method="GET",route="/machines",status="200"} 2` + "\n",
+		`machined_http_request_duration_seconds_bucket{method="GET",route="/machines",le="0.025"} 1` + "\n",
+		`machined_http_request_duration_seconds_bucket{method="GET",route="/machines",le="+Inf"} 2` + "\n",
+		`machined_http_request_duration_seconds_count{method="GET",route="/machines"} 2` + "\n",
+		`machined_operations_total{operation="start",result="failure"} 1` + "\n",
+		`machined_machines{status="stopped"} 1` + "\n",
+		`machine_up{machine="vm\"1"} 0` + "\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected %q in metrics output:\n%s", expected, text)
+		}
+	}
+}
+
+func TestReadProcStats(t *testing.T) {
+	if _, err := readProcCPUSeconds("/proc/self/stat"); err != nil {
+		t.Fatalf("failed to read cpu time: %s", err)
+	}
+	rss, err := readProcRSS("/proc/self/status")
+	if err != nil {
+		t.Fatalf("failed to read rss: %s", err)
+	}
+	if rss == 0 {
+		t.Fatalf("expected non-zero rss")
+	}
+}
+
+func TestCollectRunningStatsTimeout(t *testing.T) {
+	savedCollect, savedTimeout := collectStats, metricsCollectTimeout
+	defer func() { collectStats, metricsCollectTimeout = savedCollect, savedTimeout }()
+	metricsCollectTimeout = 100 * time.Millisecond
+	hung := make(chan struct{})
+	defer close(hung)
+	collectStats = func(m *Machine) machineStats {
+		if m.Name == "hung" {
+			<-hung
+		}
+		return machineStats{name: m.Name, hasBalloon: true}
+	}
+
+	machines := make([]Machine, 3)
+	machines[0].Name = "vm1"
+	machines[1].Name = "hung"
+	machines[1].Config.Memory = 1024
+	machines[2].Name = "vm2"
+	start := time.Now()
+	stats := collectRunningStats([]*Machine{&machines[0], &machines[1], &machines[2]})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("collecting stats took %s", elapsed)
+	}
+	if !stats[0].hasBalloon || !stats[2].hasBalloon {
+		t.Fatalf("expected stats of responsive machines, got %+v", stats)
+	}
+	if stats[1].name != "hung" || stats[1].hasBalloon || stats[1].memoryBytes != 1024*1024*1024 {
+		t.Fatalf("expected configured memory only for hung machine, got %+v", stats[1])
+	}
+}
+
+// pcapStream returns a pcap stream in little endian order with a record for
+// each packet length
+func pcapStream(lengths ...uint32) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(header, pcapMagic)
+	buf.Write(header)
+	for _, length := range lengths {
+		record := make([]byte, pcapRecordHeaderLen)
+		capLen := length
+		if capLen > nicDumpMaxLen {
+			capLen = nicDumpMaxLen
+		}
+		binary.LittleEndian.PutUint32(record[8:], capLen)
+		binary.LittleEndian.PutUint32(record[12:], length)
+		buf.Write(record)
+		buf.Write(make([]byte, capLen))
+	}
+	return buf.Bytes()
+}
+
+func TestNICCounters(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-nic-counters")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	c := &qcli.Config{NetDevices: []qcli.NetDevice{{ID: "net0"}}}
+	counters := newNICCounters(c, tmpDir)
+	expected := []string{
+		"-object", "filter-dump,id=nicstats-net0-rx,netdev=net0,queue=tx,file=" + tmpDir + "/nicstats-net0-rx.pcap,maxlen=64",
+		"-object", "filter-dump,id=nicstats-net0-tx,netdev=net0,queue=rx,file=" + tmpDir + "/nicstats-net0-tx.pcap,maxlen=64",
+	}
+	if params := nicCounterParams(counters); strings.Join(params, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected params\n%v\ngot\n%v", expected, params)
+	}
+
+	vm := &VM{nicCounters: counters}
+	if err := vm.startNICCounters(); err != nil {
+		t.Fatalf("failed to start nic counters: %s", err)
+	}
+	defer vm.stopNICCounters()
+	for _, n := range counters {
+		lengths := []uint32{60, 1514}
+		if !n.rx {
+			lengths = []uint32{42}
+		}
+		fifo, err := os.OpenFile(n.fifo, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("failed to open fifo: %s", err)
+		}
+		fifo.Write(pcapStream(lengths...))
+		fifo.Close()
+	}
+
+	expectedTraffic := NICTraffic{RxBytes: 1574, RxPackets: 2, TxBytes: 42, TxPackets: 1}
+	for i := 0; i < 100 && vm.NICTraffic()["net0"] != expectedTraffic; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if traffic := vm.NICTraffic()["net0"]; traffic != expectedTraffic {
+		t.Fatalf("expected traffic %+v, got %+v", expectedTraffic, traffic)
+	}
+
+	// a counter which cannot parse its FIFO closes and removes it so that
+	// QEMU never blocks on a full pipe
+	bad := &nicCounter{netdev: "net1", rx: true, fifo: filepath.Join(tmpDir, "bad.pcap")}
+	vm.nicCounters = append(vm.nicCounters, bad)
+	if err := bad.start(vm.dropNICCounter); err != nil {
+		t.Fatalf("failed to start nic counter: %s", err)
+	}
+	fifo, err := os.OpenFile(bad.fifo, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open fifo: %s", err)
+	}
+	fifo.Write(make([]byte, pcapHeaderLen))
+	fifo.Close()
+	for i := 0; i < 100 && PathExists(bad.fifo); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if PathExists(bad.fifo) {
+		t.Fatalf("expected the failed nic counter FIFO to be removed")
+	}
+	bad.lock.Lock()
+	closed := bad.file == nil
+	bad.lock.Unlock()
+	if !closed {
+		t.Fatalf("expected the failed nic counter FIFO to be closed")
+	}
+
+	saved := collectStats
+	defer func() { collectStats = saved }()
+	collectStats = func(m *Machine) machineStats {
+		return machineStats{name: m.Name, traffic: vm.NICTraffic()}
+	}
+	var out bytes.Buffer
+	WriteMachineMetrics(&out, []Machine{{Name: "vm1", Status: MachineStatusRunning}})
+	for _, sample := range []string{
+		`machine_nic_receive_bytes_total{machine="vm1",netdev="net0"} 1574`,
+		`machine_nic_transmit_packets_total{machine="vm1",netdev="net0"} 1`,
+	} {
+		if !strings.Contains(out.String(), sample+"\n") {
+			t.Fatalf("expected %q in metrics output:\n%s", sample, out.String())
+		}
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/project-machine/qcli"
+	log "github.com/sirupsen/logrus"
+)
+
+// QMP has no traffic counters for user mode networking, so each netdev gets
+// a filter-dump per direction which writes pcap records to a FIFO that
+// machined reads to count packets and bytes.
+const (
+	// only the start of each packet is written to the FIFO
+	nicDumpMaxLen = 64
+
+	pcapMagic           = 0xa1b2c3d4
+	pcapHeaderLen       = 24
+	pcapRecordHeaderLen = 16
+)
+
+// NICTraffic is the traffic of a guest nic as seen by the guest
+type NICTraffic struct {
+	RxBytes   uint64
+	RxPackets uint64
+	TxBytes   uint64
+	TxPackets uint64
+}
+
+// nicCounter counts the packets QEMU dumps for one direction of a netdev
+type nicCounter struct {
+	netdev  string
+	rx      bool
+	fifo    string
+	lock    sync.Mutex
+	file    *os.File
+	bytes   atomic.Uint64
+	packets atomic.Uint64
+}
+
+// newNICCounters returns a receive and a transmit counter for each netdev
+func newNICCounters(c *qcli.Config, sockDir string) []*nicCounter {
+	counters := []*nicCounter{}
+	for _, netdev := range c.NetDevices {
+		for _, rx := range []bool{true, false} {
+			counter := &nicCounter{netdev: netdev.ID, rx: rx}
+			counter.fifo = filepath.Join(sockDir, fmt.Sprintf("%s.pcap", counter.id()))
+			counters = append(counters, counter)
+		}
+	}
+	return counters
+}
+
+func (n *nicCounter) id() string {
+	if n.rx {
+		return "nicstats-" + n.netdev + "-rx"
+	}
+	return "nicstats-" + n.netdev + "-tx"
+}
+
+// nicCounterParams returns the filter-dump objects of the counters.  The
+// transmit queue of a netdev carries the packets the guest receives.
+func nicCounterParams(counters []*nicCounter) []string {
+	params := []string{}
+	for _, n := range counters {
+		queue := "rx"
+		if n.rx {
+			queue = "tx"
+		}
+		params = append(params, "-object",
+			fmt.Sprintf("filter-dump,id=%s,netdev=%s,queue=%s,file=%s,maxlen=%d", n.id(), n.netdev, queue, n.fifo, nicDumpMaxLen))
+	}
+	return params
+}
+
+// start creates the FIFO and counts what QEMU writes to it until stop.  The
+// FIFO is opened read-write so that it never reports EOF and QEMU does not
+// block opening it.  failed is called if counting stops before stop.
+func (n *nicCounter) start(failed func(n *nicCounter, err error)) error {
+	os.Remove(n.fifo)
+	if err := syscall.Mkfifo(n.fifo, 0600); err != nil {
+		return fmt.Errorf("Failed to create nic counter FIFO %q: %s", n.fifo, err)
+	}
+	file, err := os.OpenFile(n.fifo, os.O_RDWR, 0)
+	if err != nil {
+		os.Remove(n.fifo)
+		return fmt.Errorf("Failed to open nic counter FIFO %q: %s", n.fifo, err)
+	}
+	n.file = file
+	go func() {
+		if err := n.count(file); err != nil && !errors.Is(err, os.ErrClosed) {
+			failed(n, err)
+		}
+	}()
+	return nil
+}
+
+func (n *nicCounter) stop() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.file != nil {
+		n.file.Close()
+		n.file = nil
+	}
+	os.Remove(n.fifo)
+}
+
+// count adds up the original length of the packets in a pcap stream
+func (n *nicCounter) count(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, pcapHeaderLen)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return err
+	}
+	// QEMU writes pcap in host byte order
+	var order binary.ByteOrder = binary.LittleEndian
+	if binary.BigEndian.Uint32(header) == pcapMagic {
+		order = binary.BigEndian
+	} else if binary.LittleEndian.Uint32(header) != pcapMagic {
+		return fmt.Errorf("Unexpected pcap magic %x", header[:4])
+	}
+	record := make([]byte, pcapRecordHeaderLen)
+	for {
+		if _, err := io.ReadFull(br, record); err != nil {
+			return err
+		}
+		capLen := order.Uint32(record[8:12])
+		origLen := order.Uint32(record[12:16])
+		if _, err := br.Discard(int(capLen)); err != nil {
+			return err
+		}
+		n.packets.Add(1)
+		n.bytes.Add(uint64(origLen))
+	}
+}
+
+// startNICCounters must run before QEMU opens the FIFOs
+func (v *VM) startNICCounters() error {
+	for _, n := range v.nicCounters {
+		if err := n.start(v.dropNICCounter); err != nil {
+			v.stopNICCounters()
+			return err
+		}
+	}
+	return nil
+}
+
+// dropNICCounter stops a counter which can no longer read its FIFO.  Closing
+// the FIFO makes QEMU's writes fail instead of blocking the netdev once the
+// pipe is full, and deleting the filter stops QEMU dumping the packets.
+func (v *VM) dropNICCounter(n *nicCounter, err error) {
+	log.Warnf("VM:%s nic counter %s stopped: %s", v.Name(), n.id(), err)
+	n.stop()
+	if err := v.QMPExecute("object-del", map[string]string{"id": n.id()}, nil); err != nil {
+		log.Warnf("VM:%s failed to remove nic counter filter %s: %s", v.Name(), n.id(), err)
+	}
+}
+
+func (v *VM) stopNICCounters() {
+	for _, n := range v.nicCounters {
+		n.stop()
+	}
+}
+
+// NICTraffic returns the traffic of each netdev of the VM
+func (v *VM) NICTraffic() map[string]NICTraffic {
+	traffic := map[string]NICTraffic{}
+	for _, n := range v.nicCounters {
+		t := traffic[n.netdev]
+		if n.rx {
+			t.RxBytes = n.bytes.Load()
+			t.RxPackets = n.packets.Load()
+		} else {
+			t.TxBytes = n.bytes.Load()
+			t.TxPackets = n.packets.Load()
+		}
+		traffic[n.netdev] = t
+	}
+	return traffic
+}
@@ -0,0 +1,594 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Disk and cdrom images may be pulled from OCI registries with
+// oci://registry/repository:tag or from OCI layout directories with
+// oci-layout:/path/to/layout:tag, either may use @sha256:<digest> in place
+// of the tag
+const (
+	OCIRegistryPrefix = "oci://"
+	OCILayoutPrefix   = "oci-layout:"
+
+	ociDefaultTag = "latest"
+
+	ociMediaTypeManifest          = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeIndex             = "application/vnd.oci.image.index.v1+json"
+	dockerMediaTypeManifest       = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerMediaTypeList           = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociAnnotationTitle            = "org.opencontainers.image.title"
+	ociAnnotationRefName          = "org.opencontainers.image.ref.name"
+	ociManifestMaxSize      int64 = 4 * 1024 * 1024
+
+	// registries which stop answering fail the pull instead of holding it
+	ociResponseTimeout = time.Second * 60
+	ociRequestTimeout  = time.Second * 3600
+)
+
+// layers with these suffixes hold disk or cdrom images
+var ociDiskSuffixes = []string{".qcow2", ".img", ".raw", ".iso", "qcow2", "raw-disk-image", "iso9660"}
+
+// ImagePullRequest is the body of POST /images/pull
+type ImagePullRequest struct {
+	Ref   string   `json:"ref"`
+	Names []string `json:"names"`
+}
+
+type OCIReference struct {
+	Registry   string
+	Repository string
+	LayoutDir  string
+	Tag        string
+	Digest     string
+}
+
+// IsOCIReference returns true if ref names an image in a registry or
+// layout directory
+func IsOCIReference(ref string) bool {
+	return strings.HasPrefix(ref, OCIRegistryPrefix) || strings.HasPrefix(ref, OCILayoutPrefix)
+}
+
+// checkOCILayoutAccess checks that the caller may read the layout of an
+// oci-layout reference, other references are not host paths
+func checkOCILayoutAccess(ref string, access PathAccessFunc) error {
+	if !strings.HasPrefix(ref, OCILayoutPrefix) {
+		return nil
+	}
+	r, err := ParseOCIReference(ref)
+	if err != nil {
+		return err
+	}
+	return access(r.LayoutDir, unix.R_OK|unix.X_OK)
+}
+
+func ParseOCIReference(ref string) (OCIReference, error) {
+	var r OCIReference
+	var rest string
+	switch {
+	case strings.HasPrefix(ref, OCIRegistryPrefix):
+		rest = strings.TrimPrefix(ref, OCIRegistryPrefix)
+	case strings.HasPrefix(ref, OCILayoutPrefix):
+		rest = strings.TrimPrefix(ref, OCILayoutPrefix)
+	default:
+		return r, fmt.Errorf("Invalid OCI reference '%s', expected %s or %s prefix", ref, OCIRegistryPrefix, OCILayoutPrefix)
+	}
+
+	if name, digest, found := strings.Cut(rest, "@"); found {
+		if !strings.HasPrefix(digest, ImageDigestAlgo+":") || len(digest) != len(ImageDigestAlgo)+1+sha256.Size*2 {
+			return r, fmt.Errorf("Invalid OCI reference '%s', unsupported digest '%s'", ref, digest)
+		}
+		rest = name
+		r.Digest = digest
+	}
+	// a tag follows the last ':' after the last '/'
+	if idx := strings.LastIndex(rest, ":"); idx > strings.LastIndex(rest, "/") {
+		r.Tag = rest[idx+1:]
+		rest = rest[:idx]
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = ociDefaultTag
+	}
+
+	if strings.HasPrefix(ref, OCILayoutPrefix) {
+		if rest == "" {
+			return r, fmt.Errorf("Invalid OCI reference '%s', missing layout directory", ref)
+		}
+		r.LayoutDir = rest
+		return r, nil
+	}
+	registry, repository, found := strings.Cut(rest, "/")
+	if !found || registry == "" || repository == "" {
+		return r, fmt.Errorf("Invalid OCI reference '%s', expected %sregistry/repository[:tag]", ref, OCIRegistryPrefix)
+	}
+	r.Registry = registry
+	r.Repository = repository
+	return r, nil
+}
+
+func (r OCIReference) String() string {
+	var s string
+	if r.LayoutDir != "" {
+		s = OCILayoutPrefix + r.LayoutDir
+	} else {
+		s = OCIRegistryPrefix + r.Registry + "/" + r.Repository
+	}
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// Name returns a file and image name for the reference, the last path
+// element and tag, e.g. ubuntu:22.04
+func (r OCIReference) Name() string {
+	base := path.Base(r.Repository)
+	if r.LayoutDir != "" {
+		base = filepath.Base(r.LayoutDir)
+	}
+	if r.Tag != "" {
+		return base + ":" + r.Tag
+	}
+	return base
+}
+
+type ociDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest covers both image manifests and indexes
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+func (m ociManifest) isIndex(mediaType string) bool {
+	return mediaType == ociMediaTypeIndex || mediaType == dockerMediaTypeList || len(m.Manifests) > 0
+}
+
+// ociSource fetches manifests and blobs from a registry or layout
+type ociSource interface {
+	// manifest returns the manifest for a tag or digest
+	manifest(reference string) ([]byte, string, error)
+	blob(desc ociDescriptor) (io.ReadCloser, error)
+}
+
+type ociLayout struct {
+	dir string
+}
+
+func (l *ociLayout) manifest(reference string) ([]byte, string, error) {
+	if !strings.HasPrefix(reference, ImageDigestAlgo+":") {
+		content, err := os.ReadFile(filepath.Join(l.dir, "index.json"))
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to read OCI layout index: %s", err)
+		}
+		var index ociManifest
+		if err := json.Unmarshal(content, &index); err != nil {
+			return nil, "", fmt.Errorf("Failed to parse OCI layout index: %s", err)
+		}
+		found := false
+		for _, desc := range index.Manifests {
+			if desc.Annotations[ociAnnotationRefName] == reference {
+				reference = desc.Digest
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, "", fmt.Errorf("Tag '%s' not found in OCI layout %s", reference, l.dir)
+		}
+	}
+	rc, err := l.blob(ociDescriptor{Digest: reference})
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(io.LimitReader(rc, ociManifestMaxSize))
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to read manifest %s: %s", reference, err)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, "", fmt.Errorf("Failed to parse manifest %s: %s", reference, err)
+	}
+	return content, m.MediaType, nil
+}
+
+func (l *ociLayout) blob(desc ociDescriptor) (io.ReadCloser, error) {
+	algo, hexDigest, _ := strings.Cut(desc.Digest, ":")
+	f, err := os.Open(filepath.Join(l.dir, "blobs", algo, filepath.Base(hexDigest)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open blob %s: %s", desc.Digest, err)
+	}
+	return f, nil
+}
+
+// ociRegistry speaks the OCI distribution protocol, fetching anonymous
+// bearer tokens when the registry asks for them
+type ociRegistry struct {
+	ref    OCIReference
+	client *http.Client
+	token  string
+}
+
+func newOCIRegistry(ref OCIReference) *ociRegistry {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = ociResponseTimeout
+	return &ociRegistry{
+		ref:    ref,
+		client: &http.Client{Transport: transport, Timeout: ociRequestTimeout},
+	}
+}
+
+func (r *ociRegistry) baseURL() string {
+	// like other container tools, registries on the local host use http
+	scheme := "https"
+	host := r.ref.Registry
+	if h, _, found := strings.Cut(host, ":"); found {
+		host = h
+	}
+	if host == "localhost" || host == "127.0.0.1" || strings.HasPrefix(r.ref.Registry, "[::1]") {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, r.ref.Registry, r.ref.Repository)
+}
+
+func (r *ociRegistry) get(endpoint string, accept []string) (*http.Response, error) {
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, r.baseURL()+endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		}
+		return r.client.Do(req)
+	}
+	resp, err := do()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch %s from %s: %s", endpoint, r.ref.Registry, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized && r.token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := r.authenticate(challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = do(); err != nil {
+			return nil, fmt.Errorf("Failed to fetch %s from %s: %s", endpoint, r.ref.Registry, err)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Failed to fetch %s from %s: %s", endpoint, r.ref.Registry, resp.Status)
+	}
+	return resp, nil
+}
+
+// authenticate requests an anonymous token for the bearer challenge
+func (r *ociRegistry) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("Registry %s requires unsupported authentication '%s'", r.ref.Registry, scheme)
+	}
+	values := url.Values{}
+	var realm string
+	for _, param := range strings.Split(params, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if key == "realm" {
+			realm = value
+		} else {
+			values.Set(key, value)
+		}
+	}
+	if realm == "" {
+		return fmt.Errorf("Registry %s sent a bearer challenge without realm", r.ref.Registry)
+	}
+	if values.Get("scope") == "" {
+		values.Set("scope", fmt.Sprintf("repository:%s:pull", r.ref.Repository))
+	}
+	resp, err := r.client.Get(realm + "?" + values.Encode())
+	if err != nil {
+		return fmt.Errorf("Failed to get token from %s: %s", realm, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to get token from %s: %s", realm, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("Failed to parse token from %s: %s", realm, err)
+	}
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	return nil
+}
+
+func (r *ociRegistry) manifest(reference string) ([]byte, string, error) {
+	accept := []string{ociMediaTypeManifest, ociMediaTypeIndex, dockerMediaTypeManifest, dockerMediaTypeList}
+	resp, err := r.get("/manifests/"+reference, accept)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(io.LimitReader(resp.Body, ociManifestMaxSize))
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to read manifest %s: %s", reference, err)
+	}
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	return content, mediaType, nil
+}
+
+func (r *ociRegistry) blob(desc ociDescriptor) (io.ReadCloser, error) {
+	resp, err := r.get("/blobs/"+desc.Digest, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func newOCISource(ref OCIReference) ociSource {
+	if ref.LayoutDir != "" {
+		return &ociLayout{dir: ref.LayoutDir}
+	}
+	return newOCIRegistry(ref)
+}
+
+// resolveOCIManifest returns the image manifest for ref and its digest,
+// choosing the entry for this host from an index
+func resolveOCIManifest(source ociSource, ref OCIReference) (ociManifest, string, error) {
+	reference := ref.Digest
+	if reference == "" {
+		reference = ref.Tag
+	}
+	for depth := 0; depth < 2; depth++ {
+		content, mediaType, err := source.manifest(reference)
+		if err != nil {
+			return ociManifest{}, "", err
+		}
+		digest := ImageDigestAlgo + ":" + hex.EncodeToString(sha256Sum(content))
+		if strings.HasPrefix(reference, ImageDigestAlgo+":") && digest != reference {
+			return ociManifest{}, "", fmt.Errorf("Manifest digest mismatch for %s: got %s", reference, digest)
+		}
+		var m ociManifest
+		if err := json.Unmarshal(content, &m); err != nil {
+			return ociManifest{}, "", fmt.Errorf("Failed to parse manifest %s: %s", reference, err)
+		}
+		if !m.isIndex(mediaType) {
+			return m, digest, nil
+		}
+		reference = ""
+		for _, desc := range m.Manifests {
+			if desc.Platform == nil || (desc.Platform.Architecture == runtime.GOARCH && desc.Platform.OS == "linux") {
+				reference = desc.Digest
+				break
+			}
+		}
+		if reference == "" {
+			return ociManifest{}, "", fmt.Errorf("No manifest for linux/%s in %s", runtime.GOARCH, ref)
+		}
+	}
+	return ociManifest{}, "", fmt.Errorf("Nested index in %s is not supported", ref)
+}
+
+func sha256Sum(content []byte) []byte {
+	sum := sha256.Sum256(content)
+	return sum[:]
+}
+
+// selectDiskLayer picks the disk or cdrom image out of the manifest
+// layers, the only layer or the one whose title or media type names a
+// disk image
+func selectDiskLayer(m ociManifest) (ociDescriptor, error) {
+	if len(m.Layers) == 1 {
+		return m.Layers[0], nil
+	}
+	for _, layer := range m.Layers {
+		title := strings.ToLower(layer.Annotations[ociAnnotationTitle])
+		mediaType := strings.TrimSuffix(strings.TrimSuffix(layer.MediaType, "+gzip"), ".gzip")
+		for _, suffix := range ociDiskSuffixes {
+			if strings.HasSuffix(title, suffix) || strings.HasSuffix(mediaType, suffix) {
+				return layer, nil
+			}
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("Found %d layers but none is a disk image, expected a single layer or one titled *.qcow2, *.img, *.raw or *.iso", len(m.Layers))
+}
+
+// fetchOCIBlob downloads desc into dir, verifying its size and digest, and
+// decompresses gzip layers.  The caller removes the returned file.
+func fetchOCIBlob(source ociSource, desc ociDescriptor, dir string) (string, error) {
+	if !strings.HasPrefix(desc.Digest, ImageDigestAlgo+":") {
+		return "", fmt.Errorf("Unsupported layer digest '%s'", desc.Digest)
+	}
+	rc, err := source.blob(desc)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	if err := EnsureDir(dir); err != nil {
+		return "", fmt.Errorf("Failed to create image dir: %s", err)
+	}
+	tmp, err := os.CreateTemp(dir, "pull-")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create temp file: %s", err)
+	}
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), rc)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("Failed to download %s: %s", desc.Digest, err)
+	}
+	digest := ImageDigestAlgo + ":" + hex.EncodeToString(h.Sum(nil))
+	if digest != desc.Digest || (desc.Size > 0 && size != desc.Size) {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("Layer verification failed: expected %s (%d bytes), got %s (%d bytes)", desc.Digest, desc.Size, digest, size)
+	}
+
+	if !strings.HasSuffix(desc.MediaType, "gzip") {
+		return tmp.Name(), nil
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	zr, err := gzip.NewReader(tmp)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decompress %s: %s", desc.Digest, err)
+	}
+	out, err := os.CreateTemp(dir, "pull-")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create temp file: %s", err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, zr); err != nil {
+		os.Remove(out.Name())
+		return "", fmt.Errorf("Failed to decompress %s: %s", desc.Digest, err)
+	}
+	return out.Name(), nil
+}
+
+// Pull fetches the disk image layer of ref into the store.  Images are
+// recorded with the pinned layer reference as Source so pulling an
+// unchanged tag again does not download it.
+func (s *ImageStore) Pull(refStr string, names []string, ownerUID int) (Image, error) {
+	ref, err := ParseOCIReference(refStr)
+	if err != nil {
+		return Image{}, err
+	}
+	if len(names) == 0 && ref.Tag != "" {
+		names = []string{ref.Name()}
+	}
+	for _, name := range names {
+		if err := ValidImageName(name); err != nil {
+			return Image{}, err
+		}
+	}
+
+	source := newOCISource(ref)
+	log.Infof("Resolving %s", ref)
+	manifest, manifestDigest, err := resolveOCIManifest(source, ref)
+	if err != nil {
+		return Image{}, err
+	}
+	layer, err := selectDiskLayer(manifest)
+	if err != nil {
+		return Image{}, fmt.Errorf("%s: %s", ref, err)
+	}
+	pinned := ref
+	pinned.Tag = ""
+	pinned.Digest = manifestDigest
+	sourceRef := pinned.String()
+
+	if image, found, err := s.findSource(sourceRef); err != nil {
+		return Image{}, err
+	} else if found {
+		log.Infof("Image %s is up to date", ref)
+		image.Names = names
+		return s.add("", image)
+	}
+
+	log.Infof("Pulling %s layer %s (%d bytes)", ref, layer.Digest, layer.Size)
+	start := time.Now()
+	tmpFile, err := fetchOCIBlob(source, layer, filepath.Join(s.Dir, "tmp"))
+	if err != nil {
+		return Image{}, err
+	}
+	defer os.Remove(tmpFile)
+	log.Infof("Pulled %s in %s", ref, time.Since(start).Round(time.Millisecond))
+
+	format, err := DetectImageFormat(tmpFile)
+	if err != nil {
+		return Image{}, err
+	}
+	if err := checkStandaloneImage(tmpFile); err != nil {
+		return Image{}, fmt.Errorf("%s: %s", ref, err)
+	}
+	digest, size, err := hashFile(tmpFile)
+	if err != nil {
+		return Image{}, err
+	}
+	return s.add(tmpFile, Image{
+		Digest:   digest,
+		Names:    names,
+		Format:   format,
+		Size:     size,
+		Source:   sourceRef,
+		OwnerUID: ownerUID,
+	})
+}
+
+// findSource returns the stored image pulled from source
+func (s *ImageStore) findSource(source string) (Image, bool, error) {
+	imageStoreLock.Lock()
+	defer imageStoreLock.Unlock()
+	images, err := s.load()
+	if err != nil {
+		return Image{}, false, err
+	}
+	for _, image := range images {
+		if image.Source == source && PathExists(s.BlobPath(image.Digest)) {
+			return image, true, nil
+		}
+	}
+	return Image{}, false, nil
+}
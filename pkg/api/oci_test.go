@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeOCIBlob(t *testing.T, layoutDir string, content []byte) string {
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	blobDir := filepath.Join(layoutDir, "blobs", "sha256")
+	if err := EnsureDir(blobDir); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.WriteFile(filepath.Join(blobDir, hex.EncodeToString(sum[:])), content, 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return digest
+}
+
+// writeOCILayout writes an OCI layout with a single disk image layer
+// tagged tag and returns the manifest digest
+func writeOCILayout(t *testing.T, layoutDir, tag string, layer []byte, mediaType string) string {
+	layerDigest := writeOCIBlob(t, layoutDir, layer)
+	configDigest := writeOCIBlob(t, layoutDir, []byte("{}"))
+	manifest, err := json.Marshal(ociManifest{
+		MediaType: ociMediaTypeManifest,
+		Config:    ociDescriptor{MediaType: "application/vnd.oci.empty.v1+json", Digest: configDigest, Size: 2},
+		Layers: []ociDescriptor{
+			{MediaType: mediaType, Digest: layerDigest, Size: int64(len(layer)), Annotations: map[string]string{ociAnnotationTitle: "disk.qcow2"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	manifestDigest := writeOCIBlob(t, layoutDir, manifest)
+	index, err := json.Marshal(ociManifest{
+		MediaType: ociMediaTypeIndex,
+		Manifests: []ociDescriptor{
+			{MediaType: ociMediaTypeManifest, Digest: manifestDigest, Size: int64(len(manifest)), Annotations: map[string]string{ociAnnotationRefName: tag}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.WriteFile(filepath.Join(layoutDir, "index.json"), index, 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return manifestDigest
+}
+
+// newTestRegistry serves the layout dir as repository machine/ubuntu,
+// requiring an anonymous bearer token
+func newTestRegistry(t *testing.T, layoutDir string) *httptest.Server {
+	layout := &ociLayout{dir: layoutDir}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			json.NewEncoder(w).Encode(map[string]string{"token": "anonymous"})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer anonymous" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		prefix := "/v2/machine/ubuntu/"
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		kind, reference, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		switch kind {
+		case "manifests":
+			content, mediaType, err := layout.manifest(reference)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", mediaType)
+			w.Write(content)
+		case "blobs":
+			rc, err := layout.blob(ociDescriptor{Digest: reference})
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			defer rc.Close()
+			w.Header().Set("Content-Type", "application/octet-stream")
+			io.Copy(w, rc)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestParseOCIReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	cases := map[string]OCIReference{
+		"oci://zothub.io/machine/ubuntu:22.04":      {Registry: "zothub.io", Repository: "machine/ubuntu", Tag: "22.04"},
+		"oci://localhost:5000/ubuntu":               {Registry: "localhost:5000", Repository: "ubuntu", Tag: "latest"},
+		"oci://localhost:5000/ubuntu@" + digest:     {Registry: "localhost:5000", Repository: "ubuntu", Digest: digest},
+		"oci-layout:/srv/images/ubuntu:22.04":       {LayoutDir: "/srv/images/ubuntu", Tag: "22.04"},
+		"oci-layout:layouts/ubuntu:22.04@" + digest: {LayoutDir: "layouts/ubuntu", Tag: "22.04", Digest: digest},
+	}
+	for input, expected := range cases {
+		ref, err := ParseOCIReference(input)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", input, err)
+		}
+		if ref != expected {
+			t.Fatalf("parsing %s expected %+v got %+v", input, expected, ref)
+		}
+	}
+	for _, input := range []string{"zothub.io/ubuntu", "oci://ubuntu", "oci://zothub.io/ubuntu@sha256:abc", "oci-layout:"} {
+		if _, err := ParseOCIReference(input); err == nil {
+			t.Fatalf("expected error parsing %s", input)
+		}
+	}
+}
+
+func TestImageStorePullLayout(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-oci")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("raw disk image"))
+	zw.Close()
+	layoutDir := filepath.Join(tmpDir, "ubuntu")
+	writeOCILayout(t, layoutDir, "22.04", compressed.Bytes(), "application/vnd.machine.disk.raw+gzip")
+
+	store := NewImageStore(filepath.Join(tmpDir, "images"))
+	image, err := store.Pull("oci-layout:"+layoutDir+":22.04", nil, 1000)
+	if err != nil {
+		t.Fatalf("failed to pull image: %s", err)
+	}
+	content, err := os.ReadFile(store.BlobPath(image.Digest))
+	if err != nil || string(content) != "raw disk image" {
+		t.Fatalf("expected decompressed layer in the store, got %q: %v", content, err)
+	}
+	if len(image.Names) != 1 || image.Names[0] != "ubuntu:22.04" || image.Format != "raw" {
+		t.Fatalf("unexpected image %+v", image)
+	}
+	if _, err := store.Pull("oci-layout:"+layoutDir+":missing", nil, 1000); err == nil {
+		t.Fatalf("expected error pulling a missing tag")
+	}
+	backedDir := filepath.Join(tmpDir, "backed")
+	writeOCILayout(t, backedDir, "latest", qcow2Header("/etc/shadow", ""), "application/vnd.machine.disk.qcow2")
+	if _, err := store.Pull("oci-layout:"+backedDir+":latest", nil, 1000); err == nil {
+		t.Fatalf("expected error pulling an image with a backing file")
+	}
+	// layouts are host paths, the caller must be able to read them
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyOwner}
+	ref := "oci-layout:" + layoutDir + ":22.04"
+	if err := checkOCILayoutAccess(ref, cfg.PathAccess(Caller{UID: 54321, GID: 54321})); err == nil {
+		t.Fatalf("expected error for a layout the caller cannot read")
+	}
+	if err := checkOCILayoutAccess("oci://zot.local/ubuntu:22.04", cfg.PathAccess(Caller{UID: 54321, GID: 54321})); err != nil {
+		t.Fatalf("registry references are not host paths: %s", err)
+	}
+}
+
+func TestImageStorePullRegistry(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-oci")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	layoutDir := filepath.Join(tmpDir, "layout")
+	layer := qcow2Header("", "")
+	manifestDigest := writeOCILayout(t, layoutDir, "22.04", layer, "application/vnd.machine.disk.qcow2")
+	server := newTestRegistry(t, layoutDir)
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	store := NewImageStore(filepath.Join(tmpDir, "images"))
+	ref := "oci://" + registry + "/machine/ubuntu:22.04"
+	image, err := store.Pull(ref, []string{"ubuntu"}, 1000)
+	if err != nil {
+		t.Fatalf("failed to pull image: %s", err)
+	}
+	if image.Format != "qcow2" || image.Source != "oci://"+registry+"/machine/ubuntu@"+manifestDigest {
+		t.Fatalf("unexpected image %+v", image)
+	}
+
+	// pulling the same manifest again is served from the store
+	os.RemoveAll(filepath.Join(layoutDir, "blobs", "sha256", strings.TrimPrefix(image.Digest, "sha256:")))
+	again, err := store.Pull("oci://"+registry+"/machine/ubuntu@"+manifestDigest, []string{"ubuntu-latest"}, 1000)
+	if err != nil || again.Digest != image.Digest || len(again.Names) != 2 {
+		t.Fatalf("expected the stored image to be reused, got %+v: %v", again, err)
+	}
+
+	// a layer which does not match its digest is rejected
+	m, _, err := resolveOCIManifest(&ociLayout{dir: layoutDir}, OCIReference{Tag: "22.04"})
+	if err != nil {
+		t.Fatalf("failed to resolve manifest: %s", err)
+	}
+	layerHex := strings.TrimPrefix(m.Layers[0].Digest, "sha256:")
+	if err := os.WriteFile(filepath.Join(layoutDir, "blobs", "sha256", layerHex), []byte("tampered!!!!!!"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := fetchOCIBlob(&ociLayout{dir: layoutDir}, m.Layers[0], filepath.Join(tmpDir, "tmp")); err == nil {
+		t.Fatalf("expected digest verification to fail")
+	}
+
+	disk := QemuDisk{File: ref, Type: "cdrom"}
+	if err := disk.Sanitize(tmpDir); err != nil {
+		t.Fatalf("failed to sanitize OCI disk: %s", err)
+	}
+	if disk.Image != ref || disk.File != filepath.Join(tmpDir, "ubuntu-22.04.iso") || disk.Format != "raw" {
+		t.Fatalf("unexpected OCI cdrom %+v", disk)
+	}
+	if err := disk.CreateFromImage(store); err != nil {
+		t.Fatalf("failed to create cdrom from image: %s", err)
+	}
+	if target, err := os.Readlink(disk.File); err != nil || target != store.BlobPath(image.Digest) {
+		t.Fatalf("expected cdrom linked to the stored image, got %s: %v", target, err)
+	}
+}
@@ -106,6 +106,12 @@ func NewDefaultX86Config(name string, numCpus, numMemMB uint32, sockDir string)
 				NoWait: true,
 				Name:   filepath.Join(sockDir, "qmp.sock"),
 			},
+			{
+				Type:   "unix",
+				Server: true,
+				NoWait: true,
+				Name:   filepath.Join(sockDir, QMPControlSocketName),
+			},
 		},
 		PCIeRootPortDevices: []qcli.PCIeRootPortDevice{
 			{
@@ -205,6 +211,12 @@ func NewDefaultAarch64Config(name string, numCpus uint32, numMemMB uint32, sockD
 				NoWait: true,
 				Name:   filepath.Join(sockDir, "qmp.sock"),
 			},
+			{
+				Type:   "unix",
+				Server: true,
+				NoWait: true,
+				Name:   filepath.Join(sockDir, QMPControlSocketName),
+			},
 		},
 		Knobs: qcli.Knobs{
 			NoGraphic: true,
@@ -213,14 +225,23 @@ func NewDefaultAarch64Config(name string, numCpus uint32, numMemMB uint32, sockD
 	return c, nil
 }
 
-// FIXME: what to do with remote client/server ? push to zot and use zot URLs?
 // ImportDiskImage will copy/create a source image to server image
 func (qd *QemuDisk) ImportDiskImage(imageDir string) error {
+	// overlays on stored or pulled images are created by CreateFromImage
+	if qd.Image != "" {
+		if !PathExists(qd.File) {
+			return fmt.Errorf("Disk File %q for image %q has not been created", qd.File, qd.Image)
+		}
+		return nil
+	}
+
 	// What to do about sparse? use reflink and sparse=auto for now.
-	if qd.Size > 0 {
+	// Backing files are shared, only the overlay is created.
+	if qd.Size > 0 || qd.BackingFile != "" {
 		if PathExists(qd.File) {
 			log.Infof("Skipping creation of existing disk: %s", qd.File)
-			return nil
+			// a larger size in the definition grows the disk
+			return qd.growToSize()
 		}
 		return qd.Create()
 	}
@@ -256,12 +277,12 @@ func (qd *QemuDisk) QBlockDevice(qti *qcli.QemuTypeIndex) (qcli.BlockDevice, err
 		ID:           fmt.Sprintf("drive%d", qti.NextDriveIndex()),
 		File:         qd.File,
 		Interface:    qcli.NoInterface,
-		AIO:          qcli.Threads,
+		AIO:          qcli.BlockDeviceAIO(qd.AIO),
 		BusAddr:      qd.BusAddr,
 		ReadOnly:     qd.ReadOnly,
-		Cache:        qcli.CacheModeUnsafe,
-		Discard:      qcli.DiscardUnmap,
-		DetectZeroes: qcli.DetectZeroesUnmap,
+		Cache:        qcli.CacheMode(qd.Cache),
+		Discard:      qcli.DiscardMode(qd.Discard),
+		DetectZeroes: qcli.DetectZeroesMode(qd.DetectZeroes),
 		Serial:       qd.serial(),
 	}
 	if blk.BlockSize == 0 {
@@ -294,9 +315,7 @@ func (qd *QemuDisk) QBlockDevice(qti *qcli.QemuTypeIndex) (qcli.BlockDevice, err
 	case "scsi":
 		blk.Driver = qcli.SCSIHD
 		blk.SCSI = true
-		// FIXME: we should scan disks for buses, create buses, then
-		// walk disks a second time to configure bus= for each device
-		blk.Bus = "scsi0.0" // this is the default scsi bus
+		// the controller, scsi-id and lun are set by the StoragePlan
 	case "nvme":
 		blk.Driver = qcli.NVME
 	case "virtio":
@@ -364,44 +383,6 @@ func (nd NicDef) QNetDevice(qti *qcli.QemuTypeIndex) (qcli.NetDevice, error) {
 	return ndev, nil
 }
 
-func ConfigureUEFIVars(c *qcli.Config, srcCode, srcVars, runDir string, secureBoot bool) error {
-	uefiDev, err := qcli.NewSystemUEFIFirmwareDevice(secureBoot)
-	if err != nil {
-		return fmt.Errorf("failed to create a UEFI Firmware Device: %s", err)
-	}
-	// Import  source UEFI Code (if provided)
-	src := uefiDev.Code
-	if len(srcCode) > 0 {
-		src = srcCode
-	}
-	// FIXME: create a qcli.UEFICodeFileName
-	dest := filepath.Join(runDir, "uefi-code.fd")
-	log.Infof("Importing UEFI Code from '%s' to '%q'", src, dest)
-	if err := CopyFileBits(src, dest); err != nil {
-		return fmt.Errorf("Failed to import UEFI Code from '%s' to '%q': %s", src, dest, err)
-	}
-	uefiDev.Code = dest
-
-	// Import  source UEFI Vxrs (if provided)
-	src = uefiDev.Vars
-	if len(srcVars) > 0 {
-		src = srcVars
-	}
-	dest = filepath.Join(runDir, qcli.UEFIVarsFileName)
-	log.Infof("Importing UEFI Vars from '%s' to '%q'", src, dest)
-	if !PathExists(dest) {
-		if err := CopyFileBits(src, dest); err != nil {
-			return fmt.Errorf("Failed to import UEFI Vars from '%s' to '%q': %s", src, dest, err)
-		}
-	} else {
-		log.Infof("Already imported UEFI Vars file %q to %q.  Not overwriting.", src, dest)
-	}
-	uefiDev.Vars = dest
-
-	c.UEFIFirmwareDevices = []qcli.UEFIFirmwareDevice{*uefiDev}
-	return nil
-}
-
 func NewVVFATBlockDev(id, directory, label string) (qcli.BlockDevice, error) {
 	blkdev := qcli.BlockDevice{
 		Driver: qcli.VVFAT,
@@ -416,7 +397,54 @@ func NewVVFATBlockDev(id, directory, label string) (qcli.BlockDevice, error) {
 	return blkdev, nil
 }
 
-func GenerateQConfig(runDir, sockDir string, v VMDef) (*qcli.Config, error) {
+// the ICH9 AHCI controller has 6 ports
+const ahciPorts = 6
+
+// resolveCdromPath returns the absolute path of a cdrom image, relative
+// paths are from the machined working directory
+func resolveCdromPath(cdrom string) (string, error) {
+	if strings.HasPrefix(cdrom, "/") {
+		return cdrom, nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get current working dir: %s", err)
+	}
+	return filepath.Join(cwd, cdrom), nil
+}
+
+// cdromDisks returns the disks of the cdrom drives, the first cdrom is the
+// boot cdrom
+func (v VMDef) cdromDisks() ([]QemuDisk, error) {
+	cdroms := v.Cdroms
+	if v.Cdrom != "" {
+		cdroms = append([]string{v.Cdrom}, cdroms...)
+	}
+	disks := []QemuDisk{}
+	for idx, cdrom := range cdroms {
+		cdromPath, err := resolveCdromPath(cdrom)
+		if err != nil {
+			return disks, err
+		}
+		qd := QemuDisk{
+			File:     cdromPath,
+			Format:   "raw",
+			Attach:   "ide",
+			Type:     "cdrom",
+			ReadOnly: true,
+		}
+		if idx == 0 && v.Boot == "cdrom" {
+			qd.BootIndex = "0"
+			log.Infof("Boot from cdrom requested: bootindex=%s", qd.BootIndex)
+		}
+		disks = append(disks, qd)
+	}
+	return disks, nil
+}
+
+// GenerateQConfig returns the qcli config of the VM and the plan placing its
+// disks on storage controllers, which must be applied to the parameters
+func GenerateQConfig(runDir, sockDir string, v VMDef) (*qcli.Config, StoragePlan, error) {
 	var c *qcli.Config
 	var err error
 	switch runtime.GOARCH {
@@ -427,88 +455,69 @@ func GenerateQConfig(runDir, sockDir string, v VMDef) (*qcli.Config, error) {
 	}
 
 	if err != nil {
-		return c, err
+		return c, StoragePlan{}, err
 	}
 
-	err = ConfigureUEFIVars(c, v.UEFICode, v.UEFIVars, runDir, v.SecureBoot)
-	if err != nil {
-		return c, fmt.Errorf("Error configuring UEFI Vars: %s", err)
+	ConfigureDisplay(c, v.Display)
+
+	if err := sanitizeShares(v.Shares); err != nil {
+		return c, StoragePlan{}, err
 	}
+	configureShareMemory(c, v.Shares)
 
-	cdromPath := v.Cdrom
-	if !strings.HasPrefix(v.Cdrom, "/") {
-		cwd, err := os.Getwd()
-		if err != nil {
-			return c, fmt.Errorf("Failed to get current working dir: %s", err)
-		}
-		cdromPath = filepath.Join(cwd, v.Cdrom)
+	if err := ConfigureFirmware(c, v, runDir); err != nil {
+		return c, StoragePlan{}, fmt.Errorf("Error configuring firmware: %s", err)
 	}
 
 	qti := qcli.NewQemuTypeIndex()
 
-	if v.Cdrom != "" {
-		qd := QemuDisk{
-			File:     cdromPath,
-			Format:   "raw",
-			Attach:   "ide",
-			Type:     "cdrom",
-			ReadOnly: true,
-		}
-		if v.Boot == "cdrom" {
-			qd.BootIndex = "0"
-			log.Infof("Boot from cdrom requested: bootindex=%s", qd.BootIndex)
-		}
-		v.Disks = append(v.Disks, qd)
+	cdroms, err := v.cdromDisks()
+	if err != nil {
+		return c, StoragePlan{}, err
 	}
+	v.Disks = append(v.Disks, cdroms...)
 
 	if err := v.AdjustBootIndicies(qti); err != nil {
-		return c, err
+		return c, StoragePlan{}, err
+	}
+
+	for i := range v.Disks {
+		if err := v.Disks[i].Sanitize(runDir); err != nil {
+			return c, StoragePlan{}, err
+		}
+	}
+	storage, err := newStorageTopology(v.Controllers)
+	if err != nil {
+		return c, StoragePlan{}, err
+	}
+	placements, err := storage.placeAll(v.Disks)
+	if err != nil {
+		return c, StoragePlan{}, err
 	}
 
-	busses := make(map[string]bool)
+	diskBlkDevices := []qcli.BlockDevice{}
 	for i := range v.Disks {
 		var disk *QemuDisk
 		disk = &v.Disks[i]
 
-		if err := disk.Sanitize(runDir); err != nil {
-			return c, err
-		}
-
 		// import/create files into stateDir/images/basename(File)
 		if err := disk.ImportDiskImage(runDir); err != nil {
-			return c, err
+			return c, StoragePlan{}, err
 		}
 
 		qblk, err := disk.QBlockDevice(qti)
 		if err != nil {
-			return c, err
-		}
-		c.BlkDevices = append(c.BlkDevices, qblk)
-
-		_, ok := busses[disk.Attach]
-		// we only need one controller per attach
-		if !ok {
-			if disk.Attach == "scsi" {
-				scsiCon := qcli.SCSIControllerDevice{
-					ID:       fmt.Sprintf("scsi%d", qti.Next("scsi")),
-					IOThread: fmt.Sprintf("iothread%d", qti.Next("iothread")),
-				}
-				c.SCSIControllerDevices = append(c.SCSIControllerDevices, scsiCon)
-			}
-			if disk.Attach == "ide" {
-				ideCon := qcli.IDEControllerDevice{
-					Driver: qcli.ICH9AHCIController,
-					ID:     fmt.Sprintf("ide%d", qti.Next("ide")),
-				}
-				c.IDEControllerDevices = append(c.IDEControllerDevices, ideCon)
-			}
+			return c, StoragePlan{}, err
 		}
+		diskBlkDevices = append(diskBlkDevices, qblk)
 	}
+	c.BlkDevices = append(c.BlkDevices, diskBlkDevices...)
+	plan := storage.configure(c, qti, v.Disks, placements, diskBlkDevices)
 
 	for _, nic := range v.Nics {
 		qnet, err := nic.QNetDevice(qti)
 		if err != nil {
-			return c, err
+			return c, StoragePlan{}, err
 		}
 		c.NetDevices = append(c.NetDevices, qnet)
 	}
@@ -522,7 +531,7 @@ func GenerateQConfig(runDir, sockDir string, v VMDef) (*qcli.Config, error) {
 		}
 	}
 
-	return c, nil
+	return c, plan, nil
 }
 
 type QMPMachineLogger struct{}
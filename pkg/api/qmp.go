@@ -0,0 +1,149 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The qcli QMP connection only exposes a fixed set of commands, so each VM
+// has a second QMP socket which machined uses to issue arbitrary commands.
+const QMPControlSocketName = "qmp-ctl.sock"
+
+const qmpTimeout = time.Second * 30
+
+type QMPError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *QMPError) Error() string {
+	return fmt.Sprintf("QMP %s: %s", e.Class, e.Desc)
+}
+
+type qmpRequest struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *QMPError       `json:"error"`
+	Event  string          `json:"event"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// QMPEvent is an asynchronous event received on a QMPConn
+type QMPEvent struct {
+	Event string
+	Data  json.RawMessage
+}
+
+// QMPConn is a minimal synchronous QMP client
+type QMPConn struct {
+	conn   net.Conn
+	dec    *json.Decoder
+	enc    *json.Encoder
+	events []QMPEvent
+}
+
+// DialQMP connects to a QMP socket and negotiates capabilities
+func DialQMP(socketPath string) (*QMPConn, error) {
+	conn, err := net.DialTimeout("unix", socketPath, qmpTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to QMP socket %q: %s", socketPath, err)
+	}
+	q := &QMPConn{conn: conn, dec: json.NewDecoder(conn), enc: json.NewEncoder(conn)}
+
+	conn.SetDeadline(time.Now().Add(qmpTimeout))
+	var greeting map[string]interface{}
+	if err := q.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to read QMP greeting: %s", err)
+	}
+	if _, ok := greeting["QMP"]; !ok {
+		conn.Close()
+		return nil, fmt.Errorf("Unexpected QMP greeting: %v", greeting)
+	}
+	if err := q.Execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Execute runs a QMP command, unmarshaling the return value into result if
+// it is not nil.  Asynchronous events received while waiting are kept for
+// WaitEvent.
+func (q *QMPConn) Execute(command string, args interface{}, result interface{}) error {
+	q.conn.SetDeadline(time.Now().Add(qmpTimeout))
+	if err := q.enc.Encode(qmpRequest{Execute: command, Arguments: args}); err != nil {
+		return fmt.Errorf("Failed to send QMP command %s: %s", command, err)
+	}
+	for {
+		var resp qmpResponse
+		if err := q.dec.Decode(&resp); err != nil {
+			return fmt.Errorf("Failed to read QMP response to %s: %s", command, err)
+		}
+		if resp.Event != "" {
+			q.events = append(q.events, QMPEvent{Event: resp.Event, Data: resp.Data})
+			continue
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result != nil && len(resp.Return) > 0 {
+			if err := json.Unmarshal(resp.Return, result); err != nil {
+				return fmt.Errorf("Failed to unmarshal QMP %s response: %s", command, err)
+			}
+		}
+		return nil
+	}
+}
+
+// WaitEvent returns the first event named event for which match returns
+// true, waiting up to timeout for it to arrive
+func (q *QMPConn) WaitEvent(event string, match func(data json.RawMessage) bool, timeout time.Duration) (QMPEvent, error) {
+	matches := func(e QMPEvent) bool {
+		return e.Event == event && (match == nil || match(e.Data))
+	}
+	for idx, e := range q.events {
+		if matches(e) {
+			q.events = append(q.events[:idx], q.events[idx+1:]...)
+			return e, nil
+		}
+	}
+	q.conn.SetDeadline(time.Now().Add(timeout))
+	for {
+		var resp qmpResponse
+		if err := q.dec.Decode(&resp); err != nil {
+			return QMPEvent{}, fmt.Errorf("Failed waiting for QMP event %s: %s", event, err)
+		}
+		if resp.Event == "" {
+			continue
+		}
+		e := QMPEvent{Event: resp.Event, Data: resp.Data}
+		if matches(e) {
+			return e, nil
+		}
+		q.events = append(q.events, e)
+	}
+}
+
+func (q *QMPConn) Close() error {
+	return q.conn.Close()
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/project-machine/qcli"
+)
+
+type fakeQMPCommand struct {
+	Execute   string                 `json:"execute"`
+	Arguments map[string]interface{} `json:"arguments"`
+}
+
+// fakeQMPHandler returns the result or error of a command and any events
+// to send after the reply
+type fakeQMPHandler func(cmd fakeQMPCommand) (interface{}, *QMPError, []QMPEvent)
+
+// fakeQMP is a QMP server which records the commands it receives
+type fakeQMP struct {
+	listener net.Listener
+	handler  fakeQMPHandler
+	mutex    sync.Mutex
+	commands []fakeQMPCommand
+}
+
+func newFakeQMP(t *testing.T, socketPath string, handler fakeQMPHandler) *fakeQMP {
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", socketPath, err)
+	}
+	f := &fakeQMP{listener: listener, handler: handler}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeQMP) serve(conn net.Conn) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+	enc.Encode(map[string]interface{}{"QMP": map[string]interface{}{"version": map[string]interface{}{}}})
+	for {
+		var cmd fakeQMPCommand
+		if err := dec.Decode(&cmd); err != nil {
+			return
+		}
+		if cmd.Execute == "qmp_capabilities" {
+			enc.Encode(map[string]interface{}{"return": map[string]interface{}{}})
+			continue
+		}
+		f.mutex.Lock()
+		f.commands = append(f.commands, cmd)
+		f.mutex.Unlock()
+
+		var result interface{}
+		var qmpErr *QMPError
+		var events []QMPEvent
+		if f.handler != nil {
+			result, qmpErr, events = f.handler(cmd)
+		}
+		if result == nil {
+			result = map[string]interface{}{}
+		}
+		if qmpErr != nil {
+			enc.Encode(map[string]interface{}{"error": qmpErr})
+		} else {
+			enc.Encode(map[string]interface{}{"return": result})
+		}
+		for _, event := range events {
+			enc.Encode(map[string]interface{}{"event": event.Event, "data": event.Data, "timestamp": map[string]int64{"seconds": time.Now().Unix()}})
+		}
+	}
+}
+
+// Commands returns the commands received so far
+func (f *fakeQMP) Commands() []fakeQMPCommand {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]fakeQMPCommand{}, f.commands...)
+}
+
+func (f *fakeQMP) Close() {
+	f.listener.Close()
+}
+
+// newFakeQMPVM returns a running VM whose control socket is served by a
+// fakeQMP in dir
+func newFakeQMPVM(t *testing.T, dir string, handler fakeQMPHandler) (*VM, *fakeQMP) {
+	socketPath := filepath.Join(dir, QMPControlSocketName)
+	f := newFakeQMP(t, socketPath, handler)
+	vm := &VM{
+		Config: VMDef{Name: "vm1"},
+		State:  VMStarted,
+		RunDir: dir,
+		qcli: &qcli.Config{
+			QMPSockets: []qcli.QMPSocket{{Type: "unix", Server: true, NoWait: true, Name: socketPath}},
+		},
+	}
+	return vm, f
+}
+
+func TestQMPWaitEvent(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-qmp")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	handler := func(cmd fakeQMPCommand) (interface{}, *QMPError, []QMPEvent) {
+		if cmd.Execute == "device_del" {
+			return nil, nil, []QMPEvent{
+				{Event: "DEVICE_DELETED", Data: json.RawMessage(`{"device":"other"}`)},
+				{Event: "DEVICE_DELETED", Data: json.RawMessage(`{"device":"dev0"}`)},
+			}
+		}
+		return nil, &QMPError{Class: "CommandNotFound", Desc: "unknown"}, nil
+	}
+	f := newFakeQMP(t, filepath.Join(dir, "qmp.sock"), handler)
+	defer f.Close()
+
+	q, err := DialQMP(filepath.Join(dir, "qmp.sock"))
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	defer q.Close()
+
+	if err := q.Execute("bogus", nil, nil); err == nil {
+		t.Fatalf("expected QMP error")
+	}
+	if err := q.Execute("device_del", map[string]string{"id": "dev0"}, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	match := func(data json.RawMessage) bool { return string(data) == `{"device":"dev0"}` }
+	if _, err := q.WaitEvent("DEVICE_DELETED", match, time.Second); err != nil {
+		t.Fatalf("failed waiting for event: %s", err)
+	}
+	if _, err := q.WaitEvent("DEVICE_DELETED", nil, time.Second); err != nil {
+		t.Fatalf("expected the other event to be kept: %s", err)
+	}
+	if _, err := q.WaitEvent("DEVICE_DELETED", nil, time.Millisecond*100); err == nil {
+		t.Fatalf("expected timeout waiting for a further event")
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// HasRemoteListener returns true if machined should serve the API over TCP
+func (c *MachineDaemonConfig) HasRemoteListener() bool {
+	return c.RemoteListenAddress != ""
+}
+
+// RemoteTLSConfig returns the server TLS config for the remote listener.
+// Clients must present a certificate signed by RemoteTLSClientCA.
+func (c *MachineDaemonConfig) RemoteTLSConfig() (*tls.Config, error) {
+	if c.RemoteTLSCert == "" || c.RemoteTLSKey == "" || c.RemoteTLSClientCA == "" {
+		return nil, fmt.Errorf("Remote listener requires a TLS certificate, key and client CA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.RemoteTLSCert, c.RemoteTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS certificate %q and key %q: %s", c.RemoteTLSCert, c.RemoteTLSKey, err)
+	}
+
+	caPool, err := LoadCertPool(c.RemoteTLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caPool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// RemoteListener returns a TCP listener on RemoteListenAddress which
+// terminates mutual TLS before handing connections to the API server.
+func (c *MachineDaemonConfig) RemoteListener() (net.Listener, error) {
+	tlsConfig, err := c.RemoteTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", c.RemoteListenAddress, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on %s: %s", c.RemoteListenAddress, err)
+	}
+	return listener, nil
+}
+
+// LoadCertPool reads a PEM encoded CA bundle into a new cert pool
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	caBytes, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA file %q: %s", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("Failed to parse any certificates from CA file %q", caFile)
+	}
+	return pool, nil
+}
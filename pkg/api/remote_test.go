@@ -0,0 +1,175 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the remote listener tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %s", err)
+	}
+	ca := &testCA{cert: cert, key: key, dir: dir}
+	writeTestPEM(t, ca.path(name), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name+".pem")
+}
+
+// issue writes a certificate and key for cn and returns their paths
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	certFile := ca.path(cn + "-" + ca.cert.Subject.CommonName)
+	keyFile := ca.path(cn + "-" + ca.cert.Subject.CommonName + "-key")
+	writeTestPEM(t, certFile, "CERTIFICATE", der)
+	writeTestPEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func writeTestPEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", path, err)
+	}
+}
+
+func TestRemoteListener(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-remote")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	serverCA := newTestCA(t, tmpDir, "server-ca")
+	clientCA := newTestCA(t, tmpDir, "client-ca")
+	otherCA := newTestCA(t, tmpDir, "other-ca")
+	serverCert, serverKey := serverCA.issue(t, "machined", x509.ExtKeyUsageServerAuth)
+
+	cfg := MachineDaemonConfig{RemoteListenAddress: "127.0.0.1:0"}
+	if _, err := cfg.RemoteListener(); err == nil {
+		t.Fatalf("expected error listening without TLS settings")
+	}
+	cfg.RemoteTLSCert = serverCert
+	cfg.RemoteTLSKey = serverKey
+	cfg.RemoteTLSClientCA = clientCA.path("client-ca")
+	listener, err := cfg.RemoteListener()
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// the handshake runs on the first read
+			go func() {
+				defer conn.Close()
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+
+	roots, err := LoadCertPool(serverCA.path("server-ca"))
+	if err != nil {
+		t.Fatalf("failed to load server CA: %s", err)
+	}
+	dial := func(certFile, keyFile string) error {
+		config := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatalf("failed to load client certificate: %s", err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// TLS 1.3 servers report a rejected client certificate after the
+		// client finished its side of the handshake, accepted clients see
+		// the server close the connection
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("x")); err != nil {
+			return err
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			return err
+		}
+		return nil
+	}
+
+	trustedCert, trustedKey := clientCA.issue(t, "alice", x509.ExtKeyUsageClientAuth)
+	if err := dial(trustedCert, trustedKey); err != nil {
+		t.Fatalf("expected a client certificate from the client CA to be accepted: %s", err)
+	}
+	untrustedCert, untrustedKey := otherCA.issue(t, "alice", x509.ExtKeyUsageClientAuth)
+	if err := dial(untrustedCert, untrustedKey); err == nil {
+		t.Fatalf("expected a client certificate from another CA to be rejected")
+	}
+	if err := dial("", ""); err == nil {
+		t.Fatalf("expected a client without certificate to be rejected")
+	}
+}
@@ -15,11 +15,15 @@ limitations under the License.
 package api
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 type RouteHandler struct {
@@ -34,18 +38,120 @@ func NewRouteHandler(c *Controller) *RouteHandler {
 }
 
 func (rh *RouteHandler) SetupRoutes() {
+	rh.c.Router.Use(rh.Instrument, rh.IdentifyCaller)
 	rh.c.Router.GET("/machines", rh.GetMachines)
-	rh.c.Router.POST("/machines", rh.PostMachine)
+	rh.c.Router.POST("/machines", rh.Audit("create"), rh.Operation("create"), rh.PostMachine)
 	rh.c.Router.GET("/machines/:machinename", rh.GetMachine)
-	rh.c.Router.PUT("/machines/:machinename", rh.UpdateMachine)
-	rh.c.Router.DELETE("/machines/:machinename", rh.DeleteMachine)
-	rh.c.Router.POST("/machines/:machinename/start", rh.StartMachine)
-	rh.c.Router.POST("/machines/:machinename/stop", rh.StopMachine)
-	rh.c.Router.POST("/machines/:machinename/console", rh.GetMachineConsole)
+	rh.c.Router.PUT("/machines/:machinename", rh.Audit("update"), rh.AuthorizeMachine, rh.Operation("update"), rh.UpdateMachine)
+	rh.c.Router.DELETE("/machines/:machinename", rh.Audit("delete"), rh.AuthorizeMachine, rh.Operation("delete"), rh.DeleteMachine)
+	rh.c.Router.POST("/machines/:machinename/start", rh.Audit("start"), rh.AuthorizeMachine, rh.Operation("start"), rh.StartMachine)
+	rh.c.Router.POST("/machines/:machinename/stop", rh.Audit("stop"), rh.AuthorizeMachine, rh.Operation("stop"), rh.StopMachine)
+	rh.c.Router.POST("/machines/:machinename/console", rh.Audit("console"), rh.AuthorizeMachine, rh.GetMachineConsole)
+	rh.c.Router.GET("/machines/:machinename/console/stream", rh.Audit("console"), rh.AuthorizeMachine, rh.StreamMachineConsole)
+	rh.c.Router.POST("/machines/:machinename/console/script", rh.Audit("console-script"), rh.AuthorizeMachine, rh.RunMachineConsoleScript)
+	rh.c.Router.GET("/machines/:machinename/logs", rh.AuthorizeMachine, rh.GetMachineLogs)
+	rh.c.Router.GET("/machines/:machinename/screenshot", rh.AuthorizeMachine, rh.GetMachineScreenshot)
+	rh.c.Router.POST("/machines/:machinename/keys", rh.Audit("keys"), rh.AuthorizeMachine, rh.SendMachineKeys)
+	rh.c.Router.POST("/machines/:machinename/disks", rh.Audit("disk-attach"), rh.AuthorizeMachine, rh.AttachMachineDisk)
+	rh.c.Router.DELETE("/machines/:machinename/disks/:diskname", rh.Audit("disk-detach"), rh.AuthorizeMachine, rh.DetachMachineDisk)
+	rh.c.Router.GET("/machines/:machinename/disks/:diskname", rh.AuthorizeMachine, rh.GetMachineDiskInfo)
+	rh.c.Router.POST("/machines/:machinename/disks/:diskname/resize", rh.Audit("disk-resize"), rh.AuthorizeMachine, rh.ResizeMachineDisk)
+	rh.c.Router.POST("/machines/:machinename/disks/:diskname/convert", rh.Audit("disk-convert"), rh.AuthorizeMachine, rh.ConvertMachineDisk)
+	rh.c.Router.POST("/machines/:machinename/disks/:diskname/throttle", rh.Audit("disk-throttle"), rh.AuthorizeMachine, rh.ThrottleMachineDisk)
+	rh.c.Router.GET("/machines/:machinename/cdroms", rh.AuthorizeMachine, rh.GetMachineCdroms)
+	rh.c.Router.PUT("/machines/:machinename/cdroms/:cdrom", rh.Audit("cdrom-insert"), rh.AuthorizeMachine, rh.InsertMachineCdrom)
+	rh.c.Router.DELETE("/machines/:machinename/cdroms/:cdrom", rh.Audit("cdrom-eject"), rh.AuthorizeMachine, rh.EjectMachineCdrom)
+	rh.c.Router.GET("/images", rh.GetImages)
+	rh.c.Router.POST("/images", rh.Audit("image-import"), rh.ImportImage)
+	rh.c.Router.POST("/images/pull", rh.Audit("image-pull"), rh.PullImage)
+	rh.c.Router.GET("/images/:image", rh.GetImage)
+	rh.c.Router.DELETE("/images/:image", rh.Audit("image-rm"), rh.RemoveImage)
+	rh.c.Router.GET("/secrets", rh.GetSecrets)
+	rh.c.Router.PUT("/secrets/:secret", rh.Audit("secret-set"), rh.SetSecret)
+	rh.c.Router.DELETE("/secrets/:secret", rh.Audit("secret-rm"), rh.RemoveSecret)
+	rh.c.Router.GET("/audit", rh.GetAudit)
+	rh.c.Router.GET("/metrics", rh.GetMetrics)
+}
+
+// Instrument records request counts and latency for /metrics
+func (rh *RouteHandler) Instrument(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+	route := ctx.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	rh.c.Metrics.ObserveRequest(ctx.Request.Method, route, ctx.Writer.Status(), time.Since(start))
+}
+
+// Operation returns a handler which records the duration and result of a
+// machine operation for /metrics
+func (rh *RouteHandler) Operation(operation string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		rh.c.Metrics.ObserveOperation(operation, ctx.Writer.Status() < 400, time.Since(start))
+	}
+}
+
+const callerKey = "caller"
+
+// IdentifyCaller records the identity of the client for later handlers
+func (rh *RouteHandler) IdentifyCaller(ctx *gin.Context) {
+	caller := rh.c.Config.CallerFromRequest(ctx.Request)
+	log.Debugf("%s %s from %s", ctx.Request.Method, ctx.Request.URL.Path, caller)
+	ctx.Set(callerKey, caller)
+	ctx.Next()
+}
+
+func getCaller(ctx *gin.Context) Caller {
+	if v, ok := ctx.Get(callerKey); ok {
+		if caller, ok := v.(Caller); ok {
+			return caller
+		}
+	}
+	return Caller{UID: UnknownID, GID: UnknownID, Name: "unknown"}
+}
+
+// AuthorizeMachine aborts the request unless the caller may modify the machine
+func (rh *RouteHandler) AuthorizeMachine(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	caller := getCaller(ctx)
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if !rh.c.Config.CanAccessMachine(caller, machine) {
+		log.Warnf("Denied %s %s for %s", ctx.Request.Method, ctx.Request.URL.Path, caller)
+		err := fmt.Errorf("User %s is not permitted to modify machine '%s'", caller.Name, machineName)
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Next()
 }
 
 func (rh *RouteHandler) GetMachines(ctx *gin.Context) {
-	ctx.IndentedJSON(http.StatusOK, rh.c.MachineController.GetMachines())
+	caller := getCaller(ctx)
+	cfg := rh.c.Config
+	all := ctx.Query("all") == "true"
+	if all && !cfg.IsOpen() && !cfg.IsAdmin(caller) {
+		err := fmt.Errorf("User %s is not permitted to list all machines", caller.Name)
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	machines := rh.c.MachineController.GetMachines()
+	if all || cfg.IsOpen() {
+		ctx.IndentedJSON(http.StatusOK, machines)
+		return
+	}
+	visible := []Machine{}
+	for idx := range machines {
+		if cfg.SharesMachine(caller, &machines[idx]) {
+			visible = append(visible, machines[idx])
+		}
+	}
+	ctx.IndentedJSON(http.StatusOK, visible)
 }
 
 func (rh *RouteHandler) GetMachine(ctx *gin.Context) {
@@ -56,6 +162,12 @@ func (rh *RouteHandler) GetMachine(ctx *gin.Context) {
 		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	// machines the caller may not list are reported as missing
+	if !rh.c.Config.CanAccessMachine(getCaller(ctx), &machine) {
+		err := fmt.Errorf("Failed to find machine with Name: %s", machineName)
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
 	ctx.IndentedJSON(http.StatusOK, machine)
 }
 
@@ -65,6 +177,23 @@ func (rh *RouteHandler) PostMachine(ctx *gin.Context) {
 		return
 	}
 	cfg := rh.c.Config
+	caller := getCaller(ctx)
+	if !cfg.CanCreateMachine(caller) {
+		err := fmt.Errorf("User %s is not permitted to create machines", caller.Name)
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	newMachine.OwnerUID = caller.UID
+	newMachine.OwnerGID = caller.GID
+	newMachine.ctx = cfg.GetConfigContext()
+	if err := newMachine.CheckHostAccess(cfg.PathAccess(caller), cfg.IsAdmin(caller)); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.checkDiskSecrets(caller, &newMachine, newMachine.Config.Disks); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 	if err := rh.c.MachineController.AddMachine(newMachine, cfg); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 	}
@@ -77,6 +206,7 @@ func (rh *RouteHandler) DeleteMachine(ctx *gin.Context) {
 	err := rh.c.MachineController.DeleteMachine(machineName, cfg)
 	if err != nil {
 		log.Errorf("Failed to delete machine '%s': %s\n", machineName, err)
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 	}
 }
 
@@ -86,7 +216,28 @@ func (rh *RouteHandler) UpdateMachine(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// authorization was checked against the machine in the URL
+	if newMachine.Name != ctx.Param("machinename") {
+		err := fmt.Errorf("Machine name '%s' does not match request path", newMachine.Name)
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	machine, err := rh.c.MachineController.GetMachineByName(newMachine.Name)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
 	cfg := rh.c.Config
+	caller := getCaller(ctx)
+	newMachine.ctx = cfg.GetConfigContext()
+	if err := newMachine.CheckHostAccess(cfg.PathAccess(caller), cfg.IsAdmin(caller)); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.checkDiskSecrets(caller, machine, newMachine.Config.Disks); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 	if err := rh.c.MachineController.UpdateMachine(newMachine, cfg); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 	}
@@ -102,6 +253,10 @@ func (rh *RouteHandler) StartMachine(ctx *gin.Context) {
 		return
 	}
 	if request.Status == "running" {
+		if err := rh.checkMachineSecrets(getCaller(ctx), machineName); err != nil {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
 		if err := rh.c.MachineController.StartMachine(machineName); err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		}
@@ -135,6 +290,7 @@ func (rh *RouteHandler) StopMachine(ctx *gin.Context) {
 
 type MachineConsoleRequest struct {
 	ConsoleType string `json:"type"`
+	ReadOnly    bool   `json:"read-only"`
 }
 
 func (rh *RouteHandler) GetMachineConsole(ctx *gin.Context) {
@@ -145,15 +301,17 @@ func (rh *RouteHandler) GetMachineConsole(ctx *gin.Context) {
 		return
 	}
 	if request.ConsoleType == SerialConsole {
-		consoleInfo, err := rh.c.MachineController.GetMachineConsole(machineName, SerialConsole)
+		consoleInfo, err := rh.c.MachineController.GetMachineConsole(machineName, SerialConsole, request.ReadOnly)
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 		ctx.IndentedJSON(http.StatusOK, consoleInfo)
-	} else if request.ConsoleType == VGAConsole {
-		consoleInfo, err := rh.c.MachineController.GetMachineConsole(machineName, VGAConsole)
+	} else if request.ConsoleType == VGAConsole || request.ConsoleType == VNCConsole {
+		consoleInfo, err := rh.c.MachineController.GetMachineConsole(machineName, request.ConsoleType, false)
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 		ctx.IndentedJSON(http.StatusOK, consoleInfo)
 	} else {
@@ -162,3 +320,489 @@ func (rh *RouteHandler) GetMachineConsole(ctx *gin.Context) {
 		return
 	}
 }
+
+// StreamMachineConsole serves the serial console over a websocket so that it
+// is reachable through the remote listener as well as the local socket
+func (rh *RouteHandler) StreamMachineConsole(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	readOnly := ctx.Query("read-only") == "true"
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	console, err := machine.Console()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := UpgradeConsoleStream(ctx.Writer, ctx.Request, console, readOnly); err != nil {
+		log.Infof("Console stream for machine '%s' ended: %s", machineName, err)
+	}
+}
+
+func (rh *RouteHandler) RunMachineConsoleScript(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	var script ConsoleScript
+	if err := ctx.ShouldBindJSON(&script); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := script.Validate(); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	console, err := machine.Console()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := RunConsoleScript(ctx.Request.Context(), console, script)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, result)
+}
+
+func (rh *RouteHandler) GetMachineLogs(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	source := ctx.DefaultQuery("source", LogSourceSerial)
+	if !ValidLogSource(source) {
+		err := fmt.Errorf("Invalid log source '%s', must be one of %v", source, LogSources)
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	logFile := LogFile(machine.LogDir(), source)
+
+	if ctx.Query("follow") != "true" {
+		content, err := os.ReadFile(logFile)
+		if err != nil && !os.IsNotExist(err) {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Data(http.StatusOK, "text/plain; charset=utf-8", content)
+		return
+	}
+
+	ctx.Header("Content-Type", "text/plain; charset=utf-8")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+	if err := FollowLog(ctx.Request.Context(), logFile, ctx.Writer, ctx.Writer.Flush); err != nil {
+		log.Warnf("Stopped following %s log for machine '%s': %s", source, machineName, err)
+	}
+}
+
+func (rh *RouteHandler) GetMachineScreenshot(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	var img bytes.Buffer
+	if err := machine.Screenshot(&img); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Data(http.StatusOK, ScreenshotContentType, img.Bytes())
+}
+
+func (rh *RouteHandler) SendMachineKeys(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	var request SendKeysRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err := machine.SendKeys(request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) AttachMachineDisk(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	var disk QemuDisk
+	if err := ctx.ShouldBindJSON(&disk); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	caller := getCaller(ctx)
+	if machine, err := rh.c.MachineController.GetMachineByName(machineName); err == nil {
+		if err := rh.checkDiskSecrets(caller, machine, []QemuDisk{disk}); err != nil {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	access := rh.c.Config.PathAccess(caller)
+	attached, err := rh.c.MachineController.AttachMachineDisk(machineName, disk, access)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, attached)
+}
+
+func (rh *RouteHandler) DetachMachineDisk(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	if err := rh.c.MachineController.DetachMachineDisk(machineName, ctx.Param("diskname")); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) GetMachineDiskInfo(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	info, err := machine.DiskInfo(ctx.Param("diskname"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, info)
+}
+
+func (rh *RouteHandler) ResizeMachineDisk(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	var request DiskResizeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.checkMachineSecrets(getCaller(ctx), machineName); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.MachineController.ResizeMachineDisk(machineName, ctx.Param("diskname"), request.Size); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) ConvertMachineDisk(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	var request DiskConvertRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.checkMachineSecrets(getCaller(ctx), machineName); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.MachineController.ConvertMachineDisk(machineName, ctx.Param("diskname"), request.Format); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) ThrottleMachineDisk(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	var throttle DiskThrottle
+	if err := ctx.ShouldBindJSON(&throttle); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.MachineController.ThrottleMachineDisk(machineName, ctx.Param("diskname"), throttle); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) GetMachineCdroms(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	cdroms, err := machine.Cdroms()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, cdroms)
+}
+
+func (rh *RouteHandler) InsertMachineCdrom(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	var request CdromRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	access := rh.c.Config.PathAccess(getCaller(ctx))
+	if err := machine.InsertCdrom(ctx.Param("cdrom"), request.File, access); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) EjectMachineCdrom(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err := machine.EjectCdrom(ctx.Param("cdrom")); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) GetImages(ctx *gin.Context) {
+	images, err := rh.c.ImageStore.List()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, images)
+}
+
+func (rh *RouteHandler) GetImage(ctx *gin.Context) {
+	image, err := rh.c.ImageStore.Get(ctx.Param("image"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, image)
+}
+
+func (rh *RouteHandler) ImportImage(ctx *gin.Context) {
+	caller := getCaller(ctx)
+	if !rh.c.Config.CanCreateMachine(caller) {
+		err := fmt.Errorf("User %s is not permitted to import images", caller.Name)
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	var request ImageImportRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// machined reads the source with its own rights
+	if err := rh.c.Config.PathAccess(caller)(request.Source, unix.R_OK); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	image, err := rh.c.ImageStore.Import(request.Source, request.Names, caller.UID)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, image)
+}
+
+func (rh *RouteHandler) PullImage(ctx *gin.Context) {
+	caller := getCaller(ctx)
+	if !rh.c.Config.CanCreateMachine(caller) {
+		err := fmt.Errorf("User %s is not permitted to pull images", caller.Name)
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	var request ImagePullRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkOCILayoutAccess(request.Ref, rh.c.Config.PathAccess(caller)); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	image, err := rh.c.ImageStore.Pull(request.Ref, request.Names, caller.UID)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, image)
+}
+
+func (rh *RouteHandler) RemoveImage(ctx *gin.Context) {
+	caller := getCaller(ctx)
+	ref := ctx.Param("image")
+	image, err := rh.c.ImageStore.Get(ref)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	cfg := rh.c.Config
+	if !cfg.IsOpen() && !cfg.IsAdmin(caller) && caller.UID != image.OwnerUID {
+		err := fmt.Errorf("User %s is not permitted to remove image '%s'", caller.Name, ref)
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	inUse := func(image Image) error {
+		return rh.c.MachineController.ImageInUse(rh.c.ImageStore, image)
+	}
+	if _, err := rh.c.ImageStore.Remove(ref, inUse); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) GetSecrets(ctx *gin.Context) {
+	secrets, err := rh.c.SecretStore.List()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// without admin rights callers only see their own secrets
+	caller := getCaller(ctx)
+	cfg := rh.c.Config
+	if !cfg.IsOpen() && !cfg.IsAdmin(caller) {
+		visible := []Secret{}
+		for _, secret := range secrets {
+			if caller.Known() && secret.OwnerUID == caller.UID {
+				visible = append(visible, secret)
+			}
+		}
+		secrets = visible
+	}
+	ctx.IndentedJSON(http.StatusOK, secrets)
+}
+
+// checkDiskSecrets returns an error unless the caller may give the machine
+// the encrypted disks, see CanUseSecret
+func (rh *RouteHandler) checkDiskSecrets(caller Caller, m *Machine, disks []QemuDisk) error {
+	mayUse := func(secret Secret) bool {
+		return rh.c.Config.CanUseSecret(caller, m, secret)
+	}
+	return checkDiskSecrets(rh.c.SecretStore, disks, mayUse)
+}
+
+// checkMachineSecrets is checkDiskSecrets for the disks of the named
+// machine, which must pass again before the secrets are used since a secret
+// may be stored after the disk referring to it was defined
+func (rh *RouteHandler) checkMachineSecrets(caller Caller, machineName string) error {
+	machine, err := rh.c.MachineController.GetMachineByName(machineName)
+	if err != nil {
+		return nil
+	}
+	return rh.checkDiskSecrets(caller, machine, machine.Config.Disks)
+}
+
+// canChangeSecret returns an error unless caller may replace or remove the
+// named secret, which only its owner and admins may do
+func (rh *RouteHandler) canChangeSecret(caller Caller, name string) error {
+	cfg := rh.c.Config
+	secret, err := rh.c.SecretStore.Get(name)
+	if err != nil || cfg.IsOpen() || cfg.IsAdmin(caller) {
+		return nil
+	}
+	if caller.UID != secret.OwnerUID {
+		return fmt.Errorf("User %s is not permitted to change secret '%s'", caller.Name, name)
+	}
+	return nil
+}
+
+func (rh *RouteHandler) SetSecret(ctx *gin.Context) {
+	caller := getCaller(ctx)
+	name := ctx.Param("secret")
+	if !rh.c.Config.CanCreateMachine(caller) {
+		err := fmt.Errorf("User %s is not permitted to store secrets", caller.Name)
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.canChangeSecret(caller, name); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	// disks encrypted with the old value could no longer be opened
+	if secret, err := rh.c.SecretStore.Get(name); err == nil {
+		if err := rh.c.MachineController.SecretInUse(secret); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	var request SecretSetRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	secret, err := rh.c.SecretStore.Set(name, []byte(request.Value), caller.UID)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, secret)
+}
+
+func (rh *RouteHandler) RemoveSecret(ctx *gin.Context) {
+	caller := getCaller(ctx)
+	name := ctx.Param("secret")
+	if err := rh.canChangeSecret(caller, name); err != nil {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.SecretStore.Remove(name, rh.c.MachineController.SecretInUse); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) GetAudit(ctx *gin.Context) {
+	since, err := ParseAuditSince(ctx.Query("since"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entries, err := rh.c.AuditLog.Query(ctx.Query("machine"), since)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// without admin rights callers only see their own actions and those
+	// made on machines they own
+	caller := getCaller(ctx)
+	cfg := rh.c.Config
+	if !cfg.IsOpen() && !cfg.IsAdmin(caller) {
+		visible := []AuditEntry{}
+		for _, entry := range entries {
+			if caller.Known() && (entry.UID == caller.UID || entry.OwnerUID == caller.UID) {
+				visible = append(visible, entry)
+			}
+		}
+		entries = visible
+	}
+	ctx.IndentedJSON(http.StatusOK, entries)
+}
+
+func (rh *RouteHandler) GetMetrics(ctx *gin.Context) {
+	// per machine metrics follow the same visibility rules as GetMachines
+	caller := getCaller(ctx)
+	cfg := rh.c.Config
+	machines := rh.c.MachineController.GetMachines()
+	if !cfg.IsOpen() && !cfg.IsAdmin(caller) {
+		visible := []Machine{}
+		for idx := range machines {
+			if cfg.SharesMachine(caller, &machines[idx]) {
+				visible = append(visible, machines[idx])
+			}
+		}
+		machines = visible
+	}
+
+	var body bytes.Buffer
+	rh.c.Metrics.WriteDaemonMetrics(&body)
+	WriteMachineMetrics(&body, machines)
+	ctx.Data(http.StatusOK, MetricsContentType, body.Bytes())
+}
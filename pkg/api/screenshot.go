@@ -0,0 +1,219 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ScreenshotContentType = "image/png"
+	ScreenshotsDirName    = "screenshots"
+)
+
+var screenshotPollInterval = time.Second * 2
+
+var pngMagic = []byte("\x89PNG\r\n\x1a\n")
+
+// Screendump writes a PNG of the guest display to w
+func (v *VM) Screendump(w io.Writer) error {
+	if v.Config.Display.Type == DisplayNone {
+		return fmt.Errorf("VM:%s has no display", v.Name())
+	}
+
+	// QEMU writes the image itself so the file must be somewhere it can reach
+	f, err := os.CreateTemp(v.RunDir, "screendump-*.png")
+	if err != nil {
+		return fmt.Errorf("Failed to create screendump file: %s", err)
+	}
+	dumpFile := f.Name()
+	f.Close()
+	defer os.Remove(dumpFile)
+
+	args := map[string]string{"filename": dumpFile, "format": "png"}
+	if err := v.QMPExecute("screendump", args, nil); err != nil {
+		// QEMU before 7.1 only writes PPM
+		log.Debugf("VM:%s png screendump failed, retrying as ppm: %s", v.Name(), err)
+		if err := v.QMPExecute("screendump", map[string]string{"filename": dumpFile}, nil); err != nil {
+			return fmt.Errorf("Failed to capture screen of VM:%s: %s", v.Name(), err)
+		}
+	}
+
+	content, err := os.ReadFile(dumpFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read screendump: %s", err)
+	}
+	return writePNG(w, content)
+}
+
+// writePNG copies a PNG screendump to w, converting PPM if required
+func writePNG(w io.Writer, content []byte) error {
+	if bytes.HasPrefix(content, pngMagic) {
+		_, err := w.Write(content)
+		return err
+	}
+	img, err := decodePPM(bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("Failed to decode screendump: %s", err)
+	}
+	return png.Encode(w, img)
+}
+
+// decodePPM decodes the binary (P6) PPM images written by QEMU
+func decodePPM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	header := []int{}
+	magic, err := ppmToken(br)
+	if err != nil {
+		return nil, err
+	}
+	if magic != "P6" {
+		return nil, fmt.Errorf("unsupported image format %q", magic)
+	}
+	for len(header) < 3 {
+		token, err := ppmToken(br)
+		if err != nil {
+			return nil, err
+		}
+		var val int
+		if _, err := fmt.Sscanf(token, "%d", &val); err != nil || val <= 0 {
+			return nil, fmt.Errorf("invalid PPM header value %q", token)
+		}
+		header = append(header, val)
+	}
+	width, height, maxVal := header[0], header[1], header[2]
+	if maxVal > 255 {
+		return nil, fmt.Errorf("unsupported PPM max value %d", maxVal)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	pixel := make([]byte, 3)
+	scale := func(v byte) uint8 { return uint8(int(v) * 255 / maxVal) }
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if _, err := io.ReadFull(br, pixel); err != nil {
+				return nil, fmt.Errorf("short PPM image data: %s", err)
+			}
+			img.SetRGBA(x, y, color.RGBA{scale(pixel[0]), scale(pixel[1]), scale(pixel[2]), 255})
+		}
+	}
+	return img, nil
+}
+
+// ppmToken reads the next whitespace separated header token, skipping
+// comments, and consumes the single whitespace byte after it
+func ppmToken(br *bufio.Reader) (string, error) {
+	token := []byte{}
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("short PPM header: %s", err)
+		}
+		switch {
+		case c == '#' && len(token) == 0:
+			if _, err := br.ReadString('\n'); err != nil {
+				return "", fmt.Errorf("short PPM header: %s", err)
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if len(token) > 0 {
+				return string(token), nil
+			}
+		default:
+			token = append(token, c)
+		}
+	}
+}
+
+// saveScreenshot writes a screenshot named after reason into dir
+func (v *VM) saveScreenshot(dir, reason string) (string, error) {
+	if err := EnsureDir(dir); err != nil {
+		return "", fmt.Errorf("Failed to create screenshot dir %q: %s", dir, err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.png", reason, time.Now().Format("20060102-150405")))
+	var img bytes.Buffer
+	if err := v.Screendump(&img); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, img.Bytes(), 0640); err != nil {
+		return "", fmt.Errorf("Failed to write screenshot %q: %s", path, err)
+	}
+	return path, nil
+}
+
+// isGuestFailure returns true for the QMP run states the VM is paused in
+// after a guest panic or an emulation error
+func isGuestFailure(status string) bool {
+	return status == "guest-panicked" || status == "internal-error"
+}
+
+// guestFailureParams returns the QEMU arguments which report guest panics
+// and keep the VM paused, rather than shut down, so the screen can be saved
+func guestFailureParams() []string {
+	device := "pvpanic"
+	if runtime.GOARCH == "arm64" {
+		device = "pvpanic-pci"
+	}
+	return []string{"-device", device, "-action", "panic=pause"}
+}
+
+// watchGuestFailure saves a screenshot when the VM enters a failed state and
+// then stops it, QEMU would otherwise keep the paused VM forever.  The VM is
+// left in the VMFailed state.
+func (v *VM) watchGuestFailure(dir string) {
+	for {
+		select {
+		case <-v.Ctx.Done():
+			return
+		case <-time.After(screenshotPollInterval):
+		}
+		if v.State == VMStopped || v.State == VMFailed {
+			return
+		}
+		var status struct {
+			Status string `json:"status"`
+		}
+		if err := v.QMPExecute("query-status", nil, &status); err != nil {
+			continue
+		}
+		if !isGuestFailure(status.Status) {
+			continue
+		}
+		log.Warnf("VM:%s entered state %s, saving screenshot", v.Name(), status.Status)
+		path, err := v.saveScreenshot(dir, status.Status)
+		if err != nil {
+			log.Errorf("VM:%s failed to save screenshot: %s", v.Name(), err)
+		} else {
+			log.Infof("VM:%s saved screenshot %s", v.Name(), path)
+		}
+		log.Warnf("VM:%s stopping after %s", v.Name(), status.Status)
+		if err := v.QMPExecute("quit", nil, nil); err != nil {
+			log.Errorf("VM:%s quit failed, killing QEMU: %s", v.Name(), err)
+			v.Cancel()
+		}
+		v.State = VMFailed
+		return
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWritePNGFromPPM(t *testing.T) {
+	ppm := []byte("P6\n# written by qemu\n2 1\n255\n\xff\x00\x00\x00\x80\xff")
+	var out bytes.Buffer
+	if err := writePNG(&out, ppm); err != nil {
+		t.Fatalf("failed to convert ppm: %s", err)
+	}
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatalf("output is not a png: %s", err)
+	}
+	if img.Bounds().Dx() != 2 || img.Bounds().Dy() != 1 {
+		t.Fatalf("expected 2x1 image, got %v", img.Bounds())
+	}
+	expected := []color.RGBA{{255, 0, 0, 255}, {0, 128, 255, 255}}
+	for x, want := range expected {
+		got := color.RGBAModel.Convert(img.At(x, 0)).(color.RGBA)
+		if got != want {
+			t.Fatalf("pixel %d: expected %v, got %v", x, want, got)
+		}
+	}
+}
+
+func TestWritePNGPassthrough(t *testing.T) {
+	content := append([]byte{}, pngMagic...)
+	content = append(content, []byte("rest of image")...)
+	var out bytes.Buffer
+	if err := writePNG(&out, content); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Fatalf("expected png to be copied unchanged")
+	}
+}
+
+func TestWritePNGInvalid(t *testing.T) {
+	bad := [][]byte{
+		[]byte("P3\n1 1\n255\n0 0 0\n"),
+		[]byte("P6\n2 2\n255\n\x00\x00\x00"),
+		[]byte("P6\nwide 1\n255\n"),
+	}
+	for _, content := range bad {
+		if err := writePNG(&bytes.Buffer{}, content); err == nil {
+			t.Fatalf("expected error converting %q", content)
+		}
+	}
+}
+
+func TestWatchGuestFailure(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-screenshot")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	saved := screenshotPollInterval
+	defer func() { screenshotPollInterval = saved }()
+	screenshotPollInterval = time.Millisecond * 10
+
+	polls := 0
+	handler := func(cmd fakeQMPCommand) (interface{}, *QMPError, []QMPEvent) {
+		if cmd.Execute == "query-status" {
+			polls++
+			if polls > 2 {
+				return map[string]interface{}{"status": "guest-panicked", "running": false}, nil, nil
+			}
+			return map[string]interface{}{"status": "running", "running": true}, nil, nil
+		}
+		return nil, nil, nil
+	}
+	vm, f := newFakeQMPVM(t, dir, handler)
+	defer f.Close()
+	vm.Ctx, vm.Cancel = context.WithCancel(context.Background())
+	defer vm.Cancel()
+
+	done := make(chan struct{})
+	go func() {
+		vm.watchGuestFailure(dir)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("watchGuestFailure did not return after the guest panicked")
+	}
+	if vm.State != VMFailed {
+		t.Fatalf("expected the VM to be failed, got %s", vm.State)
+	}
+	commands := f.Commands()
+	if len(commands) == 0 || commands[len(commands)-1].Execute != "quit" {
+		t.Fatalf("expected QEMU to be told to quit, got %+v", commands)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// machined keeps the passphrases of encrypted disks in
+// ConfigDirectory/secrets, readable only by machined.  QEMU and qemu-img
+// read them from there, secret values are never returned by the API.
+const (
+	SecretsDirName  = "secrets"
+	secretIndexName = "index.json"
+	secretValuesDir = "values"
+
+	secretDirMode  = 0700
+	secretFileMode = 0600
+)
+
+var (
+	secretNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+	// the index is rewritten by each change
+	secretStoreLock sync.Mutex
+)
+
+type Secret struct {
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	OwnerUID int       `json:"owner-uid"`
+}
+
+type SecretSetRequest struct {
+	Value string `json:"value"`
+}
+
+type SecretStore struct {
+	Dir string
+}
+
+func NewSecretStore(dir string) *SecretStore {
+	return &SecretStore{Dir: dir}
+}
+
+// ValidSecretName returns an error if name cannot be used for a secret
+func ValidSecretName(name string) error {
+	if !secretNameRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid secret name '%s', names start with a letter or digit followed by letters, digits, '.', '_' or '-'", name)
+	}
+	return nil
+}
+
+// Path returns the file holding the value of the named secret
+func (s *SecretStore) Path(name string) string {
+	return filepath.Join(s.Dir, secretValuesDir, name)
+}
+
+func (s *SecretStore) ensureDirs() error {
+	for _, dir := range []string{s.Dir, filepath.Join(s.Dir, secretValuesDir)} {
+		if err := os.MkdirAll(dir, secretDirMode); err != nil {
+			return fmt.Errorf("Failed to create secret dir: %s", err)
+		}
+		// MkdirAll does not change existing directories
+		if err := os.Chmod(dir, secretDirMode); err != nil {
+			return fmt.Errorf("Failed to restrict secret dir: %s", err)
+		}
+	}
+	return nil
+}
+
+func (s *SecretStore) load() ([]Secret, error) {
+	content, err := os.ReadFile(filepath.Join(s.Dir, secretIndexName))
+	if os.IsNotExist(err) {
+		return []Secret{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read secret index: %s", err)
+	}
+	secrets := []Secret{}
+	if err := json.Unmarshal(content, &secrets); err != nil {
+		return nil, fmt.Errorf("Failed to parse secret index: %s", err)
+	}
+	return secrets, nil
+}
+
+func (s *SecretStore) save(secrets []Secret) error {
+	content, err := json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal secret index: %s", err)
+	}
+	return writeSecretFile(filepath.Join(s.Dir, secretIndexName), content)
+}
+
+// writeSecretFile replaces file with content, which is never readable by
+// other users
+func writeSecretFile(file string, content []byte) error {
+	tmpFile := file + ".tmp"
+	os.Remove(tmpFile)
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, secretFileMode)
+	if err != nil {
+		return fmt.Errorf("Failed to create %q: %s", tmpFile, err)
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(tmpFile)
+		return fmt.Errorf("Failed to write %q: %s", tmpFile, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("Failed to write %q: %s", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, file); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("Failed to replace %q: %s", file, err)
+	}
+	return nil
+}
+
+func findSecret(secrets []Secret, name string) int {
+	for idx := range secrets {
+		if secrets[idx].Name == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+// List returns the stored secrets sorted by name
+func (s *SecretStore) List() ([]Secret, error) {
+	secretStoreLock.Lock()
+	defer secretStoreLock.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	return secrets, nil
+}
+
+func (s *SecretStore) Get(name string) (Secret, error) {
+	secretStoreLock.Lock()
+	defer secretStoreLock.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return Secret{}, err
+	}
+	idx := findSecret(secrets, name)
+	if idx < 0 {
+		return Secret{}, fmt.Errorf("Secret '%s' not found", name)
+	}
+	return secrets[idx], nil
+}
+
+// Set stores value as the named secret, replacing any previous value
+func (s *SecretStore) Set(name string, value []byte, ownerUID int) (Secret, error) {
+	if err := ValidSecretName(name); err != nil {
+		return Secret{}, err
+	}
+	if len(value) == 0 {
+		return Secret{}, fmt.Errorf("Secret '%s' has an empty value", name)
+	}
+	secretStoreLock.Lock()
+	defer secretStoreLock.Unlock()
+	if err := s.ensureDirs(); err != nil {
+		return Secret{}, err
+	}
+	secrets, err := s.load()
+	if err != nil {
+		return Secret{}, err
+	}
+	if err := writeSecretFile(s.Path(name), value); err != nil {
+		return Secret{}, err
+	}
+	idx := findSecret(secrets, name)
+	if idx < 0 {
+		secrets = append(secrets, Secret{Name: name, Created: time.Now().UTC(), OwnerUID: ownerUID})
+		idx = len(secrets) - 1
+	}
+	if err := s.save(secrets); err != nil {
+		return Secret{}, err
+	}
+	log.Infof("Stored secret %s", name)
+	return secrets[idx], nil
+}
+
+// Remove deletes the named secret.  inUse is called first and may veto it.
+func (s *SecretStore) Remove(name string, inUse func(Secret) error) error {
+	secretStoreLock.Lock()
+	defer secretStoreLock.Unlock()
+	secrets, err := s.load()
+	if err != nil {
+		return err
+	}
+	idx := findSecret(secrets, name)
+	if idx < 0 {
+		return fmt.Errorf("Secret '%s' not found", name)
+	}
+	if inUse != nil {
+		if err := inUse(secrets[idx]); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(s.Path(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove secret %s: %s", name, err)
+	}
+	secrets = append(secrets[:idx], secrets[idx+1:]...)
+	log.Infof("Removed secret %s", name)
+	return s.save(secrets)
+}
+
+// SecretInUse returns an error naming the machines with a disk encrypted
+// with secret
+func (ctl *MachineController) SecretInUse(secret Secret) error {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+	users := []string{}
+	for idx := range ctl.Machines {
+		for _, disk := range ctl.Machines[idx].disks() {
+			if disk.Secret == secret.Name {
+				users = append(users, ctl.Machines[idx].Name)
+				break
+			}
+		}
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("Secret '%s' is used by machines %v", secret.Name, users)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/project-machine/qcli"
+)
+
+func TestSecretStore(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-secrets")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	store := NewSecretStore(filepath.Join(tmpDir, SecretsDirName))
+
+	if _, err := store.Set("../escape", []byte("x"), 1000); err == nil {
+		t.Fatalf("expected error for invalid secret name")
+	}
+	if _, err := store.Set("empty", []byte{}, 1000); err == nil {
+		t.Fatalf("expected error for empty secret")
+	}
+	secret, err := store.Set("customer-a", []byte("passphrase"), 1000)
+	if err != nil {
+		t.Fatalf("failed to set secret: %s", err)
+	}
+	if secret.Name != "customer-a" || secret.OwnerUID != 1000 {
+		t.Fatalf("unexpected secret %+v", secret)
+	}
+
+	for _, file := range []string{store.Dir, filepath.Join(store.Dir, secretValuesDir), store.Path("customer-a"), filepath.Join(store.Dir, secretIndexName)} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			t.Fatalf("%s is accessible by other users: %s", file, info.Mode())
+		}
+	}
+	value, err := os.ReadFile(store.Path("customer-a"))
+	if err != nil || string(value) != "passphrase" {
+		t.Fatalf("unexpected secret value %q: %v", value, err)
+	}
+
+	if _, err := store.Set("customer-a", []byte("other"), 1000); err != nil {
+		t.Fatalf("failed to replace secret: %s", err)
+	}
+	secrets, err := store.List()
+	if err != nil || len(secrets) != 1 {
+		t.Fatalf("expected one secret, got %+v: %v", secrets, err)
+	}
+
+	// machines only use secrets of their owner, unless an admin says so
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyOwner}
+	disks := []QemuDisk{
+		{File: "data.qcow2", Encryption: DiskEncryptionLUKS, Secret: "customer-a"},
+		{File: "other.qcow2", Encryption: DiskEncryptionLUKS, Secret: "missing"},
+	}
+	for _, tc := range []struct {
+		caller Caller
+		owner  int
+		ok     bool
+	}{
+		{Caller{UID: 1000, GID: 1000}, 1000, true},
+		{Caller{UID: 2000, GID: 2000}, 2000, false},
+		{Caller{UID: 2000, GID: 2000}, 1000, true},
+		{Caller{UID: 0, GID: 0}, 2000, true},
+	} {
+		m := Machine{Name: "vm1", OwnerUID: tc.owner}
+		mayUse := func(secret Secret) bool { return cfg.CanUseSecret(tc.caller, &m, secret) }
+		if err := checkDiskSecrets(store, disks, mayUse); (err == nil) != tc.ok {
+			t.Fatalf("caller %s, machine owner %d: unexpected result %v", tc.caller, tc.owner, err)
+		}
+	}
+
+	ctl := MachineController{Machines: []*Machine{{}}}
+	ctl.Machines[0].Name = "vm1"
+	ctl.Machines[0].Config.Disks = []QemuDisk{{File: "data.qcow2", Encryption: DiskEncryptionLUKS, Secret: "customer-a"}}
+	if err := store.Remove("customer-a", ctl.SecretInUse); err == nil || !strings.Contains(err.Error(), "vm1") {
+		t.Fatalf("expected secret in use by vm1, got %v", err)
+	}
+	ctl.Machines[0].Config.Disks = nil
+	if err := store.Remove("customer-a", ctl.SecretInUse); err != nil {
+		t.Fatalf("failed to remove secret: %s", err)
+	}
+	if PathExists(store.Path("customer-a")) {
+		t.Fatalf("secret value not removed")
+	}
+	if err := store.Remove("customer-a", nil); err == nil {
+		t.Fatalf("expected error removing unknown secret")
+	}
+}
+
+func TestDiskEncryption(t *testing.T) {
+	good := []QemuDisk{
+		{File: "data.qcow2", Encryption: "luks", Secret: "customer-a"},
+		{File: "data.img", Format: "raw", Encryption: "luks", Secret: "customer-a"},
+	}
+	for _, d := range good {
+		if err := d.Sanitize("/state/vm1"); err != nil {
+			t.Fatalf("unexpected error for disk %+v: %s", d, err)
+		}
+	}
+	bad := []QemuDisk{
+		{File: "data.qcow2", Encryption: "aes", Secret: "customer-a"},
+		{File: "data.qcow2", Encryption: "luks"},
+		{File: "data.qcow2", Secret: "customer-a"},
+		{File: "data.qcow2", Encryption: "luks", Secret: "../x"},
+		{Image: "ubuntu", Encryption: "luks", Secret: "customer-a"},
+		{File: "install.iso", Type: "cdrom", Format: "raw", Encryption: "luks", Secret: "customer-a"},
+	}
+	for _, d := range bad {
+		if err := d.Sanitize("/state/vm1"); err == nil {
+			t.Fatalf("expected error for disk %+v", d)
+		}
+	}
+
+	qcow2 := QemuDisk{File: "/state/vm1/data.qcow2", Format: "qcow2", Encryption: "luks", Secret: "a", secretFile: "/secrets/values/a"}
+	raw := QemuDisk{File: "/state/vm1/data,1.img", Format: "raw", Encryption: "luks", Secret: "a", secretFile: "/secrets/values/a"}
+	expected := "--object secret,id=sec0,file=/secrets/values/a,format=raw --image-opts driver=qcow2,file.filename=/state/vm1/data.qcow2,encrypt.format=luks,encrypt.key-secret=sec0"
+	if args := strings.Join(qcow2.qemuImgSource(), " "); args != expected {
+		t.Fatalf("expected qemu-img arguments %q, got %q", expected, args)
+	}
+	expected = "--image-opts driver=luks,file.filename=/state/vm1/data,,1.img,key-secret=sec0"
+	if args := strings.Join(raw.qemuImgSource(), " "); !strings.HasSuffix(args, expected) {
+		t.Fatalf("expected qemu-img arguments ending in %q, got %q", expected, args)
+	}
+	if args := strings.Join(raw.qemuImgTarget("-O", "qcow2"), " "); args != "-O qcow2 -o encrypt.format=luks,encrypt.key-secret=sec0" {
+		t.Fatalf("unexpected qemu-img target arguments %q", args)
+	}
+
+	args := blockdevAddArgs(raw, "hp-data", "hp-secret-data")
+	if args["driver"] != "luks" || args["key-secret"] != "hp-secret-data" {
+		t.Fatalf("unexpected blockdev-add arguments %v", args)
+	}
+
+	params := []string{"-m", "1G", "-drive", "file=/state/vm1/data.qcow2,id=drive0,format=qcow2", "-drive", "file=/state/vm1/data,1.img,id=drive1,format=raw"}
+	blkDevices := []qcli.BlockDevice{{ID: "drive0", File: qcow2.File}, {ID: "drive1", File: raw.File}}
+	params, err := addDiskEncryption(params, blkDevices, "/state/vm1", []QemuDisk{qcow2, raw, {File: "root.qcow2"}})
+	if err != nil {
+		t.Fatalf("failed to add disk encryption: %s", err)
+	}
+	expectedParams := []string{"-m", "1G",
+		"-object", "secret,id=secret-drive0,file=/secrets/values/a,format=raw",
+		"-object", "secret,id=secret-drive1,file=/secrets/values/a,format=raw",
+		"-drive", "file=/state/vm1/data.qcow2,id=drive0,format=qcow2,encrypt.format=luks,encrypt.key-secret=secret-drive0",
+		"-drive", "file=/state/vm1/data,1.img,id=drive1,format=luks,key-secret=secret-drive1",
+	}
+	if strings.Join(params, " ") != strings.Join(expectedParams, " ") {
+		t.Fatalf("expected params\n%v\ngot\n%v", expectedParams, params)
+	}
+
+	if summary := auditSummary("secret-set", []byte(`{"value":"passphrase"}`)); summary != "" {
+		t.Fatalf("secret recorded in audit log: %q", summary)
+	}
+}
@@ -0,0 +1,377 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// clients connect to these instead of the QEMU serial socket
+	ConsoleSocketName         = "console-mux.sock"
+	ConsoleReadOnlySocketName = "console-ro.sock"
+
+	consoleScrollbackSize = 64 * 1024
+	consoleClientBacklog  = 256
+)
+
+// scrollback keeps the most recent output of the console
+type scrollback struct {
+	buf  []byte
+	size int
+}
+
+func (s *scrollback) Write(p []byte) {
+	s.buf = append(s.buf, p...)
+	if len(s.buf) > s.size {
+		s.buf = append([]byte{}, s.buf[len(s.buf)-s.size:]...)
+	}
+}
+
+func (s *scrollback) Bytes() []byte {
+	return append([]byte{}, s.buf...)
+}
+
+// SerialMux owns the connection to the QEMU serial socket and fans the
+// console output out to any number of clients.  Read-write clients may also
+// send input to the guest.
+type SerialMux struct {
+	Name         string
+	SerialSocket string
+	conn         net.Conn
+	mutex        sync.Mutex
+	scrollback   scrollback
+	clients      map[*ConsoleClient]bool
+	listeners    []net.Listener
+	closed       bool
+	done         chan struct{}
+	cols         int
+	rows         int
+}
+
+// ConsoleClient is a single viewer of a SerialMux
+type ConsoleClient struct {
+	ReadOnly bool
+	mux      *SerialMux
+	output   chan []byte
+	once     sync.Once
+
+	// recorders queue output without limit instead of being dropped, the
+	// queue is guarded by the mux mutex
+	recorder bool
+	queue    [][]byte
+	detached bool
+	wake     chan struct{}
+}
+
+func NewSerialMux(name, serialSocket string) *SerialMux {
+	return &SerialMux{
+		Name:         name,
+		SerialSocket: serialSocket,
+		scrollback:   scrollback{size: consoleScrollbackSize},
+		clients:      map[*ConsoleClient]bool{},
+		done:         make(chan struct{}),
+	}
+}
+
+// Start connects to the QEMU serial socket and begins distributing output
+func (s *SerialMux) Start() error {
+	conn, err := net.Dial("unix", s.SerialSocket)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to serial socket %q: %s", s.SerialSocket, err)
+	}
+	s.conn = conn
+	go s.readSerial()
+	return nil
+}
+
+func (s *SerialMux) readSerial() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.conn.Read(buf)
+		if n > 0 {
+			data := append([]byte{}, buf[:n]...)
+			s.mutex.Lock()
+			s.scrollback.Write(data)
+			for client := range s.clients {
+				if client.recorder {
+					client.enqueue(data)
+					continue
+				}
+				select {
+				case client.output <- data:
+				default:
+					// never let a slow viewer stall the guest console
+					log.Warnf("VM:%s console client is not keeping up, disconnecting", s.Name)
+					s.removeClient(client)
+				}
+			}
+			s.mutex.Unlock()
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Infof("VM:%s serial console read failed: %s", s.Name, err)
+			}
+			s.Close()
+			return
+		}
+	}
+}
+
+// Attach registers a new console client, the scrollback is queued first
+func (s *SerialMux) Attach(readOnly bool) (*ConsoleClient, error) {
+	return s.attach(readOnly, true)
+}
+
+// AttachLive registers a console client which only sees new output
+func (s *SerialMux) AttachLive(readOnly bool) (*ConsoleClient, error) {
+	return s.attach(readOnly, false)
+}
+
+// AttachRecorder registers a read-only client which is never disconnected
+// for falling behind, its output is queued until it is read.  Recordings
+// must not lose output to a slow disk.
+func (s *SerialMux) AttachRecorder() (*ConsoleClient, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("VM:%s serial console is closed", s.Name)
+	}
+	client := &ConsoleClient{
+		ReadOnly: true,
+		mux:      s,
+		output:   make(chan []byte),
+		recorder: true,
+		wake:     make(chan struct{}, 1),
+	}
+	if history := s.scrollback.Bytes(); len(history) > 0 {
+		client.enqueue(history)
+	}
+	s.clients[client] = true
+	go client.pump()
+	return client, nil
+}
+
+func (s *SerialMux) attach(readOnly, replay bool) (*ConsoleClient, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("VM:%s serial console is closed", s.Name)
+	}
+	client := &ConsoleClient{
+		ReadOnly: readOnly,
+		mux:      s,
+		output:   make(chan []byte, consoleClientBacklog),
+	}
+	if history := s.scrollback.Bytes(); replay && len(history) > 0 {
+		client.output <- history
+	}
+	s.clients[client] = true
+	return client, nil
+}
+
+// removeClient must be called with the mutex held
+func (s *SerialMux) removeClient(client *ConsoleClient) {
+	if s.clients[client] {
+		delete(s.clients, client)
+		if client.recorder {
+			// the pump closes the output once the queue is drained
+			client.detached = true
+			client.signal()
+		} else {
+			close(client.output)
+		}
+	}
+}
+
+// Resize records the terminal size of the most recent interactive client.
+// The guest is not told, but recordings of the console use it.
+func (s *SerialMux) Resize(cols, rows int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cols = cols
+	s.rows = rows
+}
+
+// Size returns the last terminal size reported by a client, or 80x24
+func (s *SerialMux) Size() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cols <= 0 || s.rows <= 0 {
+		return 80, 24
+	}
+	return s.cols, s.rows
+}
+
+// Done is closed when the serial console goes away
+func (s *SerialMux) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *SerialMux) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for client := range s.clients {
+		s.removeClient(client)
+	}
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	close(s.done)
+}
+
+// Listen serves the console on a unix socket, e.g. for socat
+func (s *SerialMux) Listen(socketPath string, readOnly bool) error {
+	if PathExists(socketPath) {
+		os.Remove(socketPath)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on console socket %q: %s", socketPath, err)
+	}
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		listener.Close()
+		return fmt.Errorf("VM:%s serial console is closed", s.Name)
+	}
+	s.listeners = append(s.listeners, listener)
+	s.mutex.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if err := s.Serve(conn, readOnly); err != nil {
+					log.Infof("VM:%s console client: %s", s.Name, err)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// Serve attaches conn as a console client until either side goes away
+func (s *SerialMux) Serve(conn io.ReadWriteCloser, readOnly bool) error {
+	defer conn.Close()
+	client, err := s.Attach(readOnly)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 && !readOnly {
+				if _, err := client.Write(buf[:n]); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		// closing the client ends the output loop below
+		client.Close()
+	}()
+
+	for data := range client.Output() {
+		if _, err := conn.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Output returns the console output, it is closed when the client is
+// detached
+func (c *ConsoleClient) Output() <-chan []byte {
+	return c.output
+}
+
+// Write sends input to the guest
+func (c *ConsoleClient) Write(p []byte) (int, error) {
+	if c.ReadOnly {
+		return 0, fmt.Errorf("Console client is read-only")
+	}
+	c.mux.mutex.Lock()
+	conn := c.mux.conn
+	closed := c.mux.closed
+	c.mux.mutex.Unlock()
+	if closed || conn == nil {
+		return 0, fmt.Errorf("VM:%s serial console is closed", c.mux.Name)
+	}
+	return conn.Write(p)
+}
+
+// enqueue must be called with the mux mutex held
+func (c *ConsoleClient) enqueue(data []byte) {
+	c.queue = append(c.queue, data)
+	c.signal()
+}
+
+func (c *ConsoleClient) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pump delivers the queued output of a recorder until it is detached
+func (c *ConsoleClient) pump() {
+	defer close(c.output)
+	for {
+		c.mux.mutex.Lock()
+		queue := c.queue
+		c.queue = nil
+		detached := c.detached
+		c.mux.mutex.Unlock()
+		for _, data := range queue {
+			c.output <- data
+		}
+		if len(queue) > 0 {
+			continue
+		}
+		if detached {
+			return
+		}
+		<-c.wake
+	}
+}
+
+func (c *ConsoleClient) Close() {
+	c.once.Do(func() {
+		c.mux.mutex.Lock()
+		c.mux.removeClient(c)
+		c.mux.mutex.Unlock()
+	})
+}
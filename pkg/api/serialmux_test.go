@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readConsole(t *testing.T, client *ConsoleClient, expected string) {
+	got := ""
+	timeout := time.After(5 * time.Second)
+	for got != expected {
+		select {
+		case data, ok := <-client.Output():
+			if !ok {
+				t.Fatalf("console closed, expected %q got %q", expected, got)
+			}
+			got += string(data)
+		case <-timeout:
+			t.Fatalf("timed out, expected %q got %q", expected, got)
+		}
+	}
+}
+
+func TestSerialMux(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-serial-mux")
+	if err != nil {
+		t.Fatalf("failed to create a tempdir for test")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// stand in for the QEMU serial chardev
+	serialSocket := filepath.Join(tmpDir, "console.sock")
+	listener, err := net.Listen("unix", serialSocket)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer listener.Close()
+	guestCh := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			guestCh <- conn
+		}
+	}()
+
+	mux := NewSerialMux("vm1", serialSocket)
+	if err := mux.Start(); err != nil {
+		t.Fatalf("failed to start mux: %s", err)
+	}
+	defer mux.Close()
+	guest := <-guestCh
+
+	guest.Write([]byte("login: "))
+	viewer, err := mux.Attach(true)
+	if err != nil {
+		t.Fatalf("failed to attach: %s", err)
+	}
+	// the first client sees the scrollback
+	readConsole(t, viewer, "login: ")
+
+	typist, err := mux.Attach(false)
+	if err != nil {
+		t.Fatalf("failed to attach: %s", err)
+	}
+	readConsole(t, typist, "login: ")
+
+	if _, err := viewer.Write([]byte("nope\n")); err == nil {
+		t.Fatalf("expected read-only client write to fail")
+	}
+	if _, err := typist.Write([]byte("root\n")); err != nil {
+		t.Fatalf("failed to write to console: %s", err)
+	}
+	line, err := bufio.NewReader(guest).ReadString('\n')
+	if err != nil || line != "root\n" {
+		t.Fatalf("expected guest to receive 'root', got %q: %v", line, err)
+	}
+
+	guest.Write([]byte("Password: "))
+	readConsole(t, viewer, "Password: ")
+	readConsole(t, typist, "Password: ")
+
+	// the guest going away detaches everyone
+	guest.Close()
+	select {
+	case <-mux.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("mux did not close after the serial socket closed")
+	}
+	if _, ok := <-viewer.Output(); ok {
+		t.Fatalf("expected viewer output to be closed")
+	}
+}
+
+func TestSerialMuxRecorder(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-serial-mux")
+	if err != nil {
+		t.Fatalf("failed to create a tempdir for test")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	serialSocket := filepath.Join(tmpDir, "console.sock")
+	listener, err := net.Listen("unix", serialSocket)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer listener.Close()
+	guestCh := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			guestCh <- conn
+		}
+	}()
+
+	mux := NewSerialMux("vm1", serialSocket)
+	if err := mux.Start(); err != nil {
+		t.Fatalf("failed to start mux: %s", err)
+	}
+	defer mux.Close()
+	guest := <-guestCh
+
+	viewer, err := mux.Attach(true)
+	if err != nil {
+		t.Fatalf("failed to attach: %s", err)
+	}
+	recorder, err := mux.AttachRecorder()
+	if err != nil {
+		t.Fatalf("failed to attach recorder: %s", err)
+	}
+
+	// neither client reads while the guest writes more chunks than a viewer
+	// may fall behind
+	expected := ""
+	for i := 0; i < consoleClientBacklog*2; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		expected += line
+		guest.Write([]byte(line))
+		// keep the chunks apart
+		time.Sleep(time.Millisecond)
+	}
+	guest.Close()
+	select {
+	case <-mux.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("mux did not close after the serial socket closed")
+	}
+
+	got := ""
+	for data := range recorder.Output() {
+		got += string(data)
+	}
+	if got != expected {
+		t.Fatalf("recorder lost output, got %d of %d bytes", len(got), len(expected))
+	}
+	viewed := 0
+	for data := range viewer.Output() {
+		viewed += len(data)
+	}
+	if viewed >= len(expected) {
+		t.Fatalf("expected the slow viewer to be disconnected")
+	}
+}
@@ -0,0 +1,435 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/project-machine/qcli"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ShareVirtioFS = "virtiofs"
+	Share9P       = "9p"
+
+	// the guest kernel limits 9p mount tags to 31 bytes
+	shareTagMaxLen = 31
+
+	// virtiofs maps guest memory from the shared memory filesystem
+	virtioFSMemPath = "/dev/shm"
+
+	// virtiofsd checks the shared dir at start and exits if it cannot serve it
+	virtioFSDStartTimeout = time.Millisecond * 500
+)
+
+var (
+	shareTagRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+	// distributions install virtiofsd outside of PATH
+	virtioFSDPaths = []string{"/usr/libexec/virtiofsd", "/usr/lib/qemu/virtiofsd", "/usr/lib/virtiofsd"}
+
+	// findVirtioFSD returns the path of virtiofsd or "" if it is not installed
+	findVirtioFSD = func() string {
+		if path := Which("virtiofsd"); path != "" {
+			return path
+		}
+		for _, path := range virtioFSDPaths {
+			if PathExists(path) {
+				return path
+			}
+		}
+		return ""
+	}
+)
+
+// Share is a host directory which the guest mounts with its Tag
+type Share struct {
+	Path     string `yaml:"path"`
+	Tag      string `yaml:"tag"`
+	ReadOnly bool   `yaml:"read-only,omitempty"`
+
+	// virtiofs or 9p, defaults to virtiofs if virtiofsd is installed
+	Type string `yaml:"type,omitempty"`
+
+	// mount the share at this guest path with cloud-init
+	Mount string `yaml:"mount,omitempty"`
+}
+
+func (s *Share) Sanitize() error {
+	errors := []string{}
+	if s.Path == "" {
+		errors = append(errors, "empty path")
+	} else {
+		// like cdroms, relative paths are relative to machined
+		if absPath, err := filepath.Abs(s.Path); err == nil {
+			s.Path = absPath
+		}
+		if info, err := os.Stat(s.Path); err != nil || !info.IsDir() {
+			errors = append(errors, fmt.Sprintf("path %q is not a directory", s.Path))
+		}
+	}
+	if !shareTagRegexp.MatchString(s.Tag) || len(s.Tag) > shareTagMaxLen {
+		errors = append(errors, fmt.Sprintf("invalid tag '%s': must be at most %d letters, digits, '.', '_' or '-'", s.Tag, shareTagMaxLen))
+	}
+	if s.Type == "" {
+		s.Type = ShareVirtioFS
+		if findVirtioFSD() == "" {
+			log.Infof("virtiofsd not found, sharing %s with 9p", s.Path)
+			s.Type = Share9P
+		}
+	}
+	switch s.Type {
+	case ShareVirtioFS:
+		if findVirtioFSD() == "" {
+			errors = append(errors, "type virtiofs requires virtiofsd, install it or use type 9p")
+		}
+	case Share9P:
+	default:
+		errors = append(errors, fmt.Sprintf("invalid type: found %s expected %v", s.Type, []string{ShareVirtioFS, Share9P}))
+	}
+	if s.Mount != "" && !filepath.IsAbs(s.Mount) {
+		errors = append(errors, fmt.Sprintf("invalid mount %q: must be an absolute guest path", s.Mount))
+	}
+	if len(errors) != 0 {
+		return fmt.Errorf("bad share %#v: %s", s, strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+// sanitizeShares sanitizes each share and rejects duplicate tags
+func sanitizeShares(shares []Share) error {
+	tags := map[string]bool{}
+	for idx := range shares {
+		if err := shares[idx].Sanitize(); err != nil {
+			return err
+		}
+		if tags[shares[idx].Tag] {
+			return fmt.Errorf("Duplicate share tag '%s'", shares[idx].Tag)
+		}
+		tags[shares[idx].Tag] = true
+	}
+	return nil
+}
+
+// checkShareAccess checks the directories of sanitized shares with access,
+// writable shares need write access as well.  9p shares are refused unless
+// serve9P is set.
+func checkShareAccess(shares []Share, access PathAccessFunc, serve9P bool) error {
+	for _, share := range shares {
+		if share.Type == Share9P && !serve9P {
+			return fmt.Errorf("Share '%s' cannot use 9p, which serves %q with the privileges of machined, use virtiofs", share.Tag, share.Path)
+		}
+		mode := uint32(unix.R_OK | unix.X_OK)
+		if !share.ReadOnly {
+			mode |= unix.W_OK
+		}
+		if err := access(share.Path, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureShareMemory makes guest memory shareable with virtiofsd, which
+// virtiofs requires
+func configureShareMemory(c *qcli.Config, shares []Share) {
+	for _, share := range shares {
+		if share.Type == ShareVirtioFS {
+			c.Knobs.FileBackedMem = true
+			c.Knobs.MemShared = true
+			c.Memory.Path = virtioFSMemPath
+			return
+		}
+	}
+}
+
+// virtioFSSocket returns the vhost-user socket of the share with index idx
+func virtioFSSocket(sockDir string, idx int) string {
+	return filepath.Join(sockDir, fmt.Sprintf("virtiofs%d.sock", idx))
+}
+
+// shareParams returns the QEMU parameters of the shares, which qcli cannot
+// add to its config
+func shareParams(c *qcli.Config, sockDir string, shares []Share) []string {
+	params := []string{}
+	for idx, share := range shares {
+		id := fmt.Sprintf("fs%d", idx)
+		switch share.Type {
+		case ShareVirtioFS:
+			dev := qcli.VhostUserDevice{
+				SocketPath:    virtioFSSocket(sockDir, idx),
+				CharDevID:     id,
+				Tag:           share.Tag,
+				VhostUserType: qcli.VhostUserFS,
+			}
+			params = append(params, dev.QemuParams(c)...)
+		case Share9P:
+			dev := qcli.FSDevice{
+				Driver:        qcli.Virtio9P,
+				FSDriver:      qcli.Local,
+				ID:            id,
+				Path:          share.Path,
+				MountTag:      share.Tag,
+				SecurityModel: qcli.None,
+				Multidev:      qcli.Remap,
+			}
+			fsParams := dev.QemuParams(c)
+			if share.ReadOnly {
+				for i := range fsParams {
+					if i > 0 && fsParams[i-1] == "-fsdev" {
+						fsParams[i] += ",readonly=on"
+					}
+				}
+			}
+			params = append(params, fsParams...)
+		}
+	}
+	return params
+}
+
+// addShareMounts adds a cloud-init mount for each share with a guest mount
+// point to the cloud-config user-data
+func addShareMounts(config *CloudInitConfig, shares []Share) error {
+	mounts := [][]string{}
+	for _, share := range shares {
+		if share.Mount == "" {
+			continue
+		}
+		options := "defaults,nofail"
+		if share.Type == Share9P {
+			options = "trans=virtio,version=9p2000.L,nofail"
+		}
+		if share.ReadOnly {
+			options += ",ro"
+		}
+		mounts = append(mounts, []string{share.Tag, share.Mount, share.Type, options, "0", "0"})
+	}
+	if len(mounts) == 0 {
+		return nil
+	}
+
+	const header = "#cloud-config"
+	if config.UserData != "" && !strings.HasPrefix(config.UserData, header) {
+		log.Warnf("cloud-init user-data is not a cloud-config, not adding share mounts")
+		return nil
+	}
+	userData := yaml.MapSlice{}
+	if err := yaml.Unmarshal([]byte(config.UserData), &userData); err != nil {
+		return fmt.Errorf("Failed to parse cloud-init user-data: %s", err)
+	}
+	found := false
+	for idx := range userData {
+		if userData[idx].Key != "mounts" {
+			continue
+		}
+		existing, ok := userData[idx].Value.([]interface{})
+		if !ok {
+			return fmt.Errorf("cloud-init user-data mounts is not a list")
+		}
+		for _, mount := range mounts {
+			existing = append(existing, mount)
+		}
+		userData[idx].Value = existing
+		found = true
+	}
+	if !found {
+		userData = append(userData, yaml.MapItem{Key: "mounts", Value: mounts})
+	}
+	content, err := yaml.Marshal(userData)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal cloud-init user-data: %s", err)
+	}
+	config.UserData = header + "\n" + string(content)
+	return nil
+}
+
+// VirtioFSD serves a shared directory to QEMU over a vhost-user socket
+type VirtioFSD struct {
+	SharedDir string
+	Socket    string
+	ReadOnly  bool
+	// Owner is the user virtiofsd runs as when machined runs as root, so
+	// the guest only gets the access to SharedDir the machine owner has
+	Owner Caller
+	// Log receives the output of virtiofsd
+	Log      io.Writer
+	cmd      *exec.Cmd
+	finished chan error
+}
+
+// runAsOwner returns true if virtiofsd must drop the privileges of machined
+func (d *VirtioFSD) runAsOwner() bool {
+	return os.Geteuid() == 0 && d.Owner.Known() && d.Owner.UID != 0
+}
+
+func (d *VirtioFSD) Start() error {
+	virtiofsd := findVirtioFSD()
+	if virtiofsd == "" {
+		return fmt.Errorf("no 'virtiofsd' command found in PATH or %v", virtioFSDPaths)
+	}
+	// machined listens on the socket and passes it to virtiofsd, which
+	// cannot create it in the socket dir once it runs as the owner
+	socket, err := listenVirtioFS(d.Socket)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+	args := []string{
+		"--fd=3",
+		"--shared-dir=" + d.SharedDir,
+		"--cache=auto",
+	}
+	if d.ReadOnly {
+		args = append(args, "--readonly")
+	}
+	// the namespace sandbox requires root
+	if os.Geteuid() != 0 || d.runAsOwner() {
+		args = append(args, "--sandbox=none")
+	}
+
+	cmd := exec.Command(virtiofsd, args...)
+	cmd.Stdout = d.Log
+	cmd.Stderr = d.Log
+	cmd.ExtraFiles = []*os.File{socket}
+	if d.runAsOwner() {
+		owner := d.Owner
+		lookupCaller(&owner)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: owner.Credential()}
+	}
+	log.Infof("virtiofsd args: %s", cmd.String())
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to start virtiofsd: %s", err)
+	}
+	d.cmd = cmd
+	d.finished = make(chan error, 1)
+	go func() {
+		d.finished <- d.cmd.Wait()
+	}()
+
+	// machined created the socket, so virtiofsd has started if it is still
+	// running once it had time to check the shared dir
+	select {
+	case <-d.finished:
+		d.cmd = nil
+		return fmt.Errorf("virtiofsd sharing %s failed to start: %s", d.SharedDir, cmd.ProcessState)
+	case <-time.After(virtioFSDStartTimeout):
+	}
+	log.Infof("virtiofsd sharing %s started with pid %d", d.SharedDir, cmd.Process.Pid)
+	return nil
+}
+
+// listenVirtioFS returns the listening vhost-user socket at path
+func listenVirtioFS(path string) (*os.File, error) {
+	// a stale socket from a previous run makes listening fail
+	os.Remove(path)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on virtiofs socket %q: %s", path, err)
+	}
+	// virtiofsd keeps serving the socket after machined closes its copy
+	listener.SetUnlinkOnClose(false)
+	defer listener.Close()
+	file, err := listener.File()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get virtiofs socket %q: %s", path, err)
+	}
+	return file, nil
+}
+
+func (d *VirtioFSD) Stop() error {
+	// never started.
+	if d.cmd == nil {
+		return nil
+	}
+
+	pid := d.cmd.Process.Pid
+	if err := d.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		if err == os.ErrProcessDone {
+			return nil
+		}
+		log.Warnf("Failed to kill %d: %v", pid, err)
+		return err
+	}
+
+	timeout := time.Duration(2) * time.Second
+	select {
+	case <-d.finished:
+		log.Infof("virtiofsd pid %d exited after sigterm", pid)
+	case <-time.After(timeout):
+		log.Infof("virtiofsd pid %d didn't die right away, killing.", pid)
+		if err := d.cmd.Process.Kill(); err != nil {
+			return err
+		}
+		<-d.finished
+	}
+	return nil
+}
+
+// startVirtioFS starts a virtiofsd for each virtiofs share of the VM
+func (v *VM) startVirtioFS() error {
+	owner := Caller{UID: UnknownID, GID: UnknownID}
+	if o, ok := v.Ctx.Value(clsCtxOwner).(Caller); ok {
+		owner = o
+	}
+	for idx, share := range v.Config.Shares {
+		if share.Type != ShareVirtioFS {
+			continue
+		}
+		if v.shareLog == nil {
+			shareLog, err := OpenRotatingLog(LogFile(v.LogDir, LogSourceVirtioFS))
+			if err != nil {
+				return err
+			}
+			v.shareLog = shareLog
+		}
+		daemon := &VirtioFSD{
+			SharedDir: share.Path,
+			Socket:    virtioFSSocket(v.sockDir, idx),
+			ReadOnly:  share.ReadOnly,
+			Owner:     owner,
+			Log:       v.shareLog,
+		}
+		if err := daemon.Start(); err != nil {
+			return err
+		}
+		v.virtioFS = append(v.virtioFS, daemon)
+	}
+	return nil
+}
+
+// stopVirtioFS stops the virtiofsd of the VM, which normally exit with QEMU
+func (v *VM) stopVirtioFS() {
+	for _, daemon := range v.virtioFS {
+		if err := daemon.Stop(); err != nil {
+			log.Warnf("VM:%s failed to stop virtiofsd for %s: %s", v.Name(), daemon.SharedDir, err)
+		}
+	}
+	v.virtioFS = nil
+	if v.shareLog != nil {
+		v.shareLog.Close()
+		v.shareLog = nil
+	}
+}
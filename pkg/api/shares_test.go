@@ -0,0 +1,248 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/project-machine/qcli"
+	"gopkg.in/yaml.v2"
+)
+
+func TestShareSanitize(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-shares")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	saved := findVirtioFSD
+	defer func() { findVirtioFSD = saved }()
+	findVirtioFSD = func() string { return "" }
+
+	share := Share{Path: tmpDir, Tag: "artifacts"}
+	if err := share.Sanitize(); err != nil {
+		t.Fatalf("failed to sanitize share: %s", err)
+	}
+	if share.Type != Share9P {
+		t.Fatalf("expected 9p without virtiofsd, got %s", share.Type)
+	}
+	if err := (&Share{Path: tmpDir, Tag: "artifacts", Type: ShareVirtioFS}).Sanitize(); err == nil {
+		t.Fatalf("expected error for virtiofs without virtiofsd")
+	}
+
+	findVirtioFSD = func() string { return "/usr/libexec/virtiofsd" }
+	share = Share{Path: tmpDir, Tag: "artifacts"}
+	if err := share.Sanitize(); err != nil {
+		t.Fatalf("failed to sanitize share: %s", err)
+	}
+	if share.Type != ShareVirtioFS {
+		t.Fatalf("expected virtiofs with virtiofsd, got %s", share.Type)
+	}
+
+	bad := []Share{
+		{Path: "", Tag: "a"},
+		{Path: tmpDir + "/missing", Tag: "a"},
+		{Path: tmpDir, Tag: ""},
+		{Path: tmpDir, Tag: "has space"},
+		{Path: tmpDir, Tag: strings.Repeat("a", shareTagMaxLen+1)},
+		{Path: tmpDir, Tag: "a", Type: "nfs"},
+		{Path: tmpDir, Tag: "a", Mount: "mnt/a"},
+	}
+	for _, s := range bad {
+		if err := s.Sanitize(); err == nil {
+			t.Fatalf("expected error for share %+v", s)
+		}
+	}
+	if err := sanitizeShares([]Share{{Path: tmpDir, Tag: "a"}, {Path: tmpDir, Tag: "a"}}); err == nil {
+		t.Fatalf("expected error for duplicate tags")
+	}
+}
+
+func TestShareParams(t *testing.T) {
+	shares := []Share{
+		{Path: "/src/build", Tag: "build", Type: ShareVirtioFS},
+		{Path: "/src/tools", Tag: "tools", Type: Share9P, ReadOnly: true},
+	}
+	c := &qcli.Config{Name: "x", Path: "/bin/true", Memory: qcli.Memory{Size: "1024m"}}
+	configureShareMemory(c, shares)
+	params, err := qcli.ConfigureParams(c, nil)
+	if err != nil {
+		t.Fatalf("failed to configure params: %s", err)
+	}
+	if !strings.Contains(strings.Join(params, " "), "memory-backend-file,id=dimm1,size=1024m,mem-path=/dev/shm,share=on") {
+		t.Fatalf("guest memory is not shared: %v", params)
+	}
+
+	expected := []string{
+		"-chardev", "socket,id=fs0,path=/tmp/sock/virtiofs0.sock",
+		"-device", "vhost-user-fs-pci,chardev=fs0,tag=build",
+		"-device", "virtio-9p-pci,disable-modern=false,fsdev=fs1,mount_tag=tools",
+		"-fsdev", "local,id=fs1,path=/src/tools,security_model=none,multidevs=remap,readonly=on",
+	}
+	params = shareParams(c, "/tmp/sock", shares)
+	if strings.Join(params, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected params\n%v\ngot\n%v", expected, params)
+	}
+
+	c = &qcli.Config{}
+	configureShareMemory(c, shares[1:])
+	if c.Knobs.MemShared {
+		t.Fatalf("9p shares do not need shared memory")
+	}
+}
+
+func TestAddShareMounts(t *testing.T) {
+	shares := []Share{
+		{Path: "/src/build", Tag: "build", Type: ShareVirtioFS, Mount: "/mnt/build"},
+		{Path: "/src/tools", Tag: "tools", Type: Share9P, ReadOnly: true, Mount: "/mnt/tools"},
+		{Path: "/src/other", Tag: "other", Type: Share9P},
+	}
+	config := CloudInitConfig{UserData: "#cloud-config\nruncmd:\n- ls\nmounts:\n- [/dev/vdb, /data]\n"}
+	if err := addShareMounts(&config, shares); err != nil {
+		t.Fatalf("failed to add share mounts: %s", err)
+	}
+	if !strings.HasPrefix(config.UserData, "#cloud-config\n") {
+		t.Fatalf("user-data lost its header: %q", config.UserData)
+	}
+	var userData struct {
+		RunCmd []string   `yaml:"runcmd"`
+		Mounts [][]string `yaml:"mounts"`
+	}
+	if err := yaml.Unmarshal([]byte(config.UserData), &userData); err != nil {
+		t.Fatalf("failed to parse user-data: %s", err)
+	}
+	if len(userData.RunCmd) != 1 || len(userData.Mounts) != 3 {
+		t.Fatalf("unexpected user-data %q", config.UserData)
+	}
+	if strings.Join(userData.Mounts[1], " ") != "build /mnt/build virtiofs defaults,nofail 0 0" ||
+		strings.Join(userData.Mounts[2], " ") != "tools /mnt/tools 9p trans=virtio,version=9p2000.L,nofail,ro 0 0" {
+		t.Fatalf("unexpected mounts %v", userData.Mounts)
+	}
+
+	config = CloudInitConfig{}
+	if err := addShareMounts(&config, shares); err != nil {
+		t.Fatalf("failed to add share mounts: %s", err)
+	}
+	if !strings.HasPrefix(config.UserData, "#cloud-config\nmounts:") {
+		t.Fatalf("unexpected user-data %q", config.UserData)
+	}
+
+	script := CloudInitConfig{UserData: "#!/bin/sh\necho hi\n"}
+	if err := addShareMounts(&script, shares); err != nil || script.UserData != "#!/bin/sh\necho hi\n" {
+		t.Fatalf("script user-data changed %q: %v", script.UserData, err)
+	}
+}
+
+func TestShareAccess(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("share access checks need files owned by another user")
+	}
+	tmpDir, err := os.MkdirTemp("", "test-shares")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	private := filepath.Join(tmpDir, "private")
+	if err := os.Mkdir(private, 0700); err != nil {
+		t.Fatalf("%s", err)
+	}
+	public := filepath.Join(tmpDir, "public")
+	if err := os.Mkdir(public, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	cfg := MachineDaemonConfig{AuthPolicy: AuthPolicyOwner}
+	access := cfg.PathAccess(Caller{UID: 54321, GID: 54321})
+	shares := []Share{{Path: public, Tag: "public", Type: ShareVirtioFS, ReadOnly: true}}
+	if err := checkShareAccess(shares, access, false); err != nil {
+		t.Fatalf("unexpected error for readable share: %s", err)
+	}
+	for _, s := range []Share{
+		{Path: public, Tag: "public", Type: ShareVirtioFS},
+		{Path: private, Tag: "private", Type: ShareVirtioFS, ReadOnly: true},
+		{Path: public, Tag: "public", Type: Share9P, ReadOnly: true},
+	} {
+		if err := checkShareAccess([]Share{s}, access, false); err == nil {
+			t.Fatalf("expected error for share %+v", s)
+		}
+	}
+	if err := checkShareAccess(shares, cfg.PathAccess(Caller{UID: 0, GID: 0}), true); err != nil {
+		t.Fatalf("unexpected error for admin: %s", err)
+	}
+}
+
+func TestVirtioFSDOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("virtiofsd only changes user when machined runs as root")
+	}
+	tmpDir, err := os.MkdirTemp("", "test-virtiofsd")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// the fake virtiofsd reports its user and checks it got the socket
+	fake := filepath.Join(tmpDir, "virtiofsd")
+	script := "#!/bin/sh\necho \"$(id -u):$(id -g) $*\"\n[ -S /proc/self/fd/3 ] && echo socket\nexec sleep 30\n"
+	if err := os.WriteFile(fake, []byte(script), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	saved := findVirtioFSD
+	defer func() { findVirtioFSD = saved }()
+	findVirtioFSD = func() string { return fake }
+
+	var out bytes.Buffer
+	d := VirtioFSD{
+		SharedDir: tmpDir,
+		Socket:    filepath.Join(tmpDir, "virtiofs0.sock"),
+		Owner:     Caller{UID: 54321, GID: 54321},
+		Log:       &out,
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("failed to start virtiofsd: %s", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := d.Stop(); err != nil {
+		t.Fatalf("failed to stop virtiofsd: %s", err)
+	}
+	expected := "54321:54321 --fd=3 --shared-dir=" + tmpDir + " --cache=auto --sandbox=none\nsocket\n"
+	if out.String() != expected {
+		t.Fatalf("expected virtiofsd output %q, got %q", expected, out.String())
+	}
+}
+
+func TestVirtioFSDStartFailure(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-virtiofsd")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// a virtiofsd which cannot serve the shared dir exits at once
+	fake := filepath.Join(tmpDir, "virtiofsd")
+	if err := os.WriteFile(fake, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	saved := findVirtioFSD
+	defer func() { findVirtioFSD = saved }()
+	findVirtioFSD = func() string { return fake }
+
+	d := VirtioFSD{SharedDir: tmpDir, Socket: filepath.Join(tmpDir, "virtiofs0.sock"), Log: io.Discard}
+	if err := d.Start(); err == nil || !strings.Contains(err.Error(), "exit status 1") {
+		t.Fatalf("expected virtiofsd start to fail, got %v", err)
+	}
+	if err := d.Stop(); err != nil {
+		t.Fatalf("failed to stop virtiofsd: %s", err)
+	}
+}
@@ -0,0 +1,401 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/project-machine/qcli"
+)
+
+const (
+	ControllerVirtioSCSI = "virtio-scsi"
+	ControllerAHCI       = "ahci"
+	ControllerNVMe       = "nvme"
+	ControllerXHCI       = "xhci"
+
+	scsiMaxID         = 255
+	scsiMaxLUN        = 16383
+	nvmeMaxNamespaces = 256
+	xhciDefaultPorts  = 4
+	xhciMaxPorts      = 15
+
+	// the AHCI controller built into the q35 machine, disks attached with
+	// ide without a controller use its ports ide.0 to ide.5
+	builtinAHCI = "ide"
+)
+
+var controllerIDRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// StorageController is a disk controller of the machine, disks are placed
+// on it with QemuDisk.Controller.  Unit is the scsi-id on virtio-scsi, the
+// port on ahci (0-5) and xhci (1-ports) and the namespace id on nvme.
+type StorageController struct {
+	ID   string `yaml:"id"`
+	Type string `yaml:"type"`
+
+	// virtio-scsi only, handle I/O in a dedicated thread
+	IOThread bool `yaml:"iothread,omitempty"`
+
+	// nvme only, defaults to the controller ID
+	Serial string `yaml:"serial,omitempty"`
+
+	// xhci only, the number of USB 2 and of USB 3 ports
+	Ports int `yaml:"ports,omitempty"`
+
+	// created for disks without a controller, not in the machine definition
+	implicit bool
+}
+
+func (sc *StorageController) Sanitize() error {
+	errors := []string{}
+	if !controllerIDRegexp.MatchString(sc.ID) {
+		errors = append(errors, fmt.Sprintf("invalid id '%s': must start with a letter followed by letters, digits, '-' or '_'", sc.ID))
+	} else if sc.ID == builtinAHCI {
+		errors = append(errors, fmt.Sprintf("invalid id '%s': reserved for the built-in AHCI controller", sc.ID))
+	}
+	switch sc.Type {
+	case ControllerVirtioSCSI, ControllerAHCI, ControllerNVMe, ControllerXHCI:
+	default:
+		errors = append(errors, fmt.Sprintf("invalid type: found %s expected %v", sc.Type,
+			[]string{ControllerVirtioSCSI, ControllerAHCI, ControllerNVMe, ControllerXHCI}))
+	}
+	if sc.IOThread && sc.Type != ControllerVirtioSCSI {
+		errors = append(errors, "iothread is only supported on virtio-scsi controllers")
+	}
+	if sc.Serial != "" && sc.Type != ControllerNVMe {
+		errors = append(errors, "serial is only supported on nvme controllers")
+	}
+	if sc.Type == ControllerNVMe && sc.Serial == "" {
+		sc.Serial = sc.ID
+	}
+	if sc.Ports != 0 && sc.Type != ControllerXHCI {
+		errors = append(errors, "ports is only supported on xhci controllers")
+	}
+	if sc.Type == ControllerXHCI {
+		if sc.Ports == 0 {
+			sc.Ports = xhciDefaultPorts
+		}
+		if sc.Ports < 1 || sc.Ports > xhciMaxPorts {
+			errors = append(errors, fmt.Sprintf("invalid ports %d: expected 1 to %d", sc.Ports, xhciMaxPorts))
+		}
+	}
+	if len(errors) != 0 {
+		return fmt.Errorf("bad controller %#v: %s", sc, strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+// attach returns the QemuDisk.Attach of disks on the controller
+func (sc StorageController) attach() string {
+	switch sc.Type {
+	case ControllerVirtioSCSI:
+		return "scsi"
+	case ControllerAHCI:
+		return "ide"
+	case ControllerNVMe:
+		return "nvme"
+	case ControllerXHCI:
+		return "usb"
+	}
+	return ""
+}
+
+// units returns the first and last unit of the controller
+func (sc StorageController) units() (int, int) {
+	switch sc.Type {
+	case ControllerVirtioSCSI:
+		return 0, scsiMaxID
+	case ControllerAHCI:
+		return 0, ahciPorts - 1
+	case ControllerNVMe:
+		return 1, nvmeMaxNamespaces
+	case ControllerXHCI:
+		return 1, sc.Ports
+	}
+	return 0, -1
+}
+
+// diskPlacement is the address of a disk on a controller
+type diskPlacement struct {
+	Controller StorageController
+	Unit       int
+	LUN        int
+}
+
+// device returns the QEMU device driver and the options which place the
+// disk at its address
+func (p diskPlacement) device(disk QemuDisk) (string, []string) {
+	id := p.Controller.ID
+	cdrom := disk.Type == "cdrom"
+	switch p.Controller.Type {
+	case ControllerVirtioSCSI:
+		driver := "scsi-hd"
+		if cdrom {
+			driver = "scsi-cd"
+		}
+		return driver, []string{fmt.Sprintf("bus=%s.0", id), fmt.Sprintf("scsi-id=%d", p.Unit), fmt.Sprintf("lun=%d", p.LUN)}
+	case ControllerAHCI:
+		driver := "ide-hd"
+		if cdrom {
+			driver = "ide-cd"
+		}
+		return driver, []string{fmt.Sprintf("bus=%s.%d", id, p.Unit)}
+	case ControllerNVMe:
+		return "nvme-ns", []string{fmt.Sprintf("bus=%s", id), fmt.Sprintf("nsid=%d", p.Unit)}
+	case ControllerXHCI:
+		return "usb-storage", []string{fmt.Sprintf("bus=%s.0", id), fmt.Sprintf("port=%d", p.Unit)}
+	}
+	return "", nil
+}
+
+// storageTopology places disks on the controllers of a machine and checks
+// that no two disks share an address
+type storageTopology struct {
+	controllers []StorageController
+	used        map[string]string
+	// disks use the built-in AHCI controller
+	builtinAHCI bool
+}
+
+func newStorageTopology(controllers []StorageController) (*storageTopology, error) {
+	st := &storageTopology{used: map[string]string{}}
+	ids := map[string]bool{}
+	for _, sc := range controllers {
+		if err := sc.Sanitize(); err != nil {
+			return nil, err
+		}
+		if ids[sc.ID] {
+			return nil, fmt.Errorf("Duplicate storage controller id '%s'", sc.ID)
+		}
+		ids[sc.ID] = true
+		st.controllers = append(st.controllers, sc)
+	}
+	return st, nil
+}
+
+// find returns the controller with id from the machine definition
+func (st *storageTopology) find(id string) *StorageController {
+	for idx := range st.controllers {
+		if st.controllers[idx].ID == id && !st.controllers[idx].implicit {
+			return &st.controllers[idx]
+		}
+	}
+	return nil
+}
+
+// freeID returns the first of prefix0, prefix1, ... which no controller uses
+func (st *storageTopology) freeID(prefix string) string {
+	for n := 0; ; n++ {
+		id := fmt.Sprintf("%s%d", prefix, n)
+		if !slices.ContainsFunc(st.controllers, func(sc StorageController) bool { return sc.ID == id }) {
+			return id
+		}
+	}
+}
+
+// controller returns the controller disk is placed on, or nil if it is
+// attached without one
+func (st *storageTopology) controller(disk *QemuDisk) (*StorageController, error) {
+	if disk.Controller != "" {
+		sc := st.find(disk.Controller)
+		if sc == nil {
+			return nil, fmt.Errorf("Disk '%s' is placed on unknown controller '%s'", disk.Name(), disk.Controller)
+		}
+		disk.Attach = sc.attach()
+		return sc, nil
+	}
+	switch disk.Attach {
+	case "scsi":
+		for idx := range st.controllers {
+			if st.controllers[idx].Type == ControllerVirtioSCSI {
+				return &st.controllers[idx], nil
+			}
+		}
+		// without a virtio-scsi controller in the machine definition scsi
+		// disks share one with an iothread
+		st.controllers = append(st.controllers, StorageController{ID: st.freeID("scsi"), Type: ControllerVirtioSCSI, IOThread: true, implicit: true})
+		return &st.controllers[len(st.controllers)-1], nil
+	case "ide":
+		st.builtinAHCI = true
+		return &StorageController{ID: builtinAHCI, Type: ControllerAHCI}, nil
+	}
+	if disk.Unit != nil || disk.LUN != 0 {
+		return nil, fmt.Errorf("Disk '%s' sets a unit or lun but is not placed on a controller", disk.Name())
+	}
+	return nil, nil
+}
+
+func (st *storageTopology) reserve(disk QemuDisk, sc *StorageController, unit, lun int) error {
+	addr := fmt.Sprintf("%s.%d.%d", sc.ID, unit, lun)
+	if other, ok := st.used[addr]; ok {
+		return fmt.Errorf("Disks '%s' and '%s' are both placed on controller '%s' unit %d lun %d", other, disk.Name(), sc.ID, unit, lun)
+	}
+	st.used[addr] = disk.Name()
+	return nil
+}
+
+// placeAll returns the placement of each disk, nil for disks without a
+// controller.  Disks with a unit are placed first, the others take the
+// next free unit.
+func (st *storageTopology) placeAll(disks []QemuDisk) ([]*diskPlacement, error) {
+	placements := make([]*diskPlacement, len(disks))
+	controllers := make([]*StorageController, len(disks))
+	for idx := range disks {
+		disk := &disks[idx]
+		sc, err := st.controller(disk)
+		if err != nil {
+			return nil, err
+		}
+		if sc == nil {
+			continue
+		}
+		controllers[idx] = sc
+		if disk.LUN != 0 && sc.Type != ControllerVirtioSCSI {
+			return nil, fmt.Errorf("Disk '%s' sets lun %d, luns are only supported on virtio-scsi controllers", disk.Name(), disk.LUN)
+		}
+		if disk.LUN < 0 || disk.LUN > scsiMaxLUN {
+			return nil, fmt.Errorf("Disk '%s' lun %d is out of range 0 to %d", disk.Name(), disk.LUN, scsiMaxLUN)
+		}
+		if disk.Unit == nil {
+			continue
+		}
+		first, last := sc.units()
+		if *disk.Unit < first || *disk.Unit > last {
+			return nil, fmt.Errorf("Disk '%s' unit %d is out of range %d to %d of controller '%s'", disk.Name(), *disk.Unit, first, last, sc.ID)
+		}
+		if err := st.reserve(*disk, sc, *disk.Unit, disk.LUN); err != nil {
+			return nil, err
+		}
+		placements[idx] = &diskPlacement{Controller: *sc, Unit: *disk.Unit, LUN: disk.LUN}
+	}
+
+	for idx := range disks {
+		sc := controllers[idx]
+		if sc == nil || placements[idx] != nil {
+			continue
+		}
+		disk := disks[idx]
+		first, last := sc.units()
+		for unit := first; unit <= last; unit++ {
+			if _, ok := st.used[fmt.Sprintf("%s.%d.%d", sc.ID, unit, disk.LUN)]; ok {
+				continue
+			}
+			if err := st.reserve(disk, sc, unit, disk.LUN); err != nil {
+				return nil, err
+			}
+			placements[idx] = &diskPlacement{Controller: *sc, Unit: unit, LUN: disk.LUN}
+			break
+		}
+		if placements[idx] == nil {
+			if sc.ID == builtinAHCI {
+				return nil, fmt.Errorf("Too many ide disks and cdroms, at most %d are supported", ahciPorts)
+			}
+			return nil, fmt.Errorf("Controller '%s' has no free unit for disk '%s'", sc.ID, disk.Name())
+		}
+	}
+	return placements, nil
+}
+
+// StoragePlan holds what qcli cannot express about the storage topology:
+// the controllers it does not support and the placement of each drive
+type StoragePlan struct {
+	controllerParams []string
+	devices          map[string]storageDevice
+}
+
+type storageDevice struct {
+	driver  string
+	options []string
+}
+
+// configure adds the controllers to c and returns the plan which places
+// the drives of the disks
+func (st *storageTopology) configure(c *qcli.Config, qti *qcli.QemuTypeIndex, disks []QemuDisk, placements []*diskPlacement, blkDevices []qcli.BlockDevice) StoragePlan {
+	plan := StoragePlan{devices: map[string]storageDevice{}}
+	for _, sc := range st.controllers {
+		switch sc.Type {
+		case ControllerVirtioSCSI:
+			scsiCon := qcli.SCSIControllerDevice{ID: sc.ID}
+			if sc.IOThread {
+				scsiCon.IOThread = fmt.Sprintf("iothread%d", qti.Next("iothread"))
+			}
+			c.SCSIControllerDevices = append(c.SCSIControllerDevices, scsiCon)
+		case ControllerAHCI:
+			c.IDEControllerDevices = append(c.IDEControllerDevices, qcli.IDEControllerDevice{Driver: qcli.ICH9AHCIController, ID: sc.ID})
+		case ControllerNVMe:
+			plan.controllerParams = append(plan.controllerParams, "-device", fmt.Sprintf("nvme,id=%s,serial=%s", sc.ID, sc.Serial))
+		case ControllerXHCI:
+			plan.controllerParams = append(plan.controllerParams, "-device", fmt.Sprintf("qemu-xhci,id=%s,p2=%d,p3=%d", sc.ID, sc.Ports, sc.Ports))
+		}
+	}
+	// ide disks have always come with an additional AHCI controller
+	if st.builtinAHCI {
+		c.IDEControllerDevices = append(c.IDEControllerDevices, qcli.IDEControllerDevice{Driver: qcli.ICH9AHCIController, ID: st.freeID("ide")})
+	}
+	for idx, p := range placements {
+		if p == nil {
+			continue
+		}
+		driver, options := p.device(disks[idx])
+		plan.devices[blkDevices[idx].ID] = storageDevice{driver: driver, options: options}
+	}
+	return plan
+}
+
+// placement options replace these options of the drive devices from qcli
+var placementOptions = []string{"bus", "scsi", "scsi-id", "lun", "port", "nsid"}
+
+// apply adds the controllers qcli does not support before the first drive
+// and places the device of each drive
+func (p StoragePlan) apply(params []string) []string {
+	for idx := 0; idx+1 < len(params); idx++ {
+		if params[idx] != "-device" {
+			continue
+		}
+		opts := strings.Split(params[idx+1], ",")
+		for _, opt := range opts[1:] {
+			driveID, ok := strings.CutPrefix(opt, "drive=")
+			if !ok {
+				continue
+			}
+			dev, ok := p.devices[driveID]
+			if !ok {
+				break
+			}
+			placed := []string{dev.driver}
+			for _, o := range opts[1:] {
+				key, _, _ := strings.Cut(o, "=")
+				if slices.Contains(placementOptions, key) || (dev.driver == "nvme-ns" && key == "serial") {
+					continue
+				}
+				placed = append(placed, o)
+			}
+			params[idx+1] = strings.Join(append(placed, dev.options...), ",")
+			break
+		}
+	}
+	if len(p.controllerParams) == 0 {
+		return params
+	}
+	for idx := range params {
+		if params[idx] == "-drive" {
+			return append(append(params[:idx:idx], p.controllerParams...), params[idx:]...)
+		}
+	}
+	return append(params, p.controllerParams...)
+}
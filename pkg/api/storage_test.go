@@ -0,0 +1,169 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/project-machine/qcli"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestStorageControllerSanitize(t *testing.T) {
+	nvme := StorageController{ID: "nvme0", Type: ControllerNVMe}
+	if err := nvme.Sanitize(); err != nil {
+		t.Fatalf("failed to sanitize controller: %s", err)
+	}
+	if nvme.Serial != "nvme0" {
+		t.Fatalf("expected default serial nvme0, got %q", nvme.Serial)
+	}
+	usb := StorageController{ID: "usb0", Type: ControllerXHCI}
+	if err := usb.Sanitize(); err != nil {
+		t.Fatalf("failed to sanitize controller: %s", err)
+	}
+	if usb.Ports != xhciDefaultPorts {
+		t.Fatalf("expected %d default ports, got %d", xhciDefaultPorts, usb.Ports)
+	}
+
+	bad := []StorageController{
+		{ID: "", Type: ControllerAHCI},
+		{ID: "0scsi", Type: ControllerVirtioSCSI},
+		{ID: "ide", Type: ControllerAHCI},
+		{ID: "sata0", Type: "sata"},
+		{ID: "sata0", Type: ControllerAHCI, IOThread: true},
+		{ID: "scsi0", Type: ControllerVirtioSCSI, Serial: "abc"},
+		{ID: "scsi0", Type: ControllerVirtioSCSI, Ports: 2},
+		{ID: "usb0", Type: ControllerXHCI, Ports: 16},
+	}
+	for _, sc := range bad {
+		if err := sc.Sanitize(); err == nil {
+			t.Fatalf("expected error for controller %+v", sc)
+		}
+	}
+	if _, err := newStorageTopology([]StorageController{{ID: "c0", Type: ControllerAHCI}, {ID: "c0", Type: ControllerNVMe}}); err == nil {
+		t.Fatalf("expected error for duplicate controller ids")
+	}
+}
+
+func TestStoragePlaceAll(t *testing.T) {
+	controllers := []StorageController{
+		{ID: "scsi0", Type: ControllerVirtioSCSI},
+		{ID: "nvme0", Type: ControllerNVMe},
+		{ID: "usb0", Type: ControllerXHCI, Ports: 2},
+	}
+	disks := []QemuDisk{
+		{File: "a.qcow2", Controller: "scsi0"},
+		{File: "b.qcow2", Controller: "scsi0", Unit: intPtr(0), LUN: 1},
+		{File: "c.qcow2", Controller: "scsi0", Unit: intPtr(0)},
+		{File: "d.qcow2", Controller: "nvme0"},
+		{File: "e.qcow2", Controller: "usb0", Unit: intPtr(2)},
+		{File: "f.qcow2", Attach: "scsi"},
+		{File: "g.qcow2", Attach: "ide"},
+		{File: "h.qcow2", Attach: "virtio"},
+	}
+	st, err := newStorageTopology(controllers)
+	if err != nil {
+		t.Fatalf("failed to create storage topology: %s", err)
+	}
+	placements, err := st.placeAll(disks)
+	if err != nil {
+		t.Fatalf("failed to place disks: %s", err)
+	}
+	expected := []string{"scsi0.1.0", "scsi0.0.1", "scsi0.0.0", "nvme0.1.0", "usb0.2.0", "scsi0.2.0", "ide.0.0", ""}
+	for idx, p := range placements {
+		found := ""
+		if p != nil {
+			found = fmt.Sprintf("%s.%d.%d", p.Controller.ID, p.Unit, p.LUN)
+		}
+		if found != expected[idx] {
+			t.Fatalf("disk %s: expected placement %q, got %q", disks[idx].Name(), expected[idx], found)
+		}
+	}
+	if disks[0].Attach != "scsi" || disks[3].Attach != "nvme" || disks[4].Attach != "usb" {
+		t.Fatalf("attach not set from controller: %+v", disks)
+	}
+
+	bad := [][]QemuDisk{
+		{{File: "a.qcow2", Controller: "sata0"}},
+		{{File: "a.qcow2", Controller: "nvme0", Unit: intPtr(0)}},
+		{{File: "a.qcow2", Controller: "usb0", Unit: intPtr(3)}},
+		{{File: "a.qcow2", Controller: "nvme0", LUN: 1}},
+		{{File: "a.qcow2", Attach: "virtio", Unit: intPtr(1)}},
+		{{File: "a.qcow2", Controller: "usb0", Unit: intPtr(1)}, {File: "b.qcow2", Controller: "usb0", Unit: intPtr(1)}},
+		{{File: "a.qcow2", Controller: "usb0"}, {File: "b.qcow2", Controller: "usb0"}, {File: "c.qcow2", Controller: "usb0"}},
+	}
+	for _, d := range bad {
+		st, err := newStorageTopology(controllers)
+		if err != nil {
+			t.Fatalf("failed to create storage topology: %s", err)
+		}
+		if _, err := st.placeAll(d); err == nil {
+			t.Fatalf("expected error placing disks %+v", d)
+		}
+	}
+}
+
+func TestStoragePlanApply(t *testing.T) {
+	controllers := []StorageController{
+		{ID: "sata0", Type: ControllerAHCI},
+		{ID: "nvme0", Type: ControllerNVMe},
+	}
+	disks := []QemuDisk{
+		{File: "/a.qcow2", Format: "qcow2", Controller: "sata0", Unit: intPtr(3)},
+		{File: "/b.qcow2", Format: "qcow2", Controller: "nvme0"},
+		{File: "/c.qcow2", Format: "qcow2", Attach: "virtio"},
+	}
+	st, err := newStorageTopology(controllers)
+	if err != nil {
+		t.Fatalf("failed to create storage topology: %s", err)
+	}
+	placements, err := st.placeAll(disks)
+	if err != nil {
+		t.Fatalf("failed to place disks: %s", err)
+	}
+
+	c := &qcli.Config{Name: "x", Path: "/bin/true"}
+	blkDevices := []qcli.BlockDevice{
+		{Driver: qcli.IDEHardDisk, ID: "drive0", File: "/a.qcow2", Interface: qcli.NoInterface, Format: qcli.QCOW2},
+		{Driver: qcli.NVME, ID: "drive1", File: "/b.qcow2", Interface: qcli.NoInterface, Format: qcli.QCOW2, Serial: "b"},
+		{Driver: qcli.VirtioBlock, ID: "drive2", File: "/c.qcow2", Interface: qcli.NoInterface, Format: qcli.QCOW2},
+	}
+	c.BlkDevices = blkDevices
+	plan := st.configure(c, qcli.NewQemuTypeIndex(), disks, placements, blkDevices)
+	params, err := qcli.ConfigureParams(c, nil)
+	if err != nil {
+		t.Fatalf("failed to configure params: %s", err)
+	}
+	params = plan.apply(params)
+
+	devices := []string{}
+	firstDrive, nvmeController := -1, -1
+	for idx := 0; idx+1 < len(params); idx++ {
+		switch {
+		case params[idx] == "-device" && strings.Contains(params[idx+1], "drive="):
+			devices = append(devices, params[idx+1])
+		case params[idx] == "-device" && strings.HasPrefix(params[idx+1], "nvme,id=nvme0"):
+			nvmeController = idx
+		case params[idx] == "-drive" && firstDrive < 0:
+			firstDrive = idx
+		}
+	}
+	if nvmeController < 0 || nvmeController > firstDrive {
+		t.Fatalf("nvme controller not added before the drives: %v", params)
+	}
+	if len(devices) != 3 {
+		t.Fatalf("expected 3 drive devices, got %v", devices)
+	}
+	if !strings.HasPrefix(devices[0], "ide-hd,") || !strings.HasSuffix(devices[0], ",bus=sata0.3") || strings.Contains(devices[0], "scsi=") {
+		t.Fatalf("unexpected ahci device %q", devices[0])
+	}
+	if !strings.HasPrefix(devices[1], "nvme-ns,") || !strings.HasSuffix(devices[1], ",bus=nvme0,nsid=1") || strings.Contains(devices[1], "serial=") {
+		t.Fatalf("unexpected nvme namespace device %q", devices[1])
+	}
+	if !strings.HasPrefix(devices[2], "virtio-blk-pci,") || !strings.Contains(devices[2], ",bus=pcie.0,") {
+		t.Fatalf("unplaced device changed %q", devices[2])
+	}
+}
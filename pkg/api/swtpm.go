@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -35,6 +36,8 @@ type SwTPM struct {
 	StateDir string
 	Socket   string
 	Version  string
+	// LogFile receives swtpm log output when set, otherwise ${StateDir}/log
+	LogFile  string
 	cmd      *exec.Cmd
 	finished chan error
 }
@@ -198,10 +201,34 @@ func (s *SwTPM) Start() error {
 		"swtpm", "socket",
 		"--tpmstate=dir=" + s.StateDir,
 		"--ctrl=type=unixio,path=" + s.Socket,
-		"--log=level=20,file=" + path.Join(s.StateDir, "log"),
 		"--pid=file=" + path.Join(s.StateDir, "pid"),
 	}
 
+	// swtpm writes to an inherited pipe so machined can rotate the log
+	var logPipe *os.File
+	var swtpmLog *RotatingLog
+	if s.LogFile != "" {
+		swtpmLog, err = OpenRotatingLog(s.LogFile)
+		if err != nil {
+			return err
+		}
+		var logReader *os.File
+		logReader, logPipe, err = os.Pipe()
+		if err != nil {
+			swtpmLog.Close()
+			return fmt.Errorf("Failed to create swtpm log pipe: %s", err)
+		}
+		go func() {
+			io.Copy(swtpmLog, logReader)
+			logReader.Close()
+			swtpmLog.Close()
+		}()
+		// ExtraFiles[0] is fd 3 in the child
+		args = append(args, "--log=level=20,fd=3")
+	} else {
+		args = append(args, "--log=level=20,file="+path.Join(s.StateDir, "log"))
+	}
+
 	if strings.HasPrefix(s.Version, "2") {
 		args = append(args, "--tpm2")
 	} else {
@@ -212,6 +239,10 @@ func (s *SwTPM) Start() error {
 	}
 
 	cmd := exec.Command(args[0], args[1:]...)
+	if logPipe != nil {
+		cmd.ExtraFiles = []*os.File{logPipe}
+		defer logPipe.Close()
+	}
 	log.Infof("swtpm args: %s", cmd.String())
 	if err := cmd.Start(); err != nil {
 		return err
@@ -17,10 +17,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -65,6 +67,7 @@ type VMDef struct {
 	Disks      []QemuDisk      `yaml:"disks"`
 	Boot       string          `yaml:"boot"`
 	Cdrom      string          `yaml:"cdrom"`
+	Cdroms     []string        `yaml:"cdroms"`
 	UEFICode   string          `yaml:"uefi-code"`
 	UEFIVars   string          `yaml:"uefi-vars"`
 	TPM        bool            `yaml:"tpm"`
@@ -72,6 +75,20 @@ type VMDef struct {
 	SecureBoot bool            `yaml:"secure-boot"`
 	Gui        bool            `yaml:"gui"`
 	CloudInit  CloudInitConfig `yaml:"cloud-init"`
+	Display    DisplayDef      `yaml:"display"`
+	Firmware   FirmwareDef     `yaml:"firmware,omitempty"`
+
+	// storage controllers disks may be placed on
+	Controllers []StorageController `yaml:"controllers,omitempty"`
+
+	// host directories the guest can mount
+	Shares []Share `yaml:"shares,omitempty"`
+
+	// record each boot's serial console under the machine StateDir
+	ConsoleRecord bool `yaml:"console-record"`
+
+	// save a screenshot under the machine StateDir when the guest panics
+	ScreenshotOnFailure bool `yaml:"screenshot-on-failure"`
 }
 
 func (v *VMDef) adjustDiskBootIdx(qti *qcli.QemuTypeIndex) ([]string, error) {
@@ -171,13 +188,28 @@ type VM struct {
 	Config  VMDef
 	State   VMState
 	RunDir  string
+	LogDir  string
 	sockDir string
 	Cmd     *exec.Cmd
 	SwTPM   *SwTPM
+	Console *SerialMux
 	qcli    *qcli.Config
 	qmp     *qcli.QMP
 	qmpCh   chan struct{}
 	wg      sync.WaitGroup
+	qmpLock sync.Mutex
+	vnc     VNCConnection
+
+	displayPassword string
+	displayTLSDir   string
+	hotplugLock     sync.Mutex
+	hotplugged      map[string]hotpluggedDisk
+	virtioFS        []*VirtioFSD
+	shareLog        *RotatingLog
+	nicCounters     []*nicCounter
+
+	// called once the VM process has exited
+	exitHook func(*VM)
 }
 
 // note VM.sockDir is the path to the real sockets and runDir/sockets is a symlink to the socket
@@ -213,14 +245,74 @@ func (v *VM) SerialSocket() (string, error) {
 	return cdev.Path, nil
 }
 
+// ConsoleSocket returns the machined console socket which multiplexes the
+// serial console between clients
+func (v *VM) ConsoleSocket(readOnly bool) string {
+	if readOnly {
+		return filepath.Join(v.sockDir, ConsoleReadOnlySocketName)
+	}
+	return filepath.Join(v.sockDir, ConsoleSocketName)
+}
+
 func (v *VM) SpiceDevice() (qcli.SpiceDevice, error) {
 	return v.qcli.SpiceDevice, nil
 }
 
+func (v *VM) VNCConnection() (VNCConnection, error) {
+	if v.Config.Display.Type != DisplayVNC {
+		return VNCConnection{}, fmt.Errorf("VM:%s display is not %s", v.Name(), DisplayVNC)
+	}
+	return v.vnc, nil
+}
+
 func (v *VM) TPMSocket() (string, error) {
 	return v.qcli.TPM.Path, nil
 }
 
+func (v *VM) QMPControlSocket() (string, error) {
+	for _, sock := range v.qcli.QMPSockets {
+		if filepath.Base(sock.Name) == QMPControlSocketName {
+			return sock.Name, nil
+		}
+	}
+	return "", fmt.Errorf("Failed to find QMP control socket %s", QMPControlSocketName)
+}
+
+// WithQMP runs fn with a connection to the VM's QMP control socket.  The
+// socket accepts a single client so callers are serialized.
+func (v *VM) WithQMP(fn func(q *QMPConn) error) error {
+	if !v.IsRunning() {
+		return fmt.Errorf("VM:%s is not running", v.Name())
+	}
+	qmpSocket, err := v.QMPControlSocket()
+	if err != nil {
+		return err
+	}
+	v.qmpLock.Lock()
+	defer v.qmpLock.Unlock()
+	q, err := DialQMP(qmpSocket)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	return fn(q)
+}
+
+// QMPExecute runs a single QMP command on the VM
+func (v *VM) QMPExecute(command string, args interface{}, result interface{}) error {
+	return v.WithQMP(func(q *QMPConn) error {
+		return q.Execute(command, args, result)
+	})
+}
+
+// Pid returns the pid of the QEMU process, or 0 if it is not running
+func (v *VM) Pid() int {
+	if v.Cmd == nil || v.Cmd.Process == nil {
+		return 0
+	}
+	return v.Cmd.Process.Pid
+}
+
 func newVM(ctx context.Context, clusterName string, vmConfig VMDef) (*VM, error) {
 	ctx, cancelFn := context.WithCancel(ctx)
 	runDir := filepath.Join(ctx.Value(clsCtxStateDir).(string), vmConfig.Name)
@@ -248,8 +340,39 @@ func newVM(ctx context.Context, clusterName string, vmConfig VMDef) (*VM, error)
 		return &VM{}, fmt.Errorf("Failed to link socket dir: %s", err)
 	}
 
+	if err := vmConfig.Display.Sanitize(); err != nil {
+		return &VM{}, err
+	}
+
+	if _, err := vmConfig.firmware(); err != nil {
+		return &VM{}, err
+	}
+
+	if err := sanitizeShares(vmConfig.Shares); err != nil {
+		return &VM{}, err
+	}
+	if err := addShareMounts(&vmConfig.CloudInit, vmConfig.Shares); err != nil {
+		return &VM{}, err
+	}
+
+	if ephemeral, _ := ctx.Value(clsCtxEphemeral).(bool); ephemeral {
+		disks, err := ephemeralDisks(runDir, vmConfig.Disks)
+		if err != nil {
+			return &VM{}, err
+		}
+		vmConfig.Disks = disks
+	}
+
+	if err := prepareImageDisks(ctx, runDir, vmConfig.Disks); err != nil {
+		return &VM{}, err
+	}
+
+	if err := resolveDiskSecrets(ctx, vmConfig.Disks); err != nil {
+		return &VM{}, err
+	}
+
 	log.Infof("newVM: Generating QEMU Config")
-	qcfg, err := GenerateQConfig(runDir, tmpSockDir, vmConfig)
+	qcfg, storage, err := GenerateQConfig(runDir, tmpSockDir, vmConfig)
 	if err != nil {
 		return &VM{}, fmt.Errorf("Failed to generate qcli Config from VM definition: %s", err)
 	}
@@ -307,6 +430,47 @@ func newVM(ctx context.Context, clusterName string, vmConfig VMDef) (*VM, error)
 	if err != nil {
 		return &VM{}, fmt.Errorf("Failed to generate new VM command parameters: %s", err)
 	}
+	cmdParams = storage.apply(cmdParams)
+	cmdParams, err = addDiskEncryption(cmdParams, qcfg.BlkDevices, runDir, vmConfig.Disks)
+	if err != nil {
+		return &VM{}, err
+	}
+	cmdParams, err = addDiskThrottles(cmdParams, qcfg.BlkDevices, runDir, vmConfig.Disks)
+	if err != nil {
+		return &VM{}, err
+	}
+
+	// QEMU keeps a transcript of the serial console whether or not a
+	// client is attached
+	logDir := filepath.Join(ctx.Value(clsCtxArtifactDir).(string), "logs")
+	if err := EnsureDir(logDir); err != nil {
+		return &VM{}, fmt.Errorf("Error creating VM log dir '%s': %s", logDir, err)
+	}
+	cmdParams = addCharDevLogFile(cmdParams, "serial0", LogFile(logDir, LogSourceSerial))
+	cmdParams = append(cmdParams, shareParams(qcfg, tmpSockDir, vmConfig.Shares)...)
+	nicCounters := newNICCounters(qcfg, tmpSockDir)
+	cmdParams = append(cmdParams, nicCounterParams(nicCounters)...)
+
+	displayPassword, err := vmConfig.Display.StartPassword()
+	if err != nil {
+		return &VM{}, err
+	}
+	var vnc VNCConnection
+	if vmConfig.Display.Type == DisplayVNC {
+		vnc = NewVNCConnection(vmConfig.Display, tmpSockDir, displayPassword)
+		cmdParams = append(cmdParams, vnc.QemuParams()...)
+	}
+	displayTLSDir := ""
+	if vmConfig.Display.TLS {
+		displayTLSDir, err = EnsureDisplayTLS(ctx.Value(clsCtxDisplayTLSDir).(string), vmConfig.Display.Listen)
+		if err != nil {
+			return &VM{}, err
+		}
+		cmdParams = addSpiceOption(cmdParams, "x509-dir="+displayTLSDir)
+	}
+	if vmConfig.ScreenshotOnFailure {
+		cmdParams = append(cmdParams, guestFailureParams()...)
+	}
 	log.Infof("newVM: generated qcli config parameters: %s", cmdParams)
 
 	return &VM{
@@ -317,26 +481,75 @@ func newVM(ctx context.Context, clusterName string, vmConfig VMDef) (*VM, error)
 		Cmd:     exec.CommandContext(ctx, qcfg.Path, cmdParams...),
 		qcli:    qcfg,
 		RunDir:  runDir,
+		LogDir:  logDir,
 		sockDir: tmpSockDir, // this must point to the /tmp path to remain short
+		vnc:     vnc,
+
+		displayPassword: displayPassword,
+		displayTLSDir:   displayTLSDir,
+		nicCounters:     nicCounters,
 	}, nil
 }
 
+// addCharDevLogFile appends a logfile option to the -chardev with the given id
+func addCharDevLogFile(params []string, chardevID, logFile string) []string {
+	for idx := 0; idx+1 < len(params); idx++ {
+		if params[idx] != "-chardev" {
+			continue
+		}
+		for _, opt := range strings.Split(params[idx+1], ",") {
+			if opt == "id="+chardevID {
+				params[idx+1] += fmt.Sprintf(",logfile=%s,logappend=on", logFile)
+				return params
+			}
+		}
+	}
+	return params
+}
+
 func (v *VM) Name() string {
 	return v.Config.Name
 }
 
+// rotateLogs rotates the serial transcript, which QEMU writes directly,
+// until done is closed
+func (v *VM) rotateLogs(done chan struct{}) {
+	serialLog := LogFile(v.LogDir, LogSourceSerial)
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(logRotateEvery):
+			if err := copyTruncateLog(serialLog, logMaxSize, logMaxBackups); err != nil {
+				log.Warnf("VM:%s %s", v.Name(), err)
+			}
+		}
+	}
+}
+
 func (v *VM) runVM() error {
 	// add to waitgroup and spawn goroutine to run the command
 	errCh := make(chan error, 1)
 
+	qemuLog, err := OpenRotatingLog(LogFile(v.LogDir, LogSourceQemu))
+	if err != nil {
+		return err
+	}
+
 	v.wg.Add(1)
 	go func() {
 		var stderr bytes.Buffer
 		defer func() {
+			qemuLog.Close()
+			v.stopVirtioFS()
+			v.stopNICCounters()
 			v.wg.Done()
 			if v.State != VMFailed {
 				v.State = VMStopped
 			}
+			if v.exitHook != nil {
+				go v.exitHook(v)
+			}
 		}()
 
 		if v.Config.TPM {
@@ -354,6 +567,7 @@ func (v *VM) runVM() error {
 				StateDir: tpmDir,
 				Socket:   tpmSocket,
 				Version:  v.Config.TPMVersion,
+				LogFile:  LogFile(v.LogDir, LogSourceSwTPM),
 			}
 			if err := v.SwTPM.Start(); err != nil {
 				errCh <- fmt.Errorf("Failed to start SwTPM: %s", err)
@@ -361,8 +575,20 @@ func (v *VM) runVM() error {
 			}
 		}
 
+		if err := v.startVirtioFS(); err != nil {
+			errCh <- err
+			return
+		}
+
+		if err := v.startNICCounters(); err != nil {
+			errCh <- err
+			return
+		}
+
 		log.Infof("VM:%s starting QEMU process", v.Name())
-		v.Cmd.Stderr = &stderr
+		qemuLog.Printf("starting %s", v.Cmd.String())
+		v.Cmd.Stdout = qemuLog
+		v.Cmd.Stderr = io.MultiWriter(&stderr, qemuLog)
 		err := v.Cmd.Start()
 		if err != nil {
 			errCh <- fmt.Errorf("VM:%s failed with: %s", v.Name(), stderr.String())
@@ -370,12 +596,17 @@ func (v *VM) runVM() error {
 		}
 
 		v.State = VMStarted
+		rotateDone := make(chan struct{})
+		go v.rotateLogs(rotateDone)
 		log.Infof("VM:%s waiting for QEMU process to exit...", v.Name())
 		err = v.Cmd.Wait()
+		close(rotateDone)
 		if err != nil {
+			qemuLog.Printf("QEMU exited: %s", err)
 			errCh <- fmt.Errorf("VM:%s wait failed with: %s", v.Name(), stderr.String())
 			return
 		}
+		qemuLog.Printf("QEMU exited")
 		log.Infof("VM:%s QEMU process exited", v.Name())
 		errCh <- nil
 	}()
@@ -396,10 +627,10 @@ func (v *VM) StartQMP() error {
 	var wg sync.WaitGroup
 	errCh := make(chan error, 1)
 
-	// FIXME: are there more than one qmp sockets allowed?
+	// the first QMP socket is used by qcli, the others are for WithQMP()
 	numQMP := len(v.qcli.QMPSockets)
-	if numQMP != 1 {
-		return fmt.Errorf("StartQMP failed, expected 1 QMP socket, found: %d", numQMP)
+	if numQMP < 1 {
+		return fmt.Errorf("StartQMP failed, expected at least 1 QMP socket, found: %d", numQMP)
 	}
 
 	// start qmp goroutine
@@ -468,6 +699,38 @@ func (v *VM) StartQMP() error {
 	return nil
 }
 
+// StartConsole connects machined to the serial socket and serves the
+// multiplexed console sockets
+func (v *VM) StartConsole() error {
+	serialSocket, err := v.SerialSocket()
+	if err != nil {
+		return err
+	}
+	if !WaitForPath(serialSocket, 10, 1) {
+		return fmt.Errorf("VM:%s serial socket %s does not exist", v.Name(), serialSocket)
+	}
+	console := NewSerialMux(v.Name(), serialSocket)
+	if err := console.Start(); err != nil {
+		return err
+	}
+	for _, readOnly := range []bool{false, true} {
+		if err := console.Listen(v.ConsoleSocket(readOnly), readOnly); err != nil {
+			console.Close()
+			return err
+		}
+	}
+	v.Console = console
+	log.Infof("VM:%s serial console ready", v.Name())
+
+	if v.Config.ConsoleRecord {
+		recordDir := filepath.Join(v.Ctx.Value(clsCtxArtifactDir).(string), RecordingsDirName)
+		if err := recordConsole(console, recordDir); err != nil {
+			log.Errorf("VM:%s failed to record serial console: %s", v.Name(), err)
+		}
+	}
+	return nil
+}
+
 func (v *VM) BackgroundRun() error {
 
 	// start vm command in background goroutine
@@ -480,6 +743,15 @@ func (v *VM) BackgroundRun() error {
 		}
 	}()
 
+	go func() {
+		log.Infof("VM:%s backgrounding StartConsole()", v.Name())
+		err := v.StartConsole()
+		if err != nil {
+			log.Errorf("StartConsole error: %s", err)
+			return
+		}
+	}()
+
 	go func() {
 		log.Infof("VM:%s backgrounding StartQMP()", v.Name())
 		err := v.StartQMP()
@@ -487,6 +759,12 @@ func (v *VM) BackgroundRun() error {
 			log.Errorf("StartQMP error: %s", err)
 			return
 		}
+		if err := v.configureDisplayPassword(); err != nil {
+			log.Errorf("VM:%s %s", v.Name(), err)
+		}
+		if v.Config.ScreenshotOnFailure {
+			go v.watchGuestFailure(filepath.Join(v.Ctx.Value(clsCtxArtifactDir).(string), ScreenshotsDirName))
+		}
 	}()
 
 	return nil
@@ -584,6 +862,10 @@ func (v *VM) Stop(force bool) error {
 		v.SwTPM.Stop()
 	}
 
+	if v.Console != nil {
+		v.Console.Close()
+	}
+
 	// when runVM goroutine exits, it marks v.State = VMStopped
 	return nil
 }
@@ -48,12 +48,28 @@ func init() {
 }
 
 func GetMachines() ([]api.Machine, error) {
+	return getMachines(false)
+}
+
+// GetAllMachines returns machines owned by all users, this requires admin rights
+func GetAllMachines() ([]api.Machine, error) {
+	return getMachines(true)
+}
+
+func getMachines(all bool) ([]api.Machine, error) {
 	machines := []api.Machine{}
 	listURL := api.GetAPIURL("machines")
 	if len(listURL) == 0 {
 		return machines, fmt.Errorf("Failed to get API URL for 'machines' endpoint")
 	}
-	resp, _ := rootclient.R().EnableTrace().Get(listURL)
+	req := rootclient.R().EnableTrace()
+	if all {
+		req.SetQueryParam("all", "true")
+	}
+	resp, _ := req.Get(listURL)
+	if resp.StatusCode() != http.StatusOK {
+		return machines, fmt.Errorf("%s: %s", resp.Status(), resp)
+	}
 	err := json.Unmarshal(resp.Body(), &machines)
 	if err != nil {
 		return machines, fmt.Errorf("Failed to unmarshal GET on /machines")
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a certificate for cn signed by parent, or a self
+// signed CA if parent is nil, and returns it with its key
+func writeTestCert(t *testing.T, dir, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(filepath.Join(dir, cn+".pem"), certPEM, 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, cn+"-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+	return cert, key
+}
+
+func TestRemoteTransport(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-remote-client")
+	if err != nil {
+		t.Fatalf("failed to create tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ca, caKey := writeTestCert(t, tmpDir, "ca", nil, nil)
+	writeTestCert(t, tmpDir, "other-ca", nil, nil)
+	writeTestCert(t, tmpDir, "server", ca, caKey)
+	writeTestCert(t, tmpDir, "alice", ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(tmpDir, "server.pem"), filepath.Join(tmpDir, "server-key.pem"))
+	if err != nil {
+		t.Fatalf("failed to load server certificate: %s", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	remote := RemoteConfig{
+		Address:  server.Listener.Addr().String(),
+		CertFile: filepath.Join(tmpDir, "alice.pem"),
+		KeyFile:  filepath.Join(tmpDir, "alice-key.pem"),
+		CAFile:   filepath.Join(tmpDir, "ca.pem"),
+	}
+	get := func(r RemoteConfig) (*http.Response, error) {
+		transport, err := NewRemoteTransport(r)
+		if err != nil {
+			t.Fatalf("failed to create transport: %s", err)
+		}
+		// like the unix socket client, the URL host is ignored
+		return (&http.Client{Transport: transport}).Get("http://machined/machines")
+	}
+
+	resp, err := get(remote)
+	if err != nil {
+		t.Fatalf("failed to reach the remote machined: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "alice" {
+		t.Fatalf("expected the server to see client alice, got %d %q", resp.StatusCode, body)
+	}
+
+	// a server certificate from another CA is refused
+	untrusted := remote
+	untrusted.CAFile = filepath.Join(tmpDir, "other-ca.pem")
+	if _, err := get(untrusted); err == nil {
+		t.Fatalf("expected a server certificate from an untrusted CA to be refused")
+	}
+
+	incomplete := remote
+	incomplete.KeyFile = ""
+	if _, err := NewRemoteTransport(incomplete); err == nil {
+		t.Fatalf("expected error without a client key")
+	}
+	incomplete = remote
+	incomplete.Address = "machined"
+	if _, err := NewRemoteTransport(incomplete); err == nil {
+		t.Fatalf("expected error for an address without port")
+	}
+}